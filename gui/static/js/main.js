@@ -565,6 +565,32 @@ $(function() {
         update();
     }
 
+    // blocks with dynamic out routes keep their own list of them, as they
+    // change with the block's rule
+    function outRoutesOf(d) {
+        return d.OutRoutes || d.TypeInfo.OutRoutes;
+    }
+
+    function refreshOutRoutes(id) {
+        var block = null;
+        for (var i = 0; i < blocks.length; i++) {
+            if (blocks[i].Id === id) {
+                block = blocks[i];
+                break;
+            }
+        }
+        if (block === null || !block.TypeInfo.DynamicOutRoutes) {
+            return;
+        }
+        $.get('blocks/' + id + '/outroutes', function(resp) {
+            block.OutRoutes = resp.OutRoutes;
+            var routes = Math.max(block.TypeInfo.InRoutes.length, block.OutRoutes.length);
+            block.width = Math.max(block.width, routes * ROUTE + routes * ROUTE_SPACE);
+            update();
+            updateLinks();
+        });
+    }
+
     // http://stackoverflow.com/questions/10406930/how-to-construct-a-websocket-uri-relative-to-the-page-uri
     function url(s) {
         var l = window.location;
@@ -661,6 +687,7 @@ $(function() {
                         "action": "rule",
                         "id": uiMsg.Id
                     }));
+                    refreshOutRoutes(uiMsg.Id);
                     break;
                 case 'CREATE':
                     if (isBlock) {
@@ -673,6 +700,7 @@ $(function() {
                         update();
                         // we need to update the rule controller for the block.
                         d3.select('.controller[data-id=_' + uiMsg.Data.Id + ']')[0][0].refresh();
+                        refreshOutRoutes(uiMsg.Data.Id);
                     } else {
                         connections.push(uiMsg.Data);
                         update();
@@ -891,7 +919,8 @@ $(function() {
                 return d.Type;
             }).each(function(d) {
                 var bbox = this.getBBox();
-                d.width = (d.TypeInfo.InRoutes.length * ROUTE + d.TypeInfo.InRoutes.length * ROUTE_SPACE)
+                var routes = Math.max(d.TypeInfo.InRoutes.length, outRoutesOf(d).length);
+                d.width = (routes * ROUTE + routes * ROUTE_SPACE)
                 d.width = (d.width > bbox.width ? d.width : bbox.width + 30);
                 d.height = (d.height > bbox.height ? d.height : bbox.height + 5);
             }).attr('dy', function(d) {
@@ -1020,7 +1049,7 @@ $(function() {
 
         var outRoutes = node.selectAll('.out')
             .data(function(d) {
-                return d.TypeInfo.OutRoutes;
+                return outRoutesOf(d);
             });
 
         outRoutes.enter()
@@ -1157,11 +1186,12 @@ $(function() {
     // generates paths fo all links
     function updateLinks() {
         link.attr('d', function(d) {
+            var fromX = d.from.Position.X + (outRoutesOf(d.from).indexOf(d.FromRoute || 'out') * ROUTE_SPACE) + HALF_ROUTE;
             return lineStyle([{
-                x: d.from.Position.X + HALF_ROUTE,
+                x: fromX,
                 y: (d.from.Position.Y + d.from.height * 2) - HALF_ROUTE
             }, {
-                x: d.from.Position.X + HALF_ROUTE,
+                x: fromX,
                 y: (d.from.Position.Y + d.from.height * 2) + ROUTE_SPACE
             }, {
                 x: d.to.Position.X + (d.to.TypeInfo.InRoutes.indexOf(d.ToRoute) * ROUTE_SPACE) + HALF_ROUTE,
@@ -1195,16 +1225,19 @@ $(function() {
 
         var connReq = {
             'FromId': null,
+            'FromRoute': null,
             'ToId': null,
             'ToRoute': null
         };
 
         if (newConn.startType == 'out') {
             connReq.FromId = newConn.start.Id;
+            connReq.FromRoute = newConn.startRoute;
             connReq.ToId = block.Id;
             connReq.ToRoute = route;
         } else {
             connReq.FromId = block.Id;
+            connReq.FromRoute = route;
             connReq.ToId = newConn.start.Id;
             connReq.ToRoute = newConn.startRoute;
         }
@@ -1223,10 +1256,10 @@ $(function() {
         newConnection.attr('d', function() {
             return lineStyle(newConn.startType == 'out' ?
                 [{
-                    x: newConn.start.Position.X + HALF_ROUTE,
+                    x: newConn.start.Position.X + (outRoutesOf(newConn.start).indexOf(newConn.startRoute) * ROUTE_SPACE) + HALF_ROUTE,
                     y: (newConn.start.Position.Y + newConn.start.height * 2) - HALF_ROUTE
                 }, {
-                    x: newConn.start.Position.X + HALF_ROUTE,
+                    x: newConn.start.Position.X + (outRoutesOf(newConn.start).indexOf(newConn.startRoute) * ROUTE_SPACE) + HALF_ROUTE,
                     y: (newConn.start.Position.Y + newConn.start.height * 2) + ROUTE_SPACE
                 }, {
                     x: mouse.x,
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/nytlabs/streamtools/st/loghub"
 	"net/url"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -21,8 +22,9 @@ func (c MsgChan) MarshalJSON() ([]byte, error) {
 }
 
 type AddChanMsg struct {
-	Route   string
-	Channel chan *Msg
+	Route     string
+	FromRoute string // the out route to listen to, "out" if empty
+	Channel   chan *Msg
 }
 
 type QueryMsg struct {
@@ -64,9 +66,13 @@ type Block struct {
 	inRoutes         map[string]MsgChan
 	queryRoutes      map[string]chan MsgChan
 	queryParamRoutes map[string]chan Query
+	outRoutes        map[string]MsgChan
+	routed           chan *Msg
+	routeNames       chan []string
 	broadcast        MsgChan
 	quit             MsgChan
 	doesBroadcast    bool
+	doesRoute        bool
 	BlockChans
 	LogStreams
 }
@@ -78,6 +84,7 @@ type BlockDef struct {
 	QueryRoutes      []string
 	QueryParamRoutes []string
 	OutRoutes        []string
+	DynamicOutRoutes bool
 }
 
 type BlockInterface interface {
@@ -90,6 +97,9 @@ type BlockInterface interface {
 	InRoute(string) MsgChan
 	QueryRoute(string) chan MsgChan
 	QueryParamRoute(string) chan Query
+	OutRoute(string) MsgChan
+	DynamicOutRoutes() chan *Msg
+	SetOutRoutes([]string)
 	GetBlock() *Block
 	GetDef() *BlockDef
 	Log(interface{})
@@ -112,10 +122,15 @@ func (b *Block) Build(c BlockChans) {
 	b.inRoutes = make(map[string]MsgChan) // necessary to stop locking...
 	b.queryRoutes = make(map[string]chan MsgChan)
 	b.queryParamRoutes = make(map[string]chan Query)
+	b.outRoutes = make(map[string]MsgChan)
 
 	// broadcast channel
 	b.broadcast = make(MsgChan, 10) // necessary to stop locking...
 
+	// messages sent on named out routes, tagged with their route
+	b.routed = make(chan *Msg, 10)
+	b.routeNames = make(chan []string, 10)
+
 	// quit chan
 	b.quit = make(MsgChan)
 
@@ -145,6 +160,27 @@ func (b *Block) QueryParamRoute(routeName string) chan Query {
 	return route
 }
 
+// OutRoute makes an out route other than "out", so that a block can send
+// different kinds of message to different places.
+func (b *Block) OutRoute(routeName string) MsgChan {
+	route := make(MsgChan, 10)
+	b.outRoutes[routeName] = route
+	return route
+}
+
+// DynamicOutRoutes is for blocks whose out routes depend on their rule. The
+// block sends each message tagged with the name of the route it leaves on,
+// and keeps the list of those names up to date with SetOutRoutes.
+func (b *Block) DynamicOutRoutes() chan *Msg {
+	b.doesRoute = true
+	return b.routed
+}
+
+// SetOutRoutes replaces the names of a block's dynamic out routes.
+func (b *Block) SetOutRoutes(routes []string) {
+	b.routeNames <- routes
+}
+
 func (b *Block) Broadcast() MsgChan {
 	b.doesBroadcast = true
 	return b.broadcast
@@ -180,6 +216,13 @@ func (b *Block) GetDef() *BlockDef {
 		outRoutes = []string{"out"}
 	}
 
+	named := []string{}
+	for k, _ := range b.outRoutes {
+		named = append(named, k)
+	}
+	sort.Strings(named)
+	outRoutes = append(outRoutes, named...)
+
 	return &BlockDef{
 		Type:             b.Kind,
 		Desc:             b.Desc,
@@ -187,6 +230,7 @@ func (b *Block) GetDef() *BlockDef {
 		QueryRoutes:      queryRoutes,
 		QueryParamRoutes: queryParamRoutes,
 		OutRoutes:        outRoutes,
+		DynamicOutRoutes: b.doesRoute,
 	}
 }
 
@@ -197,6 +241,9 @@ func (b *Block) CleanUp() {
 	for route := range b.queryRoutes {
 		defer close(b.queryRoutes[route])
 	}
+	for route := range b.outRoutes {
+		defer close(b.outRoutes[route])
+	}
 	defer close(b.InChan)
 	defer close(b.QueryChan)
 	defer close(b.QueryParamChan)
@@ -242,8 +289,34 @@ func BlockRoutine(bi BlockInterface) {
 	dropTicker.Stop()
 
 	outChans := make(map[string]chan *Msg)
+	fromRoutes := make(map[string]string)
 	b := bi.GetBlock()
 	bi.Setup()
+
+	// the out routes a block has right now, which for blocks with dynamic
+	// out routes change with the rule
+	outRoutes := bi.GetDef().OutRoutes
+	staticRoutes := outRoutes
+
+	// tag everything sent on a named out route so that it only goes to the
+	// connections listening to that route. done stops the forwarding once
+	// the block has quit and nothing reads what it tags any more.
+	done := make(chan bool)
+	for route, c := range b.outRoutes {
+		go func(route string, c MsgChan) {
+			for msg := range c {
+				select {
+				case b.routed <- &Msg{
+					Msg:   msg,
+					Route: route,
+				}:
+				case <-done:
+					return
+				}
+			}
+		}(route, c)
+	}
+
 	go bi.Run()
 
 	for {
@@ -302,6 +375,13 @@ func BlockRoutine(bi BlockInterface) {
 				continue
 			}
 
+			if msg.Route == "outroutes" {
+				msg.MsgChan <- map[string]interface{}{
+					"OutRoutes": outRoutes,
+				}
+				continue
+			}
+
 			_, ok := b.queryRoutes[msg.Route]
 			if !ok {
 				break
@@ -321,6 +401,13 @@ func BlockRoutine(bi BlockInterface) {
 				continue
 			}
 
+			if msg.Route == "outroutes" {
+				msg.RespChan <- map[string]interface{}{
+					"OutRoutes": outRoutes,
+				}
+				continue
+			}
+
 			_, ok := b.queryParamRoutes[msg.Route]
 			if !ok {
 				break
@@ -341,17 +428,38 @@ func BlockRoutine(bi BlockInterface) {
 			b.SetId(id)
 		case msg := <-b.AddChan:
 			outChans[msg.Route] = msg.Channel
+			fromRoutes[msg.Route] = msg.FromRoute
+			if msg.FromRoute == "" {
+				fromRoutes[msg.Route] = "out"
+			}
 		case msg := <-b.DelChan:
 			delete(outChans, msg.Route)
+			delete(fromRoutes, msg.Route)
 		case msg := <-b.broadcast:
-			for _, v := range outChans {
+			for k, v := range outChans {
+				if fromRoutes[k] != "out" {
+					continue
+				}
 				v <- &Msg{
 					Msg:   msg,
 					Route: "",
 				}
 			}
+		case names := <-b.routeNames:
+			outRoutes = append(append([]string{}, staticRoutes...), names...)
+		case msg := <-b.routed:
+			for k, v := range outChans {
+				if fromRoutes[k] != msg.Route {
+					continue
+				}
+				v <- &Msg{
+					Msg:   msg.Msg,
+					Route: "",
+				}
+			}
 		case <-b.QuitChan:
 			b.quit <- true
+			close(done)
 			b.CleanUp()
 			return
 		}
@@ -0,0 +1,416 @@
+package library
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Anomaly struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	clear     blocks.MsgChan
+	in        blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewAnomaly() blocks.BlockInterface {
+	return &Anomaly{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Anomaly) Setup() {
+	b.Kind = "Stats"
+	b.Desc = "scores the value at Path against what was expected, emitting each message with an Anomaly score, the Expected value and whether it is Anomalous"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.clear = b.InRoute("clear")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// a detector scores each value against the values before it. observe returns
+// the value that was expected, how unusual x is compared to that, and whether
+// the detector has seen enough to say.
+type detector interface {
+	observe(x float64) (expected, score float64, ready bool)
+}
+
+// minSpread stops a perfectly flat series from dividing by zero. Any change
+// to a flat series scores very highly instead.
+const minSpread = 1e-9
+
+// recentValues is a ring buffer of the last n values.
+type recentValues struct {
+	values []float64
+	next   int
+}
+
+func (r *recentValues) add(x float64) {
+	if len(r.values) < cap(r.values) {
+		r.values = append(r.values, x)
+		return
+	}
+	r.values[r.next] = x
+	r.next = (r.next + 1) % len(r.values)
+}
+
+func median(xs []float64) float64 {
+	sorted := make([]float64, len(xs))
+	copy(sorted, xs)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// zScoreDetector compares a value to the mean and standard deviation of the
+// last WindowSize values.
+type zScoreDetector struct {
+	recent recentValues
+	warmUp int
+}
+
+func (d *zScoreDetector) observe(x float64) (float64, float64, bool) {
+	defer d.recent.add(x)
+	n := float64(len(d.recent.values))
+	if len(d.recent.values) < d.warmUp || n < 2 {
+		return 0, 0, false
+	}
+	mean := 0.0
+	for _, v := range d.recent.values {
+		mean += v
+	}
+	mean /= n
+	variance := 0.0
+	for _, v := range d.recent.values {
+		variance += (v - mean) * (v - mean)
+	}
+	sd := math.Max(math.Sqrt(variance/(n-1)), minSpread)
+	return mean, (x - mean) / sd, true
+}
+
+// madDetector compares a value to the median of the last WindowSize values,
+// scaled by their median absolute deviation, which is robust to outliers in
+// the window itself.
+type madDetector struct {
+	recent recentValues
+	warmUp int
+}
+
+func (d *madDetector) observe(x float64) (float64, float64, bool) {
+	defer d.recent.add(x)
+	if len(d.recent.values) < d.warmUp || len(d.recent.values) == 0 {
+		return 0, 0, false
+	}
+	med := median(d.recent.values)
+	deviations := make([]float64, len(d.recent.values))
+	for i, v := range d.recent.values {
+		deviations[i] = math.Abs(v - med)
+	}
+	mad := math.Max(median(deviations), minSpread)
+	// 0.6745 makes the score comparable to a z-score for normal data
+	return med, 0.6745 * (x - med) / mad, true
+}
+
+// ewmaDetector keeps an exponentially weighted mean and variance, and scores
+// a value by how many deviations it falls from the mean, as in an EWMA
+// control chart.
+type ewmaDetector struct {
+	alpha    float64
+	mean     float64
+	variance float64
+	n        int
+	warmUp   int
+}
+
+func (d *ewmaDetector) observe(x float64) (float64, float64, bool) {
+	if d.n == 0 {
+		d.mean = x
+		d.n++
+		return 0, 0, false
+	}
+	expected := d.mean
+	score := (x - d.mean) / math.Max(math.Sqrt(d.variance), minSpread)
+	ready := d.n >= d.warmUp
+	diff := x - d.mean
+	incr := d.alpha * diff
+	d.mean += incr
+	d.variance = (1 - d.alpha) * (d.variance + diff*incr)
+	d.n++
+	return expected, score, ready
+}
+
+// holtWintersDetector forecasts each value from a level, a trend and a
+// repeating season of Period values (additive Holt-Winters), and scores the
+// forecast error against an exponentially weighted error variance.
+type holtWintersDetector struct {
+	alpha, beta, gamma float64
+	period             int
+	warmUp             int
+	first              []float64
+	level, trend       float64
+	season             []float64
+	variance           float64
+	n                  int
+}
+
+func (d *holtWintersDetector) observe(x float64) (float64, float64, bool) {
+	// the first season sets the initial level and seasonal offsets
+	if d.n < d.period {
+		d.first = append(d.first, x)
+		d.n++
+		if d.n == d.period {
+			for _, v := range d.first {
+				d.level += v
+			}
+			d.level /= float64(d.period)
+			d.season = make([]float64, d.period)
+			for i, v := range d.first {
+				d.season[i] = v - d.level
+			}
+			d.first = nil
+		}
+		return 0, 0, false
+	}
+	i := d.n % d.period
+	forecast := d.level + d.trend + d.season[i]
+	e := x - forecast
+	score := e / math.Max(math.Sqrt(d.variance), minSpread)
+	// give the error variance a season to settle before trusting scores
+	ready := d.n >= 2*d.period && d.n >= d.warmUp
+
+	level := d.level
+	d.level = d.alpha*(x-d.season[i]) + (1-d.alpha)*(d.level+d.trend)
+	d.trend = d.beta*(d.level-level) + (1-d.beta)*d.trend
+	d.season[i] = d.gamma*(x-d.level) + (1-d.gamma)*d.season[i]
+	d.variance = (1-d.alpha)*d.variance + d.alpha*e*e
+	d.n++
+	return forecast, score, ready
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Anomaly) Run() {
+	var path, keyPath, method string
+	var tree, keyTree *jee.TokenTree
+	windowSize := 100
+	warmUp := 10
+	period := 24
+	threshold := 3.0
+	alpha := 0.3
+	beta := 0.1
+	gamma := 0.1
+	method = "zscore"
+
+	detectors := make(map[string]detector)
+
+	newDetector := func() detector {
+		switch method {
+		case "mad":
+			return &madDetector{recent: recentValues{values: make([]float64, 0, windowSize)}, warmUp: warmUp}
+		case "ewma":
+			return &ewmaDetector{alpha: alpha, warmUp: warmUp}
+		case "holtwinters":
+			return &holtWintersDetector{alpha: alpha, beta: beta, gamma: gamma, period: period, warmUp: warmUp}
+		}
+		return &zScoreDetector{recent: recentValues{values: make([]float64, 0, windowSize)}, warmUp: warmUp}
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newPath, err := util.ParseRequiredString(ruleI, "Path")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newTree, err := util.BuildTokenTree(newPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newKeyPath, _ := util.ParseString(ruleI, "KeyPath")
+			var newKeyTree *jee.TokenTree
+			if newKeyPath != "" {
+				newKeyTree, err = util.BuildTokenTree(newKeyPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newMethod := "zscore"
+			if util.KeyExists(ruleI, "Detector") {
+				newMethod, err = util.ParseString(ruleI, "Detector")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newMethod != "zscore" && newMethod != "ewma" && newMethod != "mad" && newMethod != "holtwinters" {
+				b.Error(errors.New("Detector must be one of zscore, ewma, mad or holtwinters"))
+				continue
+			}
+
+			// every number is optional and falls back to its default
+			parseNumber := func(key string, def float64) (float64, error) {
+				if !util.KeyExists(ruleI, key) {
+					return def, nil
+				}
+				return util.ParseFloat(ruleI, key)
+			}
+			newThreshold, err := parseNumber("Threshold", 3)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newAlpha, err := parseNumber("Alpha", 0.3)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newBeta, err := parseNumber("Beta", 0.1)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newGamma, err := parseNumber("Gamma", 0.1)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			for _, f := range []float64{newAlpha, newBeta, newGamma} {
+				if f <= 0 || f > 1 {
+					err = errors.New("Alpha, Beta and Gamma must be greater than 0 and at most 1")
+				}
+			}
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newWindowSize, err := parseNumber("WindowSize", 100)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newWarmUp, err := parseNumber("WarmUp", 10)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newPeriod, err := parseNumber("Period", 24)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if newWindowSize < 2 || newWarmUp < 0 || newPeriod < 1 {
+				b.Error(errors.New("WindowSize must be at least 2, and Period at least 1"))
+				continue
+			}
+
+			path = newPath
+			tree = newTree
+			keyPath = newKeyPath
+			keyTree = newKeyTree
+			method = newMethod
+			threshold = newThreshold
+			alpha = newAlpha
+			beta = newBeta
+			gamma = newGamma
+			windowSize = int(newWindowSize)
+			warmUp = int(newWarmUp)
+			period = int(newPeriod)
+			detectors = make(map[string]detector)
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case <-b.clear:
+			detectors = make(map[string]detector)
+
+		case msg := <-b.in:
+			if tree == nil {
+				continue
+			}
+			v, err := jee.Eval(tree, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			x, ok := v.(float64)
+			if !ok {
+				b.Error(errors.New("the value at Path must be a number"))
+				continue
+			}
+			in, ok := msg.(map[string]interface{})
+			if !ok {
+				b.Error(errors.New("can only annotate messages that are objects"))
+				continue
+			}
+			key := ""
+			if keyTree != nil {
+				k, err := jee.Eval(keyTree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				key, err = countKey(k)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			d, ok := detectors[key]
+			if !ok {
+				d = newDetector()
+				detectors[key] = d
+			}
+
+			expected, score, ready := d.observe(x)
+			annotation := map[string]interface{}{
+				"Score":     nil,
+				"Expected":  nil,
+				"Anomalous": false,
+			}
+			if ready {
+				annotation["Score"] = score
+				annotation["Expected"] = expected
+				annotation["Anomalous"] = math.Abs(score) > threshold
+			}
+
+			// copy the message rather than change one other blocks may hold
+			out := make(map[string]interface{}, len(in)+1)
+			for k, v := range in {
+				out[k] = v
+			}
+			out["Anomaly"] = annotation
+			b.out <- out
+
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Path":       path,
+				"KeyPath":    keyPath,
+				"Detector":   method,
+				"Threshold":  threshold,
+				"WindowSize": float64(windowSize),
+				"WarmUp":     float64(warmUp),
+				"Alpha":      alpha,
+				"Beta":       beta,
+				"Gamma":      gamma,
+				"Period":     float64(period),
+			}
+		}
+	}
+}
@@ -0,0 +1,618 @@
+package library
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// avroSchema is a parsed Avro schema. Named types that refer to themselves
+// point back at the same avroSchema.
+type avroSchema struct {
+	typ      string
+	name     string
+	fields   []avroField
+	symbols  []string
+	items    *avroSchema
+	values   *avroSchema
+	branches []*avroSchema
+	size     int
+}
+
+type avroField struct {
+	name       string
+	schema     *avroSchema
+	def        interface{}
+	hasDefault bool
+}
+
+var avroMagic = []byte("Obj\x01")
+
+// parseAvroSchema reads a schema from its JSON form.
+func parseAvroSchema(schema interface{}) (*avroSchema, error) {
+	return readAvroSchema(schema, "", make(map[string]*avroSchema))
+}
+
+// avroFullName qualifies a name with a namespace, unless it already is.
+func avroFullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+func readAvroSchema(schema interface{}, namespace string, named map[string]*avroSchema) (*avroSchema, error) {
+	switch s := schema.(type) {
+	case string:
+		switch s {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroSchema{typ: s}, nil
+		}
+		if t, ok := named[avroFullName(s, namespace)]; ok {
+			return t, nil
+		}
+		if t, ok := named[s]; ok {
+			return t, nil
+		}
+		return nil, errors.New("avro schema refers to an unknown type " + s)
+	case []interface{}:
+		union := &avroSchema{typ: "union"}
+		for _, b := range s {
+			branch, err := readAvroSchema(b, namespace, named)
+			if err != nil {
+				return nil, err
+			}
+			union.branches = append(union.branches, branch)
+		}
+		return union, nil
+	case map[string]interface{}:
+		typ, _ := s["type"].(string)
+		if typ == "" {
+			// a type can be given as a schema of its own
+			if s["type"] == nil {
+				return nil, errors.New("avro schema is missing a type")
+			}
+			return readAvroSchema(s["type"], namespace, named)
+		}
+		t := &avroSchema{typ: typ}
+		switch typ {
+		case "record", "error", "enum", "fixed":
+			// errors are records that protocols can throw
+			if typ == "error" {
+				t.typ = "record"
+			}
+			name, _ := s["name"].(string)
+			if name == "" {
+				return nil, errors.New("avro " + typ + " is missing a name")
+			}
+			if ns, ok := s["namespace"].(string); ok && !strings.Contains(name, ".") {
+				namespace = ns
+			}
+			t.name = avroFullName(name, namespace)
+			if i := strings.LastIndex(t.name, "."); i >= 0 {
+				namespace = t.name[:i]
+			}
+			named[t.name] = t
+		}
+		switch t.typ {
+		case "record":
+			fields, ok := s["fields"].([]interface{})
+			if !ok {
+				return nil, errors.New("avro record " + t.name + " needs fields")
+			}
+			for _, fI := range fields {
+				f, ok := fI.(map[string]interface{})
+				if !ok {
+					return nil, errors.New("avro record " + t.name + " has a field that isn't an object")
+				}
+				name, _ := f["name"].(string)
+				if name == "" {
+					return nil, errors.New("avro record " + t.name + " has a field without a name")
+				}
+				fieldSchema, err := readAvroSchema(f["type"], namespace, named)
+				if err != nil {
+					return nil, err
+				}
+				def, hasDefault := f["default"]
+				t.fields = append(t.fields, avroField{
+					name:       name,
+					schema:     fieldSchema,
+					def:        def,
+					hasDefault: hasDefault,
+				})
+			}
+		case "enum":
+			symbols, ok := s["symbols"].([]interface{})
+			if !ok {
+				return nil, errors.New("avro enum " + t.name + " needs symbols")
+			}
+			for _, sym := range symbols {
+				symbol, ok := sym.(string)
+				if !ok {
+					return nil, errors.New("avro enum " + t.name + " has a symbol that isn't a string")
+				}
+				t.symbols = append(t.symbols, symbol)
+			}
+		case "fixed":
+			size, ok := s["size"].(float64)
+			if !ok || size < 0 {
+				return nil, errors.New("avro fixed " + t.name + " needs a size")
+			}
+			t.size = int(size)
+		case "array":
+			items, err := readAvroSchema(s["items"], namespace, named)
+			if err != nil {
+				return nil, err
+			}
+			t.items = items
+		case "map":
+			values, err := readAvroSchema(s["values"], namespace, named)
+			if err != nil {
+				return nil, err
+			}
+			t.values = values
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			// primitives can carry logical types, which are read as the
+			// primitive they're based on
+		default:
+			return readAvroSchema(typ, namespace, named)
+		}
+		return t, nil
+	}
+	return nil, errors.New("avro schema must be a string, an array or an object")
+}
+
+// decode reads a single datum written with the schema.
+func (t *avroSchema) decode(data []byte) (interface{}, error) {
+	r := &codecReader{data: data}
+	v, err := t.read(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if r.left() != 0 {
+		return nil, errors.New("avro datum is followed by more data")
+	}
+	return v, nil
+}
+
+func readAvroLong(r *codecReader) (int64, error) {
+	u, err := r.readUvarint()
+	return zigzagDecode(u), err
+}
+
+// readAvroLength reads the length of a string, bytes or map key.
+func readAvroLength(r *codecReader) (uint64, error) {
+	n, err := readAvroLong(r)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("avro data has a negative length")
+	}
+	return uint64(n), nil
+}
+
+// maxAvroItems caps the items in one array or map, since null items take
+// no input and a short datum could otherwise claim billions of them.
+const maxAvroItems = 1 << 20
+
+// readAvroBlock reads the count of items in the next block of an array or
+// map, skipping the size of the block that may follow it. have is the count
+// of items read from earlier blocks. Items take at least a byte unless
+// they're null, so longer counts are bad data.
+func readAvroBlock(r *codecReader, nulls bool, have uint64) (uint64, error) {
+	n, err := readAvroLong(r)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		if n == math.MinInt64 {
+			return 0, errors.New("avro block count is out of range")
+		}
+		n = -n
+		if _, err := readAvroLong(r); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(n) > maxAvroItems-have {
+		return 0, errors.New("avro array or map has too many items")
+	}
+	if !nulls && uint64(n) > uint64(r.left()) {
+		return 0, errCodecTruncated
+	}
+	return uint64(n), nil
+}
+
+func (t *avroSchema) read(r *codecReader, depth int) (interface{}, error) {
+	if depth > maxCodecDepth {
+		return nil, errors.New("avro data is nested too deeply")
+	}
+	switch t.typ {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := r.readByte()
+		return b != 0, err
+	case "int", "long":
+		n, err := readAvroLong(r)
+		return float64(n), err
+	case "float":
+		b, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+	case "double":
+		b, err := r.read(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case "bytes", "string":
+		n, err := readAvroLength(r)
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.read(n)
+		if err != nil {
+			return nil, err
+		}
+		if t.typ == "bytes" {
+			return base64.StdEncoding.EncodeToString(b), nil
+		}
+		return string(b), nil
+	case "fixed":
+		b, err := r.read(uint64(t.size))
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.EncodeToString(b), nil
+	case "enum":
+		i, err := readAvroLong(r)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(t.symbols)) {
+			return nil, errors.New("avro enum " + t.name + " has no symbol for its value")
+		}
+		return t.symbols[i], nil
+	case "union":
+		i, err := readAvroLong(r)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(t.branches)) {
+			return nil, errors.New("avro union has no branch for its value")
+		}
+		return t.branches[i].read(r, depth+1)
+	case "record":
+		out := make(map[string]interface{})
+		for _, f := range t.fields {
+			v, err := f.schema.read(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			out[f.name] = v
+		}
+		return out, nil
+	case "array":
+		out := []interface{}{}
+		for {
+			n, err := readAvroBlock(r, t.items.typ == "null", uint64(len(out)))
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				return out, nil
+			}
+			for i := uint64(0); i < n; i++ {
+				v, err := t.items.read(r, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, v)
+			}
+		}
+	case "map":
+		out := make(map[string]interface{})
+		read := uint64(0)
+		for {
+			n, err := readAvroBlock(r, false, read)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				return out, nil
+			}
+			for i := uint64(0); i < n; i++ {
+				kn, err := readAvroLength(r)
+				if err != nil {
+					return nil, err
+				}
+				k, err := r.read(kn)
+				if err != nil {
+					return nil, err
+				}
+				v, err := t.values.read(r, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				out[string(k)] = v
+			}
+			read += n
+		}
+	}
+	return nil, errors.New("avro schema has an unknown type " + t.typ)
+}
+
+// isAvroContainer tells whether data is an Avro object container file.
+func isAvroContainer(data []byte) bool {
+	return bytes.HasPrefix(data, avroMagic)
+}
+
+// decodeAvroContainer reads every record in an object container file, using
+// the schema in its header.
+func decodeAvroContainer(data []byte) ([]interface{}, error) {
+	r := &codecReader{data: data, pos: len(avroMagic)}
+
+	// the header's metadata is a map of bytes
+	meta := make(map[string][]byte)
+	read := uint64(0)
+	for {
+		n, err := readAvroBlock(r, false, read)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		for i := uint64(0); i < n; i++ {
+			kn, err := readAvroLength(r)
+			if err != nil {
+				return nil, err
+			}
+			k, err := r.read(kn)
+			if err != nil {
+				return nil, err
+			}
+			vn, err := readAvroLength(r)
+			if err != nil {
+				return nil, err
+			}
+			v, err := r.read(vn)
+			if err != nil {
+				return nil, err
+			}
+			meta[string(k)] = v
+		}
+		read += n
+	}
+	sync, err := r.read(16)
+	if err != nil {
+		return nil, err
+	}
+
+	var schemaI interface{}
+	if err := json.Unmarshal(meta["avro.schema"], &schemaI); err != nil {
+		return nil, errors.New("avro container has a bad schema: " + err.Error())
+	}
+	schema, err := parseAvroSchema(schemaI)
+	if err != nil {
+		return nil, err
+	}
+	codec := string(meta["avro.codec"])
+
+	out := []interface{}{}
+	for r.left() > 0 {
+		count, err := readAvroLength(r)
+		if err != nil {
+			return nil, err
+		}
+		if count > maxAvroItems-uint64(len(out)) {
+			return nil, errors.New("avro container has too many records")
+		}
+		size, err := readAvroLength(r)
+		if err != nil {
+			return nil, err
+		}
+		block, err := r.read(size)
+		if err != nil {
+			return nil, err
+		}
+		switch codec {
+		case "", "null":
+		case "deflate":
+			block, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(block)))
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.New("avro container uses the " + codec + " codec, which isn't supported")
+		}
+		br := &codecReader{data: block}
+		for i := uint64(0); i < count; i++ {
+			v, err := schema.read(br, 0)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		marker, err := r.read(16)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(marker, sync) {
+			return nil, errors.New("avro container has a bad sync marker")
+		}
+	}
+	return out, nil
+}
+
+// encode writes a value as a single datum with the schema. Missing record
+// fields take their defaults, and union branches are picked by the first
+// one the value fits.
+func (t *avroSchema) encode(v interface{}) ([]byte, error) {
+	return t.write(nil, v, 0)
+}
+
+func appendAvroLong(out []byte, n int64) []byte {
+	return appendUvarint(out, zigzagEncode(n))
+}
+
+// fits tells whether a value can be written with the schema, without
+// looking inside arrays, maps and records.
+func (t *avroSchema) fits(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return t.typ == "null"
+	case bool:
+		return t.typ == "boolean"
+	case float64:
+		switch t.typ {
+		case "int":
+			return codecInt(v) && v >= math.MinInt32 && v <= math.MaxInt32
+		case "long":
+			return codecInt(v)
+		}
+		return t.typ == "float" || t.typ == "double"
+	case string:
+		switch t.typ {
+		case "string":
+			return true
+		case "bytes":
+			_, err := base64.StdEncoding.DecodeString(v)
+			return err == nil
+		case "fixed":
+			b, err := base64.StdEncoding.DecodeString(v)
+			return err == nil && len(b) == t.size
+		case "enum":
+			for _, sym := range t.symbols {
+				if sym == v {
+					return true
+				}
+			}
+		}
+		return false
+	case []interface{}:
+		return t.typ == "array"
+	case map[string]interface{}:
+		return t.typ == "map" || t.typ == "record"
+	}
+	return false
+}
+
+func (t *avroSchema) write(out []byte, v interface{}, depth int) ([]byte, error) {
+	if depth > maxCodecDepth {
+		return nil, errors.New("message is nested too deeply to encode")
+	}
+	v, err := codecValue(v)
+	if err != nil {
+		return nil, err
+	}
+	if t.typ == "union" {
+		for i, branch := range t.branches {
+			if branch.fits(v) {
+				out = appendAvroLong(out, int64(i))
+				return branch.write(out, v, depth+1)
+			}
+		}
+		return nil, errors.New("value doesn't fit any branch of the avro union")
+	}
+	if !t.fits(v) {
+		name := t.typ
+		if t.name != "" {
+			name = t.name
+		}
+		return nil, errors.New("value doesn't fit the avro type " + name)
+	}
+	switch t.typ {
+	case "null":
+		return out, nil
+	case "boolean":
+		if v.(bool) {
+			return append(out, 1), nil
+		}
+		return append(out, 0), nil
+	case "int", "long":
+		return appendAvroLong(out, int64(v.(float64))), nil
+	case "float":
+		out = append(out, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(out[len(out)-4:], math.Float32bits(float32(v.(float64))))
+		return out, nil
+	case "double":
+		out = append(out, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint64(out[len(out)-8:], math.Float64bits(v.(float64)))
+		return out, nil
+	case "string":
+		s := v.(string)
+		out = appendAvroLong(out, int64(len(s)))
+		return append(out, s...), nil
+	case "bytes":
+		b, _ := base64.StdEncoding.DecodeString(v.(string))
+		out = appendAvroLong(out, int64(len(b)))
+		return append(out, b...), nil
+	case "fixed":
+		b, _ := base64.StdEncoding.DecodeString(v.(string))
+		return append(out, b...), nil
+	case "enum":
+		for i, sym := range t.symbols {
+			if sym == v.(string) {
+				return appendAvroLong(out, int64(i)), nil
+			}
+		}
+	case "array":
+		list := v.([]interface{})
+		if len(list) > 0 {
+			out = appendAvroLong(out, int64(len(list)))
+			for _, item := range list {
+				if out, err = t.items.write(out, item, depth+1); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return append(out, 0), nil
+	case "map":
+		obj := v.(map[string]interface{})
+		if len(obj) > 0 {
+			out = appendAvroLong(out, int64(len(obj)))
+			for _, k := range sortedKeys(obj) {
+				out = appendAvroLong(out, int64(len(k)))
+				out = append(out, k...)
+				if out, err = t.values.write(out, obj[k], depth+1); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return append(out, 0), nil
+	case "record":
+		obj := v.(map[string]interface{})
+		for _, f := range t.fields {
+			fv, ok := obj[f.name]
+			if !ok {
+				if !f.hasDefault {
+					return nil, errors.New("avro record " + t.name + " is missing the field " + f.name)
+				}
+				fv = f.def
+				// the default for a union is for its first branch
+				if f.schema.typ == "union" && len(f.schema.branches) > 0 {
+					out = appendAvroLong(out, 0)
+					if out, err = f.schema.branches[0].write(out, fv, depth+1); err != nil {
+						return nil, err
+					}
+					continue
+				}
+			}
+			if out, err = f.schema.write(out, fv, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, errors.New("avro schema has an unknown type " + t.typ)
+}
@@ -0,0 +1,192 @@
+package library
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type BloomDeDupe struct {
+	blocks.Block
+	queryrule  chan blocks.MsgChan
+	querystate chan blocks.MsgChan
+	inrule     blocks.MsgChan
+	clear      blocks.MsgChan
+	in         blocks.MsgChan
+	out        blocks.MsgChan
+	quit       blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewBloomDeDupe() blocks.BlockInterface {
+	return &BloomDeDupe{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *BloomDeDupe) Setup() {
+	b.Kind = "Core"
+	b.Desc = "emits only those messages whose value at Path it probably hasn't seen before, using a rotating Bloom filter of fixed size"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.clear = b.InRoute("clear")
+	b.queryrule = b.QueryRoute("rule")
+	b.querystate = b.QueryRoute("state")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *BloomDeDupe) Run() {
+	var path, rotateString string
+	var tree *jee.TokenTree
+	var rotateEvery time.Duration
+	capacity := 100000
+	rate := 0.001
+	rotations := 0.0
+
+	// values are checked against both filters but only added to current. Once
+	// current is full, or old enough, it replaces previous, so the block
+	// remembers between one and two filters' worth of values.
+	current, _ := newBloomFilter(capacity, rate)
+	previous, _ := newBloomFilter(capacity, rate)
+
+	rotateTimer := time.NewTimer(time.Duration(1) * time.Second)
+	rotateTimer.Stop()
+
+	rotate := func() {
+		previous = current
+		current, _ = newBloomFilter(capacity, rate)
+		rotations++
+		if rotateEvery > 0 {
+			rotateTimer.Reset(rotateEvery)
+		}
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newPath, err := util.ParseRequiredString(ruleI, "Path")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newTree, err := util.BuildTokenTree(newPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newCapacity := 100000
+			if util.KeyExists(ruleI, "Capacity") {
+				newCapacity, err = util.ParseInt(ruleI, "Capacity")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newRate := 0.001
+			if util.KeyExists(ruleI, "FalsePositiveRate") {
+				newRate, err = util.ParseFloat(ruleI, "FalsePositiveRate")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newCurrent, err := newBloomFilter(newCapacity, newRate)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newRotateString, _ := util.ParseString(ruleI, "RotateInterval")
+			newRotate := time.Duration(0)
+			if newRotateString != "" {
+				newRotate, err = time.ParseDuration(newRotateString)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if newRotate <= 0 {
+					b.Error(errors.New("RotateInterval must be positive"))
+					continue
+				}
+			}
+
+			// a filter of a different size can't be carried over
+			if newCapacity != capacity || newRate != rate {
+				current = newCurrent
+				previous, _ = newBloomFilter(newCapacity, newRate)
+			}
+
+			path = newPath
+			tree = newTree
+			capacity = newCapacity
+			rate = newRate
+			rotateString = newRotateString
+			rotateEvery = newRotate
+
+			rotateTimer.Stop()
+			if rotateEvery > 0 {
+				rotateTimer.Reset(rotateEvery)
+			}
+
+		case <-rotateTimer.C:
+			rotate()
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case msg := <-b.in:
+			if tree == nil {
+				continue
+			}
+			v, err := jee.Eval(tree, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if v == nil {
+				continue
+			}
+			key, err := countKey(v)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if current.has(key) || previous.has(key) {
+				continue
+			}
+			// emit the incoming message, as we probably haven't seen it before
+			b.out <- msg
+			current.add(key)
+			if current.count >= capacity {
+				rotate()
+			}
+
+		case <-b.clear:
+			current, _ = newBloomFilter(capacity, rate)
+			previous, _ = newBloomFilter(capacity, rate)
+
+		case c := <-b.querystate:
+			c <- map[string]interface{}{
+				"Current":   float64(current.count),
+				"Previous":  float64(previous.count),
+				"Bits":      float64(current.m),
+				"Hashes":    float64(current.k),
+				"Rotations": rotations,
+			}
+
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Path":              path,
+				"Capacity":          float64(capacity),
+				"FalsePositiveRate": rate,
+				"RotateInterval":    rotateString,
+			}
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"container/heap"
 	"encoding/json"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/nytlabs/gojee"                 // jee
@@ -19,10 +20,14 @@ type Cache struct {
 	inrule      blocks.MsgChan
 	in          blocks.MsgChan
 	lookup      blocks.MsgChan
+	delete      blocks.MsgChan
+	clear       blocks.MsgChan
 	keys        chan blocks.MsgChan
 	values      chan blocks.MsgChan
 	dump        chan blocks.MsgChan
+	stats       chan blocks.MsgChan
 	out         blocks.MsgChan
+	evicted     blocks.MsgChan
 	quit        blocks.MsgChan
 }
 
@@ -32,89 +37,273 @@ func NewCache() blocks.BlockInterface {
 }
 
 type item struct {
+	key      string
 	value    interface{}
 	lastSeen time.Time
+	hits     int
+	size     int
+	ttl      time.Duration
+	index    int
+	// expiry is the item's entry in the queue of items to expire
+	expiry *PQMessage
 }
 
 func (i item) MarshalJSON() ([]byte, error) {
 	return json.Marshal(i.value)
 }
 
+// evictionQueue orders the items in the cache by which should be evicted
+// first: the least recently used, or the least frequently used.
+type evictionQueue struct {
+	items []*item
+	lfu   bool
+}
+
+func (q *evictionQueue) Len() int {
+	return len(q.items)
+}
+
+func (q *evictionQueue) Less(i, j int) bool {
+	a, b := q.items[i], q.items[j]
+	if q.lfu && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.lastSeen.Before(b.lastSeen)
+}
+
+func (q *evictionQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.items[i].index = i
+	q.items[j].index = j
+}
+
+func (q *evictionQueue) Push(x interface{}) {
+	i := x.(*item)
+	i.index = len(q.items)
+	q.items = append(q.items, i)
+}
+
+func (q *evictionQueue) Pop() interface{} {
+	n := len(q.items)
+	i := q.items[n-1]
+	i.index = -1
+	q.items = q.items[:n-1]
+	return i
+}
+
+// cacheSize is roughly how much memory an entry takes up: the length of its
+// key and of its value as JSON.
+func cacheSize(k string, v interface{}) int {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return len(k)
+	}
+	return len(k) + len(b)
+}
+
 // Cacheup is called once before running the block. We build up the channels and specify what kind of block this is.
 func (b *Cache) Setup() {
 	b.Kind = "Core"
-	b.Desc = "stores a set of dictionary values queryable on key"
+	b.Desc = "stores a set of dictionary values queryable on key, evicting the least recently or least frequently used when full"
 	b.inrule = b.InRoute("rule")
 	b.queryrule = b.QueryRoute("rule")
 	b.querylookup = b.QueryParamRoute("lookup")
 	b.quit = b.Quit()
 	b.out = b.Broadcast()
+	b.evicted = b.OutRoute("evicted")
 
 	b.in = b.InRoute("in")
 	b.lookup = b.InRoute("lookup")
+	b.delete = b.InRoute("delete")
+	b.clear = b.InRoute("clear")
 	b.keys = b.QueryRoute("keys")
 	b.values = b.QueryRoute("values")
 	b.dump = b.QueryRoute("dump")
+	b.stats = b.QueryRoute("stats")
 }
 
-func extractAndUpdate(k string, values map[string]item, ttlQueue *PriorityQueue) (map[string]interface{}, error) {
-	i, ok := values[k]
-	var v interface{}
-	if ok {
-		v = i.value
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Cache) Run() {
+	var keyPath, valuePath, ttlString, ttlPath, eviction string
+	var ttl time.Duration
+	var maxEntries, maxBytes int
+	cache := make(map[string]*item)
+	ttlQueue := &PriorityQueue{}
+	evictQueue := &evictionQueue{}
+	bytes := 0
+	var hits, misses, evictions, expirations float64
+
+	var keyTree, valueTree, ttlTree *jee.TokenTree
+	emitTick := time.NewTimer(500 * time.Millisecond)
+
+	eviction = "lru"
+
+	// touch marks an item as used, which keeps it from expiring and from
+	// being evicted for a while
+	touch := func(i *item) {
 		now := time.Now()
 		i.lastSeen = now
-		queueMessage := &PQMessage{
-			val: k,
-			t:   now,
+		i.hits++
+		heap.Fix(evictQueue, i.index)
+		if i.ttl <= 0 {
+			if i.expiry != nil && i.expiry.index >= 0 {
+				heap.Remove(ttlQueue, i.expiry.index)
+			}
+			i.expiry = nil
+			return
+		}
+		if i.expiry != nil && i.expiry.index >= 0 {
+			// move the item's existing expiry rather than add another
+			i.expiry.t = now.Add(i.ttl)
+			heap.Fix(ttlQueue, i.expiry.index)
+			return
+		}
+		i.expiry = &PQMessage{
+			val: i.key,
+			t:   now.Add(i.ttl),
 		}
-		heap.Push(ttlQueue, queueMessage)
+		heap.Push(ttlQueue, i.expiry)
 	}
-	out := map[string]interface{}{
-		"key":   k,
-		"value": v,
+
+	remove := func(i *item, reason string) {
+		delete(cache, i.key)
+		heap.Remove(evictQueue, i.index)
+		if i.expiry != nil && i.expiry.index >= 0 {
+			heap.Remove(ttlQueue, i.expiry.index)
+		}
+		bytes -= i.size
+		if reason == "" {
+			return
+		}
+		b.evicted <- map[string]interface{}{
+			"key":    i.key,
+			"value":  i.value,
+			"reason": reason,
+		}
 	}
-	return out, nil
 
-}
+	// evict removes items until the cache is within its limits
+	evict := func() {
+		for len(cache) > 0 && ((maxEntries > 0 && len(cache) > maxEntries) || (maxBytes > 0 && bytes > maxBytes)) {
+			remove(evictQueue.items[0], "evicted")
+			evictions++
+		}
+	}
 
-// Run is the block's main loop. Here we listen on the different channels we set up.
-func (b *Cache) Run() {
-	var keyPath, valuePath, ttlString string
-	var ttl time.Duration
-	cache := make(map[string]item)
-	ttlQueue := &PriorityQueue{}
+	// get looks up a key, counting a hit or a miss
+	get := func(k string) interface{} {
+		i, ok := cache[k]
+		if !ok {
+			misses++
+			return nil
+		}
+		hits++
+		touch(i)
+		return i.value
+	}
+
+	keyOf := func(msg interface{}) (string, error) {
+		kI, err := jee.Eval(keyTree, msg)
+		if err != nil {
+			return "", err
+		}
+		if kI == nil {
+			return "", errors.New("could not find a key at " + keyPath)
+		}
+		return countKey(kI)
+	}
 
-	var keyTree, valueTree *jee.TokenTree
-	var err error
-	emitTick := time.NewTimer(500 * time.Millisecond)
 	for {
 		select {
 		case <-emitTick.C:
 
 		case ruleI := <-b.inrule:
-			keyPath, err = util.ParseString(ruleI, "KeyPath")
-			keyTree, err = util.BuildTokenTree(keyPath)
+			newKeyPath, err := util.ParseRequiredString(ruleI, "KeyPath")
 			if err != nil {
 				b.Error(err)
 				break
 			}
-			valuePath, err = util.ParseString(ruleI, "ValuePath")
-			valueTree, err = util.BuildTokenTree(valuePath)
+			newKeyTree, err := util.BuildTokenTree(newKeyPath)
 			if err != nil {
 				b.Error(err)
 				break
 			}
-			ttlString, err = util.ParseString(ruleI, "TimeToLive")
+			newValuePath, err := util.ParseRequiredString(ruleI, "ValuePath")
 			if err != nil {
 				b.Error(err)
 				break
 			}
-			ttl, err = time.ParseDuration(ttlString)
+			newValueTree, err := util.BuildTokenTree(newValuePath)
 			if err != nil {
 				b.Error(err)
 				break
 			}
+			newTTLString, _ := util.ParseString(ruleI, "TimeToLive")
+			newTTL := time.Duration(0)
+			if newTTLString != "" {
+				newTTL, err = time.ParseDuration(newTTLString)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			newTTLPath, _ := util.ParseString(ruleI, "TimeToLivePath")
+			var newTTLTree *jee.TokenTree
+			if newTTLPath != "" {
+				newTTLTree, err = util.BuildTokenTree(newTTLPath)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			newEviction := "lru"
+			if util.KeyExists(ruleI, "Eviction") {
+				newEviction, err = util.ParseString(ruleI, "Eviction")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			if newEviction != "lru" && newEviction != "lfu" {
+				b.Error(errors.New("Eviction must be lru or lfu"))
+				break
+			}
+			newMaxEntries := 0.0
+			if util.KeyExists(ruleI, "MaxEntries") {
+				newMaxEntries, err = util.ParseFloat(ruleI, "MaxEntries")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			newMaxBytes := 0.0
+			if util.KeyExists(ruleI, "MaxBytes") {
+				newMaxBytes, err = util.ParseFloat(ruleI, "MaxBytes")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			if newMaxEntries < 0 || newMaxBytes < 0 {
+				b.Error(errors.New("MaxEntries and MaxBytes cannot be negative"))
+				break
+			}
+
+			keyPath = newKeyPath
+			keyTree = newKeyTree
+			valuePath = newValuePath
+			valueTree = newValueTree
+			ttlString = newTTLString
+			ttl = newTTL
+			ttlPath = newTTLPath
+			ttlTree = newTTLTree
+			eviction = newEviction
+			maxEntries = int(newMaxEntries)
+			maxBytes = int(newMaxBytes)
+
+			evictQueue.lfu = eviction == "lfu"
+			heap.Init(evictQueue)
+			evict()
 		case <-b.quit:
 			return
 
@@ -122,35 +311,65 @@ func (b *Cache) Run() {
 			if keyTree == nil {
 				continue
 			}
-			kI, err := jee.Eval(keyTree, msg)
+			k, err := keyOf(msg)
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-			k, ok := kI.(string)
-			if !ok {
-				b.Error(err)
-				continue
-			}
-			out, err := extractAndUpdate(k, cache, ttlQueue)
-			if err != nil {
-				b.Error(err)
-				continue
+			b.out <- map[string]interface{}{
+				"key":   k,
+				"value": get(k),
 			}
-			b.out <- out
 		case q := <-b.querylookup:
 			k, ok := q.Params["key"]
-			if !ok {
-				b.Error(errors.New("Must specify a key to lookup"))
+			prefix, hasPrefix := q.Params["prefix"]
+			if !ok && !hasPrefix {
+				b.Error(errors.New("Must specify a key or a prefix to lookup"))
+				q.RespChan <- map[string]interface{}{}
+				continue
 			}
+			// a single key gets a single value back
+			if len(k) == 1 && !hasPrefix {
+				q.RespChan <- map[string]interface{}{
+					"key":   k[0],
+					"value": get(k[0]),
+				}
+				continue
+			}
+			found := make(map[string]interface{})
 			for _, ki := range k {
-				out, err := extractAndUpdate(ki, cache, ttlQueue)
-				if err != nil {
-					b.Error(err)
-					continue
+				found[ki] = get(ki)
+			}
+			for _, p := range prefix {
+				for ki, i := range cache {
+					if strings.HasPrefix(ki, p) {
+						found[ki] = i.value
+					}
 				}
-				q.RespChan <- out
 			}
+			q.RespChan <- map[string]interface{}{
+				"values": found,
+			}
+
+		case msg := <-b.delete:
+			if keyTree == nil {
+				continue
+			}
+			k, err := keyOf(msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if i, ok := cache[k]; ok {
+				remove(i, "")
+			}
+
+		case <-b.clear:
+			cache = make(map[string]*item)
+			ttlQueue = &PriorityQueue{}
+			evictQueue = &evictionQueue{lfu: eviction == "lfu"}
+			bytes = 0
+			hits, misses, evictions, expirations = 0, 0, 0, 0
 
 		case responseChan := <-b.keys:
 			keys := make([]string, len(cache))
@@ -180,6 +399,21 @@ func (b *Cache) Run() {
 				"dump": cache,
 			}
 
+		case responseChan := <-b.stats:
+			hitRate := 0.0
+			if hits+misses > 0 {
+				hitRate = hits / (hits + misses)
+			}
+			responseChan <- map[string]interface{}{
+				"Entries":     float64(len(cache)),
+				"Bytes":       float64(bytes),
+				"Hits":        hits,
+				"Misses":      misses,
+				"HitRate":     hitRate,
+				"Evictions":   evictions,
+				"Expirations": expirations,
+			}
+
 		case msg := <-b.in:
 			if keyTree == nil {
 				continue
@@ -187,55 +421,80 @@ func (b *Cache) Run() {
 			if valueTree == nil {
 				continue
 			}
-			kI, err := jee.Eval(keyTree, msg)
+			k, err := keyOf(msg)
 			if err != nil {
 				b.Error(err)
 				break
 			}
-			k, ok := kI.(string)
-			if !ok {
-				b.Error(errors.New("key must be a string"))
-				continue
-			}
 			v, err := jee.Eval(valueTree, msg)
 			if err != nil {
 				b.Error(err)
 				break
 			}
-			now := time.Now()
-			cache[k] = item{
-				value:    v,
-				lastSeen: now,
+			itemTTL := ttl
+			if ttlTree != nil {
+				tI, err := jee.Eval(ttlTree, msg)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+				switch t := tI.(type) {
+				case nil:
+					// fall back to the TimeToLive
+				case float64:
+					itemTTL = time.Duration(t) * time.Millisecond
+				case string:
+					itemTTL, err = time.ParseDuration(t)
+				default:
+					err = errors.New("time to live must be a duration string or milliseconds")
+				}
+				if err != nil {
+					b.Error(err)
+					break
+				}
 			}
 
-			queueMessage := &PQMessage{
-				val: k,
-				t:   now,
+			i, ok := cache[k]
+			if !ok {
+				i = &item{key: k}
+				cache[k] = i
+				heap.Push(evictQueue, i)
 			}
-			heap.Push(ttlQueue, queueMessage)
+			bytes -= i.size
+			i.value = v
+			i.size = cacheSize(k, v)
+			i.ttl = itemTTL
+			bytes += i.size
+			touch(i)
+			evict()
 		case responseChan := <-b.queryrule:
 			// deal with a query request
 			responseChan <- map[string]interface{}{
-				"KeyPath":    keyPath,
-				"ValuePath":  valuePath,
-				"TimeToLive": ttlString,
+				"KeyPath":        keyPath,
+				"ValuePath":      valuePath,
+				"TimeToLive":     ttlString,
+				"TimeToLivePath": ttlPath,
+				"Eviction":       eviction,
+				"MaxEntries":     float64(maxEntries),
+				"MaxBytes":       float64(maxBytes),
 			}
 		}
 		now := time.Now()
 		for {
-			itemI, diff := ttlQueue.PeekAndShift(now, ttl)
+			itemI, diff := ttlQueue.PeekAndShift(now, 0)
 			if itemI == nil {
-				// then the queue is empty. don't check again for 5s
+				// then the queue is empty. don't check again for 500ms
 				if diff == 0 {
 					diff = time.Duration(500) * time.Millisecond
 				}
 				emitTick.Reset(diff)
 				break
 			}
-			i := itemI.(*PQMessage)
-			k := i.val.(string)
-			if i.t.Equal(cache[k].lastSeen) {
-				delete(cache, k)
+			q := itemI.(*PQMessage)
+			i, ok := cache[q.val.(string)]
+			if ok && i.expiry == q {
+				remove(i, "expired")
+				expirations++
 			}
 		}
 	}
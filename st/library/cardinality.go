@@ -0,0 +1,155 @@
+package library
+
+import (
+	"encoding/base64"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Cardinality struct {
+	blocks.Block
+	queryrule        chan blocks.MsgChan
+	querycardinality chan blocks.MsgChan
+	querysketch      chan blocks.MsgChan
+	inrule           blocks.MsgChan
+	inpoll           blocks.MsgChan
+	inmerge          blocks.MsgChan
+	clear            blocks.MsgChan
+	in               blocks.MsgChan
+	out              blocks.MsgChan
+	quit             blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewCardinality() blocks.BlockInterface {
+	return &Cardinality{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Cardinality) Setup() {
+	b.Kind = "Stats"
+	b.Desc = "estimates the number of distinct values found at Path in fixed memory, using HyperLogLog"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.inpoll = b.InRoute("poll")
+	b.inmerge = b.InRoute("merge")
+	b.clear = b.InRoute("clear")
+	b.queryrule = b.QueryRoute("rule")
+	b.querycardinality = b.QueryRoute("cardinality")
+	b.querysketch = b.QueryRoute("sketch")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Cardinality) Run() {
+	var path string
+	var tree *jee.TokenTree
+	precision := 14
+	sketch, _ := newHyperLogLog(precision)
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newPath, err := util.ParseRequiredString(ruleI, "Path")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newTree, err := util.BuildTokenTree(newPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newPrecision := 14
+			if util.KeyExists(ruleI, "Precision") {
+				newPrecision, err = util.ParseInt(ruleI, "Precision")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newPrecision != precision {
+				newSketch, err := newHyperLogLog(newPrecision)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				sketch = newSketch
+				precision = newPrecision
+			}
+			path = newPath
+			tree = newTree
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case msg := <-b.in:
+			if tree == nil {
+				continue
+			}
+			v, err := jee.Eval(tree, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if v == nil {
+				continue
+			}
+			key, err := countKey(v)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			sketch.add(key)
+
+		case msg := <-b.inmerge:
+			// merge a sketch exported from another cardinality block
+			encoded, err := util.ParseRequiredString(msg, "Registers")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			registers, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			err = sketch.merge(registers)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+		case <-b.clear:
+			sketch, _ = newHyperLogLog(precision)
+
+		case <-b.inpoll:
+			b.out <- map[string]interface{}{
+				"Cardinality": sketch.estimate(),
+			}
+
+		case c := <-b.querycardinality:
+			c <- map[string]interface{}{
+				"Cardinality": sketch.estimate(),
+			}
+
+		case c := <-b.querysketch:
+			c <- map[string]interface{}{
+				"Precision": float64(precision),
+				"Registers": base64.StdEncoding.EncodeToString(sketch.registers),
+			}
+
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Path":      path,
+				"Precision": float64(precision),
+			}
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package library
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// decodeCBOR reads a single CBOR value. Byte strings become base64 strings,
+// and tags are dropped in favour of the values they wrap.
+func decodeCBOR(data []byte) (interface{}, error) {
+	r := &codecReader{data: data}
+	v, err := readCBOR(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if v == cborBreak {
+		return nil, errors.New("cbor data has a break outside an indefinite length item")
+	}
+	if r.left() != 0 {
+		return nil, errors.New("cbor value is followed by more data")
+	}
+	return v, nil
+}
+
+// cborBreak marks the end of an indefinite length item.
+var cborBreak = &struct{}{}
+
+// readCBORHead reads the major type of an item and the number that follows
+// it. indefinite is set for items whose length isn't given up front.
+func readCBORHead(r *codecReader) (major byte, info byte, n uint64, indefinite bool, err error) {
+	c, err := r.readByte()
+	if err != nil {
+		return
+	}
+	major, info = c>>5, c&0x1f
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		var b []byte
+		b, err = r.read(1 << (info - 24))
+		if err != nil {
+			return
+		}
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+	case info == 31:
+		indefinite = true
+	default:
+		err = errors.New("cbor data has a reserved length")
+	}
+	return
+}
+
+func readCBOR(r *codecReader, depth int) (interface{}, error) {
+	if depth > maxCodecDepth {
+		return nil, errors.New("cbor data is nested too deeply")
+	}
+	major, info, n, indefinite, err := readCBORHead(r)
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		return float64(n), nil
+	case 1:
+		return -1 - float64(n), nil
+	case 2, 3:
+		b, err := readCBORString(r, major, n, indefinite)
+		if err != nil {
+			return nil, err
+		}
+		if major == 2 {
+			return base64.StdEncoding.EncodeToString(b), nil
+		}
+		return string(b), nil
+	case 4:
+		out := []interface{}{}
+		for i := uint64(0); indefinite || i < n; i++ {
+			if !indefinite && n-i > uint64(r.left()) {
+				return nil, errCodecTruncated
+			}
+			v, err := readCBOR(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if v == cborBreak {
+				if !indefinite {
+					return nil, errors.New("cbor data has a break outside an indefinite length item")
+				}
+				break
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case 5:
+		out := make(map[string]interface{})
+		for i := uint64(0); indefinite || i < n; i++ {
+			if !indefinite && n-i > uint64(r.left()) {
+				return nil, errCodecTruncated
+			}
+			k, err := readCBOR(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if k == cborBreak {
+				if !indefinite {
+					return nil, errors.New("cbor data has a break outside an indefinite length item")
+				}
+				break
+			}
+			v, err := readCBOR(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if v == cborBreak {
+				return nil, errors.New("cbor map is missing a value")
+			}
+			out[codecKey(k)] = v
+		}
+		return out, nil
+	case 6:
+		if indefinite {
+			return nil, errors.New("cbor tags can't be indefinite")
+		}
+		return readCBOR(r, depth+1)
+	}
+
+	// major type 7 holds simple values and floats
+	switch {
+	case indefinite:
+		return cborBreak, nil
+	case info == 20:
+		return false, nil
+	case info == 21:
+		return true, nil
+	case info == 22, info == 23:
+		return nil, nil
+	case info == 25:
+		return cborHalf(uint16(n)), nil
+	case info == 26:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case info == 27:
+		return math.Float64frombits(n), nil
+	}
+	return nil, errors.New("cbor data has an unknown simple value")
+}
+
+// readCBORString reads a byte or text string, joining the chunks of
+// indefinite length ones.
+func readCBORString(r *codecReader, major byte, n uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		return r.read(n)
+	}
+	var out []byte
+	for {
+		chunkMajor, _, chunkN, chunkIndefinite, err := readCBORHead(r)
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor == 7 && chunkIndefinite {
+			return out, nil
+		}
+		if chunkMajor != major || chunkIndefinite {
+			return nil, errors.New("cbor string has a chunk of the wrong type")
+		}
+		b, err := r.read(chunkN)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+}
+
+// cborHalf reads a half precision float.
+func cborHalf(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
+
+// encodeCBOR writes a value as CBOR, writing whole numbers as integers and
+// the keys of objects in order.
+func encodeCBOR(v interface{}) ([]byte, error) {
+	return appendCBOR(nil, v, 0)
+}
+
+func appendCBORHead(out []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(out, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(out, major|24, byte(n))
+	case n <= math.MaxUint16:
+		out = append(out, major|25, 0, 0)
+		binary.BigEndian.PutUint16(out[len(out)-2:], uint16(n))
+		return out
+	case n <= math.MaxUint32:
+		out = append(out, major|26, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(out[len(out)-4:], uint32(n))
+		return out
+	}
+	out = append(out, major|27, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(out[len(out)-8:], n)
+	return out
+}
+
+func appendCBOR(out []byte, v interface{}, depth int) ([]byte, error) {
+	if depth > maxCodecDepth {
+		return nil, errors.New("message is nested too deeply to encode")
+	}
+	v, err := codecValue(v)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case nil:
+		return append(out, 0xf6), nil
+	case bool:
+		if v {
+			return append(out, 0xf5), nil
+		}
+		return append(out, 0xf4), nil
+	case float64:
+		if !codecInt(v) {
+			out = append(out, 0xfb, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint64(out[len(out)-8:], math.Float64bits(v))
+			return out, nil
+		}
+		if v >= 0 {
+			return appendCBORHead(out, 0, uint64(v)), nil
+		}
+		return appendCBORHead(out, 1, uint64(-1-int64(v))), nil
+	case string:
+		out = appendCBORHead(out, 3, uint64(len(v)))
+		return append(out, v...), nil
+	case []interface{}:
+		out = appendCBORHead(out, 4, uint64(len(v)))
+		for _, item := range v {
+			if out, err = appendCBOR(out, item, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[string]interface{}:
+		out = appendCBORHead(out, 5, uint64(len(v)))
+		for _, k := range sortedKeys(v) {
+			out = appendCBORHead(out, 3, uint64(len(k)))
+			out = append(out, k...)
+			if out, err = appendCBOR(out, v[k], depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, errors.New("cannot encode this value as cbor")
+}
@@ -0,0 +1,307 @@
+package library
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/nytlabs/streamtools/st/util" // util
+)
+
+// maxCodecDepth stops deeply nested data from exhausting the stack.
+const maxCodecDepth = 256
+
+var errCodecTruncated = errors.New("data ends too soon")
+
+// codec decodes and encodes messages in one of the formats producers send,
+// as set by the Format, Schema, DescriptorSet and MessageType rules shared by
+// decode, encode and the source blocks.
+type codec struct {
+	format        string
+	schema        interface{}
+	descriptorSet string
+	messageType   string
+	avro          *avroSchema
+	proto         *protoMessage
+}
+
+// parseCodecRule reads the codec from a rule, using format when the rule
+// doesn't give one.
+func parseCodecRule(ruleI interface{}, format string) (*codec, error) {
+	var err error
+	c := &codec{}
+	c.format = format
+	if util.KeyExists(ruleI, "Format") {
+		c.format, err = util.ParseRequiredString(ruleI, "Format")
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.schema = ruleI.(map[string]interface{})["Schema"]
+	if s, ok := c.schema.(string); ok && s == "" {
+		c.schema = nil
+	}
+	c.descriptorSet, _ = util.ParseString(ruleI, "DescriptorSet")
+	c.messageType, _ = util.ParseString(ruleI, "MessageType")
+
+	switch c.format {
+	case "json", "msgpack", "cbor":
+	case "avro":
+		if c.schema == nil {
+			// the schema has to come from the header of each container
+			break
+		}
+		schema := c.schema
+		// schemas can be given as JSON text as well as JSON
+		if s, ok := schema.(string); ok {
+			if err := json.Unmarshal([]byte(s), &schema); err != nil {
+				schema = s
+			}
+		}
+		c.avro, err = parseAvroSchema(schema)
+		if err != nil {
+			return nil, err
+		}
+	case "protobuf":
+		if c.descriptorSet == "" || c.messageType == "" {
+			return nil, errors.New("protobuf needs a DescriptorSet and a MessageType")
+		}
+		data, err := ioutil.ReadFile(c.descriptorSet)
+		if err != nil {
+			return nil, err
+		}
+		c.proto, err = parseProtoDescriptorSet(data, c.messageType)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Format must be one of json, msgpack, cbor, protobuf or avro")
+	}
+	return c, nil
+}
+
+// rule gives the rules the codec was made from, to answer rule queries.
+func (c *codec) rule() map[string]interface{} {
+	return map[string]interface{}{
+		"Format":        c.format,
+		"Schema":        c.schema,
+		"DescriptorSet": c.descriptorSet,
+		"MessageType":   c.messageType,
+	}
+}
+
+// decode turns data into messages. Avro container files can hold many
+// records, so there may be more than one.
+func (c *codec) decode(data []byte) ([]interface{}, error) {
+	var v interface{}
+	var err error
+	switch c.format {
+	case "json":
+		err = json.Unmarshal(data, &v)
+	case "msgpack":
+		v, err = decodeMsgpack(data)
+	case "cbor":
+		v, err = decodeCBOR(data)
+	case "protobuf":
+		v, err = c.proto.decode(data)
+	case "avro":
+		if isAvroContainer(data) {
+			return decodeAvroContainer(data)
+		}
+		if c.avro == nil {
+			return nil, errors.New("avro data without a container header needs a Schema")
+		}
+		v, err = c.avro.decode(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{v}, nil
+}
+
+// encode turns a message into data.
+func (c *codec) encode(v interface{}) ([]byte, error) {
+	switch c.format {
+	case "json":
+		return json.Marshal(v)
+	case "msgpack":
+		return encodeMsgpack(v)
+	case "cbor":
+		return encodeCBOR(v)
+	case "protobuf":
+		return c.proto.encode(v)
+	case "avro":
+		if c.avro == nil {
+			return nil, errors.New("encoding avro needs a Schema")
+		}
+		return c.avro.encode(v)
+	}
+	return nil, errors.New("unknown format " + c.format)
+}
+
+// binaryFromValue reads the bytes held by a message value. JSON can't carry
+// raw bytes, so they're usually base64 or hex strings.
+func binaryFromValue(v interface{}, encoding string) ([]byte, error) {
+	if b, ok := v.([]byte); ok {
+		return b, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, errors.New("binary data must be a string")
+	}
+	switch encoding {
+	case "base64":
+		return base64.StdEncoding.DecodeString(s)
+	case "hex":
+		return hex.DecodeString(s)
+	case "raw":
+		return []byte(s), nil
+	}
+	return nil, errors.New("unknown encoding " + encoding)
+}
+
+// binaryToValue turns bytes into a string that can be carried in a message.
+func binaryToValue(b []byte, encoding string) (string, error) {
+	switch encoding {
+	case "base64":
+		return base64.StdEncoding.EncodeToString(b), nil
+	case "hex":
+		return hex.EncodeToString(b), nil
+	case "raw":
+		return string(b), nil
+	}
+	return "", errors.New("unknown encoding " + encoding)
+}
+
+// parseBinaryEncoding reads the Encoding rule, which defaults to base64.
+func parseBinaryEncoding(ruleI interface{}) (string, error) {
+	if !util.KeyExists(ruleI, "Encoding") {
+		return "base64", nil
+	}
+	encoding, err := util.ParseRequiredString(ruleI, "Encoding")
+	if err != nil {
+		return "", err
+	}
+	switch encoding {
+	case "base64", "hex", "raw":
+		return encoding, nil
+	}
+	return "", errors.New("Encoding must be one of base64, hex or raw")
+}
+
+// codecValue makes anything a message might hold into the handful of types
+// JSON decodes to, so the encoders only need to deal with those.
+func codecValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil, bool, float64, string, []interface{}, map[string]interface{}:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v), nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = json.Unmarshal(data, &out)
+	return out, err
+}
+
+// codecKey makes a map key of any type into the string JSON objects need.
+func codecKey(k interface{}) string {
+	switch k := k.(type) {
+	case string:
+		return k
+	case float64:
+		return strconv.FormatFloat(k, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(k)
+	case nil:
+		return "null"
+	}
+	data, _ := json.Marshal(k)
+	return string(data)
+}
+
+// codecInt tells whether a number can be written as an integer.
+func codecInt(f float64) bool {
+	return f == math.Trunc(f) && f >= -(1<<63) && f < 1<<63
+}
+
+// sortedKeys gives the keys of an object in order, so encodings are stable.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// codecReader reads through binary data, complaining if it runs out.
+type codecReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *codecReader) left() int {
+	return len(r.data) - r.pos
+}
+
+func (r *codecReader) readByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errCodecTruncated
+	}
+	r.pos++
+	return r.data[r.pos-1], nil
+}
+
+func (r *codecReader) read(n uint64) ([]byte, error) {
+	if n > uint64(r.left()) {
+		return nil, errCodecTruncated
+	}
+	out := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return out, nil
+}
+
+// readUvarint reads a base 128 varint, as protobuf and avro use.
+func (r *codecReader) readUvarint() (uint64, error) {
+	var x uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		c, err := r.readByte()
+		if err != nil {
+			return 0, err
+		}
+		x |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return x, nil
+		}
+	}
+	return 0, errors.New("varint is too long")
+}
+
+func appendUvarint(out []byte, x uint64) []byte {
+	for x >= 0x80 {
+		out = append(out, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(out, byte(x))
+}
+
+func zigzagDecode(x uint64) int64 {
+	return int64(x>>1) ^ -int64(x&1)
+}
+
+func zigzagEncode(x int64) uint64 {
+	return uint64(x<<1) ^ uint64(x>>63)
+}
@@ -2,22 +2,28 @@ package library
 
 import (
 	"container/heap"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
 	"time"
 
+	"github.com/nytlabs/gojee"                 // jee
 	"github.com/nytlabs/streamtools/st/blocks" // blocks
 	"github.com/nytlabs/streamtools/st/util"
 )
 
 type Count struct {
 	blocks.Block
-	queryrule  chan blocks.MsgChan
-	querycount chan blocks.MsgChan
-	inrule     blocks.MsgChan
-	inpoll     blocks.MsgChan
-	clear      blocks.MsgChan
-	in         blocks.MsgChan
-	out        blocks.MsgChan
-	quit       blocks.MsgChan
+	queryrule       chan blocks.MsgChan
+	querycount      chan blocks.MsgChan
+	queryparamcount chan blocks.Query
+	inrule          blocks.MsgChan
+	inpoll          blocks.MsgChan
+	clear           blocks.MsgChan
+	in              blocks.MsgChan
+	out             blocks.MsgChan
+	quit            blocks.MsgChan
 }
 
 // a bit of boilerplate for streamtools
@@ -27,23 +33,91 @@ func NewCount() blocks.BlockInterface {
 
 func (b *Count) Setup() {
 	b.Kind = "Stats"
-	b.Desc = "counts the number of messages seen over a specified Window"
+	b.Desc = "counts the number of messages seen over a specified Window, optionally keeping a count for each value found at KeyPath"
 	b.in = b.InRoute("in")
 	b.inrule = b.InRoute("rule")
 	b.inpoll = b.InRoute("poll")
 	b.clear = b.InRoute("clear")
 	b.queryrule = b.QueryRoute("rule")
 	b.querycount = b.QueryRoute("count")
+	b.queryparamcount = b.QueryParamRoute("count")
 	b.quit = b.Quit()
 	b.out = b.Broadcast()
 }
 
+// countKey turns the value found at a KeyPath into a key. Anything that
+// isn't a string is used as its JSON. Strings are used as they are unless
+// they could be mistaken for JSON, so that "1" and 1 don't share a key, in
+// which case they're quoted too.
+func countKey(v interface{}) (string, error) {
+	if s, ok := v.(string); ok && !json.Valid([]byte(s)) {
+		return s, nil
+	}
+	k, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(k), nil
+}
+
+// byCount sorts keys by their count, highest first, and then by key.
+type byCount struct {
+	keys   []string
+	counts map[string]float64
+}
+
+func (c byCount) Len() int      { return len(c.keys) }
+func (c byCount) Swap(i, j int) { c.keys[i], c.keys[j] = c.keys[j], c.keys[i] }
+func (c byCount) Less(i, j int) bool {
+	if c.counts[c.keys[i]] != c.counts[c.keys[j]] {
+		return c.counts[c.keys[i]] > c.counts[c.keys[j]]
+	}
+	return c.keys[i] < c.keys[j]
+}
+
+// topCounts returns up to n keys with the highest counts, highest first.
+func topCounts(counts map[string]float64, n int) []interface{} {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Sort(byCount{keys, counts})
+	if n > 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+	top := make([]interface{}, len(keys))
+	for i, k := range keys {
+		top[i] = map[string]interface{}{
+			"Key":   k,
+			"Count": counts[k],
+		}
+	}
+	return top
+}
+
 func (b *Count) Run() {
 	waitTimer := time.NewTimer(100 * time.Millisecond)
 	pq := &PriorityQueue{}
 	heap.Init(pq)
 	window := time.Duration(0)
 
+	var keyPath string
+	var keyTree *jee.TokenTree
+	topN := 10
+	// counts holds the number of messages in the window for each key. A key
+	// is removed as soon as its last message leaves the window.
+	counts := make(map[string]float64)
+
+	output := func() map[string]interface{} {
+		out := map[string]interface{}{
+			"Count": float64(len(*pq)),
+		}
+		if keyTree != nil {
+			out["Top"] = topCounts(counts, topN)
+		}
+		return out
+	}
+
 	for {
 		select {
 		case <-waitTimer.C:
@@ -61,31 +135,112 @@ func (b *Count) Run() {
 				continue
 			}
 
+			tmpKeyPath := ""
+			var tmpKeyTree *jee.TokenTree
+			if util.KeyExists(rule, "KeyPath") {
+				tmpKeyPath, err = util.ParseString(rule, "KeyPath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpKeyPath != "" {
+				tmpKeyTree, err = util.BuildTokenTree(tmpKeyPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			tmpTopN := 10
+			if util.KeyExists(rule, "TopN") {
+				tmpTopN, err = util.ParseInt(rule, "TopN")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			if tmpKeyPath != keyPath {
+				// the queued messages were keyed on something else
+				for len(*pq) > 0 {
+					heap.Pop(pq)
+				}
+				counts = make(map[string]float64)
+			}
+
 			window = tmpWindow
+			keyPath = tmpKeyPath
+			keyTree = tmpKeyTree
+			topN = tmpTopN
 		case <-b.quit:
 			return
-		case <-b.in:
-			empty := make([]byte, 0)
-			queueMessage := &PQMessage{
-				val: &empty,
-				t:   time.Now(),
+		case msg := <-b.in:
+			if keyTree == nil {
+				empty := make([]byte, 0)
+				heap.Push(pq, &PQMessage{
+					val: &empty,
+					t:   time.Now(),
+				})
+				break
+			}
+			v, err := jee.Eval(keyTree, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if v == nil {
+				b.Error(errors.New("couldn't find a key at " + keyPath))
+				continue
 			}
-			heap.Push(pq, queueMessage)
+			k, err := countKey(v)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			counts[k]++
+			heap.Push(pq, &PQMessage{
+				val: k,
+				t:   time.Now(),
+			})
 		case <-b.clear:
 			for len(*pq) > 0 {
 				heap.Pop(pq)
 			}
+			counts = make(map[string]float64)
 		case <-b.inpoll:
-			b.out <- map[string]interface{}{
-				"Count": float64(len(*pq)),
-			}
+			b.out <- output()
 		case c := <-b.queryrule:
 			c <- map[string]interface{}{
-				"Window": window.String(),
+				"Window":  window.String(),
+				"KeyPath": keyPath,
+				"TopN":    float64(topN),
 			}
 		case c := <-b.querycount:
-			c <- map[string]interface{}{
+			c <- output()
+		case q := <-b.queryparamcount:
+			if keys, ok := q.Params["key"]; ok {
+				keyCounts := make(map[string]interface{})
+				for _, k := range keys {
+					keyCounts[k] = counts[k]
+				}
+				q.RespChan <- map[string]interface{}{
+					"Counts": keyCounts,
+				}
+				continue
+			}
+			n := topN
+			if top := q.Params.Get("top"); top != "" {
+				var err error
+				n, err = strconv.Atoi(top)
+				if err != nil || n < 0 {
+					b.Error(errors.New("top must be a positive integer"))
+					n = topN
+				}
+			}
+			q.RespChan <- map[string]interface{}{
 				"Count": float64(len(*pq)),
+				"Top":   topCounts(counts, n),
 			}
 		}
 		for {
@@ -99,6 +254,12 @@ func (b *Count) Run() {
 				waitTimer.Reset(diff)
 				break
 			}
+			if k, ok := pqMsg.(*PQMessage).val.(string); ok {
+				counts[k]--
+				if counts[k] <= 0 {
+					delete(counts, k)
+				}
+			}
 		}
 	}
 }
@@ -0,0 +1,142 @@
+package library
+
+import (
+	"errors"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Decode struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	out       blocks.MsgChan
+	failed    blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewDecode() blocks.BlockInterface {
+	return &Decode{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Decode) Setup() {
+	b.Kind = "Parsers"
+	b.Desc = "decodes msgpack, CBOR, protobuf or Avro data found at Path, emitting the result on its own or adding it to the message at OutputPath"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+	b.failed = b.OutRoute("failed")
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Decode) Run() {
+	var outputPath string
+	c, _ := parseCodecRule(map[string]interface{}{}, "msgpack")
+	path := ".data"
+	tree, _ := util.BuildTokenTree(path)
+	encoding := "base64"
+
+	fail := func(msg interface{}, err error) {
+		b.failed <- map[string]interface{}{
+			"msg":   msg,
+			"error": err.Error(),
+		}
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newCodec, err := parseCodecRule(ruleI, "msgpack")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newPath := ".data"
+			if util.KeyExists(ruleI, "Path") {
+				newPath, err = util.ParseRequiredString(ruleI, "Path")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newTree, err := util.BuildTokenTree(newPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newEncoding, err := parseBinaryEncoding(ruleI)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newOutputPath, _ := util.ParseString(ruleI, "OutputPath")
+
+			c = newCodec
+			path = newPath
+			tree = newTree
+			encoding = newEncoding
+			outputPath = newOutputPath
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case msg := <-b.in:
+			dataI, err := jee.Eval(tree, msg)
+			if err != nil {
+				fail(msg, err)
+				continue
+			}
+			if dataI == nil {
+				fail(msg, errors.New("could not find data at "+path))
+				continue
+			}
+			data, err := binaryFromValue(dataI, encoding)
+			if err != nil {
+				fail(msg, err)
+				continue
+			}
+			values, err := c.decode(data)
+			if err != nil {
+				fail(msg, err)
+				continue
+			}
+			if outputPath == "" {
+				for _, v := range values {
+					b.out <- v
+				}
+				continue
+			}
+			in, ok := msg.(map[string]interface{})
+			if !ok {
+				fail(msg, errors.New("with an OutputPath, messages must be objects"))
+				continue
+			}
+			for _, v := range values {
+				// copy the message rather than change one other blocks may hold
+				out := recCopy(in)
+				if err := setPath(out, outputPath, v); err != nil {
+					fail(msg, err)
+					break
+				}
+				b.out <- out
+			}
+
+		case q := <-b.queryrule:
+			// deal with a query request
+			rule := c.rule()
+			rule["Path"] = path
+			rule["Encoding"] = encoding
+			rule["OutputPath"] = outputPath
+			q <- rule
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package library
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Delay struct {
+	blocks.Block
+	queryrule    chan blocks.MsgChan
+	querypending chan blocks.MsgChan
+	inrule       blocks.MsgChan
+	in           blocks.MsgChan
+	cancel       blocks.MsgChan
+	clear        blocks.MsgChan
+	out          blocks.MsgChan
+	quit         blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewDelay() blocks.BlockInterface {
+	return &Delay{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Delay) Setup() {
+	b.Kind = "Core"
+	b.Desc = "holds each message for a fixed time, or until the time found in the message, before emitting it"
+	b.in = b.InRoute("in")
+	b.cancel = b.InRoute("cancel")
+	b.clear = b.InRoute("clear")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.querypending = b.QueryRoute("pending")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// delayed is a message being held, along with the id it can be cancelled by.
+type delayed struct {
+	id  string
+	msg interface{}
+}
+
+// byDue sorts held messages without disturbing the heap they're in.
+type byDue []*PQMessage
+
+func (d byDue) Len() int           { return len(d) }
+func (d byDue) Less(i, j int) bool { return d[i].t.Before(d[j].t) }
+func (d byDue) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Delay) Run() {
+	var timePath, idPath string
+	var timeTree, idTree *jee.TokenTree
+	delayString := "0s"
+	delay := time.Duration(0)
+	maxPending := 1000
+	var dropped float64
+
+	pq := &PriorityQueue{}
+	heap.Init(pq)
+	byId := make(map[string][]*PQMessage)
+
+	emitTimer := time.NewTimer(time.Duration(1) * time.Second)
+	emitTimer.Stop()
+
+	// forget removes a message from the ids it can be cancelled by
+	forget := func(item *PQMessage) {
+		id := item.val.(*delayed).id
+		if id == "" {
+			return
+		}
+		items := byId[id]
+		for i, other := range items {
+			if other == item {
+				items = append(items[:i], items[i+1:]...)
+				break
+			}
+		}
+		if len(items) == 0 {
+			delete(byId, id)
+		} else {
+			byId[id] = items
+		}
+	}
+
+	for {
+		select {
+		case <-emitTimer.C:
+		case ruleI := <-b.inrule:
+			newDelayString := "0s"
+			var err error
+			if util.KeyExists(ruleI, "Delay") {
+				newDelayString, err = util.ParseString(ruleI, "Delay")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newDelay, err := time.ParseDuration(newDelayString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newTimePath, _ := util.ParseString(ruleI, "TimePath")
+			var newTimeTree *jee.TokenTree
+			if newTimePath != "" {
+				newTimeTree, err = util.BuildTokenTree(newTimePath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newIdPath, _ := util.ParseString(ruleI, "IdPath")
+			var newIdTree *jee.TokenTree
+			if newIdPath != "" {
+				newIdTree, err = util.BuildTokenTree(newIdPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newMaxPending := 1000.0
+			if util.KeyExists(ruleI, "MaxPending") {
+				newMaxPending, err = util.ParseFloat(ruleI, "MaxPending")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newMaxPending < 1 {
+				b.Error(errors.New("MaxPending must be at least 1"))
+				continue
+			}
+
+			delayString = newDelayString
+			delay = newDelay
+			timePath = newTimePath
+			timeTree = newTimeTree
+			idPath = newIdPath
+			idTree = newIdTree
+			maxPending = int(newMaxPending)
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case msg := <-b.in:
+			if pq.Len() >= maxPending {
+				dropped++
+				b.Error("the delay queue is full")
+				continue
+			}
+			due := time.Now()
+			if timeTree != nil {
+				tI, err := jee.Eval(timeTree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				due, err = parseEventTime(tI)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			id := ""
+			if idTree != nil {
+				idI, err := jee.Eval(idTree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if idI != nil {
+					id, err = countKey(idI)
+					if err != nil {
+						b.Error(err)
+						continue
+					}
+				}
+			}
+			item := &PQMessage{
+				val: &delayed{
+					id:  id,
+					msg: msg,
+				},
+				t: due.Add(delay),
+			}
+			heap.Push(pq, item)
+			if id != "" {
+				byId[id] = append(byId[id], item)
+			}
+
+		case msg := <-b.cancel:
+			if idTree == nil {
+				b.Error(errors.New("messages can only be cancelled with an IdPath"))
+				continue
+			}
+			idI, err := jee.Eval(idTree, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			id, err := countKey(idI)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			for _, item := range byId[id] {
+				heap.Remove(pq, item.index)
+			}
+			delete(byId, id)
+
+		case <-b.clear:
+			pq = &PriorityQueue{}
+			heap.Init(pq)
+			byId = make(map[string][]*PQMessage)
+
+		case c := <-b.querypending:
+			items := make(byDue, pq.Len())
+			copy(items, *pq)
+			sort.Sort(items)
+			pending := []interface{}{}
+			for _, item := range items {
+				d := item.val.(*delayed)
+				p := map[string]interface{}{
+					"Due": toMs(item.t),
+					"Msg": d.msg,
+				}
+				if d.id != "" {
+					p["Id"] = d.id
+				}
+				pending = append(pending, p)
+			}
+			c <- map[string]interface{}{
+				"Pending": pending,
+				"Count":   float64(len(pending)),
+				"Dropped": dropped,
+			}
+
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Delay":      delayString,
+				"TimePath":   timePath,
+				"IdPath":     idPath,
+				"MaxPending": float64(maxPending),
+			}
+		}
+
+		now := time.Now()
+		emitTimer.Stop()
+		for {
+			item, diff := pq.PeekAndShift(now, 0)
+			if item == nil {
+				if pq.Len() > 0 {
+					emitTimer.Reset(diff)
+				}
+				break
+			}
+			forget(item.(*PQMessage))
+			b.out <- item.(*PQMessage).val.(*delayed).msg
+		}
+	}
+}
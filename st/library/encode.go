@@ -0,0 +1,142 @@
+package library
+
+import (
+	"errors"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Encode struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	out       blocks.MsgChan
+	failed    blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewEncode() blocks.BlockInterface {
+	return &Encode{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Encode) Setup() {
+	b.Kind = "Parsers"
+	b.Desc = "encodes the value found at Path as msgpack, CBOR, protobuf or Avro, setting the result at OutputPath"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+	b.failed = b.OutRoute("failed")
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Encode) Run() {
+	c, _ := parseCodecRule(map[string]interface{}{}, "msgpack")
+	path := "."
+	tree, _ := util.BuildTokenTree(path)
+	encoding := "base64"
+	outputPath := ".data"
+
+	fail := func(msg interface{}, err error) {
+		b.failed <- map[string]interface{}{
+			"msg":   msg,
+			"error": err.Error(),
+		}
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newCodec, err := parseCodecRule(ruleI, "msgpack")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newPath := "."
+			if util.KeyExists(ruleI, "Path") {
+				newPath, err = util.ParseRequiredString(ruleI, "Path")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newTree, err := util.BuildTokenTree(newPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newEncoding, err := parseBinaryEncoding(ruleI)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newOutputPath := ".data"
+			if util.KeyExists(ruleI, "OutputPath") {
+				newOutputPath, err = util.ParseRequiredString(ruleI, "OutputPath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			c = newCodec
+			path = newPath
+			tree = newTree
+			encoding = newEncoding
+			outputPath = newOutputPath
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case msg := <-b.in:
+			v, err := jee.Eval(tree, msg)
+			if err != nil {
+				fail(msg, err)
+				continue
+			}
+			data, err := c.encode(v)
+			if err != nil {
+				fail(msg, err)
+				continue
+			}
+			encoded, err := binaryToValue(data, encoding)
+			if err != nil {
+				fail(msg, err)
+				continue
+			}
+
+			// when the whole message is encoded, the encoding replaces it
+			out := map[string]interface{}{}
+			if path != "." {
+				in, ok := msg.(map[string]interface{})
+				if !ok {
+					fail(msg, errors.New("can only encode part of a message that is an object"))
+					continue
+				}
+				// copy the message rather than change one other blocks may hold
+				out = recCopy(in)
+			}
+			if err := setPath(out, outputPath, encoded); err != nil {
+				fail(msg, err)
+				continue
+			}
+			b.out <- out
+
+		case q := <-b.queryrule:
+			// deal with a query request
+			rule := c.rule()
+			rule["Path"] = path
+			rule["Encoding"] = encoding
+			rule["OutputPath"] = outputPath
+			q <- rule
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package library
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Enrich struct {
+	blocks.Block
+	queryrule   chan blocks.MsgChan
+	querystats  chan blocks.MsgChan
+	querylookup chan blocks.Query
+	inrule      blocks.MsgChan
+	in          blocks.MsgChan
+	table       blocks.MsgChan
+	delete      blocks.MsgChan
+	clear       blocks.MsgChan
+	out         blocks.MsgChan
+	quit        blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewEnrich() blocks.BlockInterface {
+	return &Enrich{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Enrich) Setup() {
+	b.Kind = "Core"
+	b.Desc = "keeps a table of the messages sent to its table route by KeyPath, and adds the matching entry to each inbound message at OutputPath"
+	b.in = b.InRoute("in")
+	b.table = b.InRoute("table")
+	b.delete = b.InRoute("delete")
+	b.clear = b.InRoute("clear")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.querystats = b.QueryRoute("stats")
+	b.querylookup = b.QueryParamRoute("lookup")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// setPath sets the value at a path like .user.segment, making any objects
+// along the way that don't exist yet.
+func setPath(msg map[string]interface{}, path string, v interface{}) error {
+	keys := strings.Split(strings.TrimPrefix(path, "."), ".")
+	m := msg
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := m[k]
+		if !ok || next == nil {
+			next = make(map[string]interface{})
+			m[k] = next
+		}
+		m, ok = next.(map[string]interface{})
+		if !ok {
+			return errors.New("cannot set " + path + ": " + k + " is not an object")
+		}
+	}
+	m[keys[len(keys)-1]] = v
+	return nil
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Enrich) Run() {
+	var keyPath, valuePath, lookupPath, outputPath, miss string
+	var keyTree, valueTree, lookupTree *jee.TokenTree
+	var def interface{}
+	var hits, misses float64
+
+	table := make(map[string]interface{})
+	miss = "pass"
+
+	keyOf := func(tree *jee.TokenTree, path string, msg interface{}) (string, error) {
+		kI, err := jee.Eval(tree, msg)
+		if err != nil {
+			return "", err
+		}
+		if kI == nil {
+			return "", errors.New("could not find a key at " + path)
+		}
+		return countKey(kI)
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newKeyPath, err := util.ParseRequiredString(ruleI, "KeyPath")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newKeyTree, err := util.BuildTokenTree(newKeyPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newValuePath := "."
+			if util.KeyExists(ruleI, "ValuePath") {
+				newValuePath, err = util.ParseRequiredString(ruleI, "ValuePath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newValueTree, err := util.BuildTokenTree(newValuePath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newLookupPath, err := util.ParseRequiredString(ruleI, "LookupPath")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newLookupTree, err := util.BuildTokenTree(newLookupPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newOutputPath, _ := util.ParseString(ruleI, "OutputPath")
+			newMiss := "pass"
+			if util.KeyExists(ruleI, "Miss") {
+				newMiss, err = util.ParseString(ruleI, "Miss")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newMiss != "pass" && newMiss != "drop" && newMiss != "default" {
+				b.Error(errors.New("Miss must be one of pass, drop or default"))
+				continue
+			}
+			newDef := ruleI.(map[string]interface{})["Default"]
+
+			// a table keyed differently is a different table
+			if newKeyPath != keyPath || newValuePath != valuePath {
+				table = make(map[string]interface{})
+			}
+			keyPath = newKeyPath
+			keyTree = newKeyTree
+			valuePath = newValuePath
+			valueTree = newValueTree
+			lookupPath = newLookupPath
+			lookupTree = newLookupTree
+			outputPath = newOutputPath
+			miss = newMiss
+			def = newDef
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case msg := <-b.table:
+			if keyTree == nil {
+				continue
+			}
+			k, err := keyOf(keyTree, keyPath, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			v, err := jee.Eval(valueTree, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			table[k] = v
+
+		case msg := <-b.delete:
+			if keyTree == nil {
+				continue
+			}
+			k, err := keyOf(keyTree, keyPath, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			delete(table, k)
+
+		case <-b.clear:
+			table = make(map[string]interface{})
+
+		case msg := <-b.in:
+			if lookupTree == nil {
+				continue
+			}
+			in, ok := msg.(map[string]interface{})
+			if !ok {
+				b.Error(errors.New("can only enrich messages that are objects"))
+				continue
+			}
+			k, err := keyOf(lookupTree, lookupPath, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			v, ok := table[k]
+			if ok {
+				hits++
+			} else {
+				misses++
+				if miss == "drop" {
+					continue
+				}
+				if miss == "pass" {
+					b.out <- msg
+					continue
+				}
+				v = def
+			}
+
+			// copy the message rather than change one other blocks may hold
+			out := recCopy(in)
+			if outputPath == "" {
+				fields, ok := v.(map[string]interface{})
+				if !ok {
+					b.Error(errors.New("without an OutputPath, table entries must be objects"))
+					continue
+				}
+				for field, fv := range fields {
+					out[field] = fv
+				}
+			} else if err := setPath(out, outputPath, v); err != nil {
+				b.Error(err)
+				continue
+			}
+			b.out <- out
+
+		case q := <-b.querylookup:
+			k := q.Params.Get("key")
+			v, ok := table[k]
+			q.RespChan <- map[string]interface{}{
+				"key":   k,
+				"value": v,
+				"found": ok,
+			}
+
+		case c := <-b.querystats:
+			c <- map[string]interface{}{
+				"Entries": float64(len(table)),
+				"Hits":    hits,
+				"Misses":  misses,
+			}
+
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"KeyPath":    keyPath,
+				"ValuePath":  valuePath,
+				"LookupPath": lookupPath,
+				"OutputPath": outputPath,
+				"Miss":       miss,
+				"Default":    def,
+			}
+		}
+	}
+}
@@ -2,6 +2,10 @@ package library
 
 import (
 	"errors"
+	"math"
+	"math/cmplx"
+	"sort"
+	"strings"
 
 	"github.com/mjibson/go-dsp/fft"            // fft
 	"github.com/nytlabs/gojee"                 // jee
@@ -20,19 +24,302 @@ type FFT struct {
 	quit      blocks.MsgChan
 }
 
-func buildFFT(data tsData) [][]float64 {
-	x := make([]float64, len(data.Values))
-	for i, d := range data.Values {
-		x[i] = d.Value
+// fftOptions holds everything that happens to a timeseries on its way through
+// the transform.
+type fftOptions struct {
+	sampleRate    float64
+	interpolation string
+	window        string
+	detrend       string
+	padTo         int
+	powerOfTwo    bool
+	output        string
+	peaks         int
+}
+
+type byTimestamp []tsDataPoint
+
+func (p byTimestamp) Len() int           { return len(p) }
+func (p byTimestamp) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byTimestamp) Less(i, j int) bool { return p[i].Timestamp < p[j].Timestamp }
+
+// fftMaxSamples is the most samples the block will transform, after
+// resampling and padding, so that a high SampleRate or timestamps far apart
+// can't use up all the memory.
+const fftMaxSamples = 1 << 20
+
+var errFFTTooLong = errors.New("the timeseries would need more than 1048576 samples")
+
+// resample interpolates the points onto a grid of rate samples a second,
+// starting at the first point. Timestamps are in milliseconds.
+func resample(points []tsDataPoint, rate float64, interpolation string) ([]float64, error) {
+	step := 1000 / rate
+	start := points[0].Timestamp
+	samples := math.Floor((points[len(points)-1].Timestamp-start)/step) + 1
+	if !(samples <= fftMaxSamples) {
+		return nil, errFFTTooLong
+	}
+	x := make([]float64, int(samples))
+	j := 0
+	for i := range x {
+		t := start + float64(i)*step
+		// move j to the last point at or before t
+		for j < len(points)-1 && points[j+1].Timestamp <= t {
+			j++
+		}
+		p := points[j]
+		if j == len(points)-1 {
+			x[i] = p.Value
+			continue
+		}
+		next := points[j+1]
+		switch interpolation {
+		case "previous":
+			x[i] = p.Value
+		case "nearest":
+			x[i] = p.Value
+			if next.Timestamp-t < t-p.Timestamp {
+				x[i] = next.Value
+			}
+		default:
+			x[i] = p.Value + (next.Value-p.Value)*(t-p.Timestamp)/(next.Timestamp-p.Timestamp)
+		}
+	}
+	return x, nil
+}
+
+// detrend removes the mean, or the least squares line, from x.
+func detrend(x []float64, method string) {
+	n := float64(len(x))
+	if method == "none" || n == 0 {
+		return
+	}
+	mean := 0.0
+	for _, v := range x {
+		mean += v
+	}
+	mean /= n
+	slope := 0.0
+	mid := (n - 1) / 2
+	if method == "linear" && n > 1 {
+		num, den := 0.0, 0.0
+		for i, v := range x {
+			num += (float64(i) - mid) * (v - mean)
+			den += (float64(i) - mid) * (float64(i) - mid)
+		}
+		slope = num / den
+	}
+	for i := range x {
+		x[i] -= mean + slope*(float64(i)-mid)
+	}
+}
+
+// windowFunction returns the weights of an n sample window.
+func windowFunction(name string, n int) []float64 {
+	w := make([]float64, n)
+	for i := range w {
+		if n == 1 || name == "none" {
+			w[i] = 1
+			continue
+		}
+		a := 2 * math.Pi * float64(i) / float64(n-1)
+		switch name {
+		case "hann":
+			w[i] = 0.5 - 0.5*math.Cos(a)
+		case "hamming":
+			w[i] = 0.54 - 0.46*math.Cos(a)
+		case "blackman":
+			w[i] = 0.42 - 0.5*math.Cos(a) + 0.08*math.Cos(2*a)
+		}
+	}
+	return w
+}
+
+// spectrum is the result of running an FFT, along with what's needed to
+// label and scale its bins.
+type spectrum struct {
+	X          []complex128
+	sampleRate float64
+	windowSum  float64
+	windowSq   float64
+}
+
+func (s spectrum) frequency(k int) float64 {
+	return float64(k) * s.sampleRate / float64(len(s.X))
+}
+
+// oneSided is how many bins are left once the mirror image above the Nyquist
+// frequency is dropped.
+func (s spectrum) oneSided() int {
+	return len(s.X)/2 + 1
+}
+
+// amplitude scales bin k so that a sine wave reads as its amplitude.
+func (s spectrum) amplitude(k int) float64 {
+	a := cmplx.Abs(s.X[k]) / s.windowSum
+	if k != 0 && 2*k != len(s.X) {
+		a *= 2
+	}
+	return a
+}
+
+// power is the power spectral density of bin k, in units squared per Hz.
+func (s spectrum) power(k int) float64 {
+	a := cmplx.Abs(s.X[k])
+	p := a * a / (s.sampleRate * s.windowSq)
+	if k != 0 && 2*k != len(s.X) {
+		p *= 2
+	}
+	return p
+}
+
+// dominant gives the peaks of the spectrum, largest first, leaving out the
+// zero frequency.
+func (s spectrum) dominant(n int) []interface{} {
+	bins := s.oneSided()
+	peaks := []int{}
+	for k := 1; k < bins; k++ {
+		a := cmplx.Abs(s.X[k])
+		if a == 0 {
+			continue
+		}
+		if a >= cmplx.Abs(s.X[k-1]) && (k == bins-1 || a > cmplx.Abs(s.X[k+1])) {
+			peaks = append(peaks, k)
+		}
+	}
+	sort.Sort(byAmplitude{peaks, s})
+	if len(peaks) > n {
+		peaks = peaks[:n]
+	}
+	out := make([]interface{}, len(peaks))
+	for i, k := range peaks {
+		out[i] = map[string]interface{}{
+			"Frequency": s.frequency(k),
+			"Magnitude": s.amplitude(k),
+		}
+	}
+	return out
+}
+
+type byAmplitude struct {
+	bins []int
+	s    spectrum
+}
+
+func (b byAmplitude) Len() int      { return len(b.bins) }
+func (b byAmplitude) Swap(i, j int) { b.bins[i], b.bins[j] = b.bins[j], b.bins[i] }
+func (b byAmplitude) Less(i, j int) bool {
+	return cmplx.Abs(b.s.X[b.bins[i]]) > cmplx.Abs(b.s.X[b.bins[j]])
+}
+
+// buildFFT prepares the timeseries as asked, transforms it and shapes the
+// result for output.
+func buildFFT(data tsData, opts fftOptions) (map[string]interface{}, error) {
+	if len(data.Values) == 0 {
+		return nil, errors.New("cannot transform an empty timeseries")
+	}
+	points := make([]tsDataPoint, len(data.Values))
+	copy(points, data.Values)
+	sort.Sort(byTimestamp(points))
+	span := points[len(points)-1].Timestamp - points[0].Timestamp
+
+	var x []float64
+	rate := opts.sampleRate
+	if rate > 0 {
+		var err error
+		x, err = resample(points, rate, opts.interpolation)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// assume the samples are evenly spaced
+		x = make([]float64, len(points))
+		for i, p := range points {
+			x[i] = p.Value
+		}
+		if span > 0 {
+			rate = float64(len(points)-1) * 1000 / span
+		}
+	}
+	if rate <= 0 && opts.output != "complex" {
+		return nil, errors.New("the timestamps need to span some time to work out the sample rate")
+	}
+
+	detrend(x, opts.detrend)
+	w := windowFunction(opts.window, len(x))
+	s := spectrum{sampleRate: rate}
+	for i := range x {
+		x[i] *= w[i]
+		s.windowSum += w[i]
+		s.windowSq += w[i] * w[i]
+	}
+
+	n := len(x)
+	if opts.padTo > n {
+		n = opts.padTo
+	}
+	if opts.powerOfTwo {
+		p := 1
+		for p < n {
+			p *= 2
+		}
+		n = p
+	}
+	if n > fftMaxSamples {
+		return nil, errFFTTooLong
+	}
+	padded := make([]float64, n)
+	copy(padded, x)
+	s.X = fft.FFTReal(padded)
+
+	out := map[string]interface{}{}
+	if rate > 0 {
+		out["SampleRate"] = rate
+	}
+	switch opts.output {
+	case "magnitude", "psd":
+		bins := make([]interface{}, s.oneSided())
+		for k := range bins {
+			bin := map[string]interface{}{
+				"Frequency": s.frequency(k),
+			}
+			if opts.output == "psd" {
+				bin["Power"] = s.power(k)
+			} else {
+				bin["Magnitude"] = s.amplitude(k)
+			}
+			bins[k] = bin
+		}
+		out["fft"] = bins
+	case "dominant":
+		out["fft"] = s.dominant(opts.peaks)
+	default:
+		Xout := make([][]float64, len(s.X))
+		for i, Xi := range s.X {
+			Xout[i] = make([]float64, 2)
+			Xout[i][0] = real(Xi)
+			Xout[i][1] = imag(Xi)
+		}
+		out["fft"] = Xout
 	}
-	X := fft.FFTReal(x)
-	Xout := make([][]float64, len(X))
-	for i, Xi := range X {
-		Xout[i] = make([]float64, 2)
-		Xout[i][0] = real(Xi)
-		Xout[i][1] = imag(Xi)
+	return out, nil
+}
+
+// pointField finds a field of a timeseries point, as either the poll output
+// of the timeseries block or its query response would name it.
+func pointField(point map[string]interface{}, name, title string) (float64, error) {
+	vI, ok := point[name]
+	if !ok {
+		vI, ok = point[title]
 	}
-	return Xout
+	if !ok {
+		return 0, errors.New("could not find " + name + " in value")
+	}
+	v, ok := vI.(float64)
+	if !ok {
+		return 0, errors.New("could not assert " + name + " to float")
+	}
+	return v, nil
 }
 
 func NewFFT() blocks.BlockInterface {
@@ -41,6 +328,7 @@ func NewFFT() blocks.BlockInterface {
 
 func (b *FFT) Setup() {
 	b.Kind = "Stats"
+	b.Desc = "computes the Fourier transform of an array of {timestamp, value} points found at Path, as complex values, magnitudes, a power spectral density or its dominant frequencies"
 	b.in = b.InRoute("in")
 	b.inrule = b.InRoute("rule")
 	b.queryrule = b.QueryRoute("rule")
@@ -50,9 +338,15 @@ func (b *FFT) Setup() {
 
 func (b *FFT) Run() {
 
-	var err error
 	var path string
 	var tree *jee.TokenTree
+	opts := fftOptions{
+		interpolation: "linear",
+		window:        "none",
+		detrend:       "none",
+		output:        "complex",
+		peaks:         1,
+	}
 
 	for {
 		select {
@@ -61,16 +355,100 @@ func (b *FFT) Run() {
 			if !ok {
 				b.Error(errors.New("could not assert rule to map"))
 			}
-			path, err = util.ParseString(rule, "Path")
+			newPath, err := util.ParseString(rule, "Path")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newTree, err := util.BuildTokenTree(newPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			// every option is optional and falls back to its default
+			parseOption := func(key, def string, allowed ...string) (string, error) {
+				if !util.KeyExists(rule, key) {
+					return def, nil
+				}
+				v, err := util.ParseString(rule, key)
+				if err != nil {
+					return "", err
+				}
+				for _, a := range allowed {
+					if v == a {
+						return v, nil
+					}
+				}
+				return "", errors.New(key + " must be one of " + strings.Join(allowed, ", "))
+			}
+			parseNumber := func(key string, def float64) (float64, error) {
+				if !util.KeyExists(rule, key) {
+					return def, nil
+				}
+				v, err := util.ParseFloat(rule, key)
+				if err == nil && v < 0 {
+					err = errors.New(key + " cannot be negative")
+				}
+				return v, err
+			}
+			newOpts := fftOptions{}
+			newOpts.interpolation, err = parseOption("Interpolation", "linear", "linear", "nearest", "previous")
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-			tree, err = util.BuildTokenTree(path)
+			newOpts.window, err = parseOption("Window", "none", "none", "hann", "hamming", "blackman")
 			if err != nil {
 				b.Error(err)
 				continue
 			}
+			newOpts.detrend, err = parseOption("Detrend", "none", "none", "mean", "linear")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newOpts.output, err = parseOption("Output", "complex", "complex", "magnitude", "psd", "dominant")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newOpts.sampleRate, err = parseNumber("SampleRate", 0)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			padTo, err := parseNumber("PadTo", 0)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if padTo > fftMaxSamples {
+				b.Error(errors.New("PadTo can't be more than 1048576"))
+				continue
+			}
+			newOpts.padTo = int(padTo)
+			peaks, err := parseNumber("Peaks", 1)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newOpts.peaks = int(peaks)
+			if newOpts.peaks < 1 {
+				b.Error(errors.New("Peaks must be at least 1"))
+				continue
+			}
+			if util.KeyExists(rule, "PowerOfTwo") {
+				newOpts.powerOfTwo, err = util.ParseBool(rule, "PowerOfTwo")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			path = newPath
+			tree = newTree
+			opts = newOpts
 		case <-b.quit:
 			return
 		case msg := <-b.in:
@@ -91,40 +469,47 @@ func (b *FFT) Run() {
 			for i, vi := range v {
 				value, ok := vi.(map[string]interface{})
 				if !ok {
-					b.Error(errors.New("could not assert value to map"))
-					continue
-				}
-				tI, ok := value["timestamp"]
-				if !ok {
-					b.Error(errors.New("could not find timestamp in value"))
-					continue
+					err = errors.New("could not assert value to map")
+					break
 				}
-				t, ok := tI.(float64)
-				if !ok {
-					b.Error(errors.New("could not assert timestamp to float"))
-					continue
+				var t, y float64
+				t, err = pointField(value, "timestamp", "Timestamp")
+				if err != nil {
+					break
 				}
-				yI, ok := value["value"]
-				if !ok {
-					b.Error(errors.New("could not assert timeseries value to float"))
-					continue
+				y, err = pointField(value, "value", "Value")
+				if err != nil {
+					break
 				}
-				y, ok := yI.(float64)
 				values[i] = tsDataPoint{
 					Timestamp: t,
 					Value:     y,
 				}
 			}
+			if err != nil {
+				b.Error(err)
+				continue
+			}
 			data := tsData{
 				Values: values,
 			}
-			out := map[string]interface{}{
-				"fft": buildFFT(data),
+			out, err := buildFFT(data, opts)
+			if err != nil {
+				b.Error(err)
+				continue
 			}
 			b.out <- out
 		case respChan := <-b.queryrule:
 			respChan <- map[string]interface{}{
-				"Path": path,
+				"Path":          path,
+				"SampleRate":    opts.sampleRate,
+				"Interpolation": opts.interpolation,
+				"Window":        opts.window,
+				"Detrend":       opts.detrend,
+				"PadTo":         float64(opts.padTo),
+				"PowerOfTwo":    opts.powerOfTwo,
+				"Output":        opts.output,
+				"Peaks":         float64(opts.peaks),
 			}
 		}
 	}
@@ -1,8 +1,6 @@
 package library
 
 import (
-	"encoding/json"
-
 	"github.com/nytlabs/streamtools/st/blocks"
 	"github.com/nytlabs/streamtools/st/util"
 	"github.com/streadway/amqp"
@@ -34,19 +32,23 @@ func (b *FromAMQP) Setup() {
 type readWriteAMQPHandler struct {
 	toOut   blocks.MsgChan
 	toError chan error
+	format  *codec
 }
 
 func (self readWriteAMQPHandler) handle(deliveries <-chan amqp.Delivery) {
 	for d := range deliveries {
-		var msg interface{}
 		s := string(d.Body[:])
-		err := json.Unmarshal(d.Body, &msg)
+		msgs, err := self.format.decode(d.Body)
 		if err != nil {
-			msg = map[string]interface{}{
-				"data": s,
+			msgs = []interface{}{
+				map[string]interface{}{
+					"data": s,
+				},
 			}
 		}
-		self.toOut <- msg
+		for _, msg := range msgs {
+			self.toOut <- msg
+		}
 	}
 }
 
@@ -65,6 +67,7 @@ func (b *FromAMQP) Run() {
 	routingkey := "#"
 	exchange := "amq.topic"
 	exchange_type := "topic"
+	format, _ := parseCodecRule(map[string]interface{}{}, "json")
 
 	for {
 		select {
@@ -110,6 +113,12 @@ func (b *FromAMQP) Run() {
 				b.Error(err)
 				continue
 			}
+			newFormat, err := parseCodecRule(rule, "json")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			format = newFormat
 
 			conn, err = amqp.Dial("amqp://" + username + ":" + password + "@" + host + ":" + port + "/")
 			if err != nil {
@@ -177,7 +186,7 @@ func (b *FromAMQP) Run() {
 				continue
 			}
 
-			h := readWriteAMQPHandler{toOut, toError}
+			h := readWriteAMQPHandler{toOut, toError, format}
 			go h.handle(deliveries)
 		case <-b.quit:
 			if amqp_chan != nil {
@@ -188,15 +197,15 @@ func (b *FromAMQP) Run() {
 			}
 			return
 		case c := <-b.queryrule:
-			c <- map[string]interface{}{
-				"Host":         host,
-				"Port":         port,
-				"Username":     username,
-				"Password":     password,
-				"Exchange":     exchange,
-				"ExchangeType": exchange_type,
-				"RoutingKey":   routingkey,
-			}
+			rule := format.rule()
+			rule["Host"] = host
+			rule["Port"] = port
+			rule["Username"] = username
+			rule["Password"] = password
+			rule["Exchange"] = exchange
+			rule["ExchangeType"] = exchange_type
+			rule["RoutingKey"] = routingkey
+			c <- rule
 		}
 	}
 }
@@ -0,0 +1,361 @@
+package library
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type FromDirectory struct {
+	blocks.Block
+	queryrule    chan blocks.MsgChan
+	querypending chan blocks.MsgChan
+	inrule       blocks.MsgChan
+	out          blocks.MsgChan
+	quit         blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewFromDirectory() blocks.BlockInterface {
+	return &FromDirectory{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *FromDirectory) Setup() {
+	b.Kind = "Data Stores"
+	b.Desc = "watches a directory for new files, emitting each file's lines or whole document before moving the file to a done or error directory"
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.querypending = b.QueryRoute("pending")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// readDocument reads a whole, possibly gzipped, file.
+func readDocument(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 1 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(gz)
+	}
+	return data, nil
+}
+
+// moveFile moves name into dir, creating dir if needed. If dir already holds
+// a file of the same name, a number is added to the name rather than replace
+// it, so a.json becomes a-1.json.
+func moveFile(name, dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	base := filepath.Base(name)
+	ext := filepath.Ext(base)
+	dest := filepath.Join(dir, base)
+	for i := 1; ; i++ {
+		_, err = os.Lstat(dest)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		dest = filepath.Join(dir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(base, ext), i, ext))
+	}
+	return os.Rename(name, dest)
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *FromDirectory) Run() {
+	var directory, pattern, emit, doneDir, errorDir, intervalString string
+	var watcher *dirWatcher
+	var watched <-chan string
+	var current *lineFile
+	var pending []string
+	var err error
+
+	interval := time.Duration(1) * time.Second
+	intervalString = interval.String()
+	pattern = "*"
+	emit = "lines"
+
+	queued := make(map[string]bool)
+	// sizes remembers what each file looked like on the previous scan, so that
+	// a file is only picked up by a scan once it has stopped changing
+	sizes := make(map[string]int64)
+
+	scanTicker := time.NewTicker(interval)
+	scanTicker.Stop()
+
+	// next is signalled whenever the block should read another line
+	next := make(chan bool, 1)
+	more := func() {
+		select {
+		case next <- true:
+		default:
+		}
+	}
+
+	matches := func(name string) bool {
+		base := filepath.Base(name)
+		if strings.HasPrefix(base, ".") {
+			return false
+		}
+		ok, _ := filepath.Match(pattern, base)
+		return ok
+	}
+
+	enqueue := func(name string) {
+		if queued[name] || !matches(name) {
+			return
+		}
+		info, err := os.Stat(name)
+		if err != nil || info.IsDir() {
+			return
+		}
+		queued[name] = true
+		pending = append(pending, name)
+		more()
+	}
+
+	scan := func(all bool) {
+		entries, err := ioutil.ReadDir(directory)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		seen := make(map[string]int64)
+		for _, info := range entries {
+			name := filepath.Join(directory, info.Name())
+			if info.IsDir() || !matches(name) {
+				continue
+			}
+			seen[name] = info.Size()
+			if size, ok := sizes[name]; all || (ok && size == info.Size()) {
+				enqueue(name)
+			}
+		}
+		sizes = seen
+	}
+
+	// finish moves a file out of the watched directory once we are done with it
+	finish := func(name string, failed error) {
+		dir := doneDir
+		if failed != nil {
+			b.Error(failed)
+			dir = errorDir
+		}
+		delete(sizes, name)
+		err := moveFile(name, dir)
+		if err != nil {
+			// the file is still in the directory, so leave it marked as
+			// queued to stop it being read again
+			b.Error(fmt.Errorf("%s, so %s won't be read again until the rule is set", err.Error(), filepath.Base(name)))
+			return
+		}
+		delete(queued, name)
+	}
+
+	stop := func() {
+		if watcher != nil {
+			watcher.Close()
+			watcher = nil
+		}
+		watched = nil
+		if current != nil {
+			current.close()
+			current = nil
+		}
+		scanTicker.Stop()
+		pending = nil
+		queued = make(map[string]bool)
+		sizes = make(map[string]int64)
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newDirectory, err := util.ParseRequiredString(ruleI, "Directory")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newPattern := "*"
+			if util.KeyExists(ruleI, "Pattern") {
+				newPattern, err = util.ParseRequiredString(ruleI, "Pattern")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				_, err = filepath.Match(newPattern, "")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newEmit := "lines"
+			if util.KeyExists(ruleI, "Emit") {
+				newEmit, err = util.ParseString(ruleI, "Emit")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newEmit != "lines" && newEmit != "document" {
+				b.Error(errors.New("Emit must be either lines or document"))
+				continue
+			}
+			if util.KeyExists(ruleI, "PollInterval") {
+				newIntervalString, err := util.ParseString(ruleI, "PollInterval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				newInterval, err := time.ParseDuration(newIntervalString)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if newInterval <= 0 {
+					b.Error(errors.New("PollInterval must be positive"))
+					continue
+				}
+				interval = newInterval
+				intervalString = newIntervalString
+			}
+
+			stop()
+
+			directory = newDirectory
+			pattern = newPattern
+			emit = newEmit
+			doneDir, _ = util.ParseString(ruleI, "DoneDirectory")
+			if doneDir == "" {
+				doneDir = filepath.Join(directory, "done")
+			}
+			errorDir, _ = util.ParseString(ruleI, "ErrorDirectory")
+			if errorDir == "" {
+				errorDir = filepath.Join(directory, "error")
+			}
+
+			watcher, err = newDirWatcher(directory)
+			if err != nil {
+				b.Log(err.Error())
+			} else {
+				watched = watcher.Names
+			}
+			scanTicker = time.NewTicker(interval)
+
+			// anything left from before a restart is processed straight away
+			scan(true)
+
+		case name, ok := <-watched:
+			if !ok {
+				watched = nil
+				continue
+			}
+			enqueue(name)
+
+		case <-scanTicker.C:
+			scan(false)
+
+		case <-next:
+			if current == nil {
+				if len(pending) == 0 {
+					continue
+				}
+				name := pending[0]
+				pending = pending[1:]
+
+				if emit == "document" {
+					data, err := readDocument(name)
+					if err != nil {
+						finish(name, err)
+						more()
+						continue
+					}
+					var doc interface{}
+					err = json.Unmarshal(data, &doc)
+					if err != nil {
+						doc = string(data)
+					}
+					b.out <- map[string]interface{}{
+						"Filename": filepath.Base(name),
+						"data":     doc,
+					}
+					finish(name, nil)
+					more()
+					continue
+				}
+
+				current, err = openLineFile(name, 0)
+				if err != nil {
+					finish(name, err)
+					more()
+					continue
+				}
+			}
+
+			line, err := current.readLine(true)
+			if err != nil {
+				current.close()
+				if err == io.EOF {
+					err = nil
+				}
+				finish(current.name, err)
+				current = nil
+				more()
+				continue
+			}
+			if len(bytes.TrimSpace(line)) > 0 {
+				b.out <- lineToMsg(line)
+			}
+			more()
+
+		case c := <-b.querypending:
+			names := make([]string, len(pending))
+			for i, name := range pending {
+				names[i] = filepath.Base(name)
+			}
+			sort.Strings(names)
+			c <- map[string]interface{}{
+				"Pending": names,
+			}
+
+		case c := <-b.queryrule:
+			c <- map[string]interface{}{
+				"Directory":      directory,
+				"Pattern":        pattern,
+				"Emit":           emit,
+				"DoneDirectory":  doneDir,
+				"ErrorDirectory": errorDir,
+				"PollInterval":   intervalString,
+			}
+
+		case <-b.quit:
+			// quit the block. A file we were part way through is left where
+			// it is, and will be read again from the start when restarted.
+			stop()
+			return
+		}
+	}
+}
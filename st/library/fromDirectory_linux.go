@@ -0,0 +1,76 @@
+package library
+
+import (
+	"bytes"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// dirWatcher uses inotify to report files that have finished being written to,
+// or have been moved into, a directory.
+type dirWatcher struct {
+	Names chan string
+	fd    int
+	wd    int
+}
+
+func newDirWatcher(dir string) (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit()
+	if err != nil {
+		return nil, err
+	}
+	wd, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	w := &dirWatcher{
+		Names: make(chan string, 1000),
+		fd:    fd,
+		wd:    wd,
+	}
+	go w.read(dir)
+	return w, nil
+}
+
+func (w *dirWatcher) read(dir string) {
+	defer syscall.Close(w.fd)
+	defer close(w.Names)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n < syscall.SizeofInotifyEvent {
+			return
+		}
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			// removing the watch queues IN_IGNORED, which is how Close unblocks us
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				return
+			}
+			start := offset + syscall.SizeofInotifyEvent
+			end := start + int(event.Len)
+			if end > n {
+				break
+			}
+			name := string(bytes.TrimRight(buf[start:end], "\x00"))
+			if name != "" && event.Mask&syscall.IN_ISDIR == 0 {
+				select {
+				case w.Names <- filepath.Join(dir, name):
+				default:
+					// the periodic scan will pick up anything we drop here
+				}
+			}
+			offset = end
+		}
+	}
+}
+
+func (w *dirWatcher) Close() {
+	syscall.InotifyRmWatch(w.fd, uint32(w.wd))
+}
@@ -0,0 +1,20 @@
+// +build !linux
+
+package library
+
+import (
+	"errors"
+)
+
+// dirWatcher is only backed by inotify on linux. Everywhere else the
+// fromdirectory block falls back to scanning the directory.
+type dirWatcher struct {
+	Names chan string
+}
+
+func newDirWatcher(dir string) (*dirWatcher, error) {
+	return nil, errors.New("directory notifications are not supported on this platform, polling instead")
+}
+
+func (w *dirWatcher) Close() {
+}
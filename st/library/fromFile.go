@@ -2,9 +2,16 @@ package library
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/nytlabs/streamtools/st/blocks" // blocks
 	"github.com/nytlabs/streamtools/st/util"
@@ -29,7 +36,7 @@ func NewFromFile() blocks.BlockInterface {
 // Setup is called once before running the block. We build up the channels and specify what kind of block this is.
 func (b *FromFile) Setup() {
 	b.Kind = "Data Stores"
-	b.Desc = "reads in a file specified by the block's rule, emitting a message for each line"
+	b.Desc = "reads in the files matching the block's rule, emitting a message for each line when polled, as a stream, or by following the files as they grow"
 	b.in = b.InRoute("in")
 	b.inrule = b.InRoute("rule")
 	b.inpoll = b.InRoute("poll")
@@ -38,65 +45,466 @@ func (b *FromFile) Setup() {
 	b.out = b.Broadcast()
 }
 
+// lineFile reads lines from a single, possibly gzipped, file and keeps track
+// of how far into the file it has read.
+type lineFile struct {
+	name    string
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	gzipped bool
+	offset  int64  // bytes consumed, in the uncompressed stream for gzipped files
+	partial []byte // an incomplete trailing line
+}
+
+func openLineFile(name string, offset int64) (*lineFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f := &lineFile{
+		name: name,
+		file: file,
+		info: info,
+	}
+
+	magic := make([]byte, 2)
+	n, _ := io.ReadFull(file, magic)
+	_, err = file.Seek(0, os.SEEK_SET)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f.gzipped = n == 2 && magic[0] == 0x1f && magic[1] == 0x8b
+
+	if f.gzipped {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		f.reader = bufio.NewReader(gz)
+		// gzip streams can't seek, so skip what we've already read
+		skipped, err := io.CopyN(ioutil.Discard, f.reader, offset)
+		f.offset = skipped
+		if err != nil && err != io.EOF {
+			file.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+
+	if offset > info.Size() {
+		offset = 0
+	}
+	_, err = file.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f.offset = offset
+	f.reader = bufio.NewReader(file)
+	return f, nil
+}
+
+// readLine returns the next complete line. At EOF an incomplete trailing line
+// is held back, unless final is set in which case it is returned.
+func (f *lineFile) readLine(final bool) ([]byte, error) {
+	line, err := f.reader.ReadBytes('\n')
+	f.offset += int64(len(line))
+	if err == nil {
+		if len(f.partial) > 0 {
+			line = append(f.partial, line...)
+			f.partial = nil
+		}
+		return line, nil
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	f.partial = append(f.partial, line...)
+	if final && len(f.partial) > 0 {
+		line = f.partial
+		f.partial = nil
+		return line, nil
+	}
+	return nil, io.EOF
+}
+
+// committed is the offset of the last complete line that was read.
+func (f *lineFile) committed() int64 {
+	return f.offset - int64(len(f.partial))
+}
+
+// replaced reports whether the file at name is no longer the one we have open,
+// which happens when a file is rotated. Truncated files are rewound.
+func (f *lineFile) replaced() bool {
+	info, err := os.Stat(f.name)
+	if err != nil {
+		// the file has been moved away but nothing has replaced it yet
+		return false
+	}
+	if !os.SameFile(info, f.info) {
+		return true
+	}
+	if !f.gzipped && info.Size() < f.offset {
+		_, err := f.file.Seek(0, os.SEEK_SET)
+		if err == nil {
+			f.offset = 0
+			f.partial = nil
+			f.reader.Reset(f.file)
+		}
+	}
+	return false
+}
+
+func (f *lineFile) close() {
+	f.file.Close()
+}
+
+func loadOffsets(filename string) (map[string]int64, error) {
+	offsets := make(map[string]int64)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return offsets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &offsets)
+	return offsets, err
+}
+
+func saveOffsets(filename string, offsets map[string]int64) error {
+	data, err := json.Marshal(offsets)
+	if err != nil {
+		return err
+	}
+	// write then rename so that a crash never leaves a half written file
+	tmp := filename + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func lineToMsg(line []byte) interface{} {
+	var outMsg interface{}
+	err := json.Unmarshal(line, &outMsg)
+	// if the json parsing fails, store data unparsed as "data"
+	if err != nil {
+		outMsg = map[string]interface{}{
+			"data": string(bytes.TrimRight(line, "\r\n")),
+		}
+	}
+	return outMsg
+}
+
 // Run is the block's main loop. Here we listen on the different channels we set up.
 func (b *FromFile) Run() {
-	var file *os.File
-	var filename string
-	var err error
-	var reader *bufio.Reader
+	var filename, mode, offsetFile, intervalString string
+	var names []string
+	var files []*lineFile
+	var current int
+	var offsets map[string]int64
+	dirty := false
 
-	for {
+	mode = "poll"
+	interval := time.Duration(1) * time.Second
+	intervalString = interval.String()
+
+	// next is signalled whenever the block should read another line without being polled
+	next := make(chan bool, 1)
+	more := func() {
 		select {
-		case msgI := <-b.inrule:
-			// set a parameter of the block
-			filename, err = util.ParseString(msgI, "Filename")
+		case next <- true:
+		default:
+		}
+	}
+
+	waitTimer := time.NewTimer(interval)
+	waitTimer.Stop()
+	saveTicker := time.NewTicker(time.Duration(1) * time.Second)
+
+	save := func() {
+		if offsetFile == "" || !dirty {
+			return
+		}
+		for _, f := range files {
+			if f != nil {
+				offsets[f.name] = f.committed()
+			}
+		}
+		err := saveOffsets(offsetFile, offsets)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		dirty = false
+	}
+
+	closeAll := func() {
+		save()
+		for _, f := range files {
+			if f != nil {
+				f.close()
+			}
+		}
+		files = nil
+		names = nil
+		current = 0
+	}
+
+	// open the file at index i if it isn't already. In tail mode files that
+	// existed when the rule was set, and that we have no offset for, are read
+	// from their end.
+	open := func(i int, fromEnd bool) *lineFile {
+		if files[i] != nil {
+			return files[i]
+		}
+		offset, ok := offsets[names[i]]
+		if !ok && fromEnd {
+			info, err := os.Stat(names[i])
+			if err == nil {
+				offset = info.Size()
+			}
+		}
+		f, err := openLineFile(names[i], offset)
+		if err != nil {
+			b.Error(err)
+			return nil
+		}
+		files[i] = f
+		return f
+	}
+
+	// glob finds any new files matching the rule
+	glob := func(fromEnd bool) {
+		matches, err := filepath.Glob(filename)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		sort.Strings(matches)
+		known := make(map[string]bool)
+		for _, n := range names {
+			known[n] = true
+		}
+		for _, m := range matches {
+			if known[m] {
+				continue
+			}
+			names = append(names, m)
+			files = append(files, nil)
+			if mode == "tail" {
+				open(len(names)-1, fromEnd)
+			}
+		}
+	}
+
+	emit := func(line []byte) {
+		dirty = true
+		if len(bytes.TrimSpace(line)) == 0 {
+			return
+		}
+		b.out <- lineToMsg(line)
+	}
+
+	// readSequential reads the next line across all the files in order, returning
+	// false once every file has been read.
+	readSequential := func() bool {
+		for current < len(names) {
+			f := open(current, false)
+			if f == nil {
+				current++
+				continue
+			}
+			line, err := f.readLine(true)
+			if err == io.EOF {
+				offsets[f.name] = f.committed()
+				dirty = true
+				f.close()
+				files[current] = nil
+				current++
+				continue
+			}
 			if err != nil {
 				b.Error(err)
+				current++
 				continue
 			}
+			emit(line)
+			return true
+		}
+		return false
+	}
 
-			file, err = os.Open(filename)
-			if err != nil {
+	// readTail reads the next available line from any of the files being
+	// followed, returning false if there is nothing new to read.
+	readTail := func() bool {
+		for n := 0; n < len(files); n++ {
+			i := (current + n) % len(files)
+			f := files[i]
+			if f == nil {
+				f = open(i, false)
+				if f == nil {
+					continue
+				}
+			}
+			line, err := f.readLine(false)
+			if err == nil {
+				current = i
+				emit(line)
+				return true
+			}
+			if err != io.EOF {
 				b.Error(err)
 				continue
 			}
+			if f.replaced() {
+				// the file was rotated: finish the old file, then start on the new one
+				line, err := f.readLine(true)
+				f.close()
+				files[i] = nil
+				offsets[f.name] = 0
+				dirty = true
+				if err == nil {
+					current = i
+					emit(line)
+					return true
+				}
+				if open(i, false) != nil {
+					n--
+				}
+			}
+		}
+		return false
+	}
 
-			reader = bufio.NewReader(file)
+	for {
+		select {
+		case msgI := <-b.inrule:
+			// set a parameter of the block
+			newFilename, err := util.ParseRequiredString(msgI, "Filename")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
 
-		case c := <-b.queryrule:
-			c <- map[string]interface{}{
-				"Filename": filename,
+			newMode := "poll"
+			if util.KeyExists(msgI, "Mode") {
+				newMode, err = util.ParseString(msgI, "Mode")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newMode != "poll" && newMode != "stream" && newMode != "tail" {
+				b.Error(errors.New("Mode must be one of poll, stream or tail"))
+				continue
 			}
 
-		case <-b.inpoll:
-			if reader == nil && filename == "" {
-				b.Error("you must configure a filename before polling this block.")
-				break
+			if util.KeyExists(msgI, "PollInterval") {
+				newIntervalString, err := util.ParseString(msgI, "PollInterval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				newInterval, err := time.ParseDuration(newIntervalString)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if newInterval <= 0 {
+					b.Error(errors.New("PollInterval must be positive"))
+					continue
+				}
+				interval = newInterval
+				intervalString = newIntervalString
 			}
 
-			var outMsg interface{}
+			closeAll()
+			waitTimer.Stop()
 
-			line, err := reader.ReadBytes('\n')
-			if err != nil && err != io.EOF {
-				b.Error(err)
+			filename = newFilename
+			mode = newMode
+			offsetFile, _ = util.ParseString(msgI, "OffsetFile")
+			offsets = make(map[string]int64)
+			if offsetFile != "" {
+				offsets, err = loadOffsets(offsetFile)
+				if err != nil {
+					b.Error(err)
+					offsets = make(map[string]int64)
+				}
+			}
+
+			glob(true)
+			if len(names) == 0 && mode != "tail" {
+				b.Error(errors.New("no files match " + filename))
 				continue
 			}
 
-			err = json.Unmarshal(line, &outMsg)
-			// if the json parsing fails, store data unparsed as "data"
-			if err != nil {
-				outMsg = map[string]interface{}{
-					"data": string(line),
+			if mode != "poll" {
+				more()
+			}
+
+		case <-next:
+			switch mode {
+			case "stream":
+				if readSequential() {
+					more()
+				} else {
+					save()
+					b.out <- map[string]interface{}{
+						"EOF":      true,
+						"Filename": filename,
+					}
+				}
+			case "tail":
+				if readTail() {
+					more()
+				} else {
+					waitTimer.Reset(interval)
 				}
 			}
 
-			b.out <- outMsg
+		case <-waitTimer.C:
+			if mode == "tail" {
+				glob(false)
+				more()
+			}
+
+		case <-saveTicker.C:
+			save()
+
+		case c := <-b.queryrule:
+			c <- map[string]interface{}{
+				"Filename":     filename,
+				"Mode":         mode,
+				"OffsetFile":   offsetFile,
+				"PollInterval": intervalString,
+			}
+
+		case <-b.inpoll:
+			if filename == "" {
+				b.Error("you must configure a filename before polling this block.")
+				break
+			}
+			if mode != "poll" {
+				break
+			}
+			readSequential()
 
 		case <-b.quit:
 			// quit the block
-			if file != nil {
-				file.Close()
-			}
+			closeAll()
+			saveTicker.Stop()
 			return
 		}
 	}
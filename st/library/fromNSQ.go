@@ -1,8 +1,6 @@
 package library
 
 import (
-	"encoding/json"
-
 	"github.com/bitly/go-nsq"
 	"github.com/nytlabs/streamtools/st/blocks"
 	"github.com/nytlabs/streamtools/st/util"
@@ -36,17 +34,21 @@ func (b *FromNSQ) Setup() {
 type readWriteHandler struct {
 	toOut   blocks.MsgChan
 	toError chan error
+	format  *codec
 }
 
 func (self readWriteHandler) HandleMessage(message *nsq.Message) error {
-	var msg interface{}
-	err := json.Unmarshal(message.Body, &msg)
+	msgs, err := self.format.decode(message.Body)
 	if err != nil {
-		msg = map[string]interface{}{
-			"data": message.Body,
+		msgs = []interface{}{
+			map[string]interface{}{
+				"data": message.Body,
+			},
 		}
 	}
-	self.toOut <- msg
+	for _, msg := range msgs {
+		self.toOut <- msg
+	}
 	return nil
 }
 
@@ -58,6 +60,7 @@ func (b *FromNSQ) Run() {
 	var err error
 	toOut := make(blocks.MsgChan)
 	toError := make(chan error)
+	format, _ := parseCodecRule(map[string]interface{}{}, "json")
 
 	conf := nsq.NewConfig()
 
@@ -97,6 +100,13 @@ func (b *FromNSQ) Run() {
 				continue
 			}
 
+			newFormat, err := parseCodecRule(rule, "json")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			format = newFormat
+
 			if reader != nil {
 				reader.Stop()
 			}
@@ -107,7 +117,7 @@ func (b *FromNSQ) Run() {
 				continue
 			}
 
-			h := readWriteHandler{toOut, toError}
+			h := readWriteHandler{toOut, toError, format}
 			reader.AddHandler(h)
 
 			err = reader.ConnectToNSQLookupd(lookupdAddr)
@@ -122,12 +132,12 @@ func (b *FromNSQ) Run() {
 			}
 			return
 		case c := <-b.queryrule:
-			c <- map[string]interface{}{
-				"ReadTopic":   topic,
-				"ReadChannel": channel,
-				"LookupdAddr": lookupdAddr,
-				"MaxInFlight": maxInFlight,
-			}
+			rule := format.rule()
+			rule["ReadTopic"] = topic
+			rule["ReadChannel"] = channel
+			rule["LookupdAddr"] = lookupdAddr
+			rule["MaxInFlight"] = maxInFlight
+			c <- rule
 		}
 	}
 }
@@ -0,0 +1,205 @@
+package library
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type FromSQL struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	inpoll    blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewFromSQL() blocks.BlockInterface {
+	return &FromSQL{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *FromSQL) Setup() {
+	b.Kind = "Data Stores"
+	b.Desc = "runs a SQL query when polled, emitting each row as a message. In tail mode only rows past the last seen TailColumn are emitted"
+	b.inrule = b.InRoute("rule")
+	b.inpoll = b.InRoute("poll")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// sqlMaxExactInt is the largest integer a float64 holds exactly.
+const sqlMaxExactInt = 1 << 53
+
+// sqlRowValue converts a scanned column into a JSON-friendly value. Integers
+// too big for a float64 to hold exactly, like some ids, are kept as strings.
+func sqlRowValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case int64:
+		if v > sqlMaxExactInt || v < -sqlMaxExactInt {
+			return strconv.FormatInt(v, 10)
+		}
+		return float64(v)
+	case int32:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *FromSQL) Run() {
+	var db *sql.DB
+	var driver, dsn, query, tailColumn string
+	var last interface{}
+	mode := "poll"
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newDriver, err := util.ParseRequiredString(ruleI, "Driver")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newDSN, err := util.ParseRequiredString(ruleI, "DSN")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newQuery, err := util.ParseRequiredString(ruleI, "Query")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			newMode := "poll"
+			if util.KeyExists(ruleI, "Mode") {
+				newMode, err = util.ParseString(ruleI, "Mode")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newMode != "poll" && newMode != "tail" {
+				b.Error(errors.New("Mode must be either poll or tail"))
+				continue
+			}
+
+			newTailColumn, _ := util.ParseString(ruleI, "TailColumn")
+			if newMode == "tail" && newTailColumn == "" {
+				b.Error(errors.New("tail mode needs a TailColumn"))
+				continue
+			}
+
+			newDB, err := sql.Open(newDriver, newDSN)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if db != nil {
+				db.Close()
+			}
+
+			db = newDB
+			driver = newDriver
+			dsn = newDSN
+			query = newQuery
+			mode = newMode
+			tailColumn = newTailColumn
+			// the starting point of the tail, if not given every row is emitted on the first poll
+			last = ruleI.(map[string]interface{})["TailStart"]
+
+		case <-b.inpoll:
+			if db == nil {
+				b.Error(errors.New("you must configure a database and query before polling this block"))
+				continue
+			}
+
+			var rows *sql.Rows
+			var err error
+			if mode == "tail" {
+				tailed := fmt.Sprintf("SELECT * FROM (%s) AS st_tail", query)
+				col := sqlQuote(tailColumn)
+				if last != nil {
+					tailed += fmt.Sprintf(" WHERE %s > %s", col, sqlPlaceholder(driver, 1))
+					rows, err = db.Query(tailed+" ORDER BY "+col, last)
+				} else {
+					rows, err = db.Query(tailed + " ORDER BY " + col)
+				}
+			} else {
+				rows, err = db.Query(query)
+			}
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			columns, err := rows.Columns()
+			if err != nil {
+				b.Error(err)
+				rows.Close()
+				continue
+			}
+
+			for rows.Next() {
+				values := make([]interface{}, len(columns))
+				pointers := make([]interface{}, len(columns))
+				for i := range values {
+					pointers[i] = &values[i]
+				}
+				err = rows.Scan(pointers...)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+				row := make(map[string]interface{})
+				for i, c := range columns {
+					row[c] = sqlRowValue(values[i])
+					// keep the tail as scanned, so big ids compare exactly
+					if mode == "tail" && c == tailColumn {
+						last = values[i]
+					}
+				}
+				b.out <- row
+			}
+			err = rows.Err()
+			if err != nil {
+				b.Error(err)
+			}
+			rows.Close()
+
+		case <-b.quit:
+			// quit the block
+			if db != nil {
+				db.Close()
+			}
+			return
+
+		case MsgChan := <-b.queryrule:
+			// deal with a query request
+			MsgChan <- map[string]interface{}{
+				"Driver":     driver,
+				"DSN":        dsn,
+				"Query":      query,
+				"Mode":       mode,
+				"TailColumn": tailColumn,
+				"TailStart":  sqlRowValue(last),
+			}
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package library
 
 import (
-	"encoding/json"
 	"net"
 	"sync"
 
@@ -115,6 +114,7 @@ func (u *FromUDP) Setup() {
 // set up.
 func (u *FromUDP) Run() {
 	var ConnectionString string
+	format, _ := parseCodecRule(map[string]interface{}{}, "json")
 
 	for {
 		select {
@@ -123,13 +123,23 @@ func (u *FromUDP) Run() {
 		case msgI := <-u.inrule:
 
 			// Check for a new connection string.
-			if cs, err := util.ParseString(msgI, "ConnectionString"); err != nil {
+			cs, err := util.ParseString(msgI, "ConnectionString")
+			if err != nil {
+				u.Error(err)
+				break
+			}
+
+			// Check for a new format to decode messages with.
+			c, err := parseCodecRule(msgI, "json")
+			if err != nil {
 				u.Error(err)
 				break
-			} else {
-				ConnectionString = cs
 			}
 
+			// Both are good, so the rule can take effect.
+			ConnectionString = cs
+			format = c
+
 			// Get the listener lock for writing.
 			u.listenerLock.Lock()
 
@@ -159,11 +169,12 @@ func (u *FromUDP) Run() {
 		// Recieving a message from the listener. This is the same as from SQS
 		// etc.
 		case msg := <-u.listenerChan:
-			var outMsg interface{}
-			if err := json.Unmarshal(msg, &outMsg); err != nil {
+			if outMsgs, err := format.decode(msg); err != nil {
 				u.Error(err)
 			} else {
-				u.out <- outMsg
+				for _, outMsg := range outMsgs {
+					u.out <- outMsg
+				}
 			}
 
 		// Respond to a rule query.
@@ -172,9 +183,9 @@ func (u *FromUDP) Run() {
 			// Get the listener lock for reading.
 			u.listenerLock.RLock()
 
-			MsgChan <- map[string]interface{}{
-				"ConnectionString": u.connectionString,
-			}
+			rule := format.rule()
+			rule["ConnectionString"] = u.connectionString
+			MsgChan <- rule
 
 			// Release the listener lock.
 			u.listenerLock.RUnlock()
@@ -0,0 +1,245 @@
+package library
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// grokPatterns are the patterns grok expressions can use by name, like
+// %{IP:client}. They're based on the ones that come with logstash.
+var grokPatterns = map[string]string{
+	"USERNAME":          `[a-zA-Z0-9._-]+`,
+	"USER":              `%{USERNAME}`,
+	"EMAILLOCALPART":    `[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+(?:\.[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+)*`,
+	"EMAILADDRESS":      `%{EMAILLOCALPART}@%{HOSTNAME}`,
+	"INT":               `[+-]?[0-9]+`,
+	"BASE10NUM":         `[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+)`,
+	"NUMBER":            `%{BASE10NUM}`,
+	"BASE16NUM":         `[+-]?(?:0x)?[0-9A-Fa-f]+`,
+	"POSINT":            `[1-9][0-9]*`,
+	"NONNEGINT":         `[0-9]+`,
+	"WORD":              `\b\w+\b`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"QUOTEDSTRING":      `"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'`,
+	"QS":                `%{QUOTEDSTRING}`,
+	"UUID":              `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"MAC":               `(?:[A-Fa-f0-9]{2}[:-]){5}[A-Fa-f0-9]{2}`,
+	"IPV4":              `(?:(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])`,
+	"IPV6":              `(?:[0-9A-Fa-f]{0,4}:){2,7}(?:[0-9A-Fa-f]{0,4}|%{IPV4})`,
+	"IP":                `%{IPV6}|%{IPV4}`,
+	"HOSTNAME":          `\b[0-9A-Za-z][0-9A-Za-z-]{0,62}(?:\.[0-9A-Za-z][0-9A-Za-z-]{0,62})*\.?\b`,
+	"IPORHOST":          `%{IP}|%{HOSTNAME}`,
+	"HOSTPORT":          `%{IPORHOST}:%{POSINT}`,
+	"PATH":              `(?:/[^\s?#]*)+`,
+	"URIPROTO":          `[A-Za-z][A-Za-z0-9+\-.]*`,
+	"URIHOST":           `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":           `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_\-]*)+`,
+	"URIPARAM":          `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\-\[\]<>]*`,
+	"URIPATHPARAM":      `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":               `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{URIHOST})?(?:%{URIPATHPARAM})?`,
+	"MONTH":             `\b(?:[Jj]an(?:uary)?|[Ff]eb(?:ruary)?|[Mm]ar(?:ch)?|[Aa]pr(?:il)?|[Mm]ay|[Jj]une?|[Jj]uly?|[Aa]ug(?:ust)?|[Ss]ep(?:tember)?|[Oo]ct(?:ober)?|[Nn]ov(?:ember)?|[Dd]ec(?:ember)?)\b`,
+	"MONTHNUM":          `0?[1-9]|1[0-2]`,
+	"MONTHDAY":          `(?:0[1-9])|(?:[12][0-9])|(?:3[01])|[1-9]`,
+	"DAY":               `(?:Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?)`,
+	"YEAR":              `\d\d(?:\d\d)?`,
+	"HOUR":              `2[0123]|[01]?[0-9]`,
+	"MINUTE":            `[0-5][0-9]`,
+	"SECOND":            `(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"ISO8601_TIMEZONE":  `Z|[+-]%{HOUR}(?::?%{MINUTE})`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?(?:%{ISO8601_TIMEZONE})?`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+	"PROG":              `[\x21-\x5a\x5c\x5e-\x7e]+`,
+	"SYSLOGPROG":        `%{PROG:program}(?:\[%{POSINT:pid:int}\])?`,
+	"SYSLOGHOST":        `%{IPORHOST}`,
+	"SYSLOGBASE":        `%{SYSLOGTIMESTAMP:timestamp} (?:%{SYSLOGHOST:logsource} )?%{SYSLOGPROG}:`,
+	"SYSLOGLINE":        `%{SYSLOGBASE} %{GREEDYDATA:message}`,
+	"LOGLEVEL":          `[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo|INFO|[Ww]arn(?:ing)?|WARN(?:ING)?|[Ee]rr(?:or)?|ERR(?:OR)?|[Cc]rit(?:ical)?|CRIT(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|EMERG(?:ENCY)?|[Ee]merg(?:ency)?`,
+	"HTTPDUSER":         `%{EMAILADDRESS}|%{USER}`,
+	"COMMONAPACHELOG":   `%{IPORHOST:clientip} %{HTTPDUSER:ident} %{HTTPDUSER:auth} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:verb} %{NOTSPACE:request}(?: HTTP/%{NUMBER:httpversion})?|%{DATA:rawrequest})" %{NUMBER:response:int} (?:%{NUMBER:bytes:int}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QS:referrer} %{QS:agent}`,
+	"NGINXACCESS":       `%{COMBINEDAPACHELOG}`,
+}
+
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::([\w]+))?(?::(\w+))?\}`)
+
+// grokExpression is a compiled grok pattern, along with the types its fields
+// should be given.
+type grokExpression struct {
+	re    *regexp.Regexp
+	types map[string]string
+}
+
+// compileGrok turns a grok pattern into a regular expression, using custom
+// patterns ahead of the built in ones.
+func compileGrok(pattern string, custom map[string]string) (*grokExpression, error) {
+	types := make(map[string]string)
+	expanded, err := expandGrok(pattern, custom, types, 0)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile("^(?:" + expanded + ")$")
+	if err != nil {
+		return nil, err
+	}
+	return &grokExpression{
+		re:    re,
+		types: types,
+	}, nil
+}
+
+func expandGrok(pattern string, custom map[string]string, types map[string]string, depth int) (string, error) {
+	if depth > 20 {
+		return "", errors.New("grok patterns refer to each other too deeply")
+	}
+	var err error
+	expanded := grokReference.ReplaceAllStringFunc(pattern, func(ref string) string {
+		parts := grokReference.FindStringSubmatch(ref)
+		name, field, typ := parts[1], parts[2], parts[3]
+		sub, ok := custom[name]
+		if !ok {
+			sub, ok = grokPatterns[name]
+		}
+		if !ok {
+			err = errors.New("unknown grok pattern " + name)
+			return ""
+		}
+		inner, subErr := expandGrok(sub, custom, types, depth+1)
+		if subErr != nil {
+			err = subErr
+			return ""
+		}
+		if field == "" {
+			return "(?:" + inner + ")"
+		}
+		if typ != "" {
+			if typ != "int" && typ != "float" {
+				err = errors.New("grok fields can only be int or float, not " + typ)
+				return ""
+			}
+			types[field] = typ
+		}
+		return "(?P<" + field + ">" + inner + ")"
+	})
+	if err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
+
+// match gives the named fields of a line, leaving out any that took no part
+// in the match.
+func (g *grokExpression) match(line string) (map[string]interface{}, bool) {
+	return matchNamed(g.re, line)
+}
+
+func matchNamed(re *regexp.Regexp, line string) (map[string]interface{}, bool) {
+	idx := re.FindStringSubmatchIndex(line)
+	if idx == nil {
+		return nil, false
+	}
+	fields := make(map[string]interface{})
+	for i, name := range re.SubexpNames() {
+		if i == 0 || name == "" || idx[2*i] < 0 {
+			continue
+		}
+		fields[name] = line[idx[2*i]:idx[2*i+1]]
+	}
+	return fields, true
+}
+
+// parseLogfmt reads lines like `level=info msg="hello world" ok`. A key with
+// no value is true.
+func parseLogfmt(line string) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	i := 0
+	for i < len(line) {
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+		if i == len(line) {
+			break
+		}
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' {
+			i++
+		}
+		key := line[start:i]
+		if key == "" {
+			return nil, errors.New("logfmt key is missing at position " + strconv.Itoa(start))
+		}
+		if i == len(line) || line[i] == ' ' {
+			fields[key] = true
+			continue
+		}
+		// skip the =
+		i++
+		if i < len(line) && line[i] == '"' {
+			var value []byte
+			i++
+			closed := false
+			for i < len(line) {
+				c := line[i]
+				if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						value = append(value, '\n')
+					case 't':
+						value = append(value, '\t')
+					default:
+						value = append(value, line[i])
+					}
+					i++
+					continue
+				}
+				if c == '"' {
+					closed = true
+					i++
+					break
+				}
+				value = append(value, c)
+				i++
+			}
+			if !closed {
+				return nil, errors.New("logfmt value for " + key + " is missing its closing quote")
+			}
+			fields[key] = string(value)
+			continue
+		}
+		start = i
+		for i < len(line) && line[i] != ' ' {
+			i++
+		}
+		fields[key] = line[start:i]
+	}
+	return fields, nil
+}
+
+// parseKV reads pairs like `a=1;b=2`, split by separator and then by
+// delimiter. Quotes around values are removed.
+func parseKV(line, separator, delimiter string) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	for _, pair := range strings.Split(line, separator) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, delimiter, 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New("could not find a key and value in " + pair)
+		}
+		value := kv[1]
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		fields[strings.TrimSpace(kv[0])] = value
+	}
+	return fields, nil
+}
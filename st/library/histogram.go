@@ -3,6 +3,8 @@ package library
 import (
 	"container/heap"
 	"errors"
+	"math"
+	"sort"
 	"strconv"
 	"time"
 
@@ -50,6 +52,100 @@ func buildHistogram(histogram map[string]*PriorityQueue) interface{} {
 	return data
 }
 
+// numericBucket is a range of values in a numeric histogram. The first and
+// last buckets are open ended.
+type numericBucket struct {
+	Label string
+	Lower float64
+	Upper float64
+}
+
+func formatBound(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// bucketsFromBoundaries builds the buckets between, below and above a sorted
+// list of boundaries.
+func bucketsFromBoundaries(boundaries []float64) []numericBucket {
+	buckets := []numericBucket{{
+		Label: "<" + formatBound(boundaries[0]),
+		Lower: math.Inf(-1),
+		Upper: boundaries[0],
+	}}
+	for i := 1; i < len(boundaries); i++ {
+		buckets = append(buckets, numericBucket{
+			Label: "[" + formatBound(boundaries[i-1]) + "," + formatBound(boundaries[i]) + ")",
+			Lower: boundaries[i-1],
+			Upper: boundaries[i],
+		})
+	}
+	last := boundaries[len(boundaries)-1]
+	return append(buckets, numericBucket{
+		Label: ">=" + formatBound(last),
+		Lower: last,
+		Upper: math.Inf(1),
+	})
+}
+
+// findBucket returns the index of the bucket v falls into. v can't be NaN.
+func findBucket(buckets []numericBucket, v float64) int {
+	i := sort.Search(len(buckets), func(i int) bool {
+		return v < buckets[i].Upper
+	})
+	// +Inf isn't below the last bucket's upper bound, but belongs in it
+	if i == len(buckets) {
+		i--
+	}
+	return i
+}
+
+// sameBuckets says whether two sets of buckets count the same ranges.
+func sameBuckets(a, b []numericBucket) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// bound turns an infinite bucket bound into a null, which JSON can represent.
+func bound(f float64) interface{} {
+	if math.IsInf(f, 0) {
+		return nil
+	}
+	return f
+}
+
+// buildNumericHistogram lists every bucket in order, including empty ones.
+func buildNumericHistogram(histogram map[string]*PriorityQueue, buckets []numericBucket, cumulative bool) interface{} {
+	out := make([]interface{}, len(buckets))
+	total := 0.0
+	for i, bucket := range buckets {
+		count := 0.0
+		if pq, ok := histogram[bucket.Label]; ok {
+			count = float64(len(*pq))
+		}
+		total += count
+		b := map[string]interface{}{
+			"Label": bucket.Label,
+			"Lower": bound(bucket.Lower),
+			"Upper": bound(bucket.Upper),
+			"Count": count,
+		}
+		if cumulative {
+			b["Cumulative"] = total
+		}
+		out[i] = b
+	}
+	return map[string]interface{}{
+		"Histogram": out,
+	}
+}
+
 // Setup is called once before running the block. We build up the channels and specify what kind of block this is.
 func (b *Histogram) Setup() {
 	b.Kind = "Stats"
@@ -66,12 +162,27 @@ func (b *Histogram) Setup() {
 // Run is the block's main loop. Here we listen on the different channels we set up.
 func (b *Histogram) Run() {
 	var tree *jee.TokenTree
-	var path string
+	var path, mode, scale string
+	var boundaries []float64
+	var buckets []numericBucket
+	var start, width, factor float64
+	var count int
+	var cumulative bool
+	mode = "categorical"
+	scale = "linear"
+	boundaries = []float64{}
 	waitTimer := time.NewTimer(100 * time.Millisecond)
 	window := time.Duration(0)
 
 	histogram := map[string]*PriorityQueue{}
 	emptyByte := make([]byte, 0)
+
+	output := func() interface{} {
+		if mode == "numeric" {
+			return buildNumericHistogram(histogram, buckets, cumulative)
+		}
+		return buildHistogram(histogram)
+	}
 MainLoop:
 	for {
 		select {
@@ -92,6 +203,96 @@ MainLoop:
 				break
 			}
 
+			newMode := "categorical"
+			if util.KeyExists(ruleI, "Mode") {
+				newMode, err = util.ParseString(ruleI, "Mode")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			newBoundaries := []float64{}
+			if util.KeyExists(ruleI, "Boundaries") {
+				newBoundaries, err = util.ParseArrayFloat(ruleI, "Boundaries")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			newScale := "linear"
+			if util.KeyExists(ruleI, "Scale") {
+				newScale, err = util.ParseString(ruleI, "Scale")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			newStart, _ := util.ParseFloat(ruleI, "Start")
+			newWidth, _ := util.ParseFloat(ruleI, "Width")
+			newFactor, _ := util.ParseFloat(ruleI, "Factor")
+			newCount, _ := util.ParseInt(ruleI, "Count")
+			newCumulative, _ := util.ParseBool(ruleI, "Cumulative")
+
+			var newBuckets []numericBucket
+			switch newMode {
+			case "categorical":
+			case "numeric":
+				bounds := newBoundaries
+				if len(bounds) == 0 {
+					// generate Count buckets from Start
+					if newCount < 1 {
+						err = errors.New("numeric histograms need Boundaries, or a Start and Count")
+						break
+					}
+					bounds = make([]float64, newCount+1)
+					for i := range bounds {
+						switch newScale {
+						case "linear":
+							if newWidth <= 0 {
+								err = errors.New("linear buckets need a positive Width")
+							}
+							bounds[i] = newStart + float64(i)*newWidth
+						case "log":
+							if newStart <= 0 || newFactor <= 1 {
+								err = errors.New("log buckets need a positive Start and a Factor greater than 1")
+							}
+							bounds[i] = newStart * math.Pow(newFactor, float64(i))
+						default:
+							err = errors.New("Scale must be either linear or log")
+						}
+					}
+				}
+				for i := 1; i < len(bounds); i++ {
+					if bounds[i] <= bounds[i-1] {
+						err = errors.New("Boundaries must be in increasing order")
+					}
+				}
+				if err == nil {
+					newBuckets = bucketsFromBoundaries(bounds)
+				}
+			default:
+				err = errors.New("Mode must be either categorical or numeric")
+			}
+			if err != nil {
+				b.Error(err)
+				break
+			}
+
+			// the old counts won't line up with new buckets
+			if newMode != mode || !sameBuckets(newBuckets, buckets) {
+				histogram = map[string]*PriorityQueue{}
+			}
+
+			mode = newMode
+			boundaries = newBoundaries
+			scale = newScale
+			start = newStart
+			width = newWidth
+			factor = newFactor
+			count = newCount
+			cumulative = newCumulative
+			buckets = newBuckets
+
 		case <-b.quit:
 			// quit the block
 			return
@@ -107,18 +308,31 @@ MainLoop:
 
 			var valueString string
 
-			switch v := v.(type) {
-			default:
-				b.Error(errors.New("unexpected value type"))
-				continue MainLoop
-			case string:
-				valueString = v
-			case int:
-				valueString = strconv.Itoa(v)
-			case bool:
-				valueString = strconv.FormatBool(v)
-			case float64:
-				valueString = strconv.FormatFloat(v, 'g', -1, 64)
+			if mode == "numeric" {
+				f, ok := v.(float64)
+				if !ok {
+					b.Error(errors.New("numeric histograms need a number at Path"))
+					continue
+				}
+				if math.IsNaN(f) {
+					b.Error(errors.New("NaN can't be put in a bucket"))
+					continue
+				}
+				valueString = buckets[findBucket(buckets, f)].Label
+			} else {
+				switch v := v.(type) {
+				default:
+					b.Error(errors.New("unexpected value type"))
+					continue MainLoop
+				case string:
+					valueString = v
+				case int:
+					valueString = strconv.Itoa(v)
+				case bool:
+					valueString = strconv.FormatBool(v)
+				case float64:
+					valueString = strconv.FormatFloat(v, 'g', -1, 64)
+				}
 			}
 
 			if pq, ok := histogram[valueString]; ok {
@@ -141,18 +355,24 @@ MainLoop:
 
 		case <-b.inpoll:
 			// deal with a poll request
-			data := buildHistogram(histogram)
-			b.out <- data
+			b.out <- output()
 		case MsgChan := <-b.queryrule:
 			// deal with a query request
 			out := map[string]interface{}{
-				"Window": window.String(),
-				"Path":   path,
+				"Window":     window.String(),
+				"Path":       path,
+				"Mode":       mode,
+				"Boundaries": boundaries,
+				"Scale":      scale,
+				"Start":      start,
+				"Width":      width,
+				"Factor":     factor,
+				"Count":      float64(count),
+				"Cumulative": cumulative,
 			}
 			MsgChan <- out
 		case MsgChan := <-b.historule:
-			data := buildHistogram(histogram)
-			MsgChan <- data
+			MsgChan <- output()
 		}
 		for _, pq := range histogram {
 			for {
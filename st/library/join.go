@@ -1,16 +1,24 @@
 package library
 
 import (
+	"errors"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
 	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
 )
 
 type Join struct {
 	blocks.Block
-	inA   blocks.MsgChan
-	inB   blocks.MsgChan
-	clear blocks.MsgChan
-	out   blocks.MsgChan
-	quit  blocks.MsgChan
+	queryrule    chan blocks.MsgChan
+	querypending chan blocks.MsgChan
+	inrule       blocks.MsgChan
+	inA          blocks.MsgChan
+	inB          blocks.MsgChan
+	clear        blocks.MsgChan
+	out          blocks.MsgChan
+	quit         blocks.MsgChan
 }
 
 func NewJoin() blocks.BlockInterface {
@@ -19,42 +27,286 @@ func NewJoin() blocks.BlockInterface {
 
 func (b *Join) Setup() {
 	b.Kind = "Core"
-	b.Desc = "joins two streams together, emitting the joined message once it's been seen on both inputs"
+	b.Desc = "joins two streams together, emitting the joined message once it's been seen on both inputs, either in order or by matching keys"
 	b.inA = b.InRoute("inA")
 	b.inB = b.InRoute("inB")
+	b.inrule = b.InRoute("rule")
 	b.clear = b.InRoute("clear")
+	b.queryrule = b.QueryRoute("rule")
+	b.querypending = b.QueryRoute("pending")
 	b.quit = b.Quit()
 	b.out = b.Broadcast()
 }
 
+// joinEntry is a message waiting on one side of a keyed join.
+type joinEntry struct {
+	key     string
+	msg     interface{}
+	arrived time.Time
+	matched bool
+}
+
+// joinSide holds the messages waiting on one side of a keyed join, both by
+// key and in the order they arrived, which is also the order they expire in.
+type joinSide struct {
+	byKey map[string][]*joinEntry
+	queue []*joinEntry
+}
+
+func newJoinSide() *joinSide {
+	return &joinSide{
+		byKey: make(map[string][]*joinEntry),
+	}
+}
+
+func (s *joinSide) add(e *joinEntry) {
+	s.byKey[e.key] = append(s.byKey[e.key], e)
+	s.queue = append(s.queue, e)
+}
+
+// shift removes the oldest message.
+func (s *joinSide) shift() *joinEntry {
+	e := s.queue[0]
+	s.queue = s.queue[1:]
+	entries := s.byKey[e.key]
+	for i, other := range entries {
+		if other == e {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	if len(entries) == 0 {
+		delete(s.byKey, e.key)
+	} else {
+		s.byKey[e.key] = entries
+	}
+	return e
+}
+
 func (b *Join) Run() {
+	var keyPathA, keyPathB, windowString string
+	var keyTreeA, keyTreeB *jee.TokenTree
+	mode := "zip"
+	window := time.Minute
+	windowString = "1m"
+	maxPending := 1000
+
 	A := make(blocks.MsgChan, 1000)
 	B := make(blocks.MsgChan, 1000)
+
+	sideA := newJoinSide()
+	sideB := newJoinSide()
+
+	expireTimer := time.NewTimer(time.Duration(1) * time.Second)
+	expireTimer.Stop()
+
+	// unmatched emits a message that never found a partner, if the mode
+	// asks for it
+	unmatched := func(e *joinEntry, isA bool) {
+		if e.matched || mode == "inner" || (mode == "left" && !isA) {
+			return
+		}
+		out := map[string]interface{}{
+			"A":   nil,
+			"B":   nil,
+			"Key": e.key,
+		}
+		if isA {
+			out["A"] = e.msg
+		} else {
+			out["B"] = e.msg
+		}
+		b.out <- out
+	}
+
+	// expire lets go of messages that have been waiting longer than the
+	// window, or that don't fit
+	expire := func(now time.Time) {
+		for _, side := range []*joinSide{sideA, sideB} {
+			for len(side.queue) > 0 && (len(side.queue) > maxPending || !side.queue[0].arrived.Add(window).After(now)) {
+				unmatched(side.shift(), side == sideA)
+			}
+		}
+		// wake up when the next message is due to expire
+		next := time.Time{}
+		for _, side := range []*joinSide{sideA, sideB} {
+			if len(side.queue) > 0 && (next.IsZero() || side.queue[0].arrived.Before(next)) {
+				next = side.queue[0].arrived
+			}
+		}
+		expireTimer.Stop()
+		if !next.IsZero() {
+			expireTimer.Reset(next.Add(window).Sub(now))
+		}
+	}
+
+	// arrive matches a message against everything waiting on the other side
+	// with the same key, then waits for anything still to come
+	arrive := func(msg interface{}, tree *jee.TokenTree, side, other *joinSide) {
+		kI, err := jee.Eval(tree, msg)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		if kI == nil {
+			b.Error(errors.New("could not find a key to join on"))
+			return
+		}
+		key, err := countKey(kI)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		now := time.Now()
+		e := &joinEntry{
+			key:     key,
+			msg:     msg,
+			arrived: now,
+		}
+		for _, o := range other.byKey[key] {
+			e.matched = true
+			o.matched = true
+			out := map[string]interface{}{
+				"A":   msg,
+				"B":   o.msg,
+				"Key": key,
+			}
+			if side == sideB {
+				out["A"], out["B"] = o.msg, msg
+			}
+			b.out <- out
+		}
+		side.add(e)
+		expire(now)
+	}
+
+	clearAll := func() {
+	Clear:
+		for {
+			select {
+			case <-A:
+			case <-B:
+			default:
+				break Clear
+			}
+		}
+		sideA = newJoinSide()
+		sideB = newJoinSide()
+		expireTimer.Stop()
+	}
+
 	for {
 		select {
+		case ruleI := <-b.inrule:
+			newMode := "zip"
+			var err error
+			if util.KeyExists(ruleI, "Mode") {
+				newMode, err = util.ParseString(ruleI, "Mode")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newMode != "zip" && newMode != "inner" && newMode != "left" && newMode != "outer" {
+				b.Error(errors.New("Mode must be one of zip, inner, left or outer"))
+				continue
+			}
+			newKeyPathA, _ := util.ParseString(ruleI, "KeyPathA")
+			newKeyPathB, _ := util.ParseString(ruleI, "KeyPathB")
+			var newKeyTreeA, newKeyTreeB *jee.TokenTree
+			if newMode != "zip" {
+				newKeyTreeA, err = util.BuildTokenTree(newKeyPathA)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				newKeyTreeB, err = util.BuildTokenTree(newKeyPathB)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newWindowString := "1m"
+			if util.KeyExists(ruleI, "Window") {
+				newWindowString, err = util.ParseString(ruleI, "Window")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newWindow, err := time.ParseDuration(newWindowString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if newWindow <= 0 {
+				b.Error(errors.New("Window must be greater than zero"))
+				continue
+			}
+			newMaxPending := 1000.0
+			if util.KeyExists(ruleI, "MaxPending") {
+				newMaxPending, err = util.ParseFloat(ruleI, "MaxPending")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newMaxPending < 1 {
+				b.Error(errors.New("MaxPending must be at least 1"))
+				continue
+			}
+
+			mode = newMode
+			keyPathA = newKeyPathA
+			keyPathB = newKeyPathB
+			keyTreeA = newKeyTreeA
+			keyTreeB = newKeyTreeB
+			windowString = newWindowString
+			window = newWindow
+			maxPending = int(newMaxPending)
+			clearAll()
 		case <-b.quit:
 			return
 		case msg := <-b.inA:
+			if mode != "zip" {
+				arrive(msg, keyTreeA, sideA, sideB)
+				continue
+			}
 			select {
 			case A <- msg:
 			default:
 				b.Error("the A queue is overflowing")
 			}
 		case msg := <-b.inB:
+			if mode != "zip" {
+				arrive(msg, keyTreeB, sideB, sideA)
+				continue
+			}
 			select {
 			case B <- msg:
 			default:
 				b.Error("the B queue is overflowing")
 			}
+		case <-expireTimer.C:
+			expire(time.Now())
 		case <-b.clear:
-		Clear:
-			for {
-				select {
-				case <-A:
-				case <-B:
-				default:
-					break Clear
-				}
+			clearAll()
+		case c := <-b.queryrule:
+			c <- map[string]interface{}{
+				"Mode":       mode,
+				"KeyPathA":   keyPathA,
+				"KeyPathB":   keyPathB,
+				"Window":     windowString,
+				"MaxPending": float64(maxPending),
+			}
+		case c := <-b.querypending:
+			pendingA, pendingB := len(A), len(B)
+			if mode != "zip" {
+				pendingA, pendingB = len(sideA.queue), len(sideB.queue)
+			}
+			c <- map[string]interface{}{
+				"A": float64(pendingA),
+				"B": float64(pendingB),
 			}
 		}
 		for len(A) > 0 && len(B) > 0 {
@@ -2,8 +2,9 @@ package library
 
 import (
 	"errors"
+	"sort"
+	"time"
 
-	"github.com/jasoncapehart/go-sgd"          //sgd
 	"github.com/nytlabs/gojee"                 // jee
 	"github.com/nytlabs/streamtools/st/blocks" // blocks
 	"github.com/nytlabs/streamtools/st/util"
@@ -11,12 +12,14 @@ import (
 
 type Learn struct {
 	blocks.Block
-	queryrule chan blocks.MsgChan
-	inrule    blocks.MsgChan
-	inpoll    blocks.MsgChan
-	in        blocks.MsgChan
-	out       blocks.MsgChan
-	quit      blocks.MsgChan
+	queryrule        chan blocks.MsgChan
+	queryparams      chan blocks.MsgChan
+	queryparamparams chan blocks.Query
+	inrule           blocks.MsgChan
+	inpoll           blocks.MsgChan
+	in               blocks.MsgChan
+	out              blocks.MsgChan
+	quit             blocks.MsgChan
 }
 
 // a bit of boilerplate for streamtools
@@ -26,112 +29,195 @@ func NewLearn() blocks.BlockInterface {
 
 func (b *Learn) Setup() {
 	b.Kind = "Stats"
-	b.Desc = "applies stochastic gradient descent to learn the relationship between features and response"
+	b.Desc = "applies stochastic gradient descent to learn the relationship between features and response, emitting parameters that can be sent straight to the rule of a linearModel or logisticModel"
 	b.in = b.InRoute("in")
 	b.inrule = b.InRoute("rule")
 	b.inpoll = b.InRoute("poll")
 	b.queryrule = b.QueryRoute("rule")
+	b.queryparams = b.QueryRoute("params")
+	b.queryparamparams = b.QueryParamRoute("params")
 	b.quit = b.Quit()
 	b.out = b.Broadcast()
 }
 
 func (b *Learn) Run() {
 
-	dataChan := make(chan sgd.Obs)
-	paramChan := make(chan sgd.Params)
-	stateChan := make(chan chan []float64)
-	kernelQuitChan := make(chan bool)
-
-	lossfuncs := map[string]sgd.LossFunc{
-		"linear":   sgd.GradLinearLoss,
-		"logistic": sgd.GradLogisticLoss,
-	}
-	stepfuncs := map[string]sgd.StepFunc{
-		"inverse":  sgd.EtaInverse,
-		"constant": sgd.EtaConstant,
-		"bottou":   sgd.EtaBottou,
-	}
-	kernelStarted := false
-
-	var responsePath, lossfuncString, stepfuncString string
+	var responsePath, keyPath, emitString string
 	var featurePaths []string
 	var θ_0 []float64
 	var featureTrees []*jee.TokenTree
-	var responseTree *jee.TokenTree
-	var err error
+	var responseTree, keyTree *jee.TokenTree
+	var config sgdConfig
+
+	models := make(map[string]*sgdModel)
+
+	emitTicker := time.NewTicker(time.Duration(1) * time.Second)
+	emitTicker.Stop()
+
+	// params describes the model for one key, ready for a model block's rule
+	params := func(key string, m *sgdModel) map[string]interface{} {
+		p := m.params(featurePaths)
+		if keyTree != nil {
+			p["KeyPath"] = keyPath
+			p["Key"] = key
+		}
+		return p
+	}
+
+	emit := func() {
+		keys := make([]string, 0, len(models))
+		for key := range models {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			b.out <- params(key, models[key])
+		}
+	}
 
 	for {
-	Loop:
 		select {
 		case rule := <-b.inrule:
-			if kernelStarted {
-				// if we already have a rule, then we've already started a
-				// kernel, which we should now quit.
-				kernelQuitChan <- true
+			newFeaturePaths, err := util.ParseArrayString(rule, "FeaturePaths")
+			if err != nil {
+				b.Error(err)
+				continue
 			}
-
-			featurePaths, err = util.ParseArrayString(rule, "FeaturePaths")
+			newFeatureTrees, err := buildFeatureTrees(newFeaturePaths)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newResponsePath, err := util.ParseRequiredString(rule, "ResponsePath")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newResponseTree, err := util.BuildTokenTree(newResponsePath)
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-			featureTrees = make([]*jee.TokenTree, len(featurePaths))
-			for i, path := range featurePaths {
-				token, err := jee.Lexer(path)
+			newKeyPath, _ := util.ParseString(rule, "KeyPath")
+			var newKeyTree *jee.TokenTree
+			if newKeyPath != "" {
+				newKeyTree, err = util.BuildTokenTree(newKeyPath)
 				if err != nil {
 					b.Error(err)
-					break
+					continue
 				}
-				tree, err := jee.Parser(token)
+			}
+
+			newConfig := sgdConfig{loss: "linear", step: "inverse"}
+			if util.KeyExists(rule, "Lossfunc") {
+				newConfig.loss, err = util.ParseString(rule, "Lossfunc")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newConfig.loss != "linear" && newConfig.loss != "logistic" {
+				b.Error(errors.New("Unknown loss function: " + newConfig.loss))
+				continue
+			}
+			if util.KeyExists(rule, "Stepfunc") {
+				newConfig.step, err = util.ParseString(rule, "Stepfunc")
 				if err != nil {
 					b.Error(err)
-					break
+					continue
 				}
-				featureTrees[i] = tree
 			}
-			responsePath, err = util.ParseString(rule, "ResponsePath")
+			if newConfig.step != "inverse" && newConfig.step != "constant" && newConfig.step != "bottou" {
+				b.Error(errors.New("Unknown step function: " + newConfig.step))
+				continue
+			}
+
+			// every number is optional and falls back to its default
+			parseNumber := func(key string, def float64) (float64, error) {
+				if !util.KeyExists(rule, key) {
+					return def, nil
+				}
+				v, err := util.ParseFloat(rule, key)
+				if err == nil && v < 0 {
+					err = errors.New(key + " cannot be negative")
+				}
+				return v, err
+			}
+			newConfig.learningRate, err = parseNumber("LearningRate", 1)
 			if err != nil {
 				b.Error(err)
-				break
+				continue
 			}
-			token, err := jee.Lexer(responsePath)
+			newConfig.l1, err = parseNumber("L1", 0)
 			if err != nil {
 				b.Error(err)
-				break
+				continue
 			}
-			responseTree, err = jee.Parser(token)
+			newConfig.l2, err = parseNumber("L2", 0)
 			if err != nil {
 				b.Error(err)
-				break
+				continue
 			}
-			lossfuncString, err = util.ParseString(rule, "Lossfunc")
+			batchSize, err := parseNumber("BatchSize", 1)
 			if err != nil {
 				b.Error(err)
-				break
+				continue
 			}
-			stepfuncString, err = util.ParseString(rule, "Stepfunc")
+			newConfig.batchSize = int(batchSize)
+			newConfig.metricWindow, err = parseNumber("MetricWindow", 100)
 			if err != nil {
 				b.Error(err)
-				break
+				continue
 			}
-			grad, ok := lossfuncs[lossfuncString]
-			if !ok {
-				b.Error(errors.New("Unknown loss function: " + lossfuncString))
+			if newConfig.batchSize < 1 || newConfig.metricWindow < 1 {
+				b.Error(errors.New("BatchSize and MetricWindow must be at least 1"))
+				continue
 			}
-			step, ok := stepfuncs[stepfuncString]
-			if !ok {
-				b.Error(errors.New("Unknown step function: " + stepfuncString))
+
+			newθ_0 := make([]float64, len(newFeaturePaths))
+			if util.KeyExists(rule, "InitialState") {
+				newθ_0, err = util.ParseArrayFloat(rule, "InitialState")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
 			}
-			θ_0, err = util.ParseArrayFloat(rule, "InitialState")
-			if err != nil {
-				b.Error(err)
-				break
+			if len(newθ_0) != len(newFeaturePaths) {
+				b.Error(errors.New("InitialState must have one value for each feature"))
+				continue
+			}
+
+			newEmitString, _ := util.ParseString(rule, "EmitInterval")
+			newEmit := time.Duration(0)
+			if newEmitString != "" {
+				newEmit, err = time.ParseDuration(newEmitString)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			featurePaths = newFeaturePaths
+			featureTrees = newFeatureTrees
+			responsePath = newResponsePath
+			responseTree = newResponseTree
+			keyPath = newKeyPath
+			keyTree = newKeyTree
+			config = newConfig
+			θ_0 = newθ_0
+			emitString = newEmitString
+			models = make(map[string]*sgdModel)
+			if keyTree == nil {
+				models[""] = newSGDModel(config, θ_0)
+			}
+
+			emitTicker.Stop()
+			if newEmit > 0 {
+				emitTicker = time.NewTicker(newEmit)
 			}
-			go sgd.SgdKernel(dataChan, paramChan, stateChan, kernelQuitChan, grad, step, θ_0)
-			kernelStarted = true
 
 		case <-b.quit:
-			kernelQuitChan <- true
+			emitTicker.Stop()
 			return
 		case msg := <-b.in:
 			if featureTrees == nil {
@@ -140,57 +226,83 @@ func (b *Learn) Run() {
 			if responseTree == nil {
 				continue
 			}
-			x := make([]float64, len(featureTrees))
-			for i, tree := range featureTrees {
-				feature, err := jee.Eval(tree, msg)
-				if err != nil {
-					b.Error(err)
-					break Loop
-				}
-				fi, ok := feature.(float64)
-				if !ok {
-					b.Error(errors.New("features must be float64"))
-					break Loop
-				}
-				x[i] = fi
+			x, err := extractFeatures(featureTrees, msg)
+			if err != nil {
+				b.Error(err)
+				continue
 			}
 			responseI, err := jee.Eval(responseTree, msg)
 			if err != nil {
 				b.Error(err)
-				break
+				continue
 			}
 			y, ok := responseI.(float64)
 			if !ok {
 				b.Error(errors.New("response must be float64"))
-				break
+				continue
+			}
+			key := ""
+			if keyTree != nil {
+				k, err := jee.Eval(keyTree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				key, err = countKey(k)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
 			}
-			d := sgd.Obs{
-				X: x,
-				Y: y,
+			m, ok := models[key]
+			if !ok {
+				m = newSGDModel(config, θ_0)
+				models[key] = m
 			}
-			dataChan <- d
+			m.observe(x, y)
 		case <-b.inpoll:
-			var params []interface{}
-			var model []float64
-			if kernelStarted {
-				kernelMsgChan := make(chan []float64)
-				stateChan <- kernelMsgChan
-				model = <-kernelMsgChan
-				params = make([]interface{}, len(model))
-				for i, p := range model {
-					params[i] = p
+			emit()
+		case <-emitTicker.C:
+			emit()
+		case c := <-b.queryparams:
+			if keyTree == nil {
+				m, ok := models[""]
+				if !ok {
+					c <- map[string]interface{}{}
+					continue
 				}
+				c <- params("", m)
+				continue
 			}
-			b.out <- map[string]interface{}{
-				"params": params,
+			keys := make(map[string]interface{})
+			for key, m := range models {
+				keys[key] = params(key, m)
+			}
+			c <- map[string]interface{}{
+				"Keys": keys,
+			}
+		case q := <-b.queryparamparams:
+			key := q.Params.Get("key")
+			m, ok := models[key]
+			if !ok {
+				q.RespChan <- map[string]interface{}{}
+				continue
 			}
+			q.RespChan <- params(key, m)
 		case c := <-b.queryrule:
 			c <- map[string]interface{}{
-				"Lossfunc":     lossfuncString,
-				"Stepfunc":     stepfuncString,
+				"Lossfunc":     config.loss,
+				"Stepfunc":     config.step,
 				"FeaturePaths": featurePaths,
 				"ResponsePath": responsePath,
 				"InitialState": θ_0,
+				"KeyPath":      keyPath,
+				"LearningRate": config.learningRate,
+				"L1":           config.l1,
+				"L2":           config.l2,
+				"BatchSize":    float64(config.batchSize),
+				"MetricWindow": config.metricWindow,
+				"EmitInterval": emitString,
 			}
 		}
 	}
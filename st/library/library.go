@@ -7,20 +7,29 @@ import (
 )
 
 var Blocks = map[string]func() blocks.BlockInterface{
+	"anomaly":            NewAnomaly,
 	"bang":               NewBang,
+	"bloomdedupe":        NewBloomDeDupe,
 	"cache":              NewCache,
+	"cardinality":        NewCardinality,
 	"categorical":        NewCategorical,
 	"count":              NewCount,
+	"decode":             NewDecode,
 	"dedupe":             NewDeDupe,
+	"delay":              NewDelay,
+	"encode":             NewEncode,
+	"enrich":             NewEnrich,
 	"fft":                NewFFT,
 	"filter":             NewFilter,
 	"fromamqp":           NewFromAMQP,
+	"fromdirectory":      NewFromDirectory,
 	"fromemail":          NewFromEmail,
 	"fromfile":           NewFromFile,
 	"fromHTTPGetRequest": NewFromHTTPGetRequest,
 	"fromhttpstream":     NewFromHTTPStream,
 	"fromnsq":            NewFromNSQ,
 	"frompost":           NewFromPost,
+	"fromsql":            NewFromSQL,
 	"fromsqs":            NewFromSQS,
 	"fromwebsocket":      NewFromWebsocket,
 	"fromudp":            NewFromUDP,
@@ -38,15 +47,21 @@ var Blocks = map[string]func() blocks.BlockInterface{
 	"packbycount":        NewPackByCount,
 	"packbyinterval":     NewPackByInterval,
 	"packbyvalue":        NewPackByValue,
+	"parse":              NewParse,
 	"parsecsv":           NewParseCSV,
 	"parsexml":           NewParseXML,
 	"poisson":            NewPoisson,
 	"javascript":         NewJavascript,
+	"quantiles":          NewQuantiles,
 	"queue":              NewQueue,
 	"redis":              NewRedis,
 	"set":                NewSet,
+	"switch":             NewSwitch,
 	"sync":               NewSync,
+	"template":           NewTemplate,
+	"throttle":           NewThrottle,
 	"ticker":             NewTicker,
+	"time":               NewTime,
 	"timeseries":         NewTimeseries,
 	"toamqp":             NewToAMQP,
 	"tobeanstalkd":       NewToBeanstalkd,
@@ -59,8 +74,13 @@ var Blocks = map[string]func() blocks.BlockInterface{
 	"tomongodb":          NewToMongoDB,
 	"tonsq":              NewToNSQ,
 	"tonsqmulti":         NewToNSQMulti,
+	"topk":               NewTopK,
+	"tos3":               NewToS3,
+	"tosql":              NewToSQL,
 	"unpack":             NewUnpack,
+	"validate":           NewValidate,
 	"webRequest":         NewWebRequest,
+	"window":             NewWindow,
 	"zipf":               NewZipf,
 	"exponential":        NewExponential,
 }
@@ -1,13 +1,9 @@
 package library
 
 import (
-	"errors"
-	"math"
 	"math/rand"
 
-	"github.com/nytlabs/gojee"                 // jee
 	"github.com/nytlabs/streamtools/st/blocks" // blocks
-	"github.com/nytlabs/streamtools/st/util"   // util
 )
 
 // specify those channels we're going to use to communicate with streamtools
@@ -35,70 +31,31 @@ func (b *LogisticModel) Setup() {
 	b.quit = b.Quit()
 	b.out = b.Broadcast()
 }
-func logit(x float64) float64 {
-	return 1 / (1 + math.Exp(-x))
-}
 
 // Run is the block's main loop. Here we listen on the different channels we set up.
 func (b *LogisticModel) Run() {
 
-	var β []float64
-	var featurePaths []string
-	var featureTrees []*jee.TokenTree
-	var err error
+	model := newModelRule()
 
 	for {
-	Loop:
 		select {
 		case rule := <-b.inrule:
-			β, err = util.ParseArrayFloat(rule, "Weights")
-			if err != nil {
-				b.Error(err)
-				continue
-			}
-			featurePaths, err = util.ParseArrayString(rule, "FeaturePaths")
+			err := model.set(rule)
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-			featureTrees = make([]*jee.TokenTree, len(featurePaths))
-			for i, path := range featurePaths {
-				token, err := jee.Lexer(path)
-				if err != nil {
-					b.Error(err)
-					break
-				}
-				tree, err := jee.Parser(token)
-				if err != nil {
-					b.Error(err)
-					break
-				}
-				featureTrees[i] = tree
-			}
 		case <-b.quit:
 			// quit the block
 			return
 		case msg := <-b.in:
-			if featureTrees == nil {
+			if model.featureTrees == nil {
 				continue
 			}
-			x := make([]float64, len(featureTrees))
-			for i, tree := range featureTrees {
-				feature, err := jee.Eval(tree, msg)
-				if err != nil {
-					b.Error(err)
-					break Loop
-				}
-				fi, ok := feature.(float64)
-				if !ok {
-					b.Error(errors.New("features must be float64"))
-					break Loop
-				}
-				x[i] = fi
-			}
-			μ := 0.0
-			for i, βi := range β {
-				μ += βi * x[i]
+			μ, err := model.apply(msg)
+			if err != nil {
+				b.Error(err)
+				continue
 			}
 			var y float64
 			if rand.Float64() <= logit(μ) {
@@ -109,14 +66,9 @@ func (b *LogisticModel) Run() {
 			b.out <- map[string]interface{}{
 				"Response": y,
 			}
-
 		case MsgChan := <-b.queryrule:
 			// deal with a query request
-			out := map[string]interface{}{
-				"Weights":      β,
-				"FeaturePaths": featurePaths,
-			}
-			MsgChan <- out
+			MsgChan <- model.query()
 		}
 	}
 }
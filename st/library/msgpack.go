@@ -0,0 +1,301 @@
+package library
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// decodeMsgpack reads a single MessagePack value. Binary data becomes a
+// base64 string, and timestamps an RFC3339 string.
+func decodeMsgpack(data []byte) (interface{}, error) {
+	r := &codecReader{data: data}
+	v, err := readMsgpack(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if r.left() != 0 {
+		return nil, errors.New("msgpack value is followed by more data")
+	}
+	return v, nil
+}
+
+func readMsgpackUint(r *codecReader, n uint64) (uint64, error) {
+	b, err := r.read(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func readMsgpack(r *codecReader, depth int) (interface{}, error) {
+	if depth > maxCodecDepth {
+		return nil, errors.New("msgpack data is nested too deeply")
+	}
+	c, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return float64(c), nil
+	case c >= 0xe0:
+		return float64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return readMsgpackMap(r, uint64(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return readMsgpackArray(r, uint64(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		b, err := r.read(uint64(c & 0x1f))
+		return string(b), err
+	}
+
+	// the rest say how many bytes their length or value takes
+	var size uint64
+	switch c {
+	case 0xc4, 0xc7, 0xcc, 0xd0, 0xd4, 0xd9:
+		size = 1
+	case 0xc5, 0xc8, 0xcd, 0xd1, 0xd5, 0xda, 0xdc, 0xde:
+		size = 2
+	case 0xc6, 0xc9, 0xca, 0xce, 0xd2, 0xd6, 0xdb, 0xdd, 0xdf:
+		size = 4
+	case 0xcb, 0xcf, 0xd3, 0xd7:
+		size = 8
+	case 0xd8:
+		size = 16
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xca:
+		u, err := readMsgpackUint(r, 4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := readMsgpackUint(r, 8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := readMsgpackUint(r, size)
+		return float64(u), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		u, err := readMsgpackUint(r, size)
+		if err != nil {
+			return nil, err
+		}
+		// sign extend from the size of the integer
+		shift := 64 - 8*size
+		return float64(int64(u<<shift) >> shift), nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := readMsgpackUint(r, size)
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.read(n)
+		return base64.StdEncoding.EncodeToString(b), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := readMsgpackUint(r, size)
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.read(n)
+		return string(b), err
+	case 0xdc, 0xdd:
+		n, err := readMsgpackUint(r, size)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, n, depth)
+	case 0xde, 0xdf:
+		n, err := readMsgpackUint(r, size)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, n, depth)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return readMsgpackExt(r, size)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := readMsgpackUint(r, size)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackExt(r, n)
+	}
+	return nil, errors.New("msgpack data has an unknown type")
+}
+
+func readMsgpackArray(r *codecReader, n uint64, depth int) (interface{}, error) {
+	// every value takes at least a byte
+	if n > uint64(r.left()) {
+		return nil, errCodecTruncated
+	}
+	out := make([]interface{}, n)
+	for i := range out {
+		v, err := readMsgpack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func readMsgpackMap(r *codecReader, n uint64, depth int) (interface{}, error) {
+	if n > uint64(r.left()) {
+		return nil, errCodecTruncated
+	}
+	out := make(map[string]interface{})
+	for i := uint64(0); i < n; i++ {
+		k, err := readMsgpack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readMsgpack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		out[codecKey(k)] = v
+	}
+	return out, nil
+}
+
+// readMsgpackExt reads extension types. Timestamps (type -1) are understood,
+// and anything else is given as {"type": ..., "data": ...}.
+func readMsgpackExt(r *codecReader, n uint64) (interface{}, error) {
+	typ, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	b, err := r.read(n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(typ) == -1 {
+		var t time.Time
+		switch n {
+		case 4:
+			t = time.Unix(int64(binary.BigEndian.Uint32(b)), 0)
+		case 8:
+			u := binary.BigEndian.Uint64(b)
+			t = time.Unix(int64(u&0x3ffffffff), int64(u>>34))
+		case 12:
+			t = time.Unix(int64(binary.BigEndian.Uint64(b[4:])), int64(binary.BigEndian.Uint32(b)))
+		default:
+			return nil, errors.New("msgpack timestamp has the wrong size")
+		}
+		return t.UTC().Format(time.RFC3339Nano), nil
+	}
+	return map[string]interface{}{
+		"type": float64(int8(typ)),
+		"data": base64.StdEncoding.EncodeToString(b),
+	}, nil
+}
+
+// encodeMsgpack writes a value as MessagePack, using the smallest encoding
+// for each number and writing whole numbers as integers.
+func encodeMsgpack(v interface{}) ([]byte, error) {
+	return appendMsgpack(nil, v, 0)
+}
+
+func appendMsgpackUint(out []byte, prefix byte, size int, u uint64) []byte {
+	out = append(out, prefix)
+	for i := size - 1; i >= 0; i-- {
+		out = append(out, byte(u>>(8*uint(i))))
+	}
+	return out
+}
+
+func appendMsgpackLength(out []byte, n int, fix, fixMax, prefix16, prefix32 byte) []byte {
+	switch {
+	case n <= int(fixMax):
+		return append(out, fix|byte(n))
+	case n <= math.MaxUint16:
+		return appendMsgpackUint(out, prefix16, 2, uint64(n))
+	}
+	return appendMsgpackUint(out, prefix32, 4, uint64(n))
+}
+
+func appendMsgpack(out []byte, v interface{}, depth int) ([]byte, error) {
+	if depth > maxCodecDepth {
+		return nil, errors.New("message is nested too deeply to encode")
+	}
+	v, err := codecValue(v)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case nil:
+		return append(out, 0xc0), nil
+	case bool:
+		if v {
+			return append(out, 0xc3), nil
+		}
+		return append(out, 0xc2), nil
+	case float64:
+		if !codecInt(v) {
+			return appendMsgpackUint(out, 0xcb, 8, math.Float64bits(v)), nil
+		}
+		i := int64(v)
+		switch {
+		case i >= 0 && i <= 0x7f:
+			return append(out, byte(i)), nil
+		case i < 0 && i >= -32:
+			return append(out, byte(i)), nil
+		case i >= 0 && i <= math.MaxUint8:
+			return appendMsgpackUint(out, 0xcc, 1, uint64(i)), nil
+		case i >= 0 && i <= math.MaxUint16:
+			return appendMsgpackUint(out, 0xcd, 2, uint64(i)), nil
+		case i >= 0 && i <= math.MaxUint32:
+			return appendMsgpackUint(out, 0xce, 4, uint64(i)), nil
+		case i >= 0:
+			return appendMsgpackUint(out, 0xcf, 8, uint64(i)), nil
+		case i >= math.MinInt8:
+			return appendMsgpackUint(out, 0xd0, 1, uint64(i)), nil
+		case i >= math.MinInt16:
+			return appendMsgpackUint(out, 0xd1, 2, uint64(i)), nil
+		case i >= math.MinInt32:
+			return appendMsgpackUint(out, 0xd2, 4, uint64(i)), nil
+		}
+		return appendMsgpackUint(out, 0xd3, 8, uint64(i)), nil
+	case string:
+		if len(v) <= math.MaxUint8 && len(v) > 31 {
+			out = appendMsgpackUint(out, 0xd9, 1, uint64(len(v)))
+		} else {
+			out = appendMsgpackLength(out, len(v), 0xa0, 31, 0xda, 0xdb)
+		}
+		return append(out, v...), nil
+	case []interface{}:
+		out = appendMsgpackLength(out, len(v), 0x90, 15, 0xdc, 0xdd)
+		for _, item := range v {
+			if out, err = appendMsgpack(out, item, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[string]interface{}:
+		out = appendMsgpackLength(out, len(v), 0x80, 15, 0xde, 0xdf)
+		for _, k := range sortedKeys(v) {
+			if out, err = appendMsgpack(out, k, depth+1); err != nil {
+				return nil, err
+			}
+			if out, err = appendMsgpack(out, v[k], depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, errors.New("cannot encode this value as msgpack")
+}
@@ -0,0 +1,302 @@
+package library
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Parse struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	out       blocks.MsgChan
+	failed    blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewParse() blocks.BlockInterface {
+	return &Parse{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Parse) Setup() {
+	b.Kind = "Parsers"
+	b.Desc = "extracts fields from a line of text using a regular expression, a grok pattern, logfmt or key=value pairs, and adds them to the message"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+	b.failed = b.OutRoute("failed")
+}
+
+// coerceField gives a parsed string the type asked for. auto makes numbers
+// and booleans of anything that looks like them.
+func coerceField(s string, typ string) (interface{}, error) {
+	switch typ {
+	case "string", "":
+		return s, nil
+	case "int":
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return float64(i), nil
+	case "float":
+		return strconv.ParseFloat(s, 64)
+	case "bool":
+		return strconv.ParseBool(s)
+	case "auto":
+		if s == "true" || s == "false" {
+			return s == "true", nil
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, nil
+		}
+		return s, nil
+	}
+	return nil, errors.New("unknown type " + typ)
+}
+
+// parseStringMap reads a rule like {"bytes": "int"} into a map of strings.
+func parseStringMap(ruleI interface{}, key string) (map[string]string, error) {
+	out := make(map[string]string)
+	mI, ok := ruleI.(map[string]interface{})[key]
+	if !ok || mI == nil {
+		return out, nil
+	}
+	m, ok := mI.(map[string]interface{})
+	if !ok {
+		return nil, errors.New(key + " must be an object of strings")
+	}
+	for k, vI := range m {
+		v, ok := vI.(string)
+		if !ok {
+			return nil, errors.New(key + " must be an object of strings")
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Parse) Run() {
+	var pattern, outputPath string
+	var re *regexp.Regexp
+	var grok *grokExpression
+	types := map[string]string{}
+	patterns := map[string]string{}
+	format := "grok"
+	path := ".data"
+	tree, _ := util.BuildTokenTree(path)
+	separator := " "
+	delimiter := "="
+
+	fail := func(msg interface{}, err error) {
+		b.failed <- map[string]interface{}{
+			"msg":   msg,
+			"error": err.Error(),
+		}
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newFormat := "grok"
+			var err error
+			if util.KeyExists(ruleI, "Format") {
+				newFormat, err = util.ParseString(ruleI, "Format")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newPattern, _ := util.ParseString(ruleI, "Pattern")
+			newPatterns, err := parseStringMap(ruleI, "Patterns")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			var newRe *regexp.Regexp
+			var newGrok *grokExpression
+			switch newFormat {
+			case "regex":
+				newRe, err = regexp.Compile(newPattern)
+			case "grok":
+				newGrok, err = compileGrok(newPattern, newPatterns)
+			case "logfmt", "kv":
+			default:
+				err = errors.New("Format must be one of regex, grok, logfmt or kv")
+			}
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if (newFormat == "regex" || newFormat == "grok") && newPattern == "" {
+				b.Error(errors.New(newFormat + " needs a Pattern"))
+				continue
+			}
+			newPath := ".data"
+			if util.KeyExists(ruleI, "Path") {
+				newPath, err = util.ParseRequiredString(ruleI, "Path")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newTree, err := util.BuildTokenTree(newPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newOutputPath, _ := util.ParseString(ruleI, "OutputPath")
+			newTypes, err := parseStringMap(ruleI, "Types")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			for _, typ := range newTypes {
+				switch typ {
+				case "int", "float", "bool", "string", "auto":
+				default:
+					err = errors.New("Types must be int, float, bool, string or auto")
+				}
+			}
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newSeparator := " "
+			if util.KeyExists(ruleI, "Separator") {
+				newSeparator, err = util.ParseRequiredString(ruleI, "Separator")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newDelimiter := "="
+			if util.KeyExists(ruleI, "Delimiter") {
+				newDelimiter, err = util.ParseRequiredString(ruleI, "Delimiter")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			format = newFormat
+			pattern = newPattern
+			patterns = newPatterns
+			re = newRe
+			grok = newGrok
+			path = newPath
+			tree = newTree
+			outputPath = newOutputPath
+			types = newTypes
+			separator = newSeparator
+			delimiter = newDelimiter
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case msg := <-b.in:
+			if format == "grok" && grok == nil {
+				continue
+			}
+			in, ok := msg.(map[string]interface{})
+			if !ok {
+				fail(msg, errors.New("can only parse messages that are objects"))
+				continue
+			}
+			lineI, err := jee.Eval(tree, msg)
+			if err != nil {
+				fail(msg, err)
+				continue
+			}
+			line, ok := lineI.(string)
+			if !ok {
+				fail(msg, errors.New("could not find a string at "+path))
+				continue
+			}
+
+			var fields map[string]interface{}
+			fieldTypes := map[string]string{}
+			switch format {
+			case "regex":
+				fields, ok = matchNamed(re, line)
+				if !ok {
+					err = errors.New("line does not match the pattern")
+				}
+			case "grok":
+				fields, ok = grok.match(line)
+				if !ok {
+					err = errors.New("line does not match the pattern")
+				}
+				for field, typ := range grok.types {
+					fieldTypes[field] = typ
+				}
+			case "logfmt":
+				fields, err = parseLogfmt(line)
+			case "kv":
+				fields, err = parseKV(line, separator, delimiter)
+			}
+			if err != nil {
+				fail(msg, err)
+				continue
+			}
+
+			// types in the rule win over types in the pattern
+			for field, typ := range types {
+				fieldTypes[field] = typ
+			}
+			for field, typ := range fieldTypes {
+				s, ok := fields[field].(string)
+				if !ok {
+					continue
+				}
+				fields[field], err = coerceField(s, typ)
+				if err != nil {
+					err = errors.New("could not make " + field + " a " + typ + ": " + err.Error())
+					break
+				}
+			}
+			if err != nil {
+				fail(msg, err)
+				continue
+			}
+
+			// copy the message rather than change one other blocks may hold
+			out := recCopy(in)
+			if outputPath == "" {
+				for field, v := range fields {
+					out[field] = v
+				}
+			} else if err := setPath(out, outputPath, fields); err != nil {
+				fail(msg, err)
+				continue
+			}
+			b.out <- out
+
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Format":     format,
+				"Pattern":    pattern,
+				"Patterns":   patterns,
+				"Path":       path,
+				"OutputPath": outputPath,
+				"Types":      types,
+				"Separator":  separator,
+				"Delimiter":  delimiter,
+			}
+		}
+	}
+}
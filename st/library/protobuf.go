@@ -0,0 +1,742 @@
+package library
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// protobuf field types, as numbered in descriptor.proto
+const (
+	protoTypeDouble   = 1
+	protoTypeFloat    = 2
+	protoTypeInt64    = 3
+	protoTypeUint64   = 4
+	protoTypeInt32    = 5
+	protoTypeFixed64  = 6
+	protoTypeFixed32  = 7
+	protoTypeBool     = 8
+	protoTypeString   = 9
+	protoTypeGroup    = 10
+	protoTypeMessage  = 11
+	protoTypeBytes    = 12
+	protoTypeUint32   = 13
+	protoTypeEnum     = 14
+	protoTypeSfixed32 = 15
+	protoTypeSfixed64 = 16
+	protoTypeSint32   = 17
+	protoTypeSint64   = 18
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireStart   = 3
+	wireEnd     = 4
+	wireFixed32 = 5
+)
+
+// protoMessage describes a message type, read from a descriptor set made by
+// protoc --descriptor_set_out.
+type protoMessage struct {
+	name     string
+	fields   map[uint64]*protoField
+	ordered  []*protoField
+	byName   map[string]*protoField
+	mapEntry bool
+}
+
+type protoField struct {
+	name     string
+	jsonName string
+	number   uint64
+	repeated bool
+	typ      uint64
+	typeName string
+	packed   bool
+	message  *protoMessage
+	enum     *protoEnum
+}
+
+type protoEnum struct {
+	names   map[int64]string
+	numbers map[string]int64
+}
+
+// protoFields reads the fields of an encoded message, keeping the raw
+// bytes of length delimited ones. It's all that's needed to read
+// descriptors, which are themselves protobuf messages.
+func protoFields(data []byte, each func(number uint64, wire uint64, v uint64, b []byte) error) error {
+	r := &codecReader{data: data}
+	for r.left() > 0 {
+		key, err := r.readUvarint()
+		if err != nil {
+			return err
+		}
+		number, wire := key>>3, key&7
+		var v uint64
+		var b []byte
+		switch wire {
+		case wireVarint:
+			v, err = r.readUvarint()
+		case wireFixed64:
+			b, err = r.read(8)
+			if err == nil {
+				v = binary.LittleEndian.Uint64(b)
+			}
+		case wireFixed32:
+			b, err = r.read(4)
+			if err == nil {
+				v = uint64(binary.LittleEndian.Uint32(b))
+			}
+		case wireBytes:
+			var n uint64
+			n, err = r.readUvarint()
+			if err == nil {
+				b, err = r.read(n)
+			}
+		case wireStart:
+			if err = skipProtoGroup(r, number, 0); err != nil {
+				return err
+			}
+			continue
+		default:
+			err = errors.New("protobuf data has an unknown wire type")
+		}
+		if err != nil {
+			return err
+		}
+		if err := each(number, wire, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipProtoGroup passes over a group, which old protobufs used for nested
+// messages.
+func skipProtoGroup(r *codecReader, number uint64, depth int) error {
+	if depth > maxCodecDepth {
+		return errors.New("protobuf data is nested too deeply")
+	}
+	for {
+		key, err := r.readUvarint()
+		if err != nil {
+			return err
+		}
+		switch key & 7 {
+		case wireVarint:
+			_, err = r.readUvarint()
+		case wireFixed64:
+			_, err = r.read(8)
+		case wireFixed32:
+			_, err = r.read(4)
+		case wireBytes:
+			var n uint64
+			n, err = r.readUvarint()
+			if err == nil {
+				_, err = r.read(n)
+			}
+		case wireStart:
+			err = skipProtoGroup(r, key>>3, depth+1)
+		case wireEnd:
+			if key>>3 != number {
+				return errors.New("protobuf group ends with the wrong field")
+			}
+			return nil
+		default:
+			err = errors.New("protobuf data has an unknown wire type")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseProtoDescriptorSet reads a FileDescriptorSet and finds the message
+// type with the given name, like "shop.Order".
+func parseProtoDescriptorSet(data []byte, messageType string) (*protoMessage, error) {
+	messages := make(map[string]*protoMessage)
+	enums := make(map[string]*protoEnum)
+	var fields []*protoField
+	// fields that say whether they're packed, rather than using the default
+	packedSet := make(map[*protoField]bool)
+
+	var readEnum func(data []byte, scope string) error
+	readEnum = func(data []byte, scope string) error {
+		var name string
+		enum := &protoEnum{
+			names:   make(map[int64]string),
+			numbers: make(map[string]int64),
+		}
+		err := protoFields(data, func(number, wire, v uint64, b []byte) error {
+			switch {
+			case number == 1 && wire == wireBytes:
+				name = string(b)
+			case number == 2 && wire == wireBytes:
+				var valueName string
+				var valueNumber int64
+				err := protoFields(b, func(number, wire, v uint64, b []byte) error {
+					switch {
+					case number == 1 && wire == wireBytes:
+						valueName = string(b)
+					case number == 2 && wire == wireVarint:
+						valueNumber = int64(int32(v))
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				if _, ok := enum.names[valueNumber]; !ok {
+					enum.names[valueNumber] = valueName
+				}
+				enum.numbers[valueName] = valueNumber
+			}
+			return nil
+		})
+		enums[scope+"."+name] = enum
+		return err
+	}
+
+	var readMessage func(data []byte, scope string) error
+	readMessage = func(data []byte, scope string) error {
+		var name string
+		var nested, nestedEnums, fieldData [][]byte
+		m := &protoMessage{
+			fields: make(map[uint64]*protoField),
+			byName: make(map[string]*protoField),
+		}
+		err := protoFields(data, func(number, wire, v uint64, b []byte) error {
+			if wire != wireBytes {
+				return nil
+			}
+			switch number {
+			case 1:
+				name = string(b)
+			case 2:
+				fieldData = append(fieldData, b)
+			case 3:
+				nested = append(nested, b)
+			case 4:
+				nestedEnums = append(nestedEnums, b)
+			case 7:
+				// MessageOptions, where map_entry is field 7
+				return protoFields(b, func(number, wire, v uint64, b []byte) error {
+					if number == 7 && wire == wireVarint {
+						m.mapEntry = v != 0
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		m.name = strings.TrimPrefix(scope+"."+name, ".")
+		messages[scope+"."+name] = m
+		for _, b := range fieldData {
+			f := &protoField{}
+			err := protoFields(b, func(number, wire, v uint64, b []byte) error {
+				switch {
+				case number == 1 && wire == wireBytes:
+					f.name = string(b)
+				case number == 3 && wire == wireVarint:
+					f.number = v
+				case number == 4 && wire == wireVarint:
+					f.repeated = v == 3
+				case number == 5 && wire == wireVarint:
+					f.typ = v
+				case number == 6 && wire == wireBytes:
+					f.typeName = string(b)
+				case number == 10 && wire == wireBytes:
+					f.jsonName = string(b)
+				case number == 8 && wire == wireBytes:
+					// FieldOptions, where packed is field 2
+					return protoFields(b, func(number, wire, v uint64, b []byte) error {
+						if number == 2 && wire == wireVarint {
+							f.packed = v != 0
+							packedSet[f] = true
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			m.fields[f.number] = f
+			m.byName[f.name] = f
+			if f.jsonName != "" {
+				m.byName[f.jsonName] = f
+			}
+			m.ordered = append(m.ordered, f)
+			fields = append(fields, f)
+		}
+		sort.Sort(protoFieldsByNumber(m.ordered))
+		for _, b := range nested {
+			if err := readMessage(b, scope+"."+name); err != nil {
+				return err
+			}
+		}
+		for _, b := range nestedEnums {
+			if err := readEnum(b, scope+"."+name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// proto2 files only pack fields that ask to be, so note which fields
+	// came from them
+	proto2 := make(map[*protoField]bool)
+	err := protoFields(data, func(number, wire, v uint64, b []byte) error {
+		if number != 1 || wire != wireBytes {
+			return nil
+		}
+		var pkg, syntax string
+		var messageData, enumData [][]byte
+		err := protoFields(b, func(number, wire, v uint64, b []byte) error {
+			if wire != wireBytes {
+				return nil
+			}
+			switch number {
+			case 2:
+				pkg = string(b)
+			case 4:
+				messageData = append(messageData, b)
+			case 5:
+				enumData = append(enumData, b)
+			case 12:
+				syntax = string(b)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		scope := ""
+		if pkg != "" {
+			scope = "." + pkg
+		}
+		before := len(fields)
+		for _, b := range messageData {
+			if err := readMessage(b, scope); err != nil {
+				return err
+			}
+		}
+		for _, b := range enumData {
+			if err := readEnum(b, scope); err != nil {
+				return err
+			}
+		}
+		if syntax != "proto3" {
+			for _, f := range fields[before:] {
+				proto2[f] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("could not read the descriptor set: " + err.Error())
+	}
+
+	// now every type is known, point fields at the types they refer to
+	for _, f := range fields {
+		switch f.typ {
+		case protoTypeMessage, protoTypeGroup:
+			f.message = messages[f.typeName]
+			if f.message == nil {
+				return nil, errors.New("descriptor set is missing the message type " + f.typeName)
+			}
+		case protoTypeEnum:
+			f.enum = enums[f.typeName]
+			if f.enum == nil {
+				return nil, errors.New("descriptor set is missing the enum type " + f.typeName)
+			}
+		}
+		if !packedSet[f] {
+			// proto3 packs repeated numbers unless told not to, proto2 doesn't
+			f.packed = !proto2[f]
+		}
+	}
+	m, ok := messages["."+strings.TrimPrefix(messageType, ".")]
+	if !ok {
+		return nil, errors.New("descriptor set has no message type " + messageType)
+	}
+	return m, nil
+}
+
+type protoFieldsByNumber []*protoField
+
+func (p protoFieldsByNumber) Len() int           { return len(p) }
+func (p protoFieldsByNumber) Less(i, j int) bool { return p[i].number < p[j].number }
+func (p protoFieldsByNumber) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// decode reads an encoded message into an object keyed by field name.
+// Fields that aren't in the data are left out, as are unknown fields.
+func (m *protoMessage) decode(data []byte) (interface{}, error) {
+	return m.decodeDepth(data, 0)
+}
+
+func (m *protoMessage) decodeDepth(data []byte, depth int) (map[string]interface{}, error) {
+	if depth > maxCodecDepth {
+		return nil, errors.New("protobuf data is nested too deeply")
+	}
+	out := make(map[string]interface{})
+	err := protoFields(data, func(number, wire, v uint64, b []byte) error {
+		f, ok := m.fields[number]
+		if !ok {
+			return nil
+		}
+		// packed repeated numbers come as one length delimited run
+		if wire == wireBytes && f.typ != protoTypeString && f.typ != protoTypeBytes && f.typ != protoTypeMessage {
+			values, err := f.decodePacked(b)
+			if err != nil {
+				return err
+			}
+			list, _ := out[f.name].([]interface{})
+			out[f.name] = append(list, values...)
+			return nil
+		}
+		value, err := f.decodeValue(wire, v, b, depth)
+		if err != nil {
+			return err
+		}
+		if f.message != nil && f.message.mapEntry {
+			entry := value.(map[string]interface{})
+			obj, _ := out[f.name].(map[string]interface{})
+			if obj == nil {
+				obj = make(map[string]interface{})
+				out[f.name] = obj
+			}
+			obj[codecKey(entry["key"])] = entry["value"]
+			return nil
+		}
+		if f.repeated {
+			list, _ := out[f.name].([]interface{})
+			out[f.name] = append(list, value)
+			return nil
+		}
+		out[f.name] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// wireType gives the wire type a field's values are written with.
+func (f *protoField) wireType() uint64 {
+	switch f.typ {
+	case protoTypeDouble, protoTypeFixed64, protoTypeSfixed64:
+		return wireFixed64
+	case protoTypeFloat, protoTypeFixed32, protoTypeSfixed32:
+		return wireFixed32
+	case protoTypeString, protoTypeBytes, protoTypeMessage:
+		return wireBytes
+	case protoTypeGroup:
+		return wireStart
+	}
+	return wireVarint
+}
+
+func (f *protoField) decodePacked(b []byte) ([]interface{}, error) {
+	r := &codecReader{data: b}
+	values := []interface{}{}
+	wire := f.wireType()
+	for r.left() > 0 {
+		var v uint64
+		var err error
+		switch wire {
+		case wireVarint:
+			v, err = r.readUvarint()
+		case wireFixed64:
+			var raw []byte
+			raw, err = r.read(8)
+			if err == nil {
+				v = binary.LittleEndian.Uint64(raw)
+			}
+		case wireFixed32:
+			var raw []byte
+			raw, err = r.read(4)
+			if err == nil {
+				v = uint64(binary.LittleEndian.Uint32(raw))
+			}
+		default:
+			err = errors.New("field " + f.name + " can't be packed")
+		}
+		if err != nil {
+			return nil, err
+		}
+		value, err := f.decodeValue(wire, v, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (f *protoField) decodeValue(wire, v uint64, b []byte, depth int) (interface{}, error) {
+	if wire != f.wireType() {
+		return nil, errors.New("field " + f.name + " has the wrong wire type")
+	}
+	switch f.typ {
+	case protoTypeDouble:
+		return math.Float64frombits(v), nil
+	case protoTypeFloat:
+		return float64(math.Float32frombits(uint32(v))), nil
+	case protoTypeInt64, protoTypeSfixed64:
+		return float64(int64(v)), nil
+	case protoTypeUint64, protoTypeFixed64:
+		return float64(v), nil
+	case protoTypeInt32, protoTypeSfixed32:
+		return float64(int32(v)), nil
+	case protoTypeUint32, protoTypeFixed32:
+		return float64(uint32(v)), nil
+	case protoTypeSint32, protoTypeSint64:
+		return float64(zigzagDecode(v)), nil
+	case protoTypeBool:
+		return v != 0, nil
+	case protoTypeEnum:
+		if name, ok := f.enum.names[int64(int32(v))]; ok {
+			return name, nil
+		}
+		return float64(int32(v)), nil
+	case protoTypeString:
+		return string(b), nil
+	case protoTypeBytes:
+		return base64.StdEncoding.EncodeToString(b), nil
+	case protoTypeMessage:
+		return f.message.decodeDepth(b, depth+1)
+	}
+	return nil, errors.New("field " + f.name + " is a group, which isn't supported")
+}
+
+// encode writes an object as a message, in field number order. Keys can be
+// field names or their JSON names, and null fields are left out.
+func (m *protoMessage) encode(v interface{}) ([]byte, error) {
+	return m.encodeDepth(nil, v, 0)
+}
+
+func (m *protoMessage) encodeDepth(out []byte, v interface{}, depth int) ([]byte, error) {
+	if depth > maxCodecDepth {
+		return nil, errors.New("message is nested too deeply to encode")
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New(m.name + " must be an object")
+	}
+	values := make(map[*protoField]interface{})
+	for k, value := range obj {
+		f, ok := m.byName[k]
+		if !ok {
+			return nil, errors.New(m.name + " has no field " + k)
+		}
+		if value != nil {
+			values[f] = value
+		}
+	}
+	var err error
+	for _, f := range m.ordered {
+		value, ok := values[f]
+		if !ok {
+			continue
+		}
+		if f.message != nil && f.message.mapEntry {
+			out, err = f.encodeMap(out, value, depth)
+		} else if f.repeated {
+			out, err = f.encodeRepeated(out, value, depth)
+		} else {
+			out, err = f.encodeValue(out, value, depth)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (f *protoField) encodeMap(out []byte, v interface{}, depth int) ([]byte, error) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("field " + f.name + " must be an object")
+	}
+	keyField := f.message.fields[1]
+	if keyField == nil || f.message.fields[2] == nil {
+		return nil, errors.New("field " + f.name + " has a broken map type")
+	}
+	for _, k := range sortedKeys(obj) {
+		// keys are strings in JSON, but may be numbers or booleans in protobuf
+		var key interface{} = k
+		var err error
+		switch keyField.typ {
+		case protoTypeBool:
+			key, err = strconv.ParseBool(k)
+		case protoTypeString:
+		default:
+			key, err = strconv.ParseFloat(k, 64)
+		}
+		if err != nil {
+			return nil, errors.New("field " + f.name + " has a key of the wrong type: " + k)
+		}
+		entry, err := f.message.encodeDepth(nil, map[string]interface{}{
+			keyField.name:            key,
+			f.message.fields[2].name: obj[k],
+		}, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		out = appendUvarint(out, f.number<<3|wireBytes)
+		out = appendUvarint(out, uint64(len(entry)))
+		out = append(out, entry...)
+	}
+	return out, nil
+}
+
+func (f *protoField) encodeRepeated(out []byte, v interface{}, depth int) ([]byte, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("field " + f.name + " must be an array")
+	}
+	wire := f.wireType()
+	if !f.packed || wire == wireBytes || wire == wireStart {
+		var err error
+		for _, item := range list {
+			if out, err = f.encodeValue(out, item, depth); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	var packed []byte
+	for _, item := range list {
+		raw, err := f.encodeScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		packed = append(packed, raw...)
+	}
+	out = appendUvarint(out, f.number<<3|wireBytes)
+	out = appendUvarint(out, uint64(len(packed)))
+	return append(out, packed...), nil
+}
+
+// encodeValue writes one value of a field along with its key.
+func (f *protoField) encodeValue(out []byte, v interface{}, depth int) ([]byte, error) {
+	wire := f.wireType()
+	switch f.typ {
+	case protoTypeGroup:
+		return nil, errors.New("field " + f.name + " is a group, which isn't supported")
+	case protoTypeMessage:
+		inner, err := f.message.encodeDepth(nil, v, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		out = appendUvarint(out, f.number<<3|wire)
+		out = appendUvarint(out, uint64(len(inner)))
+		return append(out, inner...), nil
+	}
+	raw, err := f.encodeScalar(v)
+	if err != nil {
+		return nil, err
+	}
+	out = appendUvarint(out, f.number<<3|wire)
+	return append(out, raw...), nil
+}
+
+// encodeScalar writes a value that isn't a message, without its key.
+func (f *protoField) encodeScalar(v interface{}) ([]byte, error) {
+	wrongType := errors.New("field " + f.name + " has a value of the wrong type")
+	switch f.typ {
+	case protoTypeString:
+		s, ok := v.(string)
+		if !ok {
+			return nil, wrongType
+		}
+		return append(appendUvarint(nil, uint64(len(s))), s...), nil
+	case protoTypeBytes:
+		b, err := binaryFromValue(v, "base64")
+		if err != nil {
+			return nil, wrongType
+		}
+		return append(appendUvarint(nil, uint64(len(b))), b...), nil
+	case protoTypeBool:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, wrongType
+		}
+		if b {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case protoTypeEnum:
+		if s, ok := v.(string); ok {
+			n, ok := f.enum.numbers[s]
+			if !ok {
+				return nil, errors.New("field " + f.name + " has no value " + s)
+			}
+			v = float64(n)
+		}
+	}
+
+	v, err := codecValue(v)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := v.(float64)
+	if !ok {
+		// big numbers are sometimes written as strings to keep them exact
+		s, isString := v.(string)
+		if !isString {
+			return nil, wrongType
+		}
+		if n, err = strconv.ParseFloat(s, 64); err != nil {
+			return nil, wrongType
+		}
+	}
+	switch f.typ {
+	case protoTypeDouble:
+		out := make([]byte, 8)
+		binary.LittleEndian.PutUint64(out, math.Float64bits(n))
+		return out, nil
+	case protoTypeFloat:
+		out := make([]byte, 4)
+		binary.LittleEndian.PutUint32(out, math.Float32bits(float32(n)))
+		return out, nil
+	}
+	if !codecInt(n) {
+		return nil, errors.New("field " + f.name + " must be a whole number")
+	}
+	switch f.typ {
+	case protoTypeInt64, protoTypeInt32, protoTypeEnum:
+		// negative int32s are sign extended to ten bytes, like int64s
+		return appendUvarint(nil, uint64(int64(n))), nil
+	case protoTypeUint64, protoTypeUint32:
+		if n < 0 {
+			return nil, errors.New("field " + f.name + " can't be negative")
+		}
+		return appendUvarint(nil, uint64(n)), nil
+	case protoTypeSint32, protoTypeSint64:
+		return appendUvarint(nil, zigzagEncode(int64(n))), nil
+	case protoTypeFixed64, protoTypeSfixed64:
+		out := make([]byte, 8)
+		binary.LittleEndian.PutUint64(out, uint64(int64(n)))
+		return out, nil
+	case protoTypeFixed32, protoTypeSfixed32:
+		out := make([]byte, 4)
+		binary.LittleEndian.PutUint32(out, uint32(int64(n)))
+		return out, nil
+	}
+	return nil, wrongType
+}
@@ -0,0 +1,367 @@
+package library
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Quantiles struct {
+	blocks.Block
+	queryrule          chan blocks.MsgChan
+	queryquantile      chan blocks.MsgChan
+	queryparamquantile chan blocks.Query
+	inrule             blocks.MsgChan
+	inpoll             blocks.MsgChan
+	clear              blocks.MsgChan
+	in                 blocks.MsgChan
+	out                blocks.MsgChan
+	quit               blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewQuantiles() blocks.BlockInterface {
+	return &Quantiles{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Quantiles) Setup() {
+	b.Kind = "Stats"
+	b.Desc = "estimates quantiles, like the median or the 99th percentile, of the values found at Path using a t-digest"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.inpoll = b.InRoute("poll")
+	b.clear = b.InRoute("clear")
+	b.queryrule = b.QueryRoute("rule")
+	b.queryquantile = b.QueryRoute("quantile")
+	b.queryparamquantile = b.QueryParamRoute("quantile")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// windowSlices is how many digests a windowed summary is split into. Values
+// leave the window a slice at a time.
+const windowSlices = 10
+
+// quantileSummary is the t-digest, or digests, kept for one key.
+type quantileSummary struct {
+	compression float64
+	window      time.Duration
+	halfLife    time.Duration
+	digests     []*tDigest
+	starts      []time.Time
+	decayed     time.Time
+}
+
+func newQuantileSummary(compression float64, window, halfLife time.Duration) *quantileSummary {
+	return &quantileSummary{
+		compression: compression,
+		window:      window,
+		halfLife:    halfLife,
+	}
+}
+
+// age drops slices that have left the window, and decays what's left.
+func (s *quantileSummary) age(now time.Time) {
+	if s.window > 0 {
+		slice := s.window / windowSlices
+		for len(s.starts) > 0 && !s.starts[0].Add(slice).After(now.Add(-s.window)) {
+			s.digests = s.digests[1:]
+			s.starts = s.starts[1:]
+		}
+	}
+	if s.halfLife > 0 && len(s.digests) > 0 {
+		f := math.Exp2(-float64(now.Sub(s.decayed)) / float64(s.halfLife))
+		s.digests[0].scale(f)
+	}
+	s.decayed = now
+}
+
+func (s *quantileSummary) add(x float64, now time.Time) {
+	s.age(now)
+	last := len(s.digests) - 1
+	if last < 0 || (s.window > 0 && now.Sub(s.starts[last]) >= s.window/windowSlices) {
+		s.digests = append(s.digests, newTDigest(s.compression))
+		s.starts = append(s.starts, now)
+		last++
+	}
+	s.digests[last].add(x, 1)
+}
+
+// digest returns a single digest of everything currently in the summary.
+func (s *quantileSummary) digest(now time.Time) *tDigest {
+	s.age(now)
+	if len(s.digests) == 1 {
+		return s.digests[0]
+	}
+	d := newTDigest(s.compression)
+	for _, part := range s.digests {
+		d.merge(part)
+	}
+	return d
+}
+
+// quantileLabel names a quantile as a percentile, so 0.99 becomes p99.
+func quantileLabel(q float64) string {
+	p := math.Floor(q*1e6+0.5) / 1e4
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+func quantileResult(d *tDigest, qs []float64) map[string]interface{} {
+	values := make(map[string]interface{})
+	for _, q := range qs {
+		v := d.quantile(q)
+		if math.IsNaN(v) {
+			values[quantileLabel(q)] = nil
+			continue
+		}
+		values[quantileLabel(q)] = v
+	}
+	return map[string]interface{}{
+		"Count":     d.total,
+		"Quantiles": values,
+	}
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Quantiles) Run() {
+	var path, keyPath, windowString, halfLifeString string
+	var tree, keyTree *jee.TokenTree
+	var window, halfLife time.Duration
+	quantiles := []float64{0.5, 0.95, 0.99}
+	compression := 100.0
+
+	summaries := make(map[string]*quantileSummary)
+
+	summaryFor := func(key string) *quantileSummary {
+		s, ok := summaries[key]
+		if !ok {
+			s = newQuantileSummary(compression, window, halfLife)
+			summaries[key] = s
+		}
+		return s
+	}
+
+	// results gives the quantiles for each key, forgetting keys that have no
+	// values left in their window
+	results := func(qs []float64) map[string]map[string]interface{} {
+		now := time.Now()
+		out := make(map[string]map[string]interface{})
+		for key, s := range summaries {
+			d := s.digest(now)
+			if keyTree != nil && window > 0 && d.total == 0 {
+				delete(summaries, key)
+				continue
+			}
+			out[key] = quantileResult(d, qs)
+		}
+		return out
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newPath, err := util.ParseRequiredString(ruleI, "Path")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newTree, err := util.BuildTokenTree(newPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newKeyPath, _ := util.ParseString(ruleI, "KeyPath")
+			var newKeyTree *jee.TokenTree
+			if newKeyPath != "" {
+				newKeyTree, err = util.BuildTokenTree(newKeyPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newQuantiles := []float64{0.5, 0.95, 0.99}
+			if util.KeyExists(ruleI, "Quantiles") {
+				newQuantiles, err = util.ParseArrayFloat(ruleI, "Quantiles")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			for _, q := range newQuantiles {
+				if q < 0 || q > 1 {
+					err = errors.New("Quantiles must be between 0 and 1")
+				}
+			}
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newCompression := 100.0
+			if util.KeyExists(ruleI, "Compression") {
+				newCompression, err = util.ParseFloat(ruleI, "Compression")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if newCompression < 10 {
+					b.Error(errors.New("Compression must be at least 10"))
+					continue
+				}
+			}
+			newWindowString, _ := util.ParseString(ruleI, "Window")
+			newWindow := time.Duration(0)
+			if newWindowString != "" {
+				newWindow, err = time.ParseDuration(newWindowString)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newHalfLifeString, _ := util.ParseString(ruleI, "HalfLife")
+			newHalfLife := time.Duration(0)
+			if newHalfLifeString != "" {
+				newHalfLife, err = time.ParseDuration(newHalfLifeString)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newWindow > 0 && newHalfLife > 0 {
+				b.Error(errors.New("use either a Window or a HalfLife, not both"))
+				continue
+			}
+
+			path = newPath
+			tree = newTree
+			keyPath = newKeyPath
+			keyTree = newKeyTree
+			quantiles = newQuantiles
+			compression = newCompression
+			windowString = newWindowString
+			window = newWindow
+			halfLifeString = newHalfLifeString
+			halfLife = newHalfLife
+			summaries = make(map[string]*quantileSummary)
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case msg := <-b.in:
+			if tree == nil {
+				continue
+			}
+			v, err := jee.Eval(tree, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			x, ok := v.(float64)
+			if !ok {
+				b.Error(errors.New("the value at Path must be a number"))
+				continue
+			}
+			key := ""
+			if keyTree != nil {
+				k, err := jee.Eval(keyTree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				key, err = countKey(k)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			summaryFor(key).add(x, time.Now())
+
+		case <-b.clear:
+			summaries = make(map[string]*quantileSummary)
+
+		case <-b.inpoll:
+			if keyTree == nil {
+				b.out <- quantileResult(summaryFor("").digest(time.Now()), quantiles)
+				continue
+			}
+			// one message per key
+			res := results(quantiles)
+			keys := make([]string, 0, len(res))
+			for key := range res {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				res[key]["Key"] = key
+				b.out <- res[key]
+			}
+
+		case c := <-b.queryquantile:
+			if keyTree == nil {
+				c <- quantileResult(summaryFor("").digest(time.Now()), quantiles)
+				continue
+			}
+			keys := make(map[string]interface{})
+			for key, r := range results(quantiles) {
+				keys[key] = r
+			}
+			c <- map[string]interface{}{
+				"Keys": keys,
+			}
+
+		case q := <-b.queryparamquantile:
+			qs := quantiles
+			if _, ok := q.Params["q"]; ok {
+				qs = []float64{}
+				for _, s := range q.Params["q"] {
+					f, err := strconv.ParseFloat(s, 64)
+					if err != nil || f < 0 || f > 1 {
+						b.Error(errors.New("q must be a number between 0 and 1"))
+						continue
+					}
+					qs = append(qs, f)
+				}
+			}
+			if keyTree == nil {
+				q.RespChan <- quantileResult(summaryFor("").digest(time.Now()), qs)
+				continue
+			}
+			if key := q.Params.Get("key"); key != "" {
+				s, ok := summaries[key]
+				if !ok {
+					s = newQuantileSummary(compression, window, halfLife)
+				}
+				res := quantileResult(s.digest(time.Now()), qs)
+				res["Key"] = key
+				q.RespChan <- res
+				continue
+			}
+			keys := make(map[string]interface{})
+			for key, r := range results(qs) {
+				keys[key] = r
+			}
+			q.RespChan <- map[string]interface{}{
+				"Keys": keys,
+			}
+
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Path":        path,
+				"KeyPath":     keyPath,
+				"Quantiles":   quantiles,
+				"Compression": compression,
+				"Window":      windowString,
+				"HalfLife":    halfLifeString,
+			}
+		}
+	}
+}
@@ -0,0 +1,536 @@
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// jsonSchema checks values against a JSON Schema. It covers most of draft-07:
+// type, enum, const, the number, string, array and object keywords, allOf,
+// anyOf, oneOf, not, if/then/else, and $ref to other parts of the same
+// schema. Formats that aren't known are ignored, as the spec allows.
+type jsonSchema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+	// refs are the $refs whose targets have been compiled
+	refs map[string]bool
+}
+
+// schemaViolation is one way a value fails to match a schema.
+type schemaViolation struct {
+	Path    string // JSON pointer to the part of the value that failed
+	Keyword string
+	Message string
+}
+
+var schemaEmail = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+var schemaUUID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func newJSONSchema(root interface{}) (*jsonSchema, error) {
+	s := &jsonSchema{
+		root:     root,
+		patterns: make(map[string]*regexp.Regexp),
+		refs:     make(map[string]bool),
+	}
+	if err := s.compile(root); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compile checks that a schema is well formed and compiles its patterns.
+func (s *jsonSchema) compile(schemaI interface{}) error {
+	if _, ok := schemaI.(bool); ok {
+		return nil
+	}
+	schema, ok := schemaI.(map[string]interface{})
+	if !ok {
+		return errors.New("a schema must be an object or a boolean")
+	}
+	for k, v := range schema {
+		var err error
+		switch k {
+		case "pattern":
+			p, ok := v.(string)
+			if !ok {
+				return errors.New("pattern must be a string")
+			}
+			err = s.compilePattern(p)
+		case "patternProperties":
+			props, ok := v.(map[string]interface{})
+			if !ok {
+				return errors.New("patternProperties must be an object")
+			}
+			for p, sub := range props {
+				if err = s.compilePattern(p); err != nil {
+					break
+				}
+				if err = s.compile(sub); err != nil {
+					break
+				}
+			}
+		case "properties", "definitions", "$defs", "dependencies":
+			props, ok := v.(map[string]interface{})
+			if !ok {
+				return errors.New(k + " must be an object")
+			}
+			for _, sub := range props {
+				// dependencies can be lists of property names too
+				if _, ok := sub.([]interface{}); ok && k == "dependencies" {
+					continue
+				}
+				if err = s.compile(sub); err != nil {
+					break
+				}
+			}
+		case "allOf", "anyOf", "oneOf":
+			subs, ok := v.([]interface{})
+			if !ok || len(subs) == 0 {
+				return errors.New(k + " must be a non-empty array of schemas")
+			}
+			for _, sub := range subs {
+				if err = s.compile(sub); err != nil {
+					break
+				}
+			}
+		case "items":
+			if subs, ok := v.([]interface{}); ok {
+				for _, sub := range subs {
+					if err = s.compile(sub); err != nil {
+						break
+					}
+				}
+			} else {
+				err = s.compile(v)
+			}
+		case "not", "if", "then", "else", "contains", "additionalItems", "additionalProperties", "propertyNames":
+			err = s.compile(v)
+		case "$ref":
+			ref, ok := v.(string)
+			if !ok {
+				return errors.New("$ref must be a string")
+			}
+			if s.refs[ref] {
+				break
+			}
+			// the target may be somewhere compile doesn't otherwise look,
+			// and its patterns are needed just the same
+			s.refs[ref] = true
+			var sub interface{}
+			if sub, err = s.resolve(ref); err == nil {
+				err = s.compile(sub)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) compilePattern(p string) error {
+	if _, ok := s.patterns[p]; ok {
+		return nil
+	}
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return err
+	}
+	s.patterns[p] = re
+	return nil
+}
+
+// resolve finds the schema a $ref like #/definitions/user points at.
+func (s *jsonSchema) resolve(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, errors.New("only references within the schema are supported, not " + ref)
+	}
+	cur := s.root
+	pointer := strings.TrimPrefix(ref, "#")
+	if pointer == "" {
+		return cur, nil
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		part = strings.Replace(strings.Replace(part, "~1", "/", -1), "~0", "~", -1)
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			next, ok := c[part]
+			if !ok {
+				return nil, errors.New("could not resolve " + ref)
+			}
+			cur = next
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, errors.New("could not resolve " + ref)
+			}
+			cur = c[i]
+		default:
+			return nil, errors.New("could not resolve " + ref)
+		}
+	}
+	return cur, nil
+}
+
+func (s *jsonSchema) validate(v interface{}) []schemaViolation {
+	return s.check(s.root, v, "", 0)
+}
+
+// schemaType gives the JSON Schema type of a decoded JSON value.
+func schemaType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func schemaKeys(m map[string]interface{}) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func schemaNumber(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func schemaCheckFormat(format, v string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339Nano, v)
+		return err == nil
+	case "date":
+		_, err := time.Parse("2006-01-02", v)
+		return err == nil
+	case "email":
+		return schemaEmail.MatchString(v)
+	case "ipv4":
+		ip := net.ParseIP(v)
+		return ip != nil && ip.To4() != nil && strings.Contains(v, ".")
+	case "ipv6":
+		ip := net.ParseIP(v)
+		return ip != nil && strings.Contains(v, ":")
+	case "uri":
+		u, err := url.Parse(v)
+		return err == nil && u.Scheme != ""
+	case "uuid":
+		return schemaUUID.MatchString(v)
+	case "regex":
+		_, err := regexp.Compile(v)
+		return err == nil
+	}
+	return true
+}
+
+func (s *jsonSchema) check(schemaI interface{}, v interface{}, path string, depth int) []schemaViolation {
+	violations := []schemaViolation{}
+	fail := func(keyword, message string) {
+		violations = append(violations, schemaViolation{
+			Path:    path,
+			Keyword: keyword,
+			Message: message,
+		})
+	}
+
+	if b, ok := schemaI.(bool); ok {
+		if !b {
+			fail("false", "no value is allowed here")
+		}
+		return violations
+	}
+	schema, _ := schemaI.(map[string]interface{})
+
+	// stop references that go round in circles
+	if depth > 100 {
+		fail("$ref", "the schema refers to itself too deeply")
+		return violations
+	}
+
+	// in draft-07 a $ref replaces everything else in its schema
+	if ref, ok := schema["$ref"].(string); ok {
+		sub, err := s.resolve(ref)
+		if err != nil {
+			fail("$ref", err.Error())
+			return violations
+		}
+		return s.check(sub, v, path, depth+1)
+	}
+
+	if t, ok := schema["type"]; ok {
+		types := []interface{}{t}
+		if ts, ok := t.([]interface{}); ok {
+			types = ts
+		}
+		vType := schemaType(v)
+		match := false
+		names := []string{}
+		for _, tI := range types {
+			name, _ := tI.(string)
+			names = append(names, name)
+			if name == vType || (name == "number" && vType == "integer") {
+				match = true
+			}
+		}
+		if !match {
+			fail("type", fmt.Sprintf("expected %s but got %s", strings.Join(names, " or "), vType))
+			return violations
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("enum", "value is not one of the allowed values")
+		}
+	}
+
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, v) {
+		fail("const", "value is not the allowed value")
+	}
+
+	if f, ok := v.(float64); ok {
+		if m, ok := schemaNumber(schema["minimum"]); ok && f < m {
+			fail("minimum", fmt.Sprintf("%v is less than %v", f, m))
+		}
+		if m, ok := schemaNumber(schema["maximum"]); ok && f > m {
+			fail("maximum", fmt.Sprintf("%v is greater than %v", f, m))
+		}
+		if m, ok := schemaNumber(schema["exclusiveMinimum"]); ok && f <= m {
+			fail("exclusiveMinimum", fmt.Sprintf("%v is not greater than %v", f, m))
+		}
+		if m, ok := schemaNumber(schema["exclusiveMaximum"]); ok && f >= m {
+			fail("exclusiveMaximum", fmt.Sprintf("%v is not less than %v", f, m))
+		}
+		if m, ok := schemaNumber(schema["multipleOf"]); ok && m > 0 {
+			q := f / m
+			if math.Abs(q-math.Floor(q+0.5)) > 1e-9 {
+				fail("multipleOf", fmt.Sprintf("%v is not a multiple of %v", f, m))
+			}
+		}
+	}
+
+	if str, ok := v.(string); ok {
+		length := float64(utf8.RuneCountInString(str))
+		if m, ok := schemaNumber(schema["minLength"]); ok && length < m {
+			fail("minLength", fmt.Sprintf("is shorter than %v characters", m))
+		}
+		if m, ok := schemaNumber(schema["maxLength"]); ok && length > m {
+			fail("maxLength", fmt.Sprintf("is longer than %v characters", m))
+		}
+		if p, ok := schema["pattern"].(string); ok && !s.patterns[p].MatchString(str) {
+			fail("pattern", "does not match "+p)
+		}
+		if format, ok := schema["format"].(string); ok && !schemaCheckFormat(format, str) {
+			fail("format", "is not a valid "+format)
+		}
+	}
+
+	if arr, ok := v.([]interface{}); ok {
+		n := float64(len(arr))
+		if m, ok := schemaNumber(schema["minItems"]); ok && n < m {
+			fail("minItems", fmt.Sprintf("has fewer than %v items", m))
+		}
+		if m, ok := schemaNumber(schema["maxItems"]); ok && n > m {
+			fail("maxItems", fmt.Sprintf("has more than %v items", m))
+		}
+		if unique, _ := schema["uniqueItems"].(bool); unique {
+			seen := make(map[string]bool)
+			for _, item := range arr {
+				k, err := json.Marshal(item)
+				if err != nil {
+					continue
+				}
+				if seen[string(k)] {
+					fail("uniqueItems", "has duplicate items")
+					break
+				}
+				seen[string(k)] = true
+			}
+		}
+		if items, ok := schema["items"]; ok {
+			if tuple, ok := items.([]interface{}); ok {
+				for i, item := range arr {
+					itemPath := path + "/" + strconv.Itoa(i)
+					if i < len(tuple) {
+						violations = append(violations, s.check(tuple[i], item, itemPath, depth+1)...)
+					} else if additional, ok := schema["additionalItems"]; ok {
+						violations = append(violations, s.check(additional, item, itemPath, depth+1)...)
+					}
+				}
+			} else {
+				for i, item := range arr {
+					violations = append(violations, s.check(items, item, path+"/"+strconv.Itoa(i), depth+1)...)
+				}
+			}
+		}
+		if contains, ok := schema["contains"]; ok {
+			found := false
+			for _, item := range arr {
+				if len(s.check(contains, item, path, depth+1)) == 0 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				fail("contains", "has no items that match")
+			}
+		}
+	}
+
+	if obj, ok := v.(map[string]interface{}); ok {
+		n := float64(len(obj))
+		if m, ok := schemaNumber(schema["minProperties"]); ok && n < m {
+			fail("minProperties", fmt.Sprintf("has fewer than %v properties", m))
+		}
+		if m, ok := schemaNumber(schema["maxProperties"]); ok && n > m {
+			fail("maxProperties", fmt.Sprintf("has more than %v properties", m))
+		}
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, rI := range required {
+				r, _ := rI.(string)
+				if _, ok := obj[r]; !ok {
+					fail("required", "is missing "+r)
+				}
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		patternProps, _ := schema["patternProperties"].(map[string]interface{})
+		additional, hasAdditional := schema["additionalProperties"]
+		// go through properties in order so that violations come out the
+		// same way every time
+		keys := schemaKeys(obj)
+		for _, k := range keys {
+			item := obj[k]
+			itemPath := path + "/" + strings.Replace(strings.Replace(k, "~", "~0", -1), "/", "~1", -1)
+			matched := false
+			if sub, ok := props[k]; ok {
+				matched = true
+				violations = append(violations, s.check(sub, item, itemPath, depth+1)...)
+			}
+			for _, p := range schemaKeys(patternProps) {
+				if s.patterns[p].MatchString(k) {
+					matched = true
+					violations = append(violations, s.check(patternProps[p], item, itemPath, depth+1)...)
+				}
+			}
+			if !matched && hasAdditional {
+				if b, ok := additional.(bool); ok && !b {
+					violations = append(violations, schemaViolation{
+						Path:    itemPath,
+						Keyword: "additionalProperties",
+						Message: "is not an allowed property",
+					})
+				} else {
+					violations = append(violations, s.check(additional, item, itemPath, depth+1)...)
+				}
+			}
+		}
+		if names, ok := schema["propertyNames"]; ok {
+			for _, k := range keys {
+				if len(s.check(names, k, path, depth+1)) > 0 {
+					fail("propertyNames", k+" is not an allowed property name")
+				}
+			}
+		}
+		if deps, ok := schema["dependencies"].(map[string]interface{}); ok {
+			for _, k := range schemaKeys(deps) {
+				dep := deps[k]
+				if _, ok := obj[k]; !ok {
+					continue
+				}
+				if names, ok := dep.([]interface{}); ok {
+					for _, nI := range names {
+						name, _ := nI.(string)
+						if _, ok := obj[name]; !ok {
+							fail("dependencies", "has "+k+" but is missing "+name)
+						}
+					}
+				} else {
+					violations = append(violations, s.check(dep, v, path, depth+1)...)
+				}
+			}
+		}
+	}
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			violations = append(violations, s.check(sub, v, path, depth+1)...)
+		}
+	}
+
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		found := false
+		for _, sub := range anyOf {
+			if len(s.check(sub, v, path, depth+1)) == 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("anyOf", "does not match any of the schemas")
+		}
+	}
+
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, sub := range oneOf {
+			if len(s.check(sub, v, path, depth+1)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			fail("oneOf", fmt.Sprintf("matches %d of the schemas instead of exactly one", matches))
+		}
+	}
+
+	if not, ok := schema["not"]; ok && len(s.check(not, v, path, depth+1)) == 0 {
+		fail("not", "matches a schema it must not")
+	}
+
+	if cond, ok := schema["if"]; ok {
+		if len(s.check(cond, v, path, depth+1)) == 0 {
+			if then, ok := schema["then"]; ok {
+				violations = append(violations, s.check(then, v, path, depth+1)...)
+			}
+		} else if otherwise, ok := schema["else"]; ok {
+			violations = append(violations, s.check(otherwise, v, path, depth+1)...)
+		}
+	}
+
+	return violations
+}
@@ -0,0 +1,312 @@
+package library
+
+// STOCHASTIC GRADIENT DESCENT
+//
+// The learn block fits the weights of a linear or logistic model one message
+// at a time, and the linearModel and logisticModel blocks apply those
+// weights. The parameters learn emits are in the same form as the rules of
+// the model blocks, so the two can be wired together directly.
+
+import (
+	"errors"
+	"math"
+
+	"github.com/nytlabs/gojee"               // jee
+	"github.com/nytlabs/streamtools/st/util" // util
+)
+
+func logit(x float64) float64 {
+	return 1 / (1 + math.Exp(-x))
+}
+
+// dot multiplies each feature by its weight. Model rules have never had to
+// give a weight for every feature, so features or weights without a partner
+// are left out.
+func dot(w, x []float64) float64 {
+	s := 0.0
+	for i, wi := range w {
+		if i >= len(x) {
+			break
+		}
+		s += wi * x[i]
+	}
+	return s
+}
+
+// buildFeatureTrees parses each feature path.
+func buildFeatureTrees(paths []string) ([]*jee.TokenTree, error) {
+	trees := make([]*jee.TokenTree, len(paths))
+	for i, path := range paths {
+		tree, err := util.BuildTokenTree(path)
+		if err != nil {
+			return nil, err
+		}
+		trees[i] = tree
+	}
+	return trees, nil
+}
+
+// extractFeatures finds the value of every feature in msg.
+func extractFeatures(trees []*jee.TokenTree, msg interface{}) ([]float64, error) {
+	x := make([]float64, len(trees))
+	for i, tree := range trees {
+		feature, err := jee.Eval(tree, msg)
+		if err != nil {
+			return nil, err
+		}
+		fi, ok := feature.(float64)
+		if !ok {
+			return nil, errors.New("features must be float64")
+		}
+		x[i] = fi
+	}
+	return x, nil
+}
+
+// sgdConfig is how a model is trained.
+type sgdConfig struct {
+	loss         string
+	step         string
+	learningRate float64
+	l1           float64
+	l2           float64
+	batchSize    int
+	metricWindow float64
+}
+
+// eta is the step size for the t'th update.
+func (c sgdConfig) eta(t int) float64 {
+	switch c.step {
+	case "inverse":
+		return c.learningRate / float64(t)
+	case "bottou":
+		return c.learningRate / (1 + c.learningRate*c.l2*float64(t))
+	}
+	return c.learningRate
+}
+
+// sgdModel is a model being trained, along with how well it has been doing.
+// Every observation is scored before it is learnt from, so the loss and
+// accuracy measure how the model does on data it has yet to see.
+type sgdModel struct {
+	config   sgdConfig
+	weights  []float64
+	gradient []float64
+	batched  int
+	updates  int
+	count    float64
+	loss     float64
+	accuracy float64
+}
+
+func newSGDModel(config sgdConfig, initial []float64) *sgdModel {
+	weights := make([]float64, len(initial))
+	copy(weights, initial)
+	return &sgdModel{
+		config:   config,
+		weights:  weights,
+		gradient: make([]float64, len(initial)),
+	}
+}
+
+func (m *sgdModel) predict(x []float64) float64 {
+	if m.config.loss == "logistic" {
+		return logit(dot(m.weights, x))
+	}
+	return dot(m.weights, x)
+}
+
+// observe scores the model on one observation, then learns from it.
+func (m *sgdModel) observe(x []float64, y float64) {
+	p := m.predict(x)
+	var loss, correct float64
+	if m.config.loss == "logistic" {
+		// clamp the prediction so a confident mistake costs a lot, not infinity
+		q := math.Min(math.Max(p, 1e-15), 1-1e-15)
+		loss = -y*math.Log(q) - (1-y)*math.Log(1-q)
+		if (p >= 0.5) == (y >= 0.5) {
+			correct = 1
+		}
+	} else {
+		loss = (p - y) * (p - y) / 2
+	}
+	// the metrics are a running mean until there's a window's worth of
+	// observations, and a moving average after that
+	m.count++
+	alpha := 1 / math.Min(m.count, m.config.metricWindow)
+	m.loss += alpha * (loss - m.loss)
+	m.accuracy += alpha * (correct - m.accuracy)
+
+	// both losses have the same gradient with respect to the weights
+	for i := range m.gradient {
+		m.gradient[i] += (p - y) * x[i]
+	}
+	m.batched++
+	if m.batched >= m.config.batchSize {
+		m.update()
+	}
+}
+
+// update takes a step down the average gradient of the batch.
+func (m *sgdModel) update() {
+	m.updates++
+	eta := m.config.eta(m.updates)
+	for i, w := range m.weights {
+		g := m.gradient[i]/float64(m.batched) + m.config.l2*w
+		w -= eta * g
+		// L1 shrinks each weight towards zero, stopping at zero
+		if m.config.l1 > 0 {
+			shrink := eta * m.config.l1
+			switch {
+			case w > shrink:
+				w -= shrink
+			case w < -shrink:
+				w += shrink
+			default:
+				w = 0
+			}
+		}
+		m.weights[i] = w
+		m.gradient[i] = 0
+	}
+	m.batched = 0
+}
+
+// params describes the model as a rule for the linearModel or logisticModel
+// blocks, along with how well it is doing.
+func (m *sgdModel) params(featurePaths []string) map[string]interface{} {
+	weights := make([]interface{}, len(m.weights))
+	for i, w := range m.weights {
+		weights[i] = w
+	}
+	featuresI := make([]interface{}, len(featurePaths))
+	for i, f := range featurePaths {
+		featuresI[i] = f
+	}
+	out := map[string]interface{}{
+		"params":       weights,
+		"Weights":      weights,
+		"FeaturePaths": featuresI,
+		"Count":        m.count,
+		"Loss":         nil,
+		"Accuracy":     nil,
+	}
+	if m.count > 0 {
+		out["Loss"] = m.loss
+		if m.config.loss == "logistic" {
+			out["Accuracy"] = m.accuracy
+		}
+	}
+	return out
+}
+
+// modelRule is the rule of a linearModel or logisticModel block. A rule with
+// a Key only sets the weights for messages whose KeyPath has that key,
+// leaving the weights of other keys alone.
+type modelRule struct {
+	featurePaths []string
+	featureTrees []*jee.TokenTree
+	keyPath      string
+	keyTree      *jee.TokenTree
+	weights      map[string][]float64
+}
+
+func newModelRule() *modelRule {
+	return &modelRule{
+		featurePaths: []string{},
+		weights:      make(map[string][]float64),
+	}
+}
+
+func (r *modelRule) set(rule interface{}) error {
+	weights, err := util.ParseArrayFloat(rule, "Weights")
+	if err != nil {
+		return err
+	}
+	featurePaths, err := util.ParseArrayString(rule, "FeaturePaths")
+	if err != nil {
+		return err
+	}
+	featureTrees, err := buildFeatureTrees(featurePaths)
+	if err != nil {
+		return err
+	}
+	keyPath, _ := util.ParseString(rule, "KeyPath")
+	var keyTree *jee.TokenTree
+	if keyPath != "" {
+		keyTree, err = util.BuildTokenTree(keyPath)
+		if err != nil {
+			return err
+		}
+	}
+	key := ""
+	if util.KeyExists(rule, "Key") {
+		key, err = util.ParseString(rule, "Key")
+		if err != nil {
+			return err
+		}
+	}
+
+	// changing what the model looks at invalidates the weights of every key
+	if !sameStrings(featurePaths, r.featurePaths) || keyPath != r.keyPath {
+		r.weights = make(map[string][]float64)
+	}
+	r.featurePaths = featurePaths
+	r.featureTrees = featureTrees
+	r.keyPath = keyPath
+	r.keyTree = keyTree
+	r.weights[key] = weights
+	return nil
+}
+
+// apply finds the weights for msg and combines them with its features.
+func (r *modelRule) apply(msg interface{}) (float64, error) {
+	key := ""
+	if r.keyTree != nil {
+		k, err := jee.Eval(r.keyTree, msg)
+		if err != nil {
+			return 0, err
+		}
+		key, err = countKey(k)
+		if err != nil {
+			return 0, err
+		}
+	}
+	weights, ok := r.weights[key]
+	if !ok {
+		return 0, errors.New("no weights for key " + key)
+	}
+	x, err := extractFeatures(r.featureTrees, msg)
+	if err != nil {
+		return 0, err
+	}
+	return dot(weights, x), nil
+}
+
+func (r *modelRule) query() map[string]interface{} {
+	out := map[string]interface{}{
+		"Weights":      r.weights[""],
+		"FeaturePaths": r.featurePaths,
+		"KeyPath":      r.keyPath,
+	}
+	if r.keyTree != nil {
+		keys := make(map[string]interface{})
+		for k, w := range r.weights {
+			keys[k] = w
+		}
+		out["Keys"] = keys
+	}
+	return out
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
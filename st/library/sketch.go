@@ -0,0 +1,213 @@
+package library
+
+// PROBABILISTIC SKETCHES
+//
+// These are the fixed size data structures behind the topk, cardinality and
+// bloomdedupe blocks.
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+// fmix64 is the MurmurHash3 finaliser. FNV on its own doesn't spread short
+// keys over the high bits well enough for HyperLogLog.
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// sketchHash returns two independent hashes of key, which are combined to
+// simulate as many hash functions as a sketch needs.
+func sketchHash(key string) (uint64, uint64) {
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	h1 := fmix64(f.Sum64())
+	h2 := fmix64(h1 + 0x9e3779b97f4a7c15)
+	return h1, h2 | 1
+}
+
+// countMinSketch estimates how often each key has been seen. Estimates are
+// never too low, and are too high by at most epsilon times the total count
+// with probability 1 - delta.
+type countMinSketch struct {
+	width  uint64
+	depth  int
+	counts [][]float64
+}
+
+func newCountMinSketch(epsilon, delta float64) (*countMinSketch, error) {
+	if epsilon <= 0 || epsilon >= 1 || delta <= 0 || delta >= 1 {
+		return nil, errors.New("Epsilon and Delta must be between 0 and 1")
+	}
+	s := &countMinSketch{
+		width: uint64(math.Ceil(math.E / epsilon)),
+		depth: int(math.Ceil(math.Log(1 / delta))),
+	}
+	s.counts = make([][]float64, s.depth)
+	for i := range s.counts {
+		s.counts[i] = make([]float64, s.width)
+	}
+	return s, nil
+}
+
+// add increments key by weight and returns its new estimate.
+func (s *countMinSketch) add(key string, weight float64) float64 {
+	h1, h2 := sketchHash(key)
+	est := math.Inf(1)
+	for i := 0; i < s.depth; i++ {
+		j := (h1 + uint64(i)*h2) % s.width
+		s.counts[i][j] += weight
+		if s.counts[i][j] < est {
+			est = s.counts[i][j]
+		}
+	}
+	return est
+}
+
+func (s *countMinSketch) estimate(key string) float64 {
+	h1, h2 := sketchHash(key)
+	est := math.Inf(1)
+	for i := 0; i < s.depth; i++ {
+		j := (h1 + uint64(i)*h2) % s.width
+		if s.counts[i][j] < est {
+			est = s.counts[i][j]
+		}
+	}
+	return est
+}
+
+// scale multiplies every counter by f.
+func (s *countMinSketch) scale(f float64) {
+	for _, row := range s.counts {
+		for j := range row {
+			row[j] *= f
+		}
+	}
+}
+
+// hyperLogLog estimates the number of distinct keys it has seen, with a
+// standard error of about 1.04 / sqrt(2^precision).
+type hyperLogLog struct {
+	precision uint
+	registers []byte
+}
+
+func newHyperLogLog(precision int) (*hyperLogLog, error) {
+	if precision < 4 || precision > 16 {
+		return nil, errors.New("Precision must be between 4 and 16")
+	}
+	return &hyperLogLog{
+		precision: uint(precision),
+		registers: make([]byte, 1<<uint(precision)),
+	}, nil
+}
+
+func (h *hyperLogLog) add(key string) {
+	x, _ := sketchHash(key)
+	i := x >> (64 - h.precision)
+	// count the leading zeros of what's left, plus one
+	w := x<<h.precision | 1<<(h.precision-1)
+	rank := byte(1)
+	for w&(1<<63) == 0 {
+		rank++
+		w <<= 1
+	}
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() float64 {
+	m := float64(len(h.registers))
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	sum := 0.0
+	zeros := 0.0
+	for _, r := range h.registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := alpha * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// linear counting is more accurate for small cardinalities
+		est = m * math.Log(m/zeros)
+	}
+	return est
+}
+
+// merge folds another sketch of the same precision into this one, giving the
+// sketch of the union of both streams.
+func (h *hyperLogLog) merge(registers []byte) error {
+	if len(registers) != len(h.registers) {
+		return errors.New("can only merge sketches with the same precision")
+	}
+	for i, r := range registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// bloomFilter answers whether a key has probably been seen before.
+type bloomFilter struct {
+	bits  []uint64
+	m     uint64
+	k     int
+	count int
+}
+
+// newBloomFilter sizes a filter to hold capacity keys with the given false
+// positive rate.
+func newBloomFilter(capacity int, rate float64) (*bloomFilter, error) {
+	if capacity <= 0 {
+		return nil, errors.New("Capacity must be positive")
+	}
+	if rate <= 0 || rate >= 1 {
+		return nil, errors.New("FalsePositiveRate must be between 0 and 1")
+	}
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	k := int(math.Max(1, math.Floor(float64(m)/float64(capacity)*math.Ln2+0.5)))
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}, nil
+}
+
+func (f *bloomFilter) has(key string) bool {
+	h1, h2 := sketchHash(key)
+	for i := 0; i < f.k; i++ {
+		j := (h1 + uint64(i)*h2) % f.m
+		if f.bits[j/64]&(1<<(j%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) add(key string) {
+	h1, h2 := sketchHash(key)
+	for i := 0; i < f.k; i++ {
+		j := (h1 + uint64(i)*h2) % f.m
+		f.bits[j/64] |= 1 << (j % 64)
+	}
+	f.count++
+}
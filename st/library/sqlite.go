@@ -0,0 +1,10 @@
+// +build !nosqlite
+
+package library
+
+// The sqlite3 driver needs cgo, so builds that can't use it, such as cross
+// compiled ones, can leave it out with -tags nosqlite. toSQL and fromSQL then
+// only talk to postgres.
+import (
+	_ "github.com/mattn/go-sqlite3" // sqlite3 driver
+)
@@ -0,0 +1,178 @@
+package library
+
+import (
+	"errors"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Switch struct {
+	blocks.Block
+	queryrule   chan blocks.MsgChan
+	querycounts chan blocks.MsgChan
+	inrule      blocks.MsgChan
+	in          blocks.MsgChan
+	routed      chan *blocks.Msg
+	quit        blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewSwitch() blocks.BlockInterface {
+	return &Switch{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Switch) Setup() {
+	b.Kind = "Core"
+	b.Desc = "sends each message out of the route named by the first of its Cases whose Filter matches, or every matching case in all mode, and out of default if none do"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.querycounts = b.QueryRoute("counts")
+	b.quit = b.Quit()
+	// default is always an out route, but its messages are sent on routed
+	// like everything else so that they stay in order with the cases'
+	b.OutRoute("default")
+	b.routed = b.DynamicOutRoutes()
+}
+
+// switchCase is a named route and the filter that sends messages to it.
+type switchCase struct {
+	Name   string
+	Filter string
+	tree   *jee.TokenTree
+}
+
+// switchReserved are the names a case can't have: default is the switch's
+// own out route, out is every block's, and outroutes is a query.
+var switchReserved = map[string]bool{
+	"default":   true,
+	"out":       true,
+	"outroutes": true,
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Switch) Run() {
+	var cases []*switchCase
+	caseRule := []interface{}{}
+	mode := "first"
+	counts := map[string]float64{"default": 0}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newMode := "first"
+			var err error
+			if util.KeyExists(ruleI, "Mode") {
+				newMode, err = util.ParseString(ruleI, "Mode")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newMode != "first" && newMode != "all" {
+				b.Error(errors.New("Mode must be one of first or all"))
+				continue
+			}
+
+			newCases := []*switchCase{}
+			seen := map[string]bool{}
+			newCaseRule, ok := ruleI.(map[string]interface{})["Cases"].([]interface{})
+			if !ok {
+				b.Error(errors.New("Cases must be an array of objects with a Name and a Filter"))
+				continue
+			}
+			for _, cI := range newCaseRule {
+				c, ok := cI.(map[string]interface{})
+				if !ok {
+					err = errors.New("each case must be an object with a Name and a Filter")
+					break
+				}
+				sc := &switchCase{}
+				sc.Name, _ = c["Name"].(string)
+				sc.Filter, _ = c["Filter"].(string)
+				if sc.Name == "" || sc.Filter == "" {
+					err = errors.New("each case must have a Name and a Filter")
+					break
+				}
+				if seen[sc.Name] || switchReserved[sc.Name] {
+					err = errors.New("case names must be unique and can't be default, out or outroutes")
+					break
+				}
+				seen[sc.Name] = true
+				sc.tree, err = util.BuildTokenTree(sc.Filter)
+				if err != nil {
+					break
+				}
+				newCases = append(newCases, sc)
+			}
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			mode = newMode
+			cases = newCases
+			caseRule = newCaseRule
+			counts = map[string]float64{"default": 0}
+			names := []string{}
+			for _, sc := range cases {
+				counts[sc.Name] = 0
+				names = append(names, sc.Name)
+			}
+			b.SetOutRoutes(names)
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case msg := <-b.in:
+			matched := false
+			for _, sc := range cases {
+				e, err := jee.Eval(sc.tree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if eval, ok := e.(bool); !ok || !eval {
+					continue
+				}
+				matched = true
+				counts[sc.Name]++
+				b.routed <- &blocks.Msg{
+					Msg:   msg,
+					Route: sc.Name,
+				}
+				if mode == "first" {
+					break
+				}
+			}
+			if !matched {
+				counts["default"]++
+				b.routed <- &blocks.Msg{
+					Msg:   msg,
+					Route: "default",
+				}
+			}
+
+		case c := <-b.querycounts:
+			out := map[string]interface{}{}
+			for name, n := range counts {
+				out[name] = n
+			}
+			c <- map[string]interface{}{
+				"Counts": out,
+			}
+
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Cases": caseRule,
+				"Mode":  mode,
+			}
+		}
+	}
+}
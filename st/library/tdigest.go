@@ -0,0 +1,150 @@
+package library
+
+// T-DIGEST
+//
+// A t-digest summarises a distribution as a small set of weighted centroids,
+// keeping the centroids near the tails small so that extreme quantiles stay
+// accurate. See Dunning & Ertl, "Computing Extremely Accurate Quantiles
+// Using t-Digests".
+
+import (
+	"math"
+	"sort"
+)
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+type byMean []centroid
+
+func (c byMean) Len() int           { return len(c) }
+func (c byMean) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byMean) Less(i, j int) bool { return c[i].mean < c[j].mean }
+
+type tDigest struct {
+	compression float64
+	centroids   []centroid
+	buffer      []centroid
+	total       float64
+	min         float64
+	max         float64
+}
+
+func newTDigest(compression float64) *tDigest {
+	return &tDigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+func (t *tDigest) add(x, weight float64) {
+	t.buffer = append(t.buffer, centroid{x, weight})
+	t.total += weight
+	if x < t.min {
+		t.min = x
+	}
+	if x > t.max {
+		t.max = x
+	}
+	if len(t.buffer) > int(t.compression)*5 {
+		t.compress()
+	}
+}
+
+// merge adds every centroid of another digest to this one.
+func (t *tDigest) merge(o *tDigest) {
+	o.compress()
+	for _, c := range o.centroids {
+		t.buffer = append(t.buffer, c)
+		t.total += c.weight
+	}
+	if o.min < t.min {
+		t.min = o.min
+	}
+	if o.max > t.max {
+		t.max = o.max
+	}
+	t.compress()
+}
+
+// scale multiplies the weight of everything in the digest by f.
+func (t *tDigest) scale(f float64) {
+	for i := range t.centroids {
+		t.centroids[i].weight *= f
+	}
+	for i := range t.buffer {
+		t.buffer[i].weight *= f
+	}
+	t.total *= f
+}
+
+// compress folds the buffer into the centroids, merging neighbours for as
+// long as they stay under the size limit for their place in the distribution.
+func (t *tDigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+	all := append(t.centroids, t.buffer...)
+	sort.Sort(byMean(all))
+	t.buffer = nil
+
+	merged := make([]centroid, 0, len(all))
+	cur := all[0]
+	soFar := 0.0
+	for _, next := range all[1:] {
+		proposed := cur.weight + next.weight
+		q0 := soFar / t.total
+		q2 := (soFar + proposed) / t.total
+		limit := 4 * t.total * math.Min(q0*(1-q0), q2*(1-q2)) / t.compression
+		if proposed <= limit {
+			cur.mean += (next.mean - cur.mean) * next.weight / proposed
+			cur.weight = proposed
+			continue
+		}
+		merged = append(merged, cur)
+		soFar += cur.weight
+		cur = next
+	}
+	t.centroids = append(merged, cur)
+}
+
+// quantile estimates the value below which a fraction q of the weight lies.
+func (t *tDigest) quantile(q float64) float64 {
+	t.compress()
+	if len(t.centroids) == 0 {
+		return math.NaN()
+	}
+	if len(t.centroids) == 1 || q <= 0 {
+		if q >= 1 {
+			return t.max
+		}
+		if q <= 0 {
+			return t.min
+		}
+		return t.centroids[0].mean
+	}
+	if q >= 1 {
+		return t.max
+	}
+
+	// each centroid's weight is centred on its mean, so interpolate between
+	// neighbouring centres, using the exact min and max at either end
+	target := q * t.total
+	cum := 0.0
+	prevCenter, prevMean := 0.0, t.min
+	for _, c := range t.centroids {
+		center := cum + c.weight/2
+		if target < center {
+			return prevMean + (c.mean-prevMean)*(target-prevCenter)/(center-prevCenter)
+		}
+		prevCenter, prevMean = center, c.mean
+		cum += c.weight
+	}
+	if t.total == prevCenter {
+		return t.max
+	}
+	return prevMean + (t.max-prevMean)*(target-prevCenter)/(t.total-prevCenter)
+}
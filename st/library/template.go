@@ -0,0 +1,161 @@
+package library
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Template struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewTemplate() blocks.BlockInterface {
+	return &Template{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Template) Setup() {
+	b.Kind = "Core"
+	b.Desc = "renders a Go text/template with each message, adding the result to the message at OutputPath or emitting it on its own"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// templateText turns any value into the text a template would show for it.
+func templateText(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// templateFuncs are the helpers templates can use on top of those text/template
+// comes with.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		out, err := json.Marshal(v)
+		return string(out), err
+	},
+	// date formats milliseconds since the epoch, or an RFC3339 string, with a
+	// Go time layout, in UTC
+	"date": func(layout string, v interface{}) (string, error) {
+		var t time.Time
+		switch v := v.(type) {
+		case time.Time:
+			t = v
+		default:
+			var err error
+			t, err = parseEventTime(v)
+			if err != nil {
+				return "", err
+			}
+		}
+		return t.UTC().Format(layout), nil
+	},
+	"upper": func(v interface{}) string {
+		return strings.ToUpper(templateText(v))
+	},
+	"lower": func(v interface{}) string {
+		return strings.ToLower(templateText(v))
+	},
+	"join": func(sep string, v interface{}) (string, error) {
+		arr, ok := v.([]interface{})
+		if !ok {
+			return "", errors.New("join needs an array")
+		}
+		parts := make([]string, len(arr))
+		for i, item := range arr {
+			parts[i] = templateText(item)
+		}
+		return strings.Join(parts, sep), nil
+	},
+	// default gives def in place of a missing or empty value
+	"default": func(def interface{}, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Template) Run() {
+	var templateString, outputPath string
+	var tmpl *template.Template
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newTemplateString, err := util.ParseRequiredString(ruleI, "Template")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newTmpl, err := template.New("template").Funcs(templateFuncs).Parse(newTemplateString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newOutputPath, _ := util.ParseString(ruleI, "OutputPath")
+
+			templateString = newTemplateString
+			tmpl = newTmpl
+			outputPath = newOutputPath
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case msg := <-b.in:
+			if tmpl == nil {
+				continue
+			}
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, msg); err != nil {
+				b.Error(err)
+				continue
+			}
+			if outputPath == "" {
+				b.out <- buf.String()
+				continue
+			}
+			in, ok := msg.(map[string]interface{})
+			if !ok {
+				b.Error(errors.New("with an OutputPath, messages must be objects"))
+				continue
+			}
+			// copy the message rather than change one other blocks may hold
+			out := recCopy(in)
+			if err := setPath(out, outputPath, buf.String()); err != nil {
+				b.Error(err)
+				continue
+			}
+			b.out <- out
+
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Template":   templateString,
+				"OutputPath": outputPath,
+			}
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package library
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Throttle struct {
+	blocks.Block
+	queryrule  chan blocks.MsgChan
+	querystats chan blocks.MsgChan
+	inrule     blocks.MsgChan
+	in         blocks.MsgChan
+	clear      blocks.MsgChan
+	out        blocks.MsgChan
+	quit       blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewThrottle() blocks.BlockInterface {
+	return &Throttle{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Throttle) Setup() {
+	b.Kind = "Core"
+	b.Desc = "limits the rate of messages, overall or for each key, dropping, delaying or sampling those over the limit, or emits them only once they settle down or change"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.clear = b.InRoute("clear")
+	b.queryrule = b.QueryRoute("rule")
+	b.querystats = b.QueryRoute("stats")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// throttleKey is everything the block remembers about one key.
+type throttleKey struct {
+	tokens    float64
+	filled    time.Time     // when tokens was last topped up
+	queue     []interface{} // messages waiting in delay mode
+	latest    interface{}   // the message waiting in sample and debounce mode
+	waiting   bool
+	due       time.Time // when the waiting message can go
+	lastValue string    // the last value emitted in distinct mode
+	seen      time.Time // when the key last had a message in distinct mode
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Throttle) Run() {
+	var keyPath, valuePath string
+	var keyTree, valueTree *jee.TokenTree
+	mode := "drop"
+	rate := 1.0
+	intervalString := "1s"
+	interval := time.Second
+	burst := 1.0
+	maxQueue := 1000
+	quietString := "1s"
+	quiet := time.Second
+	ttlString := "1h"
+	ttl := time.Hour
+
+	var passed, dropped float64
+	keys := make(map[string]*throttleKey)
+
+	timer := time.NewTimer(time.Duration(1) * time.Second)
+	timer.Stop()
+	next := time.Time{}
+
+	// schedule makes sure the timer goes off by t
+	schedule := func(t time.Time) {
+		if !next.IsZero() && !t.Before(next) {
+			return
+		}
+		next = t
+		timer.Stop()
+		timer.Reset(t.Sub(time.Now()))
+	}
+
+	// refill tops up a key's bucket with the tokens it's earned since it was
+	// last topped up
+	refill := func(k *throttleKey, now time.Time) {
+		k.tokens += float64(now.Sub(k.filled)) / float64(interval) * rate
+		if k.tokens > burst {
+			k.tokens = burst
+		}
+		k.filled = now
+	}
+
+	// nextToken is when a key's bucket will next have a whole token in it
+	nextToken := func(k *throttleKey) time.Time {
+		return k.filled.Add(time.Duration((1 - k.tokens) / rate * float64(interval)))
+	}
+
+	// release sends whatever can now be sent, and returns false once a key
+	// has nothing left to say and can be forgotten
+	release := func(k *throttleKey, now time.Time) bool {
+		switch mode {
+		case "delay":
+			refill(k, now)
+			for len(k.queue) > 0 && k.tokens >= 1 {
+				k.tokens--
+				passed++
+				b.out <- k.queue[0]
+				k.queue = k.queue[1:]
+			}
+			if len(k.queue) > 0 {
+				schedule(nextToken(k))
+				return true
+			}
+		case "sample":
+			refill(k, now)
+			if k.waiting && k.tokens >= 1 {
+				k.tokens--
+				passed++
+				b.out <- k.latest
+				k.latest = nil
+				k.waiting = false
+			}
+			if k.waiting {
+				schedule(nextToken(k))
+				return true
+			}
+		case "debounce":
+			if k.waiting && !now.Before(k.due) {
+				passed++
+				b.out <- k.latest
+				k.latest = nil
+				k.waiting = false
+			}
+			if k.waiting {
+				schedule(k.due)
+				return true
+			}
+			return false
+		case "distinct":
+			// a key is forgotten once it has been idle for its time to live
+			if now.Sub(k.seen) < ttl {
+				schedule(k.seen.Add(ttl))
+				return true
+			}
+			return false
+		default:
+			refill(k, now)
+		}
+		// a full bucket is the same as a key we've never seen, so wait for
+		// it to fill up and then forget it
+		if k.tokens < burst {
+			schedule(k.filled.Add(time.Duration((burst - k.tokens) / rate * float64(interval))))
+			return true
+		}
+		return false
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newMode := "drop"
+			var err error
+			if util.KeyExists(ruleI, "Mode") {
+				newMode, err = util.ParseString(ruleI, "Mode")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			switch newMode {
+			case "drop", "delay", "sample", "debounce", "distinct":
+			default:
+				b.Error(errors.New("Mode must be one of drop, delay, sample, debounce or distinct"))
+				continue
+			}
+			newKeyPath, _ := util.ParseString(ruleI, "KeyPath")
+			var newKeyTree *jee.TokenTree
+			if newKeyPath != "" {
+				newKeyTree, err = util.BuildTokenTree(newKeyPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newValuePath := "."
+			if util.KeyExists(ruleI, "ValuePath") {
+				newValuePath, err = util.ParseRequiredString(ruleI, "ValuePath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newValueTree, err := util.BuildTokenTree(newValuePath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newRate := 1.0
+			if util.KeyExists(ruleI, "Rate") {
+				newRate, err = util.ParseFloat(ruleI, "Rate")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newRate <= 0 {
+				b.Error(errors.New("Rate must be greater than zero"))
+				continue
+			}
+			newIntervalString := "1s"
+			if util.KeyExists(ruleI, "Interval") {
+				newIntervalString, err = util.ParseString(ruleI, "Interval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newInterval, err := time.ParseDuration(newIntervalString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if newInterval <= 0 {
+				b.Error(errors.New("Interval must be greater than zero"))
+				continue
+			}
+			newBurst := 1.0
+			if util.KeyExists(ruleI, "Burst") {
+				newBurst, err = util.ParseFloat(ruleI, "Burst")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newBurst < 1 {
+				b.Error(errors.New("Burst must be at least 1"))
+				continue
+			}
+			newMaxQueue := 1000.0
+			if util.KeyExists(ruleI, "MaxQueue") {
+				newMaxQueue, err = util.ParseFloat(ruleI, "MaxQueue")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newMaxQueue < 1 {
+				b.Error(errors.New("MaxQueue must be at least 1"))
+				continue
+			}
+			newQuietString := "1s"
+			if util.KeyExists(ruleI, "Quiet") {
+				newQuietString, err = util.ParseString(ruleI, "Quiet")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newQuiet, err := time.ParseDuration(newQuietString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newTTLString := "1h"
+			if util.KeyExists(ruleI, "TimeToLive") {
+				newTTLString, err = util.ParseString(ruleI, "TimeToLive")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newTTL, err := time.ParseDuration(newTTLString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if newTTL <= 0 {
+				b.Error(errors.New("TimeToLive must be greater than zero"))
+				continue
+			}
+
+			mode = newMode
+			keyPath = newKeyPath
+			keyTree = newKeyTree
+			valuePath = newValuePath
+			valueTree = newValueTree
+			rate = newRate
+			intervalString = newIntervalString
+			interval = newInterval
+			burst = newBurst
+			maxQueue = int(newMaxQueue)
+			quietString = newQuietString
+			quiet = newQuiet
+			ttlString = newTTLString
+			ttl = newTTL
+
+			// a new rule starts afresh
+			keys = make(map[string]*throttleKey)
+			timer.Stop()
+			next = time.Time{}
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case <-b.clear:
+			keys = make(map[string]*throttleKey)
+			timer.Stop()
+			next = time.Time{}
+
+		case msg := <-b.in:
+			key := ""
+			if keyTree != nil {
+				kI, err := jee.Eval(keyTree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				key, err = countKey(kI)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			now := time.Now()
+			k, ok := keys[key]
+			if !ok {
+				k = &throttleKey{
+					tokens: burst,
+					filled: now,
+				}
+				keys[key] = k
+			}
+
+			switch mode {
+			case "drop":
+				refill(k, now)
+				if k.tokens < 1 {
+					dropped++
+					continue
+				}
+				k.tokens--
+				passed++
+				b.out <- msg
+				release(k, now)
+			case "delay":
+				if len(k.queue) >= maxQueue {
+					dropped++
+					continue
+				}
+				k.queue = append(k.queue, msg)
+				release(k, now)
+			case "sample":
+				if k.waiting {
+					// only the most recent message is kept
+					dropped++
+				}
+				k.latest = msg
+				k.waiting = true
+				release(k, now)
+			case "debounce":
+				if k.waiting {
+					dropped++
+				}
+				k.latest = msg
+				k.waiting = true
+				k.due = now.Add(quiet)
+				schedule(k.due)
+			case "distinct":
+				vI, err := jee.Eval(valueTree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				v, err := countKey(vI)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				k.seen = now
+				schedule(now.Add(ttl))
+				if ok && v == k.lastValue {
+					dropped++
+					continue
+				}
+				k.lastValue = v
+				passed++
+				b.out <- msg
+			}
+
+		case <-timer.C:
+			now := time.Now()
+			next = time.Time{}
+			for key, k := range keys {
+				if !release(k, now) {
+					delete(keys, key)
+				}
+			}
+
+		case c := <-b.querystats:
+			queued := 0
+			for _, k := range keys {
+				queued += len(k.queue)
+				if k.waiting {
+					queued++
+				}
+			}
+			c <- map[string]interface{}{
+				"Passed":  passed,
+				"Dropped": dropped,
+				"Queued":  float64(queued),
+				"Keys":    float64(len(keys)),
+			}
+
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Mode":       mode,
+				"KeyPath":    keyPath,
+				"ValuePath":  valuePath,
+				"Rate":       rate,
+				"Interval":   intervalString,
+				"Burst":      burst,
+				"MaxQueue":   float64(maxQueue),
+				"Quiet":      quietString,
+				"TimeToLive": ttlString,
+			}
+		}
+	}
+}
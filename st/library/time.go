@@ -0,0 +1,329 @@
+package library
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Time struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	out       blocks.MsgChan
+	failed    blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewTime() blocks.BlockInterface {
+	return &Time{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Time) Setup() {
+	b.Kind = "Parsers"
+	b.Desc = "parses the time found at Path, and adds it to the message as milliseconds since the epoch and as an RFC3339 string, optionally truncated"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+	b.failed = b.OutRoute("failed")
+}
+
+// timeLayouts are names for common layouts, which can be used in place of a
+// Go layout.
+var timeLayouts = map[string]string{
+	"rfc3339": time.RFC3339Nano,
+	"rfc1123": time.RFC1123,
+	"apache":  "02/Jan/2006:15:04:05 -0700",
+	"syslog":  time.Stamp,
+}
+
+// timeAutoLayouts are tried in turn when no layouts are given.
+var timeAutoLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999 -0700",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+	"02/Jan/2006:15:04:05 -0700",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC850,
+	time.RFC822Z,
+	time.RFC822,
+	time.RubyDate,
+	time.UnixDate,
+	time.ANSIC,
+	time.StampNano,
+}
+
+// epochTime reads a number since the epoch in the given unit, or guesses the
+// unit from its size.
+func epochTime(f float64, unit string) time.Time {
+	if unit == "" {
+		a := math.Abs(f)
+		switch {
+		case a < 1e11:
+			unit = "s"
+		case a < 1e14:
+			unit = "ms"
+		case a < 1e17:
+			unit = "us"
+		default:
+			unit = "ns"
+		}
+	}
+	switch unit {
+	case "s":
+		f *= 1e9
+	case "ms":
+		f *= 1e6
+	case "us":
+		f *= 1e3
+	}
+	return time.Unix(0, int64(f))
+}
+
+// parseTimeValue reads a time with the first of the layouts that fits,
+// guessing if there aren't any. Times without a zone are taken to be in loc.
+func parseTimeValue(v interface{}, layouts []string, loc *time.Location) (time.Time, error) {
+	if len(layouts) == 0 {
+		switch v := v.(type) {
+		case float64:
+			return epochTime(v, ""), nil
+		case string:
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return epochTime(f, ""), nil
+			}
+		}
+		layouts = timeAutoLayouts
+	}
+	for _, layout := range layouts {
+		if strings.HasPrefix(layout, "epoch_") {
+			f, ok := v.(float64)
+			if s, isString := v.(string); isString {
+				var err error
+				f, err = strconv.ParseFloat(s, 64)
+				ok = err == nil
+			}
+			if ok {
+				return epochTime(f, strings.TrimPrefix(layout, "epoch_")), nil
+			}
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if named, ok := timeLayouts[layout]; ok {
+			layout = named
+		}
+		t, err := time.ParseInLocation(layout, strings.TrimSpace(s), loc)
+		if err != nil {
+			continue
+		}
+		// layouts like syslog's leave out the year
+		if t.Year() == 0 {
+			t = t.AddDate(time.Now().In(loc).Year(), 0, 0)
+		}
+		return t, nil
+	}
+	return time.Time{}, errors.New("could not parse the time")
+}
+
+// truncateTime rounds a time down to the start of its day, week, month or
+// year in loc, or to a multiple of a duration on loc's clock.
+func truncateTime(t time.Time, unit string, d time.Duration, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch unit {
+	case "":
+		return t
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		// weeks start on Monday
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, loc)
+	}
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(d).Add(-shift).In(loc)
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Time) Run() {
+	var path, truncateString string
+	var tree *jee.TokenTree
+	var truncate time.Duration
+	layouts := []string{}
+	timezone := "UTC"
+	loc := time.UTC
+	outputTimezone := "UTC"
+	outputLoc := time.UTC
+	outputPath := ".time"
+
+	fail := func(msg interface{}, err error) {
+		b.failed <- map[string]interface{}{
+			"msg":   msg,
+			"error": err.Error(),
+		}
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newPath, err := util.ParseRequiredString(ruleI, "Path")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newTree, err := util.BuildTokenTree(newPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newLayouts := []string{}
+			if util.KeyExists(ruleI, "Layouts") {
+				newLayouts, err = util.ParseArrayString(ruleI, "Layouts")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if newLayouts == nil {
+					newLayouts = []string{}
+				}
+			}
+			newTimezone := "UTC"
+			if util.KeyExists(ruleI, "Timezone") {
+				newTimezone, err = util.ParseRequiredString(ruleI, "Timezone")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newLoc, err := time.LoadLocation(newTimezone)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newOutputTimezone := "UTC"
+			if util.KeyExists(ruleI, "OutputTimezone") {
+				newOutputTimezone, err = util.ParseRequiredString(ruleI, "OutputTimezone")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newOutputLoc, err := time.LoadLocation(newOutputTimezone)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newOutputPath := ".time"
+			if util.KeyExists(ruleI, "OutputPath") {
+				newOutputPath, err = util.ParseRequiredString(ruleI, "OutputPath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newTruncateString, _ := util.ParseString(ruleI, "Truncate")
+			var newTruncate time.Duration
+			switch newTruncateString {
+			case "", "day", "week", "month", "year":
+			default:
+				newTruncate, err = time.ParseDuration(newTruncateString)
+				if err == nil && newTruncate <= 0 {
+					err = errors.New("Truncate must be greater than zero")
+				}
+			}
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			path = newPath
+			tree = newTree
+			layouts = newLayouts
+			timezone = newTimezone
+			loc = newLoc
+			outputTimezone = newOutputTimezone
+			outputLoc = newOutputLoc
+			outputPath = newOutputPath
+			truncateString = newTruncateString
+			truncate = newTruncate
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case msg := <-b.in:
+			if tree == nil {
+				continue
+			}
+			in, ok := msg.(map[string]interface{})
+			if !ok {
+				fail(msg, errors.New("can only add times to messages that are objects"))
+				continue
+			}
+			tI, err := jee.Eval(tree, msg)
+			if err != nil {
+				fail(msg, err)
+				continue
+			}
+			if tI == nil {
+				fail(msg, errors.New("could not find a time at "+path))
+				continue
+			}
+			t, err := parseTimeValue(tI, layouts, loc)
+			if err != nil {
+				fail(msg, err)
+				continue
+			}
+			unit := truncateString
+			if truncate > 0 {
+				unit = "duration"
+			}
+			t = truncateTime(t, unit, truncate, outputLoc)
+
+			// copy the message rather than change one other blocks may hold
+			out := recCopy(in)
+			err = setPath(out, outputPath, map[string]interface{}{
+				"ms":      toMs(t),
+				"rfc3339": t.Format(time.RFC3339Nano),
+			})
+			if err != nil {
+				fail(msg, err)
+				continue
+			}
+			b.out <- out
+
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Path":           path,
+				"Layouts":        layouts,
+				"Timezone":       timezone,
+				"OutputTimezone": outputTimezone,
+				"OutputPath":     outputPath,
+				"Truncate":       truncateString,
+			}
+		}
+	}
+}
@@ -2,6 +2,8 @@ package library
 
 import (
 	"errors"
+	"math"
+	"sort"
 	"time"
 
 	"github.com/nytlabs/gojee"                 // jee
@@ -12,13 +14,14 @@ import (
 // specify those channels we're going to use to communicate with streamtools
 type Timeseries struct {
 	blocks.Block
-	queryrule  chan blocks.MsgChan
-	querystate chan blocks.MsgChan
-	inrule     blocks.MsgChan
-	inpoll     blocks.MsgChan
-	in         blocks.MsgChan
-	out        blocks.MsgChan
-	quit       blocks.MsgChan
+	queryrule       chan blocks.MsgChan
+	querystate      chan blocks.MsgChan
+	queryparamstate chan blocks.Query
+	inrule          blocks.MsgChan
+	inpoll          blocks.MsgChan
+	in              blocks.MsgChan
+	out             blocks.MsgChan
+	quit            blocks.MsgChan
 }
 
 type tsDataPoint struct {
@@ -30,6 +33,71 @@ type tsData struct {
 	Values []tsDataPoint
 }
 
+// insert adds a point, keeping the series in time order.
+func (d *tsData) insert(p tsDataPoint) {
+	i := sort.Search(len(d.Values), func(i int) bool {
+		return d.Values[i].Timestamp > p.Timestamp
+	})
+	d.Values = append(d.Values, tsDataPoint{})
+	copy(d.Values[i+1:], d.Values[i:])
+	d.Values[i] = p
+}
+
+// trim drops the oldest points until there are at most numSamples, and none
+// more than retention older than the newest.
+func (d *tsData) trim(numSamples int, retention time.Duration) {
+	if numSamples > 0 && len(d.Values) > numSamples {
+		d.Values = d.Values[len(d.Values)-numSamples:]
+	}
+	if retention > 0 && len(d.Values) > 0 {
+		oldest := d.Values[len(d.Values)-1].Timestamp - float64(retention/time.Millisecond)
+		i := sort.Search(len(d.Values), func(i int) bool {
+			return d.Values[i].Timestamp >= oldest
+		})
+		d.Values = d.Values[i:]
+	}
+}
+
+// downsample aggregates the points into buckets step milliseconds wide. Each
+// bucket is stamped with the time it starts.
+func (d tsData) downsample(step float64, agg string) tsData {
+	out := tsData{Values: []tsDataPoint{}}
+	var state *aggState
+	var start, first, last float64
+	flush := func() {
+		if state == nil {
+			return
+		}
+		var v float64
+		switch agg {
+		case "first":
+			v = first
+		case "last":
+			v = last
+		default:
+			v = state.value(agg).(float64)
+		}
+		out.Values = append(out.Values, tsDataPoint{Timestamp: start, Value: v})
+	}
+	for _, p := range d.Values {
+		bucket := math.Floor(p.Timestamp/step) * step
+		if state == nil || bucket != start {
+			flush()
+			state = &aggState{}
+			start = bucket
+			first = p.Value
+		}
+		op := agg
+		if op == "first" || op == "last" {
+			op = "count"
+		}
+		state.add(op, p.Value)
+		last = p.Value
+	}
+	flush()
+	return out
+}
+
 // we need to build a simple factory so that streamtools can make new blocks of this kind
 func NewTimeseries() blocks.BlockInterface {
 	return &Timeseries{}
@@ -38,11 +106,12 @@ func NewTimeseries() blocks.BlockInterface {
 // Setup is called once before running the block. We build up the channels and specify what kind of block this is.
 func (b *Timeseries) Setup() {
 	b.Kind = "Stats"
-	b.Desc = "stores an array of values for a specified Path along with timestamps"
+	b.Desc = "stores an array of values for a specified Path along with timestamps, optionally for each value of GroupPath"
 	b.in = b.InRoute("in")
 	b.inrule = b.InRoute("rule")
 	b.queryrule = b.QueryRoute("rule")
 	b.querystate = b.QueryRoute("timeseries")
+	b.queryparamstate = b.QueryParamRoute("timeseries")
 	b.inpoll = b.InRoute("poll")
 	b.quit = b.Quit()
 	b.out = b.Broadcast()
@@ -51,17 +120,50 @@ func (b *Timeseries) Setup() {
 // Run is the block's main loop. Here we listen on the different channels we set up.
 func (b *Timeseries) Run() {
 
-	var err error
-	//var path, lagStr string
-	var path string
-	var tree *jee.TokenTree
-	//var lag time.Duration
-	var data tsData
+	var path, timePath, groupPath, retentionStr string
+	var tree, timeTree, groupTree *jee.TokenTree
+	var retention time.Duration
 	var numSamples float64
 
 	// defaults
 	numSamples = 1
 
+	// every series is keyed by its group, which is "" without a GroupPath
+	series := make(map[string]*tsData)
+
+	groups := func() []string {
+		keys := make([]string, 0, len(series))
+		for key := range series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	// state builds the query response from one series, or a map of them
+	state := func(keys []string, each func(tsData) tsData) map[string]interface{} {
+		if groupTree == nil {
+			data := tsData{Values: []tsDataPoint{}}
+			if s, ok := series[""]; ok {
+				data = each(*s)
+			}
+			return map[string]interface{}{
+				"timeseries": data,
+			}
+		}
+		all := make(map[string]interface{})
+		for _, key := range keys {
+			if s, ok := series[key]; ok {
+				all[key] = each(*s)
+			}
+		}
+		return map[string]interface{}{
+			"timeseries": map[string]interface{}{
+				"Series": all,
+			},
+		}
+	}
+
 	for {
 		select {
 		case ruleI := <-b.inrule:
@@ -70,36 +172,66 @@ func (b *Timeseries) Run() {
 			if !ok {
 				b.Error(errors.New("could not assert rule to map"))
 			}
-			path, err = util.ParseString(rule, "Path")
+			newPath, err := util.ParseString(rule, "Path")
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-			tree, err = util.BuildTokenTree(path)
+			newTree, err := util.BuildTokenTree(newPath)
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-			/*
-				lagStr, err = util.ParseString(rule, "Lag")
+			newTimePath, _ := util.ParseString(rule, "TimePath")
+			var newTimeTree *jee.TokenTree
+			if newTimePath != "" {
+				newTimeTree, err = util.BuildTokenTree(newTimePath)
 				if err != nil {
 					b.Error(err)
 					continue
 				}
-				lag, err = time.ParseDuration(lagStr)
+			}
+			newGroupPath, _ := util.ParseString(rule, "GroupPath")
+			var newGroupTree *jee.TokenTree
+			if newGroupPath != "" {
+				newGroupTree, err = util.BuildTokenTree(newGroupPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newRetentionStr, _ := util.ParseString(rule, "Retention")
+			newRetention := time.Duration(0)
+			if newRetentionStr != "" {
+				newRetention, err = time.ParseDuration(newRetentionStr)
 				if err != nil {
 					b.Error(err)
 					continue
 				}
-			*/
-			numSamples, err = util.ParseFloat(rule, "NumSamples")
-			if err != nil {
-				b.Error(err)
-				continue
 			}
-			data = tsData{
-				Values: make([]tsDataPoint, int(numSamples)),
+			newNumSamples := 0.0
+			if util.KeyExists(rule, "NumSamples") {
+				newNumSamples, err = util.ParseFloat(rule, "NumSamples")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
 			}
+			if newNumSamples <= 0 && newRetention <= 0 {
+				b.Error(errors.New("a timeseries needs a NumSamples or a Retention to bound it"))
+				continue
+			}
+
+			path = newPath
+			tree = newTree
+			timePath = newTimePath
+			timeTree = newTimeTree
+			groupPath = newGroupPath
+			groupTree = newGroupTree
+			retentionStr = newRetentionStr
+			retention = newRetention
+			numSamples = newNumSamples
+			series = make(map[string]*tsData)
 
 		case <-b.quit:
 			// quit * time.Second the block
@@ -108,9 +240,6 @@ func (b *Timeseries) Run() {
 			if tree == nil {
 				continue
 			}
-			if data.Values == nil {
-				continue
-			}
 			// deal with inbound data
 			v, err := jee.Eval(tree, msg)
 			if err != nil {
@@ -125,41 +254,112 @@ func (b *Timeseries) Run() {
 				val = float64(v)
 			case float64:
 				val = v
+			default:
+				b.Error(errors.New("timeseries values must be numbers"))
+				continue
 			}
 
-			//t := float64(time.Now().Add(-lag).Unix())
 			t := float64(time.Now().UnixNano() / 1000000)
+			if timeTree != nil {
+				tI, err := jee.Eval(timeTree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				ts, err := parseEventTime(tI)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				t = float64(ts.UnixNano() / 1000000)
+			}
+
+			key := ""
+			if groupTree != nil {
+				g, err := jee.Eval(groupTree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if g == nil {
+					b.Error(errors.New("couldn't find a group at " + groupPath))
+					continue
+				}
+				key, err = countKey(g)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
 
-			d := tsDataPoint{
+			s, ok := series[key]
+			if !ok {
+				s = &tsData{Values: []tsDataPoint{}}
+				series[key] = s
+			}
+			s.insert(tsDataPoint{
 				Timestamp: t,
 				Value:     val,
-			}
-			data.Values = append(data.Values[1:], d)
+			})
+			s.trim(int(numSamples), retention)
 		case MsgChan := <-b.queryrule:
 			// deal with a query request
 			MsgChan <- map[string]interface{}{
-				//"Window":     lagStr,
 				"Path":       path,
 				"NumSamples": numSamples,
+				"TimePath":   timePath,
+				"GroupPath":  groupPath,
+				"Retention":  retentionStr,
 			}
 		case MsgChan := <-b.querystate:
-			out := map[string]interface{}{
-				"timeseries": data,
+			MsgChan <- state(groups(), func(d tsData) tsData { return d })
+		case q := <-b.queryparamstate:
+			keys := groups()
+			if _, ok := q.Params["key"]; ok {
+				keys = q.Params["key"]
 			}
-			MsgChan <- out
-		case <-b.inpoll:
-			outArray := make([]interface{}, len(data.Values))
-			for i, d := range data.Values {
-				di := map[string]interface{}{
-					"timestamp": d.Timestamp,
-					"value":     d.Value,
+			each := func(d tsData) tsData { return d }
+			if stepStr := q.Params.Get("step"); stepStr != "" {
+				step, err := time.ParseDuration(stepStr)
+				if err != nil || step < time.Millisecond {
+					b.Error(errors.New("step must be a duration of at least 1ms"))
+					q.RespChan <- map[string]interface{}{}
+					continue
+				}
+				agg := q.Params.Get("agg")
+				if agg == "" {
+					agg = "mean"
+				}
+				switch agg {
+				case "mean", "sum", "min", "max", "count", "first", "last":
+				default:
+					b.Error(errors.New("agg must be one of mean, sum, min, max, count, first or last"))
+					q.RespChan <- map[string]interface{}{}
+					continue
 				}
-				outArray[i] = di
+				stepMs := float64(step / time.Millisecond)
+				each = func(d tsData) tsData { return d.downsample(stepMs, agg) }
 			}
-			out := map[string]interface{}{
-				"timeseries": outArray,
+			q.RespChan <- state(keys, each)
+		case <-b.inpoll:
+			for _, key := range groups() {
+				data := series[key]
+				outArray := make([]interface{}, len(data.Values))
+				for i, d := range data.Values {
+					di := map[string]interface{}{
+						"timestamp": d.Timestamp,
+						"value":     d.Value,
+					}
+					outArray[i] = di
+				}
+				out := map[string]interface{}{
+					"timeseries": outArray,
+				}
+				if groupTree != nil {
+					out["group"] = key
+				}
+				b.out <- out
 			}
-			b.out <- out
 		}
 	}
 }
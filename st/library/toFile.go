@@ -2,10 +2,19 @@ package library
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"text/template"
+	"time"
 
+	"github.com/nytlabs/gojee"                 // jee
 	"github.com/nytlabs/streamtools/st/blocks" // blocks
 	"github.com/nytlabs/streamtools/st/util"
 )
@@ -28,7 +37,7 @@ func NewToFile() blocks.BlockInterface {
 // Setup is called once before running the block. We build up the channels and specify what kind of block this is.
 func (b *ToFile) Setup() {
 	b.Kind = "Data Stores"
-	b.Desc = "writes messages, separated by newlines, to a file on the local filesystem"
+	b.Desc = "writes messages, separated by newlines, to a file on the local filesystem, optionally rotating and compressing the file"
 	b.in = b.InRoute("in")
 	b.inrule = b.InRoute("rule")
 	b.queryrule = b.QueryRoute("rule")
@@ -36,46 +45,441 @@ func (b *ToFile) Setup() {
 	b.out = b.Broadcast()
 }
 
+// countingWriter keeps track of how many bytes have passed through it.
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// outFile is an open output file along with the writers layered on top of it.
+// Messages are written to w, and counter keeps track of the file's size on
+// disk, which with Gzip is its compressed size.
+type outFile struct {
+	name    string
+	file    *os.File
+	gz      *gzip.Writer
+	buf     *bufio.Writer
+	counter *countingWriter
+	w       io.Writer
+	csv     *csv.Writer
+	opened  time.Time
+	written bool
+}
+
+// openOutFile opens a file to write to, emptying it first if truncate is set
+// and adding to the end of it otherwise.
+func openOutFile(name string, truncate, compress bool) (*outFile, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if truncate {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(name, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f := &outFile{
+		name:   name,
+		file:   file,
+		opened: time.Now(),
+	}
+	if compress {
+		// appending a new gzip member to an existing file is still valid gzip.
+		// compressed bytes are only counted as they reach the file.
+		f.counter = &countingWriter{w: file, count: info.Size()}
+		f.gz = gzip.NewWriter(f.counter)
+		f.buf = bufio.NewWriter(f.gz)
+		f.w = f.buf
+	} else {
+		f.buf = bufio.NewWriter(file)
+		f.counter = &countingWriter{w: f.buf, count: info.Size()}
+		f.w = f.counter
+	}
+	f.csv = csv.NewWriter(f.w)
+	return f, nil
+}
+
+func (f *outFile) flush(sync bool) error {
+	err := f.buf.Flush()
+	if err != nil {
+		return err
+	}
+	if f.gz != nil {
+		err = f.gz.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if sync {
+		return f.file.Sync()
+	}
+	return nil
+}
+
+func (f *outFile) close(sync bool) error {
+	err := f.buf.Flush()
+	if err == nil && f.gz != nil {
+		err = f.gz.Close()
+	}
+	if err == nil && sync {
+		err = f.file.Sync()
+	}
+	closeErr := f.file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// csvValue renders a single value for a CSV cell.
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(out)
+}
+
 // Run is the block's main loop. Here we listen on the different channels we set up.
 func (b *ToFile) Run() {
 	var err error
-	var file *os.File
-	var filename string
+	var file *outFile
+	var filename, format, path, rotateString, flushString, fsync string
+	var nameTemplate *template.Template
+	var columns, headers []string
+	var columnTrees []*jee.TokenTree
+	var pathTree *jee.TokenTree
+	var appendTo, compress bool
+	var maxBytes float64
+	var rotateEvery, flushEvery time.Duration
+	seq := 0
+
+	format = "json"
+	fsync = "never"
+	columns = []string{}
+	headers = []string{}
+
+	rotateTimer := time.NewTimer(time.Duration(1) * time.Second)
+	rotateTimer.Stop()
+	flushTicker := time.NewTicker(time.Duration(1) * time.Second)
+	flushTicker.Stop()
+
+	closeFile := func() {
+		if file == nil {
+			return
+		}
+		err := file.close(fsync != "never")
+		if err != nil {
+			b.Error(err)
+		}
+		file = nil
+	}
+
+	// nextName renders the filename for the next file
+	nextName := func() (string, error) {
+		var name bytes.Buffer
+		err := nameTemplate.Execute(&name, newRollData(b.Id, time.Now(), seq))
+		if err != nil {
+			return "", err
+		}
+		seq++
+		return name.String(), nil
+	}
+
+	openFile := func(name string, truncate bool) {
+		f, err := openOutFile(name, truncate, compress)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		if format == "csv" && len(headers) > 0 && f.counter.count == 0 {
+			f.csv.Write(headers)
+			f.csv.Flush()
+		}
+		file = f
+		if rotateEvery > 0 {
+			rotateTimer.Reset(rotateEvery)
+		}
+	}
+
+	// rotate finishes the current file and starts the next one. A rotation
+	// never empties a file, so if the next file already exists it is added to.
+	rotate := func() {
+		if file == nil || !file.written {
+			return
+		}
+		old := file.name
+		name, err := nextName()
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		closeFile()
+		if name == old {
+			// the filename doesn't change between rotations, so move the
+			// finished file out of the way before starting again
+			err = os.Rename(old, fmt.Sprintf("%s.%d", old, time.Now().UnixNano()))
+			if err != nil {
+				b.Error(err)
+			}
+		}
+		openFile(name, false)
+	}
 
 	for {
 		select {
 		case msgI := <-b.inrule:
-			filename, err = util.ParseString(msgI, "Filename")
+			newFilename, err := util.ParseRequiredString(msgI, "Filename")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpl, err := template.New("filename").Parse(newFilename)
 			if err != nil {
 				b.Error(err)
+				continue
 			}
 
-			file, err = os.Create(filename)
+			newFormat := "json"
+			if util.KeyExists(msgI, "Format") {
+				newFormat, err = util.ParseString(msgI, "Format")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			newColumns := []string{}
+			newHeaders := []string{}
+			newTrees := []*jee.TokenTree{}
+			var newPathTree *jee.TokenTree
+			newPath, _ := util.ParseString(msgI, "Path")
+
+			switch newFormat {
+			case "json":
+			case "csv":
+				newColumns, err = util.ParseArrayString(msgI, "Columns")
+				if err != nil || len(newColumns) == 0 {
+					b.Error(errors.New("csv format needs an array of Columns"))
+					continue
+				}
+				for _, c := range newColumns {
+					tree, err := util.BuildTokenTree(c)
+					if err != nil {
+						b.Error(err)
+						break
+					}
+					newTrees = append(newTrees, tree)
+				}
+				if len(newTrees) != len(newColumns) {
+					continue
+				}
+				if util.KeyExists(msgI, "Headers") {
+					newHeaders, err = util.ParseArrayString(msgI, "Headers")
+					if err != nil {
+						b.Error(err)
+						continue
+					}
+				}
+				if len(newHeaders) > 0 && len(newHeaders) != len(newColumns) {
+					b.Error(errors.New("there must be a header for every column"))
+					continue
+				}
+			case "raw":
+				newPathTree, err = util.BuildTokenTree(newPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			default:
+				b.Error(errors.New("Format must be one of json, csv or raw"))
+				continue
+			}
+
+			newRotateString, _ := util.ParseString(msgI, "RotateInterval")
+			newRotate := time.Duration(0)
+			if newRotateString != "" {
+				newRotate, err = time.ParseDuration(newRotateString)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			newFlushString, _ := util.ParseString(msgI, "FlushInterval")
+			newFlush := time.Duration(0)
+			if newFlushString != "" {
+				newFlush, err = time.ParseDuration(newFlushString)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			newFsync := "never"
+			if util.KeyExists(msgI, "Fsync") {
+				newFsync, err = util.ParseString(msgI, "Fsync")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if newFsync != "never" && newFsync != "flush" && newFsync != "close" {
+				b.Error(errors.New("Fsync must be one of never, flush or close"))
+				continue
+			}
+
+			newMaxBytes := 0.0
+			if util.KeyExists(msgI, "MaxBytes") {
+				newMaxBytes, err = util.ParseFloat(msgI, "MaxBytes")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			closeFile()
+
+			filename = newFilename
+			nameTemplate = tmpl
+			format = newFormat
+			columns = newColumns
+			headers = newHeaders
+			columnTrees = newTrees
+			path = newPath
+			pathTree = newPathTree
+			rotateString = newRotateString
+			rotateEvery = newRotate
+			flushString = newFlushString
+			flushEvery = newFlush
+			fsync = newFsync
+			maxBytes = newMaxBytes
+			appendTo, _ = util.ParseBool(msgI, "Append")
+			compress, _ = util.ParseBool(msgI, "Gzip")
+
+			rotateTimer.Stop()
+			flushTicker.Stop()
+			if flushEvery > 0 {
+				flushTicker = time.NewTicker(flushEvery)
+			}
+
+			name, err := nextName()
 			if err != nil {
 				b.Error(err)
+				continue
 			}
+			openFile(name, !appendTo)
 
 		case <-b.quit:
 			// quit the block
+			closeFile()
+			flushTicker.Stop()
+			return
+
+		case <-rotateTimer.C:
+			rotate()
+			if file != nil && rotateEvery > 0 {
+				rotateTimer.Reset(rotateEvery)
+			}
+
+		case <-flushTicker.C:
 			if file != nil {
-				file.Close()
+				err = file.flush(fsync == "flush")
+				if err != nil {
+					b.Error(err)
+				}
+				if maxBytes > 0 && float64(file.counter.count) >= maxBytes {
+					rotate()
+				}
 			}
-			return
+
 		case msg := <-b.in:
 			// deal with inbound data
-			writer := bufio.NewWriter(file)
-			msgStr, err := json.Marshal(msg)
-			if err != nil {
-				b.Error(err)
+			if file == nil {
+				b.Error(errors.New("no file is open. Please check your block settings."))
 				continue
 			}
-			fmt.Fprintln(writer, string(msgStr))
-			writer.Flush()
+
+			switch format {
+			case "json":
+				msgStr, err := json.Marshal(msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				fmt.Fprintln(file.w, string(msgStr))
+			case "csv":
+				record := make([]string, len(columnTrees))
+				for i, tree := range columnTrees {
+					v, err := jee.Eval(tree, msg)
+					if err != nil {
+						b.Error(err)
+					}
+					record[i] = csvValue(v)
+				}
+				file.csv.Write(record)
+				file.csv.Flush()
+			case "raw":
+				v, err := jee.Eval(pathTree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				s, ok := v.(string)
+				if !ok {
+					b.Error(errors.New("raw format needs Path to point at a string"))
+					continue
+				}
+				fmt.Fprintln(file.w, s)
+			}
+			file.written = true
+
+			// with no flush interval every message is flushed, as it always has been
+			if flushEvery == 0 {
+				err = file.flush(fsync == "flush")
+				if err != nil {
+					b.Error(err)
+				}
+			}
+
+			if maxBytes > 0 && float64(file.counter.count) >= maxBytes {
+				rotate()
+			}
 
 		case MsgChan := <-b.queryrule:
 			// deal with a query request
 			MsgChan <- map[string]interface{}{
-				"Filename": filename,
+				"Filename":       filename,
+				"Append":         appendTo,
+				"Gzip":           compress,
+				"Format":         format,
+				"Columns":        columns,
+				"Headers":        headers,
+				"Path":           path,
+				"MaxBytes":       maxBytes,
+				"RotateInterval": rotateString,
+				"FlushInterval":  flushString,
+				"Fsync":          fsync,
 			}
 		}
 	}
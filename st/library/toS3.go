@@ -0,0 +1,451 @@
+package library
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/mikedewar/aws4"
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type ToS3 struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	flush     blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewToS3() blocks.BlockInterface {
+	return &ToS3{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *ToS3) Setup() {
+	b.Kind = "Data Stores"
+	b.Desc = "writes messages as gzipped, newline separated JSON objects to S3 compatible storage, rolling objects by size, count or age"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.flush = b.InRoute("flush")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+}
+
+// rollData is what key and filename templates are executed against when
+// output is rolled over to a new object or file.
+type rollData struct {
+	Id     string
+	Date   string
+	Year   string
+	Month  string
+	Day    string
+	Hour   string
+	Minute string
+	Unix   int64
+	Seq    int
+}
+
+func newRollData(id string, t time.Time, seq int) rollData {
+	t = t.UTC()
+	return rollData{
+		Id:     id,
+		Date:   t.Format("2006-01-02"),
+		Year:   t.Format("2006"),
+		Month:  t.Format("01"),
+		Day:    t.Format("02"),
+		Hour:   t.Format("15"),
+		Minute: t.Format("04"),
+		Unix:   t.Unix(),
+		Seq:    seq,
+	}
+}
+
+// s3Object accumulates gzipped messages until it is time to roll it.
+type s3Object struct {
+	buf    bytes.Buffer
+	gz     *gzip.Writer
+	opened time.Time
+	count  int
+	size   int
+}
+
+func newS3Object() *s3Object {
+	o := &s3Object{
+		opened: time.Now(),
+	}
+	o.gz = gzip.NewWriter(&o.buf)
+	return o
+}
+
+func (o *s3Object) write(line []byte) error {
+	n, err := o.gz.Write(append(line, '\n'))
+	o.size += n
+	o.count++
+	return err
+}
+
+type s3Config struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+// failed uploads are retried, waiting longer each time up to a limit. Each
+// attempt gives up after s3Timeout, and at most s3MaxUploads objects are
+// uploaded or waiting to be retried at once.
+const (
+	s3MinBackoff      = time.Duration(1) * time.Second
+	s3MaxBackoff      = time.Duration(1) * time.Minute
+	s3Timeout         = time.Duration(5) * time.Minute
+	s3MaxUploads      = 8
+	s3DefaultMaxBytes = 64 * 1024 * 1024
+)
+
+// s3Escape escapes each segment of an object key for use in a URL path,
+// leaving only the characters S3 signing leaves alone.
+func s3Escape(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		var escaped bytes.Buffer
+		for _, c := range []byte(segment) {
+			if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+				c == '-' || c == '_' || c == '.' || c == '~' {
+				escaped.WriteByte(c)
+			} else {
+				fmt.Fprintf(&escaped, "%%%02X", c)
+			}
+		}
+		segments[i] = escaped.String()
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3Spill saves an object that couldn't be uploaded to dir, so it can be
+// uploaded by hand later.
+func s3Spill(dir, key string, body []byte) (string, error) {
+	path := filepath.Join(dir, strings.Replace(key, "/", "_", -1))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = f.Write(body)
+	return path, err
+}
+
+func s3Put(client *http.Client, cfg s3Config, key string, body []byte) error {
+	url := strings.TrimRight(cfg.endpoint, "/") + "/" + s3Escape(cfg.bucket) + "/" + s3Escape(key)
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(body)
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+
+	if cfg.accessKey != "" {
+		keys := &aws4.Keys{
+			AccessKey: cfg.accessKey,
+			SecretKey: cfg.secretKey,
+		}
+		service := &aws4.Service{
+			Name:   "s3",
+			Region: cfg.region,
+		}
+		err = service.Sign(keys, req)
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(fmt.Sprintf("could not upload %s: %s %s", key, resp.Status, string(msg)))
+	}
+	return nil
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *ToS3) Run() {
+	var cfg s3Config
+	var obj *s3Object
+	var keyTemplate *template.Template
+	var maxAge time.Duration
+	var maxAgeString string
+	var err error
+	var uploads sync.WaitGroup
+	quitting := make(chan bool)
+
+	keyTemplateString := "{{.Id}}/dt={{.Date}}/hour={{.Hour}}/{{.Unix}}-{{.Seq}}.json.gz"
+	keyTemplate = template.Must(template.New("key").Parse(keyTemplateString))
+	cfg.region = "us-east-1"
+	spillDirectory := os.TempDir()
+	maxBytes := s3DefaultMaxBytes
+	maxCount := 0
+	seq := 0
+
+	transport := http.Transport{
+		Dial: dialTimeout,
+	}
+
+	client := &http.Client{
+		Transport: &transport,
+		Timeout:   s3Timeout,
+	}
+
+	// uploading holds a slot for every object being uploaded or retried
+	uploading := make(chan bool, s3MaxUploads)
+
+	ageTimer := time.NewTimer(time.Duration(1) * time.Second)
+	ageTimer.Stop()
+
+	// stopAgeTimer stops the timer and empties its channel, so that a tick
+	// meant for one object can't roll the next one early
+	stopAgeTimer := func() {
+		if !ageTimer.Stop() {
+			select {
+			case <-ageTimer.C:
+			default:
+			}
+		}
+	}
+
+	// upload puts an object, retrying with backoff until it's stored. Once
+	// the block is quitting it makes one last attempt, then saves the object
+	// to the spill directory rather than lose it.
+	upload := func(c s3Config, key string, body []byte, spill string) {
+		defer uploads.Done()
+		defer func() { <-uploading }()
+		backoff := s3MinBackoff
+		for {
+			err := s3Put(client, c, key, body)
+			if err == nil {
+				return
+			}
+			select {
+			case <-quitting:
+				path, spillErr := s3Spill(spill, key, body)
+				if spillErr != nil {
+					b.Error(fmt.Errorf("%s, and could not save it: %s", err.Error(), spillErr.Error()))
+				} else {
+					b.Error(fmt.Errorf("%s, saved it to %s instead", err.Error(), path))
+				}
+				return
+			default:
+			}
+			b.Error(fmt.Errorf("%s, retrying in %s", err.Error(), backoff))
+			select {
+			case <-time.After(backoff):
+			case <-quitting:
+			}
+			backoff *= 2
+			if backoff > s3MaxBackoff {
+				backoff = s3MaxBackoff
+			}
+		}
+	}
+
+	// roll closes the current object and uploads it in the background
+	roll := func() {
+		stopAgeTimer()
+		if obj == nil || obj.count == 0 {
+			return
+		}
+		err := obj.gz.Close()
+		if err != nil {
+			b.Error(err)
+			obj = nil
+			return
+		}
+		var key bytes.Buffer
+		err = keyTemplate.Execute(&key, newRollData(b.Id, obj.opened, seq))
+		seq++
+		if err != nil {
+			b.Error(err)
+			obj = nil
+			return
+		}
+		body := obj.buf.Bytes()
+		obj = nil
+		select {
+		case uploading <- true:
+		default:
+			// too many uploads are failing to keep another in memory
+			path, err := s3Spill(spillDirectory, key.String(), body)
+			if err != nil {
+				b.Error(fmt.Errorf("too many uploads in progress to upload %s, and could not save it: %s", key.String(), err.Error()))
+			} else {
+				b.Error(fmt.Errorf("too many uploads in progress to upload %s, saved it to %s instead", key.String(), path))
+			}
+			return
+		}
+		uploads.Add(1)
+		go upload(cfg, key.String(), body, spillDirectory)
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			// anything buffered under the old rule is written with the old rule
+			roll()
+
+			var newCfg s3Config
+			newCfg.endpoint, err = util.ParseRequiredString(ruleI, "Endpoint")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newCfg.bucket, err = util.ParseRequiredString(ruleI, "Bucket")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newCfg.region, err = util.ParseString(ruleI, "Region")
+			if err != nil || newCfg.region == "" {
+				newCfg.region = "us-east-1"
+			}
+			newCfg.accessKey, _ = util.ParseString(ruleI, "AccessKey")
+			newCfg.secretKey, _ = util.ParseString(ruleI, "AccessSecret")
+
+			newSpillDirectory := os.TempDir()
+			if util.KeyExists(ruleI, "SpillDirectory") {
+				newSpillDirectory, err = util.ParseRequiredString(ruleI, "SpillDirectory")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			newKeyTemplateString := keyTemplateString
+			newKeyTemplate := keyTemplate
+			if util.KeyExists(ruleI, "KeyTemplate") {
+				newKeyTemplateString, err = util.ParseRequiredString(ruleI, "KeyTemplate")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				newKeyTemplate, err = template.New("key").Parse(newKeyTemplateString)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			newMaxBytes := s3DefaultMaxBytes
+			if util.KeyExists(ruleI, "MaxBytes") {
+				newMaxBytes, err = util.ParseInt(ruleI, "MaxBytes")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newMaxCount := 0
+			if util.KeyExists(ruleI, "MaxCount") {
+				newMaxCount, err = util.ParseInt(ruleI, "MaxCount")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newMaxAge := time.Duration(0)
+			newMaxAgeString, _ := util.ParseString(ruleI, "MaxAge")
+			if newMaxAgeString != "" {
+				newMaxAge, err = time.ParseDuration(newMaxAgeString)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			cfg = newCfg
+			spillDirectory = newSpillDirectory
+			keyTemplateString = newKeyTemplateString
+			keyTemplate = newKeyTemplate
+			maxBytes = newMaxBytes
+			maxCount = newMaxCount
+			maxAge = newMaxAge
+			maxAgeString = newMaxAgeString
+
+		case msg := <-b.in:
+			if cfg.bucket == "" {
+				b.Error(errors.New("you must configure an endpoint and bucket before sending messages to this block"))
+				continue
+			}
+			line, err := json.Marshal(msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if obj == nil {
+				obj = newS3Object()
+				if maxAge > 0 {
+					ageTimer.Reset(maxAge)
+				}
+			}
+			err = obj.write(line)
+			if err != nil {
+				b.Error(err)
+				obj = nil
+				continue
+			}
+			if (maxBytes > 0 && obj.size >= maxBytes) || (maxCount > 0 && obj.count >= maxCount) {
+				roll()
+			}
+
+		case <-ageTimer.C:
+			roll()
+
+		case <-b.flush:
+			roll()
+
+		case <-b.quit:
+			// upload whatever is left and wait for uploads in flight, which
+			// stop retrying now
+			roll()
+			close(quitting)
+			uploads.Wait()
+			return
+
+		case MsgChan := <-b.queryrule:
+			// deal with a query request
+			MsgChan <- map[string]interface{}{
+				"Endpoint":       cfg.endpoint,
+				"Bucket":         cfg.bucket,
+				"Region":         cfg.region,
+				"AccessKey":      cfg.accessKey,
+				"AccessSecret":   cfg.secretKey,
+				"KeyTemplate":    keyTemplateString,
+				"MaxBytes":       maxBytes,
+				"MaxCount":       maxCount,
+				"MaxAge":         maxAgeString,
+				"SpillDirectory": spillDirectory,
+			}
+		}
+	}
+}
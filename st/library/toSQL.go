@@ -0,0 +1,367 @@
+package library
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"                      // postgres driver
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type ToSQL struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	flush     blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewToSQL() blocks.BlockInterface {
+	return &ToSQL{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *ToSQL) Setup() {
+	b.Kind = "Data Stores"
+	b.Desc = "inserts messages into a SQL table in batches, optionally upserting on a set of conflict keys"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.flush = b.InRoute("flush")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+}
+
+// sqlQuote quotes an identifier so that it is safe to use as a table or column name.
+func sqlQuote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// sqlPlaceholder returns the nth (1-indexed) bind parameter for the given driver.
+func sqlPlaceholder(driver string, n int) string {
+	if driver == "postgres" {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// sqlValue converts a message value into something database/sql can bind.
+// Objects and arrays are stored as their JSON encoding.
+func sqlValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}, []interface{}:
+		out, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(out), nil
+	}
+	return v, nil
+}
+
+func buildCreateTable(table string, columns []string, types map[string]string, keys []string) string {
+	defs := make([]string, len(columns))
+	for i, c := range columns {
+		t, ok := types[c]
+		if !ok {
+			t = "TEXT"
+		}
+		defs[i] = sqlQuote(c) + " " + t
+	}
+	if len(keys) > 0 {
+		quoted := make([]string, len(keys))
+		for i, k := range keys {
+			quoted[i] = sqlQuote(k)
+		}
+		defs = append(defs, "PRIMARY KEY ("+strings.Join(quoted, ", ")+")")
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", sqlQuote(table), strings.Join(defs, ", "))
+}
+
+func buildInsert(driver, table string, columns []string, keys []string) string {
+	quoted := make([]string, len(columns))
+	params := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = sqlQuote(c)
+		params[i] = sqlPlaceholder(driver, i+1)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		sqlQuote(table), strings.Join(quoted, ", "), strings.Join(params, ", "))
+
+	if len(keys) == 0 {
+		return query
+	}
+
+	isKey := make(map[string]bool)
+	quotedKeys := make([]string, len(keys))
+	for i, k := range keys {
+		isKey[k] = true
+		quotedKeys[i] = sqlQuote(k)
+	}
+	var updates []string
+	for _, c := range columns {
+		if !isKey[c] {
+			updates = append(updates, sqlQuote(c)+" = excluded."+sqlQuote(c))
+		}
+	}
+	if len(updates) == 0 {
+		return query + " ON CONFLICT (" + strings.Join(quotedKeys, ", ") + ") DO NOTHING"
+	}
+	return query + " ON CONFLICT (" + strings.Join(quotedKeys, ", ") + ") DO UPDATE SET " + strings.Join(updates, ", ")
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *ToSQL) Run() {
+	var db *sql.DB
+	var driver, dsn, table, insert string
+	var columns, keys []string
+	var trees map[string]*jee.TokenTree
+	var batch [][]interface{}
+
+	keys = []string{}
+	columnRule := map[string]interface{}{}
+	typeRule := map[string]interface{}{}
+	createTable := false
+	batchSize := 1
+	interval := time.Duration(1) * time.Second
+	ticker := time.NewTicker(interval)
+
+	// write everything we have gathered so far inside a single transaction.
+	// If any of it fails the whole batch is rolled back and dropped, so say
+	// how many rows were lost.
+	flush := func() {
+		if len(batch) == 0 || db == nil {
+			return
+		}
+		defer func() {
+			batch = nil
+		}()
+		dropped := func(err error) {
+			b.Error(fmt.Errorf("dropped %d rows: %s", len(batch), err.Error()))
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			dropped(err)
+			return
+		}
+		stmt, err := tx.Prepare(insert)
+		if err != nil {
+			dropped(err)
+			tx.Rollback()
+			return
+		}
+		for _, row := range batch {
+			_, err = stmt.Exec(row...)
+			if err != nil {
+				dropped(err)
+				stmt.Close()
+				tx.Rollback()
+				return
+			}
+		}
+		stmt.Close()
+		err = tx.Commit()
+		if err != nil {
+			dropped(err)
+		}
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newDriver, err := util.ParseRequiredString(ruleI, "Driver")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newDSN, err := util.ParseRequiredString(ruleI, "DSN")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newTable, err := util.ParseRequiredString(ruleI, "Table")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			rule := ruleI.(map[string]interface{})
+			newColumnRule, _ := rule["Columns"].(map[string]interface{})
+			if len(newColumnRule) == 0 {
+				b.Error(errors.New("Columns must map at least one column to a path"))
+				continue
+			}
+			newTrees := make(map[string]*jee.TokenTree)
+			newColumns := []string{}
+			for c, pathI := range newColumnRule {
+				path, ok := pathI.(string)
+				if !ok {
+					b.Error(errors.New("column paths must be strings"))
+					break
+				}
+				tree, err := util.BuildTokenTree(path)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+				newTrees[c] = tree
+				newColumns = append(newColumns, c)
+			}
+			if len(newColumns) != len(newColumnRule) {
+				continue
+			}
+			sort.Strings(newColumns)
+
+			newKeys := []string{}
+			if util.KeyExists(ruleI, "ConflictKeys") {
+				newKeys, err = util.ParseArrayString(ruleI, "ConflictKeys")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			newTypeRule, _ := rule["Types"].(map[string]interface{})
+			types := make(map[string]string)
+			for c, tI := range newTypeRule {
+				if t, ok := tI.(string); ok {
+					types[c] = t
+				}
+			}
+
+			newCreateTable, err := util.ParseBool(ruleI, "CreateTable")
+			if err != nil {
+				newCreateTable = false
+			}
+
+			newBatchSize, err := util.ParseInt(ruleI, "BatchSize")
+			if err != nil || newBatchSize < 1 {
+				newBatchSize = 1
+			}
+
+			newInterval := interval
+			if util.KeyExists(ruleI, "FlushInterval") {
+				intervalS, err := util.ParseString(ruleI, "FlushInterval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				newInterval, err = time.ParseDuration(intervalS)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if newInterval <= 0 {
+					b.Error("FlushInterval must be positive")
+					continue
+				}
+			}
+
+			newDB, err := sql.Open(newDriver, newDSN)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if newCreateTable {
+				_, err = newDB.Exec(buildCreateTable(newTable, newColumns, types, newKeys))
+				if err != nil {
+					b.Error(err)
+					newDB.Close()
+					continue
+				}
+			}
+
+			// the rule is good, so write what was gathered under the old one
+			// before switching over
+			flush()
+			if db != nil {
+				db.Close()
+			}
+			if newInterval != interval {
+				ticker.Stop()
+				ticker = time.NewTicker(newInterval)
+			}
+
+			db = newDB
+			driver = newDriver
+			dsn = newDSN
+			table = newTable
+			columnRule = newColumnRule
+			typeRule = newTypeRule
+			keys = newKeys
+			createTable = newCreateTable
+			batchSize = newBatchSize
+			interval = newInterval
+			columns = newColumns
+			trees = newTrees
+			insert = buildInsert(driver, table, columns, keys)
+
+		case <-b.quit:
+			// write whatever is left before quitting
+			flush()
+			ticker.Stop()
+			if db != nil {
+				db.Close()
+			}
+			return
+
+		case msg := <-b.in:
+			if db == nil {
+				b.Error(errors.New("SQL connection not initiated. Please check your block settings."))
+				continue
+			}
+			row := make([]interface{}, len(columns))
+			ok := true
+			for i, c := range columns {
+				v, err := jee.Eval(trees[c], msg)
+				if err != nil {
+					b.Error(err)
+					ok = false
+					break
+				}
+				row[i], err = sqlValue(v)
+				if err != nil {
+					b.Error(err)
+					ok = false
+					break
+				}
+			}
+			if !ok {
+				continue
+			}
+			batch = append(batch, row)
+			if len(batch) >= batchSize {
+				flush()
+			}
+
+		case <-b.flush:
+			flush()
+
+		case <-ticker.C:
+			flush()
+
+		case MsgChan := <-b.queryrule:
+			// deal with a query request
+			MsgChan <- map[string]interface{}{
+				"Driver":        driver,
+				"DSN":           dsn,
+				"Table":         table,
+				"Columns":       columnRule,
+				"Types":         typeRule,
+				"ConflictKeys":  keys,
+				"CreateTable":   createTable,
+				"BatchSize":     batchSize,
+				"FlushInterval": interval.String(),
+			}
+		}
+	}
+}
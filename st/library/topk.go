@@ -0,0 +1,297 @@
+package library
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type TopK struct {
+	blocks.Block
+	queryrule      chan blocks.MsgChan
+	querytopk      chan blocks.MsgChan
+	queryparamtopk chan blocks.Query
+	inrule         blocks.MsgChan
+	inpoll         blocks.MsgChan
+	clear          blocks.MsgChan
+	in             blocks.MsgChan
+	out            blocks.MsgChan
+	quit           blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewTopK() blocks.BlockInterface {
+	return &TopK{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *TopK) Setup() {
+	b.Kind = "Stats"
+	b.Desc = "estimates the K most frequent values found at Path in fixed memory, using a Count-Min sketch"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.inpoll = b.InRoute("poll")
+	b.clear = b.InRoute("clear")
+	b.queryrule = b.QueryRoute("rule")
+	b.querytopk = b.QueryRoute("topk")
+	b.queryparamtopk = b.QueryParamRoute("topk")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// heavyHitter is a key that is currently one of the top K.
+type heavyHitter struct {
+	key   string
+	count float64
+	index int
+}
+
+// heavyHitters is a min-heap of the top K keys, so the weakest is on top.
+type heavyHitters struct {
+	items []*heavyHitter
+	keys  map[string]*heavyHitter
+}
+
+func (h *heavyHitters) Len() int           { return len(h.items) }
+func (h *heavyHitters) Less(i, j int) bool { return h.items[i].count < h.items[j].count }
+func (h *heavyHitters) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+
+func (h *heavyHitters) Push(x interface{}) {
+	item := x.(*heavyHitter)
+	item.index = len(h.items)
+	h.items = append(h.items, item)
+	h.keys[item.key] = item
+}
+
+func (h *heavyHitters) Pop() interface{} {
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items = h.items[:n-1]
+	delete(h.keys, item.key)
+	return item
+}
+
+// offer records a key's new estimate, keeping it if it is in the top k.
+func (h *heavyHitters) offer(key string, count float64, k int) {
+	if item, ok := h.keys[key]; ok {
+		item.count = count
+		heap.Fix(h, item.index)
+		return
+	}
+	if len(h.items) < k {
+		heap.Push(h, &heavyHitter{key: key, count: count})
+		return
+	}
+	if len(h.items) > 0 && count > h.items[0].count {
+		heap.Pop(h)
+		heap.Push(h, &heavyHitter{key: key, count: count})
+	}
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *TopK) Run() {
+	var path, halfLifeString string
+	var tree *jee.TokenTree
+	var halfLife time.Duration
+	var sketch *countMinSketch
+	k := 10
+	epsilon := 0.001
+	delta := 0.01
+
+	top := &heavyHitters{keys: make(map[string]*heavyHitter)}
+
+	// rather than decaying every counter as time passes, new messages are
+	// given more weight. Weights are measured from base, which is moved
+	// forward before they get too big.
+	base := time.Now()
+	weight := func(now time.Time) float64 {
+		if halfLife == 0 {
+			return 1
+		}
+		return math.Exp2(float64(now.Sub(base)) / float64(halfLife))
+	}
+	rebase := func(now time.Time) {
+		w := weight(now)
+		if w < 1e100 {
+			return
+		}
+		sketch.scale(1 / w)
+		for _, item := range top.items {
+			item.count /= w
+		}
+		base = now
+	}
+
+	results := func(n int) []interface{} {
+		items := make([]*heavyHitter, len(top.items))
+		copy(items, top.items)
+		sort.Sort(byHitterCount(items))
+		if n > 0 && len(items) > n {
+			items = items[:n]
+		}
+		w := weight(time.Now())
+		out := make([]interface{}, len(items))
+		for i, item := range items {
+			out[i] = map[string]interface{}{
+				"Key":   item.key,
+				"Count": item.count / w,
+			}
+		}
+		return out
+	}
+
+	reset := func() {
+		sketch, _ = newCountMinSketch(epsilon, delta)
+		top = &heavyHitters{keys: make(map[string]*heavyHitter)}
+		base = time.Now()
+	}
+	reset()
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			newPath, err := util.ParseRequiredString(ruleI, "Path")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newTree, err := util.BuildTokenTree(newPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newK := 10
+			if util.KeyExists(ruleI, "K") {
+				newK, err = util.ParseInt(ruleI, "K")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if newK <= 0 {
+					b.Error(errors.New("K must be positive"))
+					continue
+				}
+			}
+			newEpsilon := 0.001
+			if util.KeyExists(ruleI, "Epsilon") {
+				newEpsilon, err = util.ParseFloat(ruleI, "Epsilon")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newDelta := 0.01
+			if util.KeyExists(ruleI, "Delta") {
+				newDelta, err = util.ParseFloat(ruleI, "Delta")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			_, err = newCountMinSketch(newEpsilon, newDelta)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newHalfLifeString, _ := util.ParseString(ruleI, "HalfLife")
+			newHalfLife := time.Duration(0)
+			if newHalfLifeString != "" {
+				newHalfLife, err = time.ParseDuration(newHalfLifeString)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			path = newPath
+			tree = newTree
+			k = newK
+			epsilon = newEpsilon
+			delta = newDelta
+			halfLifeString = newHalfLifeString
+			halfLife = newHalfLife
+			reset()
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case msg := <-b.in:
+			if tree == nil {
+				continue
+			}
+			v, err := jee.Eval(tree, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if v == nil {
+				continue
+			}
+			key, err := countKey(v)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			now := time.Now()
+			rebase(now)
+			top.offer(key, sketch.add(key, weight(now)), k)
+
+		case <-b.clear:
+			reset()
+
+		case <-b.inpoll:
+			b.out <- map[string]interface{}{
+				"Top": results(k),
+			}
+
+		case c := <-b.querytopk:
+			c <- map[string]interface{}{
+				"Top": results(k),
+			}
+
+		case q := <-b.queryparamtopk:
+			counts := make(map[string]interface{})
+			w := weight(time.Now())
+			for _, key := range q.Params["key"] {
+				counts[key] = sketch.estimate(key) / w
+			}
+			q.RespChan <- map[string]interface{}{
+				"Counts": counts,
+			}
+
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Path":     path,
+				"K":        float64(k),
+				"Epsilon":  epsilon,
+				"Delta":    delta,
+				"HalfLife": halfLifeString,
+			}
+		}
+	}
+}
+
+// byHitterCount sorts heavy hitters highest first, and then by key.
+type byHitterCount []*heavyHitter
+
+func (h byHitterCount) Len() int      { return len(h) }
+func (h byHitterCount) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h byHitterCount) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count > h[j].count
+	}
+	return h[i].key < h[j].key
+}
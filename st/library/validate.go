@@ -0,0 +1,130 @@
+package library
+
+import (
+	"errors"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Validate struct {
+	blocks.Block
+	queryrule   chan blocks.MsgChan
+	querycounts chan blocks.MsgChan
+	inrule      blocks.MsgChan
+	in          blocks.MsgChan
+	out         blocks.MsgChan
+	invalid     blocks.MsgChan
+	quit        blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewValidate() blocks.BlockInterface {
+	return &Validate{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Validate) Setup() {
+	b.Kind = "Core"
+	b.Desc = "checks each message against a JSON Schema, emitting valid messages on out and invalid ones, with what's wrong with them, on invalid"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.querycounts = b.QueryRoute("counts")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+	b.invalid = b.OutRoute("invalid")
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Validate) Run() {
+	var schemaRule interface{}
+	path := "."
+	tree, _ := util.BuildTokenTree(path)
+	// until there's a rule everything is valid
+	schema, _ := newJSONSchema(true)
+	schemaRule = true
+	var valid, invalid float64
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			rule := ruleI.(map[string]interface{})
+			newSchemaRule, ok := rule["Schema"]
+			if !ok {
+				b.Error(errors.New("rule must have a Schema"))
+				continue
+			}
+			newSchema, err := newJSONSchema(newSchemaRule)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newPath := "."
+			if util.KeyExists(ruleI, "Path") {
+				newPath, err = util.ParseRequiredString(ruleI, "Path")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			newTree, err := util.BuildTokenTree(newPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			schemaRule = newSchemaRule
+			schema = newSchema
+			path = newPath
+			tree = newTree
+			valid = 0
+			invalid = 0
+
+		case <-b.quit:
+			// quit the block
+			return
+
+		case msg := <-b.in:
+			v, err := jee.Eval(tree, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			violations := schema.validate(v)
+			if len(violations) == 0 {
+				valid++
+				b.out <- msg
+				continue
+			}
+			invalid++
+			out := []interface{}{}
+			for _, violation := range violations {
+				out = append(out, map[string]interface{}{
+					"path":    violation.Path,
+					"keyword": violation.Keyword,
+					"message": violation.Message,
+				})
+			}
+			b.invalid <- map[string]interface{}{
+				"msg":        msg,
+				"violations": out,
+			}
+
+		case c := <-b.querycounts:
+			c <- map[string]interface{}{
+				"Valid":   valid,
+				"Invalid": invalid,
+			}
+
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Schema": schemaRule,
+				"Path":   path,
+			}
+		}
+	}
+}
@@ -0,0 +1,612 @@
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Window struct {
+	blocks.Block
+	queryrule  chan blocks.MsgChan
+	querystate chan blocks.MsgChan
+	inrule     blocks.MsgChan
+	inflush    blocks.MsgChan
+	in         blocks.MsgChan
+	out        blocks.MsgChan
+	quit       blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewWindow() blocks.BlockInterface {
+	return &Window{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Window) Setup() {
+	b.Kind = "Stats"
+	b.Desc = "aggregates messages into tumbling, sliding or session windows by event time, emitting one result per group as each window closes"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.inflush = b.InRoute("flush")
+	b.queryrule = b.QueryRoute("rule")
+	b.querystate = b.QueryRoute("state")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// parseEventTime turns a message's timestamp into a time. Numbers are taken to
+// be milliseconds since the epoch, as in the sync block, and strings are
+// parsed as RFC3339.
+func parseEventTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case float64:
+		return time.Unix(0, int64(v*1000000)), nil
+	case string:
+		return time.Parse(time.RFC3339Nano, v)
+	}
+	return time.Time{}, errors.New("event time must be milliseconds since the epoch or an RFC3339 string")
+}
+
+// windowAgg is a single aggregation a window keeps track of.
+type windowAgg struct {
+	Name string
+	Op   string
+	Path string
+	tree *jee.TokenTree
+}
+
+// aggState holds the running state for one aggregation in one window. Every
+// aggregation is built from mergeable parts so that session windows can be
+// joined together.
+type aggState struct {
+	count    float64
+	sum      float64
+	min      float64
+	max      float64
+	distinct map[string]bool
+}
+
+func (a *aggState) add(op string, v interface{}) error {
+	if op == "count" {
+		a.count++
+		return nil
+	}
+	if v == nil {
+		return nil
+	}
+	if op == "distinct" {
+		key, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if a.distinct == nil {
+			a.distinct = make(map[string]bool)
+		}
+		a.distinct[string(key)] = true
+		return nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return errors.New(op + " needs a number")
+	}
+	if a.count == 0 || f < a.min {
+		a.min = f
+	}
+	if a.count == 0 || f > a.max {
+		a.max = f
+	}
+	a.count++
+	a.sum += f
+	return nil
+}
+
+func (a *aggState) merge(o *aggState) {
+	if o.count > 0 {
+		if a.count == 0 || o.min < a.min {
+			a.min = o.min
+		}
+		if a.count == 0 || o.max > a.max {
+			a.max = o.max
+		}
+	}
+	a.count += o.count
+	a.sum += o.sum
+	for k := range o.distinct {
+		if a.distinct == nil {
+			a.distinct = make(map[string]bool)
+		}
+		a.distinct[k] = true
+	}
+}
+
+func (a *aggState) value(op string) interface{} {
+	switch op {
+	case "count":
+		return a.count
+	case "distinct":
+		return float64(len(a.distinct))
+	}
+	if a.count == 0 {
+		return nil
+	}
+	switch op {
+	case "sum":
+		return a.sum
+	case "min":
+		return a.min
+	case "max":
+		return a.max
+	case "mean":
+		return a.sum / a.count
+	}
+	return nil
+}
+
+// openWindow is a window that has yet to close for a single group.
+type openWindow struct {
+	start  time.Time
+	end    time.Time
+	group  string
+	key    interface{}
+	states []*aggState
+}
+
+func newOpenWindow(start, end time.Time, group string, key interface{}, n int) *openWindow {
+	w := &openWindow{
+		start:  start,
+		end:    end,
+		group:  group,
+		key:    key,
+		states: make([]*aggState, n),
+	}
+	for i := range w.states {
+		w.states[i] = &aggState{}
+	}
+	return w
+}
+
+func (w *openWindow) merge(o *openWindow) {
+	if o.start.Before(w.start) {
+		w.start = o.start
+	}
+	if o.end.After(w.end) {
+		w.end = o.end
+	}
+	for i := range w.states {
+		w.states[i].merge(o.states[i])
+	}
+}
+
+// windowsByEnd orders windows by when they close, then by group.
+type windowsByEnd []*openWindow
+
+func (w windowsByEnd) Len() int      { return len(w) }
+func (w windowsByEnd) Swap(i, j int) { w[i], w[j] = w[j], w[i] }
+func (w windowsByEnd) Less(i, j int) bool {
+	if !w[i].end.Equal(w[j].end) {
+		return w[i].end.Before(w[j].end)
+	}
+	if !w[i].start.Equal(w[j].start) {
+		return w[i].start.Before(w[j].start)
+	}
+	return w[i].group < w[j].group
+}
+
+func toMs(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1000000
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Window) Run() {
+	var timePath, groupPath, windowType, sizeString, slideString, gapString, latenessString string
+	var timeTree, groupTree *jee.TokenTree
+	var size, slide, gap, lateness time.Duration
+	var aggs []*windowAgg
+	var aggRule []interface{}
+	var maxEventTime time.Time
+	var late float64
+
+	windowType = "tumbling"
+	aggs = []*windowAgg{&windowAgg{Name: "count", Op: "count"}}
+
+	// fixed windows are keyed by group and start, session windows by group
+	fixed := make(map[string]map[int64]*openWindow)
+	sessions := make(map[string][]*openWindow)
+
+	// without a TimePath the block windows on arrival time, so the watermark
+	// has to move along with the clock
+	tick := time.NewTicker(time.Duration(100) * time.Millisecond)
+
+	watermark := func() time.Time {
+		return maxEventTime.Add(-lateness)
+	}
+
+	emit := func(closed []*openWindow) {
+		sort.Sort(windowsByEnd(closed))
+		for _, w := range closed {
+			values := make(map[string]interface{})
+			for i, agg := range aggs {
+				values[agg.Name] = w.states[i].value(agg.Op)
+			}
+			msg := map[string]interface{}{
+				"Start":      toMs(w.start),
+				"End":        toMs(w.end),
+				"Aggregates": values,
+			}
+			if groupTree != nil {
+				msg["Group"] = w.key
+			}
+			b.out <- msg
+		}
+	}
+
+	// closeWindows emits every window that ends at or before the given time
+	closeWindows := func(before time.Time, all bool) {
+		closed := []*openWindow{}
+		for group, starts := range fixed {
+			for start, w := range starts {
+				if all || !w.end.After(before) {
+					closed = append(closed, w)
+					delete(starts, start)
+				}
+			}
+			if len(starts) == 0 {
+				delete(fixed, group)
+			}
+		}
+		for group, list := range sessions {
+			open := list[:0]
+			for _, w := range list {
+				if all || !w.end.After(before) {
+					closed = append(closed, w)
+				} else {
+					open = append(open, w)
+				}
+			}
+			if len(open) == 0 {
+				delete(sessions, group)
+			} else {
+				sessions[group] = open
+			}
+		}
+		emit(closed)
+	}
+
+	// addTo folds a message into a window's aggregations
+	addTo := func(w *openWindow, msg interface{}) {
+		for i, agg := range aggs {
+			var v interface{}
+			if agg.tree != nil {
+				var err error
+				v, err = jee.Eval(agg.tree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			err := w.states[i].add(agg.Op, v)
+			if err != nil {
+				b.Error(err)
+			}
+		}
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			var newTimePath, newGroupPath string
+			var err error
+			if util.KeyExists(ruleI, "TimePath") {
+				newTimePath, err = util.ParseString(ruleI, "TimePath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			var newTimeTree *jee.TokenTree
+			if newTimePath != "" {
+				newTimeTree, err = util.BuildTokenTree(newTimePath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			if util.KeyExists(ruleI, "GroupPath") {
+				newGroupPath, err = util.ParseString(ruleI, "GroupPath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			var newGroupTree *jee.TokenTree
+			if newGroupPath != "" {
+				newGroupTree, err = util.BuildTokenTree(newGroupPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			newType := "tumbling"
+			if util.KeyExists(ruleI, "Type") {
+				newType, err = util.ParseString(ruleI, "Type")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			parseDuration := func(key string) (string, time.Duration, error) {
+				if !util.KeyExists(ruleI, key) {
+					return "", 0, nil
+				}
+				s, err := util.ParseString(ruleI, key)
+				if err != nil || s == "" {
+					return s, 0, err
+				}
+				d, err := time.ParseDuration(s)
+				if err == nil && d < 0 {
+					err = errors.New(key + " must not be negative")
+				}
+				return s, d, err
+			}
+
+			newSizeString, newSize, err := parseDuration("Size")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newSlideString, newSlide, err := parseDuration("Slide")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newGapString, newGap, err := parseDuration("Gap")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			newLatenessString, newLateness, err := parseDuration("Lateness")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			switch newType {
+			case "tumbling":
+				if newSize == 0 {
+					err = errors.New("tumbling windows need a Size")
+				}
+				newSlide = newSize
+			case "sliding":
+				if newSize == 0 || newSlide == 0 {
+					err = errors.New("sliding windows need a Size and a Slide")
+				}
+			case "session":
+				if newGap == 0 {
+					err = errors.New("session windows need a Gap")
+				}
+			default:
+				err = errors.New("Type must be one of tumbling, sliding or session")
+			}
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			newAggs := []*windowAgg{}
+			rule := ruleI.(map[string]interface{})
+			newAggRule, _ := rule["Aggregations"].([]interface{})
+			for _, aI := range newAggRule {
+				a, ok := aI.(map[string]interface{})
+				if !ok {
+					err = errors.New("each aggregation must be an object with a Name, an Op and a Path")
+					break
+				}
+				agg := &windowAgg{}
+				agg.Name, _ = a["Name"].(string)
+				agg.Op, _ = a["Op"].(string)
+				agg.Path, _ = a["Path"].(string)
+				if agg.Name == "" {
+					agg.Name = agg.Op
+				}
+				switch agg.Op {
+				case "count":
+				case "sum", "min", "max", "mean", "distinct":
+					if agg.Path == "" {
+						err = errors.New(agg.Op + " needs a Path")
+					}
+				default:
+					err = errors.New("Op must be one of count, sum, min, max, mean or distinct")
+				}
+				if err != nil {
+					break
+				}
+				if agg.Path != "" {
+					agg.tree, err = util.BuildTokenTree(agg.Path)
+					if err != nil {
+						break
+					}
+				}
+				newAggs = append(newAggs, agg)
+			}
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if len(newAggs) == 0 {
+				newAggs = []*windowAgg{&windowAgg{Name: "count", Op: "count"}}
+				newAggRule = nil
+			}
+
+			// anything open was aggregated under the old rule, so emit it now
+			closeWindows(time.Time{}, true)
+
+			timePath = newTimePath
+			timeTree = newTimeTree
+			groupPath = newGroupPath
+			groupTree = newGroupTree
+			windowType = newType
+			sizeString = newSizeString
+			size = newSize
+			slideString = newSlideString
+			slide = newSlide
+			gapString = newGapString
+			gap = newGap
+			latenessString = newLatenessString
+			lateness = newLateness
+			aggs = newAggs
+			aggRule = newAggRule
+			maxEventTime = time.Time{}
+			late = 0
+
+		case <-tick.C:
+			if timeTree != nil || (size == 0 && gap == 0) {
+				continue
+			}
+			maxEventTime = time.Now()
+			closeWindows(watermark(), false)
+
+		case <-b.inflush:
+			closeWindows(time.Time{}, true)
+
+		case msg := <-b.in:
+			if size == 0 && gap == 0 {
+				continue
+			}
+
+			t := time.Now()
+			if timeTree != nil {
+				tI, err := jee.Eval(timeTree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				t, err = parseEventTime(tI)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			group := ""
+			var key interface{}
+			if groupTree != nil {
+				var err error
+				key, err = jee.Eval(groupTree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				g, err := json.Marshal(key)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				group = string(g)
+			}
+
+			mark := watermark()
+
+			if windowType == "session" {
+				end := t.Add(gap)
+				if !maxEventTime.IsZero() && !end.After(mark) {
+					// the session this event belongs to has already closed
+					late++
+					continue
+				}
+				w := newOpenWindow(t, end, group, key, len(aggs))
+				addTo(w, msg)
+				// fold in every open session this event overlaps
+				open := []*openWindow{}
+				for _, s := range sessions[group] {
+					if s.start.After(w.end) || w.start.After(s.end) {
+						open = append(open, s)
+						continue
+					}
+					w.merge(s)
+				}
+				sessions[group] = append(open, w)
+			} else {
+				// the latest window holding t starts at the last multiple of
+				// slide at or before t, and earlier ones step back from there
+				ns := t.UnixNano()
+				last := ns - ((ns%int64(slide))+int64(slide))%int64(slide)
+				added := false
+				for start := last; start > ns-int64(size); start -= int64(slide) {
+					end := time.Unix(0, start).Add(size)
+					if !maxEventTime.IsZero() && !end.After(mark) {
+						continue
+					}
+					starts, ok := fixed[group]
+					if !ok {
+						starts = make(map[int64]*openWindow)
+						fixed[group] = starts
+					}
+					w, ok := starts[start]
+					if !ok {
+						w = newOpenWindow(time.Unix(0, start), end, group, key, len(aggs))
+						starts[start] = w
+					}
+					addTo(w, msg)
+					added = true
+				}
+				if !added {
+					late++
+					continue
+				}
+			}
+
+			if t.After(maxEventTime) {
+				maxEventTime = t
+				closeWindows(watermark(), false)
+			}
+
+		case c := <-b.querystate:
+			open := 0
+			for _, starts := range fixed {
+				open += len(starts)
+			}
+			for _, list := range sessions {
+				open += len(list)
+			}
+			var mark interface{}
+			if !maxEventTime.IsZero() {
+				mark = toMs(watermark())
+			}
+			c <- map[string]interface{}{
+				"Watermark": mark,
+				"Open":      float64(open),
+				"Late":      late,
+			}
+
+		case c := <-b.queryrule:
+			if aggRule == nil {
+				aggRule = []interface{}{}
+			}
+			c <- map[string]interface{}{
+				"TimePath":     timePath,
+				"GroupPath":    groupPath,
+				"Type":         windowType,
+				"Size":         sizeString,
+				"Slide":        slideString,
+				"Gap":          gapString,
+				"Lateness":     latenessString,
+				"Aggregations": aggRule,
+			}
+
+		case <-b.quit:
+			// quit the block
+			tick.Stop()
+			return
+		}
+	}
+}
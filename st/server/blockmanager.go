@@ -20,11 +20,12 @@ type BlockInfo struct {
 }
 
 type ConnectionInfo struct {
-	Id      string
-	FromId  string
-	ToId    string
-	ToRoute string
-	chans   blocks.BlockChans
+	Id        string
+	FromId    string
+	FromRoute string
+	ToId      string
+	ToRoute   string
+	chans     blocks.BlockChans
 }
 
 type Coords struct {
@@ -261,6 +262,26 @@ func (b *BlockManager) Connect(connInfo *ConnectionInfo) (*ConnectionInfo, error
 		return nil, errors.New(fmt.Sprintf("Cannot create connection %s: ToId ID does not exist", connInfo.Id))
 	}
 
+	// connections made before blocks had more than one out route don't name
+	// the route they come from
+	if connInfo.FromRoute == "" {
+		connInfo.FromRoute = "out"
+	}
+	fromRouteExists := false
+	if from, ok := b.blockMap[connInfo.FromId]; ok {
+		// blocks whose out routes come from their rule may not have made
+		// the route yet, so any name will do
+		fromRouteExists = library.BlockDefs[from.Type].DynamicOutRoutes
+		for _, route := range library.BlockDefs[from.Type].OutRoutes {
+			if route == connInfo.FromRoute {
+				fromRouteExists = true
+			}
+		}
+	}
+	if !fromRouteExists {
+		return nil, errors.New(fmt.Sprintf("Cannot create connection %s: FromRoute %s does not exist", connInfo.Id, connInfo.FromRoute))
+	}
+
 	// create connection info for server
 	// and create connection routine
 	newConn := &blocks.Connection{
@@ -286,8 +307,9 @@ func (b *BlockManager) Connect(connInfo *ConnectionInfo) (*ConnectionInfo, error
 
 	// ask to connect the blocks together
 	b.blockMap[connInfo.FromId].chans.AddChan <- &blocks.AddChanMsg{
-		Route:   connInfo.Id,
-		Channel: connInfo.chans.InChan,
+		Route:     connInfo.Id,
+		FromRoute: connInfo.FromRoute,
+		Channel:   connInfo.chans.InChan,
 	}
 
 	b.connMap[connInfo.Id].chans.AddChan <- &blocks.AddChanMsg{
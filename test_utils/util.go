@@ -2,6 +2,8 @@ package test_utils
 
 import (
 	"log"
+	"reflect"
+	"time"
 
 	"github.com/nytlabs/streamtools/st/blocks"
 	"github.com/nytlabs/streamtools/st/library"
@@ -50,3 +52,86 @@ func StringInSlice(stringSlice []string, term string) bool {
 	}
 	return true
 }
+
+// BlockRun describes a short run of a block: its rule is set, Msgs are sent
+// to its in route 100ms later, each of Queries is asked at 800ms and the
+// block is told to quit after a second. Routes are the out routes to listen
+// to, with "out" for the block's usual output.
+type BlockRun struct {
+	Kind    string
+	Rule    interface{}
+	Msgs    []interface{}
+	Routes  []string
+	Queries []string
+}
+
+// BlockRunResult holds what came out of each route and each query during a
+// run, along with any errors the block returned.
+type BlockRunResult struct {
+	Out     map[string][]interface{}
+	Queries map[string]interface{}
+	Errors  []error
+}
+
+// RunBlock runs a block as described by run, and returns once it has quit.
+func RunBlock(id string, run BlockRun) BlockRunResult {
+	b, ch := NewBlock(id, run.Kind)
+	go blocks.BlockRoutine(b)
+
+	result := BlockRunResult{
+		Out:     make(map[string][]interface{}),
+		Queries: make(map[string]interface{}),
+	}
+
+	// the first case waits for the block to finish, and the rest are
+	// the routes and then the queries
+	cases := []reflect.SelectCase{{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(ch.ErrChan),
+	}}
+	for _, route := range run.Routes {
+		c := make(chan *blocks.Msg)
+		ch.AddChan <- &blocks.AddChanMsg{Route: route, FromRoute: route, Channel: c}
+		result.Out[route] = []interface{}{}
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c)})
+	}
+	queryChans := make([]blocks.MsgChan, len(run.Queries))
+	for i := range run.Queries {
+		queryChans[i] = make(blocks.MsgChan)
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(queryChans[i])})
+	}
+
+	ch.InChan <- &blocks.Msg{Msg: run.Rule, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, msg := range run.Msgs {
+			ch.InChan <- &blocks.Msg{Msg: msg, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(800)*time.Millisecond, func() {
+		for i, query := range run.Queries {
+			ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryChans[i], Route: query}
+		}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		chosen, v, _ := reflect.Select(cases)
+		switch {
+		case chosen == 0:
+			if v.IsNil() {
+				return result
+			}
+			result.Errors = append(result.Errors, v.Interface().(error))
+		case chosen <= len(run.Routes):
+			route := run.Routes[chosen-1]
+			result.Out[route] = append(result.Out[route], v.Interface().(*blocks.Msg).Msg)
+		default:
+			result.Queries[run.Queries[chosen-1-len(run.Routes)]] = v.Interface()
+		}
+	}
+}
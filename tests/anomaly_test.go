@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"log"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type AnomalySuite struct{}
+
+var anomalySuite = Suite(&AnomalySuite{})
+
+// anomalous pulls the Anomalous flag out of an annotated message.
+func anomalous(msg interface{}) bool {
+	annotation, ok := msg.(map[string]interface{})["Anomaly"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	flag, _ := annotation["Anomalous"].(bool)
+	return flag
+}
+
+func (s *AnomalySuite) TestAnomalyZScore(c *C) {
+	log.Println("testing Anomaly z-score by key")
+	b, ch := test_utils.NewBlock("testingAnomalyZScore", "anomaly")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{
+		"Path":       ".v",
+		"KeyPath":    ".host",
+		"Detector":   "zscore",
+		"WindowSize": 20.0,
+		"WarmUp":     10.0,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	// host a hovers around 10 and host b around 100, so 100 is only
+	// unusual for a
+	msgs := []map[string]interface{}{}
+	for i := 0; i < 20; i++ {
+		msgs = append(msgs, map[string]interface{}{"host": "a", "v": 10.0 + float64(i%2)})
+		msgs = append(msgs, map[string]interface{}{"host": "b", "v": 100.0 + float64(i%3)})
+	}
+	msgs = append(msgs, map[string]interface{}{"host": "a", "v": 100.0, "spike": true})
+	msgs = append(msgs, map[string]interface{}{"host": "b", "v": 100.0})
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, msg := range msgs {
+			ch.InChan <- &blocks.Msg{Msg: msg, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	i := 0
+	for {
+		select {
+		case messageI := <-outChan:
+			msg := messageI.Msg.(map[string]interface{})
+			spike := msg["spike"] == true
+			if anomalous(msg) != spike {
+				log.Println("wrongly flagged", msg)
+				c.Fail()
+			}
+			i++
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if i != len(msgs) {
+				log.Println("expected", len(msgs), "messages, got", i)
+				c.Fail()
+			}
+			return
+		}
+	}
+}
+
+func (s *AnomalySuite) TestAnomalyHoltWinters(c *C) {
+	log.Println("testing Anomaly Holt-Winters")
+	b, ch := test_utils.NewBlock("testingAnomalyHoltWinters", "anomaly")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{
+		"Path":     ".v",
+		"Detector": "holtwinters",
+		"Period":   4.0,
+		"Alpha":    0.2,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	// a strong daily-ish cycle that a z-score would find unremarkable, with
+	// one value that is normal overall but wrong for its place in the cycle
+	season := []float64{0, 50, 100, 50}
+	msgs := []map[string]interface{}{}
+	for i := 0; i < 40; i++ {
+		msgs = append(msgs, map[string]interface{}{"v": season[i%4] + float64(i%3)})
+	}
+	msgs = append(msgs, map[string]interface{}{"v": 100.0, "spike": true})
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, msg := range msgs {
+			ch.InChan <- &blocks.Msg{Msg: msg, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	i := 0
+	for {
+		select {
+		case messageI := <-outChan:
+			msg := messageI.Msg.(map[string]interface{})
+			spike := msg["spike"] == true
+			if anomalous(msg) != spike {
+				log.Println("wrongly flagged", msg)
+				c.Fail()
+			}
+			i++
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if i != len(msgs) {
+				log.Println("expected", len(msgs), "messages, got", i)
+				c.Fail()
+			}
+			return
+		}
+	}
+}
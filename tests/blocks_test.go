@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"log"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	. "launchpad.net/gocheck"
+)
+
+type BlocksSuite struct{}
+
+var blocksSuite = Suite(&BlocksSuite{})
+
+// twoRoutes sends every message it gets to both its out route and a named
+// "copies" out route.
+type twoRoutes struct {
+	blocks.Block
+	in     blocks.MsgChan
+	out    blocks.MsgChan
+	copies blocks.MsgChan
+	quit   blocks.MsgChan
+}
+
+func (b *twoRoutes) Setup() {
+	b.Kind = "Core"
+	b.Desc = "for testing named out routes"
+	b.in = b.InRoute("in")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+	b.copies = b.OutRoute("copies")
+}
+
+func (b *twoRoutes) Run() {
+	for {
+		select {
+		case msg := <-b.in:
+			b.out <- msg
+			b.copies <- map[string]interface{}{"copy": msg}
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+func newTwoRoutes() (*twoRoutes, blocks.BlockChans) {
+	chans := blocks.BlockChans{
+		InChan:         make(chan *blocks.Msg),
+		QueryChan:      make(chan *blocks.QueryMsg),
+		QueryParamChan: make(chan *blocks.QueryParamMsg),
+		AddChan:        make(chan *blocks.AddChanMsg),
+		DelChan:        make(chan *blocks.Msg),
+		IdChan:         make(chan string),
+		ErrChan:        make(chan error),
+		QuitChan:       make(chan bool),
+	}
+	b := &twoRoutes{}
+	b.Build(chans)
+	return b, chans
+}
+
+func (s *BlocksSuite) TestNamedOutRoutes(c *C) {
+	log.Println("testing named out routes")
+	b, ch := newTwoRoutes()
+	go blocks.BlockRoutine(b)
+
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+	copiesChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "2", FromRoute: "copies", Channel: copiesChan}
+
+	routesChan := make(blocks.MsgChan)
+	ch.QueryChan <- &blocks.QueryMsg{MsgChan: routesChan, Route: "outroutes"}
+	c.Assert(<-routesChan, DeepEquals, map[string]interface{}{
+		"OutRoutes": []string{"out", "copies"},
+	})
+
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"n": 1.0}, Route: "in"}
+
+	var out, copies []interface{}
+	for len(out) == 0 || len(copies) == 0 {
+		select {
+		case messageI := <-outChan:
+			out = append(out, messageI.Msg)
+		case messageI := <-copiesChan:
+			copies = append(copies, messageI.Msg)
+		case <-time.After(time.Duration(1) * time.Second):
+			c.Fatal("timed out waiting for messages")
+		}
+	}
+	c.Assert(out, DeepEquals, []interface{}{map[string]interface{}{"n": 1.0}})
+	c.Assert(copies, DeepEquals, []interface{}{
+		map[string]interface{}{"copy": map[string]interface{}{"n": 1.0}},
+	})
+
+	ch.QuitChan <- true
+	<-ch.ErrChan
+}
@@ -2,8 +2,9 @@ package tests
 
 import (
 	"log"
-	"time"
+	"net/url"
 	"sort"
+	"time"
 
 	"github.com/nytlabs/streamtools/st/blocks"
 	"github.com/nytlabs/streamtools/st/loghub"
@@ -88,3 +89,175 @@ func (s *CacheSuite) TestCache(c *C) {
 		}
 	}
 }
+
+func (s *CacheSuite) TestCacheBounded(c *C) {
+	log.Println("testing bounded cache")
+	b, ch := test_utils.NewBlock("testing bounded cache", "cache")
+
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+	evictedChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "evicted", FromRoute: "evicted", Channel: evictedChan}
+
+	ruleMsg := map[string]interface{}{
+		"KeyPath":        ".key",
+		"ValuePath":      ".value",
+		"TimeToLivePath": ".ttl",
+		"MaxEntries":     3.0,
+		"Eviction":       "lru",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"key": "user:a", "value": 1.0}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"key": "user:b", "value": 2.0}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"key": "user:c", "value": 3.0}, Route: "in"}
+	})
+	time.AfterFunc(time.Duration(150)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"key": "user:a"}, Route: "lookup"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"key": "user:z"}, Route: "lookup"}
+	})
+	time.AfterFunc(time.Duration(200)*time.Millisecond, func() {
+		// user:b is now the least recently used
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"key": map[string]interface{}{"id": 1.0}, "value": "short lived", "ttl": "200ms"}, Route: "in"}
+	})
+
+	statsChan := make(blocks.MsgChan)
+	lookupChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(600)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: statsChan, Route: "stats"}
+		ch.QueryParamChan <- &blocks.QueryParamMsg{
+			Route:    "lookup",
+			RespChan: lookupChan,
+			Params:   url.Values{"prefix": []string{"user:"}},
+		}
+	})
+
+	keysChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(700)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"key": "user:a"}, Route: "delete"}
+	})
+	time.AfterFunc(time.Duration(800)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: keysChan, Route: "keys"}
+	})
+
+	// clearing the cache starts its stats over too
+	clearedChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(850)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "clear"}
+	})
+	time.AfterFunc(time.Duration(900)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: clearedChan, Route: "stats"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	evicted := []interface{}{}
+	lookups := 0
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(lookups, Equals, 2)
+			c.Assert(evicted, DeepEquals, []interface{}{
+				map[string]interface{}{"key": "user:b", "value": 2.0, "reason": "evicted"},
+				map[string]interface{}{"key": `{"id":1}`, "value": "short lived", "reason": "expired"},
+			})
+			return
+
+		case messageI := <-outChan:
+			lookups++
+			message := messageI.Msg.(map[string]interface{})
+			if message["key"] == "user:a" {
+				c.Assert(message["value"], Equals, 1.0)
+			} else {
+				c.Assert(message["value"], IsNil)
+			}
+
+		case messageI := <-evictedChan:
+			evicted = append(evicted, messageI.Msg)
+
+		case messageI := <-statsChan:
+			message := messageI.(map[string]interface{})
+			c.Assert(message["Entries"], Equals, 2.0)
+			c.Assert(message["Hits"], Equals, 1.0)
+			c.Assert(message["Misses"], Equals, 1.0)
+			c.Assert(message["Evictions"], Equals, 1.0)
+			c.Assert(message["Expirations"], Equals, 1.0)
+
+		case messageI := <-lookupChan:
+			message := messageI.(map[string]interface{})
+			c.Assert(message["values"], DeepEquals, map[string]interface{}{"user:a": 1.0, "user:c": 3.0})
+
+		case messageI := <-keysChan:
+			message := messageI.(map[string]interface{})
+			c.Assert(message["keys"], DeepEquals, []string{"user:c"})
+
+		case messageI := <-clearedChan:
+			c.Assert(messageI, DeepEquals, map[string]interface{}{
+				"Entries":     0.0,
+				"Bytes":       0.0,
+				"Hits":        0.0,
+				"Misses":      0.0,
+				"HitRate":     0.0,
+				"Evictions":   0.0,
+				"Expirations": 0.0,
+			})
+		}
+	}
+}
+
+func (s *CacheSuite) TestCacheKeyTypes(c *C) {
+	log.Println("testing cache keys of different types")
+	b, ch := test_utils.NewBlock("testing cache key types", "cache")
+
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{"KeyPath": ".key", "ValuePath": ".value"}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	// "1" and 1 are different keys, as are "true" and true
+	keys := []interface{}{"1", 1.0, "true", true}
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for i, k := range keys {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"key": k, "value": float64(i)}, Route: "in"}
+		}
+	})
+	time.AfterFunc(time.Duration(200)*time.Millisecond, func() {
+		for _, k := range keys {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"key": k}, Route: "lookup"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	lookups := []interface{}{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(lookups, DeepEquals, []interface{}{
+				map[string]interface{}{"key": `"1"`, "value": 0.0},
+				map[string]interface{}{"key": "1", "value": 1.0},
+				map[string]interface{}{"key": `"true"`, "value": 2.0},
+				map[string]interface{}{"key": "true", "value": 3.0},
+			})
+			return
+		case messageI := <-outChan:
+			lookups = append(lookups, messageI.Msg)
+		}
+	}
+}
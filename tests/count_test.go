@@ -2,6 +2,7 @@ package tests
 
 import (
 	"log"
+	"net/url"
 	"reflect"
 	"testing"
 	"time"
@@ -55,7 +56,12 @@ func (s *CountSuite) TestCount(c *C) {
 	for {
 		select {
 		case messageI := <-queryOutChan:
-			if !reflect.DeepEqual(messageI, ruleMsg) {
+			expectedRule := map[string]interface{}{
+				"Window":  "1s",
+				"KeyPath": "",
+				"TopN":    10.0,
+			}
+			if !reflect.DeepEqual(messageI, expectedRule) {
 				c.Fail()
 			}
 
@@ -80,3 +86,76 @@ func (s *CountSuite) TestCount(c *C) {
 		}
 	}
 }
+
+func (s *CountSuite) TestCountKeyed(c *C) {
+	log.Println("testing Count with a KeyPath")
+	b, ch := test_utils.NewBlock("testingCountKeyed", "count")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{"Window": "10s", "KeyPath": ".user", "TopN": 2.0}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, user := range []string{"a", "a", "b", "c", "a", "b"} {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"user": user}, Route: "in"}
+		}
+	})
+
+	keyChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "poll"}
+		ch.QueryParamChan <- &blocks.QueryParamMsg{
+			Route:    "count",
+			RespChan: keyChan,
+			Params:   url.Values{"key": []string{"c", "d"}},
+		}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	pollOutput := map[string]interface{}{
+		"Count": 6.0,
+		"Top": []interface{}{
+			map[string]interface{}{"Key": "a", "Count": 3.0},
+			map[string]interface{}{"Key": "b", "Count": 2.0},
+		},
+	}
+	keyOutput := map[string]interface{}{
+		"Counts": map[string]interface{}{"c": 1.0, "d": 0.0},
+	}
+	polled, queried := false, false
+
+	for {
+		select {
+		case messageI := <-outChan:
+			polled = true
+			if !reflect.DeepEqual(messageI.Msg, pollOutput) {
+				log.Println("poll mismatch", messageI.Msg, pollOutput)
+				c.Fail()
+			}
+
+		case messageI := <-keyChan:
+			queried = true
+			if !reflect.DeepEqual(messageI, keyOutput) {
+				log.Println("key count mismatch", messageI, keyOutput)
+				c.Fail()
+			}
+
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if !polled || !queried {
+				log.Println("expected a poll and a key query")
+				c.Fail()
+			}
+			return
+		}
+	}
+}
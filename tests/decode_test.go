@@ -0,0 +1,287 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type DecodeSuite struct{}
+
+var decodeSuite = Suite(&DecodeSuite{})
+
+// codecRun sends msgs to a decode or encode block with the given rule, and
+// returns what came out of out and of failed.
+func codecRun(c *C, name string, blockType string, ruleMsg map[string]interface{}, msgs []interface{}) ([]interface{}, []interface{}) {
+	result := test_utils.RunBlock(name, test_utils.BlockRun{
+		Kind:   blockType,
+		Rule:   ruleMsg,
+		Msgs:   msgs,
+		Routes: []string{"out", "failed"},
+	})
+	c.Assert(result.Errors, HasLen, 0)
+	return result.Out["out"], result.Out["failed"]
+}
+
+// varint writes a base 128 varint, as protobuf and avro lengths use.
+func varint(x int) []byte {
+	var out []byte
+	for x >= 0x80 {
+		out = append(out, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(out, byte(x))
+}
+
+// pb writes a protobuf field, which is enough to build a descriptor set by
+// hand.
+func pb(number int, v interface{}) []byte {
+	switch v := v.(type) {
+	case int:
+		return append(varint(number<<3), varint(v)...)
+	case string:
+		return pb(number, []byte(v))
+	case []byte:
+		out := append(varint(number<<3|2), varint(len(v))...)
+		return append(out, v...)
+	}
+	return nil
+}
+
+func joinBytes(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func (s *DecodeSuite) TestDecodeMsgpack(c *C) {
+	log.Println("testing Decode with msgpack")
+	out, failed := codecRun(c, "testingDecodeMsgpack", "decode", map[string]interface{}{
+		"Format": "msgpack",
+	}, []interface{}{
+		map[string]interface{}{"data": "g6FhAaFik8PAoXihY8s/+AAAAAAAAA=="},
+		map[string]interface{}{"data": "kw=="},
+	})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{"a": 1.0, "b": []interface{}{true, nil, "x"}, "c": 1.5},
+	})
+	c.Assert(failed, DeepEquals, []interface{}{
+		map[string]interface{}{
+			"msg":   map[string]interface{}{"data": "kw=="},
+			"error": "data ends too soon",
+		},
+	})
+}
+
+func (s *DecodeSuite) TestDecodeCBOR(c *C) {
+	log.Println("testing Decode with CBOR in hex, adding it to the message")
+	out, _ := codecRun(c, "testingDecodeCBOR", "decode", map[string]interface{}{
+		"Format":     "cbor",
+		"Path":       ".payload",
+		"Encoding":   "hex",
+		"OutputPath": ".decoded",
+	}, []interface{}{
+		map[string]interface{}{"payload": "a361610161628202036163f93e00"},
+	})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{
+			"payload": "a361610161628202036163f93e00",
+			"decoded": map[string]interface{}{"a": 1.0, "b": []interface{}{2.0, 3.0}, "c": 1.5},
+		},
+	})
+}
+
+func (s *DecodeSuite) TestEncode(c *C) {
+	log.Println("testing Encode with msgpack and CBOR")
+	msg := map[string]interface{}{"a": 1.0, "b": []interface{}{true, nil, "x"}, "c": 1.5}
+	out, _ := codecRun(c, "testingEncodeMsgpack", "encode", map[string]interface{}{
+		"Format": "msgpack",
+	}, []interface{}{msg})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{"data": "g6FhAaFik8PAoXihY8s/+AAAAAAAAA=="},
+	})
+
+	out, _ = codecRun(c, "testingEncodeCBOR", "encode", map[string]interface{}{
+		"Format":     "cbor",
+		"Path":       ".body",
+		"OutputPath": ".cbor",
+	}, []interface{}{
+		map[string]interface{}{"id": "x", "body": map[string]interface{}{"a": 1.0, "b": []interface{}{2.0, 3.0}, "c": 1.5}},
+	})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{
+			"id":   "x",
+			"body": map[string]interface{}{"a": 1.0, "b": []interface{}{2.0, 3.0}, "c": 1.5},
+			"cbor": "o2FhAWFiggIDYWP7P/gAAAAAAAA=",
+		},
+	})
+}
+
+func (s *DecodeSuite) TestProtobuf(c *C) {
+	log.Println("testing Decode and Encode with protobuf")
+	// package shop;
+	// enum Status { NEW = 0; SHIPPED = 1; }
+	// message Order {
+	//   string id = 1;
+	//   int64 quantity = 2;
+	//   repeated double prices = 3;
+	//   Status status = 4;
+	//   map<string, int32> stock = 5;
+	// }
+	field := func(name string, number, label, typ int, typeName string) []byte {
+		f := joinBytes(pb(1, name), pb(3, number), pb(4, label), pb(5, typ))
+		if typeName != "" {
+			f = joinBytes(f, pb(6, typeName))
+		}
+		return pb(2, f)
+	}
+	stockEntry := joinBytes(
+		pb(1, "StockEntry"),
+		field("key", 1, 1, 9, ""),
+		field("value", 2, 1, 5, ""),
+		pb(7, pb(7, 1)),
+	)
+	order := joinBytes(
+		pb(1, "Order"),
+		field("id", 1, 1, 9, ""),
+		field("quantity", 2, 1, 3, ""),
+		field("prices", 3, 3, 1, ""),
+		field("status", 4, 1, 14, ".shop.Status"),
+		field("stock", 5, 3, 11, ".shop.Order.StockEntry"),
+		pb(3, stockEntry),
+	)
+	status := joinBytes(
+		pb(1, "Status"),
+		pb(2, joinBytes(pb(1, "NEW"), pb(2, 0))),
+		pb(2, joinBytes(pb(1, "SHIPPED"), pb(2, 1))),
+	)
+	descriptorSet := pb(1, joinBytes(
+		pb(1, "shop.proto"),
+		pb(2, "shop"),
+		pb(4, order),
+		pb(5, status),
+		pb(12, "proto3"),
+	))
+
+	f, err := ioutil.TempFile("", "streamtools_test_decode.pb")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	f.Write(descriptorSet)
+	f.Close()
+
+	rule := map[string]interface{}{
+		"Format":        "protobuf",
+		"DescriptorSet": f.Name(),
+		"MessageType":   "shop.Order",
+	}
+	encoded := "CgJhMRADGhAAAAAAAAD4PwAAAAAAAAJAIAEqBQoBeBAF"
+	decoded := map[string]interface{}{
+		"id":       "a1",
+		"quantity": 3.0,
+		"prices":   []interface{}{1.5, 2.25},
+		"status":   "SHIPPED",
+		"stock":    map[string]interface{}{"x": 5.0},
+	}
+
+	out, _ := codecRun(c, "testingDecodeProtobuf", "decode", rule, []interface{}{
+		map[string]interface{}{"data": encoded},
+	})
+	c.Assert(out, DeepEquals, []interface{}{decoded})
+
+	out, _ = codecRun(c, "testingEncodeProtobuf", "encode", rule, []interface{}{decoded})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{"data": encoded},
+	})
+}
+
+func (s *DecodeSuite) TestAvro(c *C) {
+	log.Println("testing Decode and Encode with Avro")
+	schema := map[string]interface{}{
+		"type": "record",
+		"name": "Click",
+		"fields": []interface{}{
+			map[string]interface{}{"name": "url", "type": "string"},
+			map[string]interface{}{"name": "ms", "type": "long"},
+			map[string]interface{}{"name": "ref", "type": []interface{}{"null", "string"}, "default": nil},
+		},
+	}
+
+	out, _ := codecRun(c, "testingEncodeAvro", "encode", map[string]interface{}{
+		"Format": "avro",
+		"Schema": schema,
+	}, []interface{}{
+		map[string]interface{}{"url": "/a", "ms": 1000.0},
+	})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{"data": "BC9h0A8A"},
+	})
+
+	// a container file carries its own schema, so none is needed in the rule
+	schemaJSON, _ := json.Marshal(schema)
+	sync := []byte("0123456789abcdef")
+	records := joinBytes(
+		[]byte{4}, []byte("/a"), []byte{0xd0, 0x0f}, []byte{0},
+		[]byte{4}, []byte("/b"), []byte{1}, []byte{2, 2}, []byte("x"),
+	)
+	container := joinBytes(
+		[]byte("Obj\x01"),
+		// avro lengths are zigzag encoded, which doubles them
+		[]byte{2, 22}, []byte("avro.schema"), varint(len(schemaJSON)*2), schemaJSON, []byte{0},
+		sync,
+		[]byte{4}, varint(len(records)*2), records,
+		sync,
+	)
+	out, failed := codecRun(c, "testingDecodeAvro", "decode", map[string]interface{}{
+		"Format":   "avro",
+		"Encoding": "raw",
+	}, []interface{}{
+		map[string]interface{}{"data": string(container)},
+		map[string]interface{}{"data": "BC9h0A8A"},
+	})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{"url": "/a", "ms": 1000.0, "ref": nil},
+		map[string]interface{}{"url": "/b", "ms": -1.0, "ref": "x"},
+	})
+	c.Assert(failed, DeepEquals, []interface{}{
+		map[string]interface{}{
+			"msg":   map[string]interface{}{"data": "BC9h0A8A"},
+			"error": "avro data without a container header needs a Schema",
+		},
+	})
+}
+
+func (s *DecodeSuite) TestAvroCounts(c *C) {
+	log.Println("testing Decode with Avro block counts that claim too much")
+	// zigzag encoding of the smallest long, which stays negative when negated
+	minLong := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	huge := joinBytes(varint(1<<41), []byte{0})
+	bad := joinBytes(minLong, []byte{0, 0})
+	out, failed := codecRun(c, "testingDecodeAvroCounts", "decode", map[string]interface{}{
+		"Format":   "avro",
+		"Encoding": "raw",
+		"Schema":   map[string]interface{}{"type": "array", "items": "null"},
+	}, []interface{}{
+		map[string]interface{}{"data": string(huge)},
+		map[string]interface{}{"data": string(bad)},
+		map[string]interface{}{"data": string([]byte{6, 0})},
+	})
+	c.Assert(out, DeepEquals, []interface{}{
+		[]interface{}{nil, nil, nil},
+	})
+	c.Assert(failed, DeepEquals, []interface{}{
+		map[string]interface{}{
+			"msg":   map[string]interface{}{"data": string(huge)},
+			"error": "avro array or map has too many items",
+		},
+		map[string]interface{}{
+			"msg":   map[string]interface{}{"data": string(bad)},
+			"error": "avro block count is out of range",
+		},
+	})
+}
@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"log"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type DelaySuite struct{}
+
+var delaySuite = Suite(&DelaySuite{})
+
+func (s *DelaySuite) TestDelay(c *C) {
+	log.Println("testing Delay")
+	b, ch := test_utils.NewBlock("testingDelay", "delay")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{
+		"Delay":  "300ms",
+		"IdPath": ".id",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	var sent time.Time
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		sent = time.Now()
+		for _, id := range []string{"a", "b", "c"} {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"id": id}, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(150)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"id": "b"}, Route: "cancel"}
+	})
+
+	pendingChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(250)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: pendingChan, Route: "pending"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	out := []interface{}{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(out, DeepEquals, []interface{}{
+				map[string]interface{}{"id": "a"},
+				map[string]interface{}{"id": "c"},
+			})
+			return
+		case messageI := <-outChan:
+			if time.Since(sent) < time.Duration(300)*time.Millisecond {
+				log.Println("message released early", messageI.Msg)
+				c.Fail()
+			}
+			out = append(out, messageI.Msg)
+		case messageI := <-pendingChan:
+			pending := messageI.(map[string]interface{})
+			c.Assert(pending["Count"], Equals, 2.0)
+			items := pending["Pending"].([]interface{})
+			c.Assert(items[0].(map[string]interface{})["Id"], Equals, "a")
+			c.Assert(items[1].(map[string]interface{})["Id"], Equals, "c")
+		}
+	}
+}
+
+func (s *DelaySuite) TestDelayUntilTime(c *C) {
+	log.Println("testing Delay until a time in the message")
+	b, ch := test_utils.NewBlock("testingDelayUntil", "delay")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{
+		"TimePath": ".at",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		now := float64(time.Now().UnixNano()) / 1000000
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"n": 1.0, "at": now + 400}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"n": 2.0, "at": now + 200}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"n": 3.0, "at": now - 1000}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	out := []interface{}{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(out, DeepEquals, []interface{}{3.0, 2.0, 1.0})
+			return
+		case messageI := <-outChan:
+			out = append(out, messageI.Msg.(map[string]interface{})["n"])
+		}
+	}
+}
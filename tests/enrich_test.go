@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"log"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type EnrichSuite struct{}
+
+var enrichSuite = Suite(&EnrichSuite{})
+
+func (s *EnrichSuite) TestEnrich(c *C) {
+	log.Println("testing Enrich")
+	b, ch := test_utils.NewBlock("testingEnrich", "enrich")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{
+		"KeyPath":    ".id",
+		"ValuePath":  ".segment",
+		"LookupPath": ".user.id",
+		"OutputPath": ".user.segment",
+		"Miss":       "default",
+		"Default":    "unknown",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"id": 1.0, "segment": "premium"}, Route: "table"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"id": 2.0, "segment": "free"}, Route: "table"}
+	})
+
+	time.AfterFunc(time.Duration(200)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"id": 2.0}, Route: "delete"}
+	})
+
+	events := []interface{}{
+		map[string]interface{}{"user": map[string]interface{}{"id": 1.0}, "page": "/"},
+		map[string]interface{}{"user": map[string]interface{}{"id": 2.0}, "page": "/about"},
+	}
+	time.AfterFunc(time.Duration(300)*time.Millisecond, func() {
+		for _, e := range events {
+			ch.InChan <- &blocks.Msg{Msg: e, Route: "in"}
+		}
+	})
+
+	statsChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: statsChan, Route: "stats"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	enriched := []interface{}{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(enriched, DeepEquals, []interface{}{
+				map[string]interface{}{"user": map[string]interface{}{"id": 1.0, "segment": "premium"}, "page": "/"},
+				map[string]interface{}{"user": map[string]interface{}{"id": 2.0, "segment": "unknown"}, "page": "/about"},
+			})
+			// the inbound messages are left as they were
+			c.Assert(events[0], DeepEquals, map[string]interface{}{"user": map[string]interface{}{"id": 1.0}, "page": "/"})
+			return
+		case messageI := <-outChan:
+			enriched = append(enriched, messageI.Msg)
+		case messageI := <-statsChan:
+			c.Assert(messageI, DeepEquals, map[string]interface{}{"Entries": 1.0, "Hits": 1.0, "Misses": 1.0})
+		}
+	}
+}
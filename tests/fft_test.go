@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type FFTSuite struct{}
+
+var fftSuite = Suite(&FFTSuite{})
+
+// sineSeries samples an 8Hz sine wave with an amplitude of 2 around 5. The
+// timestamps wander by up to a millisecond either side of 64 samples a
+// second, so that only resampling puts them back on an even grid.
+func sineSeries(n int) []interface{} {
+	series := make([]interface{}, n)
+	for i := range series {
+		t := float64(i)*1000/64 + math.Sin(float64(i))
+		series[i] = map[string]interface{}{
+			"timestamp": 1000000000000 + t,
+			"value":     5 + 2*math.Sin(2*math.Pi*8*t/1000),
+		}
+	}
+	return series
+}
+
+func (s *FFTSuite) TestFFT(c *C) {
+	log.Println("testing FFT")
+	b, ch := test_utils.NewBlock("testingFFT", "fft")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"Path": ".timeseries"}, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"timeseries": sineSeries(100)}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	received := false
+	for {
+		select {
+		case messageI := <-outChan:
+			received = true
+			X, ok := messageI.Msg.(map[string]interface{})["fft"].([][]float64)
+			if !ok || len(X) != 100 || math.Abs(X[0][0]-500) > 10 {
+				log.Println("unexpected fft", messageI.Msg)
+				c.Fail()
+			}
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if !received {
+				log.Println("expected an fft")
+				c.Fail()
+			}
+			return
+		}
+	}
+}
+
+func (s *FFTSuite) TestFFTDominant(c *C) {
+	log.Println("testing FFT dominant frequencies")
+	b, ch := test_utils.NewBlock("testingFFTDominant", "fft")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{
+		"Path":       ".timeseries",
+		"SampleRate": 64.0,
+		"Window":     "hann",
+		"Detrend":    "linear",
+		"PadTo":      200.0,
+		"PowerOfTwo": true,
+		"Output":     "dominant",
+		"Peaks":      2.0,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"timeseries": sineSeries(129)}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	received := false
+	for {
+		select {
+		case messageI := <-outChan:
+			received = true
+			result := messageI.Msg.(map[string]interface{})
+			peaks, ok := result["fft"].([]interface{})
+			if !ok || len(peaks) != 2 || result["SampleRate"] != 64.0 {
+				log.Println("unexpected fft", result)
+				c.Fail()
+				continue
+			}
+			top := peaks[0].(map[string]interface{})
+			if top["Frequency"] != 8.0 || math.Abs(top["Magnitude"].(float64)-2) > 0.1 {
+				log.Println("unexpected dominant frequency", top)
+				c.Fail()
+			}
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if !received {
+				log.Println("expected an fft")
+				c.Fail()
+			}
+			return
+		}
+	}
+}
+
+func (s *FFTSuite) TestFFTTooLong(c *C) {
+	log.Println("testing FFT turns down a series that would need too many samples")
+	b, ch := test_utils.NewBlock("testingFFTTooLong", "fft")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{
+		"Path":       ".timeseries",
+		"SampleRate": 64.0,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	// a year apart at 64 samples a second is two billion samples
+	yearApart := []interface{}{
+		map[string]interface{}{"timestamp": 1000000000000.0, "value": 1.0},
+		map[string]interface{}{"timestamp": 1000000000000.0 + 365*24*3600*1000, "value": 2.0},
+	}
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"timeseries": yearApart}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"timeseries": sineSeries(64)}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	received := 0
+	for {
+		select {
+		case <-outChan:
+			received++
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			// only the short series is transformed
+			c.Assert(received, Equals, 1)
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type FromDirectorySuite struct{}
+
+var fromDirectorySuite = Suite(&FromDirectorySuite{})
+
+func (s *FromDirectorySuite) TestFromDirectory(c *C) {
+	log.Println("testing FromDirectory")
+	dir, err := ioutil.TempDir("", "streamtools_test_from_directory")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a file that was already waiting when the block started
+	ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte("{\"n\":1}\n{\"n\":2}\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "ignored.txt"), []byte("{\"n\":0}\n"), 0644)
+	// a file finished earlier with the same name as one still to come
+	os.Mkdir(filepath.Join(dir, "done"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "done", "b.json"), []byte("{\"n\":0}"), 0644)
+
+	b, ch := test_utils.NewBlock("testingFromDirectory", "fromdirectory")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Directory":    dir,
+		"Pattern":      "*.json",
+		"PollInterval": "100ms",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	// a file that turns up while the block is running
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ioutil.WriteFile(filepath.Join(dir, "b.json"), []byte("{\"n\":3}"), 0644)
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	expected := []interface{}{
+		map[string]interface{}{"n": 1.0},
+		map[string]interface{}{"n": 2.0},
+		map[string]interface{}{"n": 3.0},
+	}
+	i := 0
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if i != len(expected) {
+				log.Println("expected", len(expected), "messages, got", i)
+				c.Fail()
+			}
+			old, _ := ioutil.ReadFile(filepath.Join(dir, "done", "b.json"))
+			if string(old) != "{\"n\":0}" {
+				log.Println("a file in the done directory was replaced")
+				c.Fail()
+			}
+			for _, name := range []string{"a.json", "b-1.json"} {
+				if _, err := os.Stat(filepath.Join(dir, "done", name)); err != nil {
+					log.Println(name, "was not moved to the done directory")
+					c.Fail()
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, "ignored.txt")); err != nil {
+				log.Println("a file not matching the pattern was moved")
+				c.Fail()
+			}
+			return
+		case messageI := <-outChan:
+			if i >= len(expected) || !reflect.DeepEqual(messageI.Msg, expected[i]) {
+				log.Println("unexpected message", messageI.Msg)
+				c.Fail()
+			}
+			i++
+		}
+	}
+}
+
+func (s *FromDirectorySuite) TestFromDirectoryMoveFailure(c *C) {
+	log.Println("testing FromDirectory with a file it can't move")
+	dir, err := ioutil.TempDir("", "streamtools_test_from_directory")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte("{\"n\":1}\n"), 0644)
+	// the done directory can't be made, because a file is in the way
+	ioutil.WriteFile(filepath.Join(dir, "done"), []byte{}, 0644)
+
+	b, ch := test_utils.NewBlock("testingFromDirectoryMoveFailure", "fromdirectory")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Directory":    dir,
+		"PollInterval": "100ms",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	i := 0
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(i, Equals, 1)
+			_, err = os.Stat(filepath.Join(dir, "a.json"))
+			c.Assert(err, IsNil)
+			return
+		case <-outChan:
+			i++
+		}
+	}
+}
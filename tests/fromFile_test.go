@@ -1,8 +1,13 @@
 package tests
 
 import (
+	"bytes"
+	"compress/gzip"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"reflect"
 	"syscall"
 	//	"syscall"
 	"time"
@@ -92,3 +97,150 @@ func (s *FromFileSuite) TestFromFile(c *C) {
 		}
 	}
 }
+
+func (s *FromFileSuite) TestFromFileStream(c *C) {
+	log.Println("testing FromFile stream mode")
+	dir, err := ioutil.TempDir("", "streamtools_test_from_file")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.log"), []byte("{\"n\":1}\n{\"n\":2}\n"), 0644)
+
+	var zipped bytes.Buffer
+	gz := gzip.NewWriter(&zipped)
+	gz.Write([]byte("{\"n\":3}\nnot json"))
+	gz.Close()
+	ioutil.WriteFile(filepath.Join(dir, "b.log.gz"), zipped.Bytes(), 0644)
+
+	b, ch := test_utils.NewBlock("testingFileStream", "fromfile")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	offsetFile := filepath.Join(dir, "offsets.json")
+	ruleMsg := map[string]interface{}{
+		"Filename":   filepath.Join(dir, "*.log*"),
+		"Mode":       "stream",
+		"OffsetFile": offsetFile,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	expected := []interface{}{
+		map[string]interface{}{"n": 1.0},
+		map[string]interface{}{"n": 2.0},
+		map[string]interface{}{"n": 3.0},
+		map[string]interface{}{"data": "not json"},
+	}
+	i := 0
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if i != len(expected)+1 {
+				log.Println("expected", len(expected), "lines and an EOF, got", i)
+				c.Fail()
+			}
+			if _, err := os.Stat(offsetFile); err != nil {
+				log.Println("offsets were not saved")
+				c.Fail()
+			}
+			return
+		case messageI := <-outChan:
+			if i < len(expected) {
+				if !reflect.DeepEqual(messageI.Msg, expected[i]) {
+					log.Println("unexpected message", messageI.Msg)
+					c.Fail()
+				}
+			} else {
+				message := messageI.Msg.(map[string]interface{})
+				if message["EOF"] != true {
+					log.Println("expected EOF, got", message)
+					c.Fail()
+				}
+			}
+			i++
+		}
+	}
+}
+
+func (s *FromFileSuite) TestFromFileTail(c *C) {
+	log.Println("testing FromFile tail mode")
+	dir, err := ioutil.TempDir("", "streamtools_test_from_file")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(name, []byte("{\"old\":true}\n"), 0644)
+
+	b, ch := test_utils.NewBlock("testingFileTail", "fromfile")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Filename":     name,
+		"Mode":         "tail",
+		"PollInterval": "50ms",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(300)*time.Millisecond, func() {
+		f, _ := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+		f.Write([]byte("{\"n\":1}\n{\"n\""))
+		f.Close()
+	})
+	time.AfterFunc(time.Duration(600)*time.Millisecond, func() {
+		f, _ := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+		f.Write([]byte(":2}\n"))
+		f.Close()
+		// rotate the file
+		os.Rename(name, name+".1")
+		ioutil.WriteFile(name, []byte("{\"n\":3}\n"), 0644)
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var received []float64
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if !reflect.DeepEqual(received, []float64{1, 2, 3}) {
+				log.Println("unexpected tail output", received)
+				c.Fail()
+			}
+			return
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			n, ok := message["n"].(float64)
+			if !ok {
+				log.Println("unexpected message", message)
+				c.Fail()
+				continue
+			}
+			received = append(received, n)
+		}
+	}
+}
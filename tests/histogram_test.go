@@ -2,6 +2,7 @@ package tests
 
 import (
 	"log"
+	"math"
 	"reflect"
 	"time"
 
@@ -39,7 +40,19 @@ func (s *HistogramSuite) TestHistogram(c *C) {
 	for {
 		select {
 		case messageI := <-queryOutChan:
-			if !reflect.DeepEqual(messageI, ruleMsg) {
+			expectedRule := map[string]interface{}{
+				"Window":     "10s",
+				"Path":       ".data",
+				"Mode":       "categorical",
+				"Boundaries": []float64{},
+				"Scale":      "linear",
+				"Start":      0.0,
+				"Width":      0.0,
+				"Factor":     0.0,
+				"Count":      0.0,
+				"Cumulative": false,
+			}
+			if !reflect.DeepEqual(messageI, expectedRule) {
 				c.Fail()
 			}
 
@@ -53,3 +66,136 @@ func (s *HistogramSuite) TestHistogram(c *C) {
 		}
 	}
 }
+
+func (s *HistogramSuite) TestHistogramNumeric(c *C) {
+	log.Println("testing Histogram with numeric buckets")
+	b, ch := test_utils.NewBlock("testingHistogramNumeric", "histogram")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Window":     "10s",
+		"Path":       ".latency",
+		"Mode":       "numeric",
+		"Scale":      "log",
+		"Start":      1.0,
+		"Factor":     10.0,
+		"Count":      2.0,
+		"Cumulative": true,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, v := range []float64{0.5, 1, 5, 9.99, 10, 50, 99, 100, 1000} {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"latency": v}, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "poll"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	expected := map[string]interface{}{
+		"Histogram": []interface{}{
+			map[string]interface{}{"Label": "<1", "Lower": nil, "Upper": 1.0, "Count": 1.0, "Cumulative": 1.0},
+			map[string]interface{}{"Label": "[1,10)", "Lower": 1.0, "Upper": 10.0, "Count": 3.0, "Cumulative": 4.0},
+			map[string]interface{}{"Label": "[10,100)", "Lower": 10.0, "Upper": 100.0, "Count": 3.0, "Cumulative": 7.0},
+			map[string]interface{}{"Label": ">=100", "Lower": 100.0, "Upper": nil, "Count": 2.0, "Cumulative": 9.0},
+		},
+	}
+	polled := false
+	for {
+		select {
+		case messageI := <-outChan:
+			polled = true
+			if !reflect.DeepEqual(messageI.Msg, expected) {
+				log.Println("unexpected histogram", messageI.Msg)
+				c.Fail()
+			}
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if !polled {
+				log.Println("expected a histogram")
+				c.Fail()
+			}
+			return
+		}
+	}
+}
+
+func (s *HistogramSuite) TestHistogramNumericEdges(c *C) {
+	log.Println("testing Histogram with infinite values, NaN and a new Window")
+	b, ch := test_utils.NewBlock("testingHistogramNumericEdges", "histogram")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Window":     "10s",
+		"Path":       ".latency",
+		"Mode":       "numeric",
+		"Boundaries": []interface{}{1.0, 10.0},
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, v := range []float64{math.Inf(-1), 5, math.Inf(1), math.NaN()} {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"latency": v}, Route: "in"}
+		}
+	})
+
+	// changing only the Window keeps the counts
+	time.AfterFunc(time.Duration(300)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{
+			"Window":     "20s",
+			"Path":       ".latency",
+			"Mode":       "numeric",
+			"Boundaries": []interface{}{1.0, 10.0},
+		}, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "poll"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	expected := map[string]interface{}{
+		"Histogram": []interface{}{
+			map[string]interface{}{"Label": "<1", "Lower": nil, "Upper": 1.0, "Count": 1.0},
+			map[string]interface{}{"Label": "[1,10)", "Lower": 1.0, "Upper": 10.0, "Count": 1.0},
+			map[string]interface{}{"Label": ">=10", "Lower": 10.0, "Upper": nil, "Count": 1.0},
+		},
+	}
+	polled := false
+	for {
+		select {
+		case messageI := <-outChan:
+			polled = true
+			c.Assert(messageI.Msg, DeepEquals, expected)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(polled, Equals, true)
+			return
+		}
+	}
+}
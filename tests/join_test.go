@@ -39,3 +39,58 @@ func (s *JoinSuite) TestJoin(c *C) {
 		}
 	}
 }
+
+func (s *JoinSuite) TestJoinKeyed(c *C) {
+	log.Println("testing keyed join")
+	b, ch := test_utils.NewBlock("testing keyed join", "join")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Mode":     "outer",
+		"KeyPathA": ".id",
+		"KeyPathB": ".user.id",
+		"Window":   "300ms",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	a1 := map[string]interface{}{"id": 1.0, "clicked": true}
+	a2 := map[string]interface{}{"id": 2.0, "clicked": false}
+	b1 := map[string]interface{}{"user": map[string]interface{}{"id": 1.0}}
+	b3 := map[string]interface{}{"user": map[string]interface{}{"id": 3.0}}
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: a1, Route: "inA"}
+		ch.InChan <- &blocks.Msg{Msg: a2, Route: "inA"}
+	})
+	time.AfterFunc(time.Duration(150)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: b3, Route: "inB"}
+		ch.InChan <- &blocks.Msg{Msg: b1, Route: "inB"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	joined := []interface{}{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(joined, DeepEquals, []interface{}{
+				map[string]interface{}{"A": a1, "B": b1, "Key": "1"},
+				map[string]interface{}{"A": a2, "B": nil, "Key": "2"},
+				map[string]interface{}{"A": nil, "B": b3, "Key": "3"},
+			})
+			return
+		case messageI := <-outChan:
+			joined = append(joined, messageI.Msg)
+		}
+	}
+}
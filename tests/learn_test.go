@@ -0,0 +1,219 @@
+package tests
+
+import (
+	"log"
+	"math"
+	"net/url"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type LearnSuite struct{}
+
+var learnSuite = Suite(&LearnSuite{})
+
+// learnExample gives the i'th of a repeatable set of features and the
+// response 2a + 3b.
+func learnExample(i int) map[string]interface{} {
+	a := float64(i%10) / 10
+	b := float64((i*7)%13) / 13
+	return map[string]interface{}{"a": a, "b": b, "y": 2*a + 3*b}
+}
+
+func (s *LearnSuite) TestLearnIntoLinearModel(c *C) {
+	log.Println("testing Learn wired into a LinearModel")
+	b, ch := test_utils.NewBlock("testingLearn", "learn")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	mb, mch := test_utils.NewBlock("testingLearnModel", "linearModel")
+	go blocks.BlockRoutine(mb)
+	modelChan := make(chan *blocks.Msg)
+	mch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: modelChan}
+
+	ruleMsg := map[string]interface{}{
+		"FeaturePaths": []interface{}{".a", ".b"},
+		"ResponsePath": ".y",
+		"Stepfunc":     "constant",
+		"LearningRate": 0.5,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for i := 0; i < 900; i++ {
+			ch.InChan <- &blocks.Msg{Msg: learnExample(i), Route: "in"}
+		}
+	})
+
+	paramChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "poll"}
+		ch.QueryParamChan <- &blocks.QueryParamMsg{
+			Route:    "params",
+			RespChan: paramChan,
+			Params:   url.Values{},
+		}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+		mch.QuitChan <- true
+	})
+
+	queried, modelled := false, false
+	for {
+		select {
+		case messageI := <-outChan:
+			// hand the parameters straight to the model
+			mch.InChan <- &blocks.Msg{Msg: messageI.Msg, Route: "rule"}
+			time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+				mch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"a": 1.0, "b": 1.0}, Route: "in"}
+			})
+		case messageI := <-modelChan:
+			modelled = true
+			y, _ := messageI.Msg.(map[string]interface{})["Response"].(float64)
+			if math.Abs(y-5) > 0.1 {
+				log.Println("unexpected response", messageI.Msg)
+				c.Fail()
+			}
+		case messageI := <-paramChan:
+			queried = true
+			params := messageI.(map[string]interface{})
+			weights, _ := params["Weights"].([]interface{})
+			loss, _ := params["Loss"].(float64)
+			if len(weights) != 2 || math.Abs(weights[0].(float64)-2) > 0.1 ||
+				math.Abs(weights[1].(float64)-3) > 0.1 || params["Count"] != 900.0 || loss > 0.01 {
+				log.Println("unexpected params", params)
+				c.Fail()
+			}
+		case err := <-mch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			}
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if !queried || !modelled {
+				log.Println("expected a params query and a model response")
+				c.Fail()
+			}
+			return
+		}
+	}
+}
+
+func (s *LearnSuite) TestLearnByKey(c *C) {
+	log.Println("testing Learn by key")
+	b, ch := test_utils.NewBlock("testingLearnByKey", "learn")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{
+		"FeaturePaths": []interface{}{".x", ".bias"},
+		"ResponsePath": ".clicked",
+		"KeyPath":      ".site",
+		"Lossfunc":     "logistic",
+		"Stepfunc":     "constant",
+		"LearningRate": 1.0,
+		"L2":           0.001,
+		"BatchSize":    5.0,
+		"EmitInterval": "300ms",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	// site a clicks when x is high, site b when x is low
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for i := 0; i < 400; i++ {
+			x := float64(i%20)/10 - 1
+			high := 0.0
+			if x > 0 {
+				high = 1
+			}
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"site": "a", "x": x, "bias": 1.0, "clicked": high}, Route: "in"}
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"site": "b", "x": x, "bias": 1.0, "clicked": 1 - high}, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(700)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	seen := map[string]bool{}
+	for {
+		select {
+		case messageI := <-outChan:
+			params := messageI.Msg.(map[string]interface{})
+			key, _ := params["Key"].(string)
+			weights, _ := params["Weights"].([]interface{})
+			accuracy, _ := params["Accuracy"].(float64)
+			if params["KeyPath"] != ".site" || len(weights) != 2 || accuracy < 0.8 {
+				log.Println("unexpected params", params)
+				c.Fail()
+				continue
+			}
+			slope := weights[0].(float64)
+			if (key == "a" && slope <= 0) || (key == "b" && slope >= 0) {
+				log.Println("learnt the wrong relationship", params)
+				c.Fail()
+			}
+			seen[key] = true
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if !seen["a"] || !seen["b"] {
+				log.Println("expected parameters for both keys")
+				c.Fail()
+			}
+			return
+		}
+	}
+}
+
+func (s *LearnSuite) TestLinearModelFewerWeights(c *C) {
+	log.Println("testing LinearModel with fewer weights than features")
+	b, ch := test_utils.NewBlock("testingLinearModelFewerWeights", "linearModel")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	// features without a weight have always been left out
+	ruleMsg := map[string]interface{}{
+		"Weights":      []interface{}{2.0},
+		"FeaturePaths": []interface{}{".a", ".b"},
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"a": 3.0, "b": 5.0}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	var responses []interface{}
+	for {
+		select {
+		case messageI := <-outChan:
+			responses = append(responses, messageI.Msg)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(responses, DeepEquals, []interface{}{
+				map[string]interface{}{"Response": 6.0},
+			})
+			return
+		}
+	}
+}
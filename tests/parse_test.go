@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"log"
+
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type ParseSuite struct{}
+
+var parseSuite = Suite(&ParseSuite{})
+
+// parseRun sends lines to a parse block with the given rule, and returns
+// what came out of out and of failed.
+func parseRun(c *C, name string, ruleMsg map[string]interface{}, lines []string) ([]interface{}, []interface{}) {
+	msgs := make([]interface{}, len(lines))
+	for i, line := range lines {
+		msgs[i] = map[string]interface{}{"data": line}
+	}
+	result := test_utils.RunBlock(name, test_utils.BlockRun{
+		Kind:   "parse",
+		Rule:   ruleMsg,
+		Msgs:   msgs,
+		Routes: []string{"out", "failed"},
+	})
+	c.Assert(result.Errors, HasLen, 0)
+	return result.Out["out"], result.Out["failed"]
+}
+
+func (s *ParseSuite) TestParseGrok(c *C) {
+	log.Println("testing Parse with grok")
+	line := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"`
+	out, failed := parseRun(c, "testingParseGrok", map[string]interface{}{
+		"Pattern": "%{COMBINEDAPACHELOG}",
+	}, []string{line, "not a log line"})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{
+			"data":        line,
+			"clientip":    "127.0.0.1",
+			"ident":       "-",
+			"auth":        "frank",
+			"timestamp":   "10/Oct/2000:13:55:36 -0700",
+			"verb":        "GET",
+			"request":     "/apache_pb.gif",
+			"httpversion": "1.0",
+			"response":    200.0,
+			"bytes":       2326.0,
+			"referrer":    `"http://www.example.com/start.html"`,
+			"agent":       `"Mozilla/4.08"`,
+		},
+	})
+	c.Assert(failed, DeepEquals, []interface{}{
+		map[string]interface{}{
+			"msg":   map[string]interface{}{"data": "not a log line"},
+			"error": "line does not match the pattern",
+		},
+	})
+}
+
+func (s *ParseSuite) TestParseLogfmt(c *C) {
+	log.Println("testing Parse with logfmt")
+	out, failed := parseRun(c, "testingParseLogfmt", map[string]interface{}{
+		"Format":     "logfmt",
+		"OutputPath": ".fields",
+		"Types":      map[string]interface{}{"took": "float", "ok": "bool"},
+	}, []string{`level=info msg="hello \"world\"" took=1.5 ok=true cached`, `took=fast`})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{
+			"data": `level=info msg="hello \"world\"" took=1.5 ok=true cached`,
+			"fields": map[string]interface{}{
+				"level":  "info",
+				"msg":    `hello "world"`,
+				"took":   1.5,
+				"ok":     true,
+				"cached": true,
+			},
+		},
+	})
+	c.Assert(len(failed), Equals, 1)
+}
+
+func (s *ParseSuite) TestParseRegex(c *C) {
+	log.Println("testing Parse with a regular expression")
+	out, _ := parseRun(c, "testingParseRegex", map[string]interface{}{
+		"Format":  "regex",
+		"Pattern": `user=(?P<user>\w+) age=(?P<age>\d+)`,
+		"Types":   map[string]interface{}{"age": "auto"},
+	}, []string{"login user=ada age=36"})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{"data": "login user=ada age=36", "user": "ada", "age": 36.0},
+	})
+}
@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"log"
+	"math"
+	"net/url"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type QuantilesSuite struct{}
+
+var quantilesSuite = Suite(&QuantilesSuite{})
+
+// closeTo reports whether the value at key in a quantiles result is within
+// tolerance of want.
+func closeTo(result interface{}, key string, want, tolerance float64) bool {
+	quantiles, ok := result.(map[string]interface{})["Quantiles"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	got, ok := quantiles[key].(float64)
+	return ok && math.Abs(got-want) <= tolerance
+}
+
+func (s *QuantilesSuite) TestQuantiles(c *C) {
+	log.Println("testing Quantiles")
+	b, ch := test_utils.NewBlock("testingQuantiles", "quantiles")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"Path": ".latency"}, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for i := 1; i <= 500; i++ {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"latency": float64(i)}, Route: "in"}
+		}
+	})
+
+	paramChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "poll"}
+		ch.QueryParamChan <- &blocks.QueryParamMsg{
+			Route:    "quantile",
+			RespChan: paramChan,
+			Params:   url.Values{"q": []string{"0.1", "0.999"}},
+		}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	polled, queried := false, false
+	for {
+		select {
+		case messageI := <-outChan:
+			polled = true
+			result := messageI.Msg
+			if result.(map[string]interface{})["Count"] != 500.0 ||
+				!closeTo(result, "p50", 250.5, 2) ||
+				!closeTo(result, "p95", 475.5, 2) ||
+				!closeTo(result, "p99", 495.5, 2) {
+				log.Println("unexpected quantiles", result)
+				c.Fail()
+			}
+		case messageI := <-paramChan:
+			queried = true
+			if !closeTo(messageI, "p10", 50.5, 2) || !closeTo(messageI, "p99.9", 500, 1) {
+				log.Println("unexpected quantiles", messageI)
+				c.Fail()
+			}
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if !polled || !queried {
+				log.Println("expected a poll and a quantile query")
+				c.Fail()
+			}
+			return
+		}
+	}
+}
+
+func (s *QuantilesSuite) TestQuantilesByKey(c *C) {
+	log.Println("testing Quantiles by key")
+	b, ch := test_utils.NewBlock("testingQuantilesByKey", "quantiles")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{
+		"Path":      ".latency",
+		"KeyPath":   ".host",
+		"Quantiles": []interface{}{0.5},
+		"Window":    "1m",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for i := 1; i <= 99; i++ {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"host": "a", "latency": float64(i)}, Route: "in"}
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"host": "b", "latency": float64(1000 + i)}, Route: "in"}
+		}
+	})
+
+	paramChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "poll"}
+		ch.QueryParamChan <- &blocks.QueryParamMsg{
+			Route:    "quantile",
+			RespChan: paramChan,
+			Params:   url.Values{"q": []string{"0.5"}, "key": []string{"b"}},
+		}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	medians := map[string]float64{"a": 50, "b": 1050}
+	polled, queried := 0, false
+	for {
+		select {
+		case messageI := <-outChan:
+			result := messageI.Msg.(map[string]interface{})
+			key, _ := result["Key"].(string)
+			if want, ok := medians[key]; !ok || !closeTo(result, "p50", want, 1) {
+				log.Println("unexpected quantiles", result)
+				c.Fail()
+			}
+			polled++
+		case messageI := <-paramChan:
+			queried = true
+			if messageI.(map[string]interface{})["Key"] != "b" || !closeTo(messageI, "p50", 1050, 1) {
+				log.Println("unexpected quantiles", messageI)
+				c.Fail()
+			}
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if polled != 2 || !queried {
+				log.Println("expected one poll result per key and a quantile query")
+				c.Fail()
+			}
+			return
+		}
+	}
+}
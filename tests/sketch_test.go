@@ -0,0 +1,194 @@
+package tests
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"reflect"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type SketchSuite struct{}
+
+var sketchSuite = Suite(&SketchSuite{})
+
+func (s *SketchSuite) TestTopK(c *C) {
+	log.Println("testing TopK")
+	b, ch := test_utils.NewBlock("testingTopK", "topk")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"Path": ".page", "K": 2.0}, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, page := range []string{"a", "b", "a", "c", "a", "b", "d", "a", "b", "a"} {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"page": page}, Route: "in"}
+		}
+	})
+
+	keyChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "poll"}
+		ch.QueryParamChan <- &blocks.QueryParamMsg{
+			Route:    "topk",
+			RespChan: keyChan,
+			Params:   url.Values{"key": []string{"c"}},
+		}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	pollOutput := map[string]interface{}{
+		"Top": []interface{}{
+			map[string]interface{}{"Key": "a", "Count": 5.0},
+			map[string]interface{}{"Key": "b", "Count": 3.0},
+		},
+	}
+	keyOutput := map[string]interface{}{
+		"Counts": map[string]interface{}{"c": 1.0},
+	}
+	polled, queried := false, false
+	for {
+		select {
+		case messageI := <-outChan:
+			polled = true
+			if !reflect.DeepEqual(messageI.Msg, pollOutput) {
+				log.Println("poll mismatch", messageI.Msg, pollOutput)
+				c.Fail()
+			}
+		case messageI := <-keyChan:
+			queried = true
+			if !reflect.DeepEqual(messageI, keyOutput) {
+				log.Println("estimate mismatch", messageI, keyOutput)
+				c.Fail()
+			}
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if !polled || !queried {
+				log.Println("expected a poll and a key query")
+				c.Fail()
+			}
+			return
+		}
+	}
+}
+
+func (s *SketchSuite) TestCardinality(c *C) {
+	log.Println("testing Cardinality")
+	b, ch := test_utils.NewBlock("testingCardinality", "cardinality")
+	go blocks.BlockRoutine(b)
+
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"Path": ".user", "Precision": 12.0}, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		// stay under the route's buffer so no messages are dropped
+		for i := 0; i < 900; i++ {
+			user := fmt.Sprintf("user-%d", i%500)
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"user": user}, Route: "in"}
+		}
+	})
+
+	cardinalityChan := make(blocks.MsgChan)
+	sketchChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: cardinalityChan, Route: "cardinality"}
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: sketchChan, Route: "sketch"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	queried, exported := false, false
+	for {
+		select {
+		case messageI := <-cardinalityChan:
+			queried = true
+			estimate := messageI.(map[string]interface{})["Cardinality"].(float64)
+			// precision 12 has a standard error of about 1.6%
+			if math.Abs(estimate-500)/500 > 0.08 {
+				log.Println("cardinality estimate too far out", estimate)
+				c.Fail()
+			}
+		case messageI := <-sketchChan:
+			exported = true
+			sketch := messageI.(map[string]interface{})
+			if sketch["Precision"] != 12.0 {
+				log.Println("unexpected sketch", sketch["Precision"])
+				c.Fail()
+			}
+			if _, ok := sketch["Registers"].(string); !ok {
+				log.Println("sketch registers weren't exported")
+				c.Fail()
+			}
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if !queried || !exported {
+				log.Println("expected cardinality and sketch queries")
+				c.Fail()
+			}
+			return
+		}
+	}
+}
+
+func (s *SketchSuite) TestBloomDeDupe(c *C) {
+	log.Println("testing BloomDeDupe")
+	b, ch := test_utils.NewBlock("testingBloomDeDupe", "bloomdedupe")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{"Path": ".id", "Capacity": 3.0, "FalsePositiveRate": 0.0001}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	// the filter rotates after a, b and c, but a is still remembered by the
+	// previous filter. Once d, e and f rotate it out, a is new again.
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, id := range []string{"a", "b", "a", "c", "d", "a", "e", "f", "a"} {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"id": id}, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	expected := []string{"a", "b", "c", "d", "e", "f", "a"}
+	i := 0
+	for {
+		select {
+		case messageI := <-outChan:
+			id := messageI.Msg.(map[string]interface{})["id"]
+			if i >= len(expected) || id != expected[i] {
+				log.Println("unexpected message", messageI.Msg)
+				c.Fail()
+			}
+			i++
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if i != len(expected) {
+				log.Println("expected", len(expected), "messages, got", i)
+				c.Fail()
+			}
+			return
+		}
+	}
+}
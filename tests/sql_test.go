@@ -0,0 +1,187 @@
+package tests
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type SQLSuite struct{}
+
+var sqlSuite = Suite(&SQLSuite{})
+
+func (s *SQLSuite) TestToSQL(c *C) {
+	log.Println("testing ToSQL")
+	dir, err := ioutil.TempDir("", "streamtools_test_sql")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "test.db")
+
+	b, ch := test_utils.NewBlock("testingToSQL", "tosql")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Driver": "sqlite3",
+		"DSN":    dsn,
+		"Table":  "people",
+		"Columns": map[string]interface{}{
+			"name": ".name",
+			"dog":  ".dog",
+		},
+		"Types":         map[string]interface{}{},
+		"ConflictKeys":  []interface{}{"name"},
+		"CreateTable":   true,
+		"BatchSize":     10.0,
+		"FlushInterval": "100ms",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"name": "mike", "dog": "percy"}, Route: "in"}
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"name": "nik", "dog": "none"}, Route: "in"}
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"name": "nik", "dog": "rex"}, Route: "in"}
+
+	queryOutChan := make(blocks.MsgChan)
+	ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		select {
+		case messageI := <-queryOutChan:
+			message := messageI.(map[string]interface{})
+			if message["Table"] != "people" || message["Driver"] != "sqlite3" {
+				log.Println("rule mismatch", message)
+				c.Fail()
+			}
+
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			db, err := sql.Open("sqlite3", dsn)
+			if err != nil {
+				c.Fatal(err)
+			}
+			defer db.Close()
+			var dog string
+			err = db.QueryRow(`SELECT dog FROM people WHERE name = ?`, "nik").Scan(&dog)
+			if err != nil {
+				c.Fatal(err)
+			}
+			if dog != "rex" {
+				log.Println("upsert failed, got", dog)
+				c.Fail()
+			}
+			var count int
+			err = db.QueryRow(`SELECT COUNT(*) FROM people`).Scan(&count)
+			if err != nil {
+				c.Fatal(err)
+			}
+			if count != 2 {
+				log.Println("expected 2 rows, got", count)
+				c.Fail()
+			}
+			return
+		}
+	}
+}
+
+func (s *SQLSuite) TestFromSQL(c *C) {
+	log.Println("testing FromSQL")
+	dir, err := ioutil.TempDir("", "streamtools_test_sql")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "test.db")
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		c.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE events (id INTEGER, kind TEXT)`)
+	if err != nil {
+		c.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO events VALUES (1, 'a'), (2, 'b')`)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	b, ch := test_utils.NewBlock("testingFromSQL", "fromsql")
+	go blocks.BlockRoutine(b)
+
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{
+		"Driver":     "sqlite3",
+		"DSN":        dsn,
+		"Query":      "SELECT id, kind FROM events",
+		"Mode":       "tail",
+		"TailColumn": "id",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "poll"}
+
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		db.Exec(`INSERT INTO events VALUES (3, 'c')`)
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "poll"}
+	})
+
+	// ids past 2^53 can't be held exactly by a float, so they come out as
+	// strings, and the tail must still move past them exactly
+	time.AfterFunc(time.Duration(1000)*time.Millisecond, func() {
+		db.Exec(`INSERT INTO events VALUES (9007199254740993, 'd')`)
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "poll"}
+	})
+	time.AfterFunc(time.Duration(1500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "poll"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	expected := []map[string]interface{}{
+		{"id": 1.0, "kind": "a"},
+		{"id": 2.0, "kind": "b"},
+		{"id": 3.0, "kind": "c"},
+		{"id": "9007199254740993", "kind": "d"},
+	}
+	i := 0
+	for {
+		select {
+		case messageI := <-outChan:
+			if i >= len(expected) || !reflect.DeepEqual(messageI.Msg, expected[i]) {
+				log.Println("unexpected row", messageI.Msg)
+				c.Fail()
+			}
+			i++
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				db.Close()
+				if i != len(expected) {
+					log.Println("expected", len(expected), "rows, got", i)
+					c.Fail()
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package tests
+
+import (
+	"log"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type SwitchSuite struct{}
+
+var switchSuite = Suite(&SwitchSuite{})
+
+func (s *SwitchSuite) TestSwitch(c *C) {
+	log.Println("testing Switch")
+	b, ch := test_utils.NewBlock("testingSwitch", "switch")
+	go blocks.BlockRoutine(b)
+	hotChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "hot", FromRoute: "hot", Channel: hotChan}
+	warmChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "warm", FromRoute: "warm", Channel: warmChan}
+	defaultChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "default", FromRoute: "default", Channel: defaultChan}
+
+	ruleMsg := map[string]interface{}{
+		"Cases": []interface{}{
+			map[string]interface{}{"Name": "hot", "Filter": ".temperature > 50"},
+			map[string]interface{}{"Name": "warm", "Filter": ".temperature > 20"},
+		},
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, t := range []float64{60, 30, 10, 70} {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"temperature": t}, Route: "in"}
+		}
+	})
+
+	routesChan := make(blocks.MsgChan)
+	countsChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: routesChan, Route: "outroutes"}
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: countsChan, Route: "counts"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	routed := map[string][]interface{}{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(routed, DeepEquals, map[string][]interface{}{
+				"hot":     []interface{}{60.0, 70.0},
+				"warm":    []interface{}{30.0},
+				"default": []interface{}{10.0},
+			})
+			return
+		case messageI := <-hotChan:
+			routed["hot"] = append(routed["hot"], messageI.Msg.(map[string]interface{})["temperature"])
+		case messageI := <-warmChan:
+			routed["warm"] = append(routed["warm"], messageI.Msg.(map[string]interface{})["temperature"])
+		case messageI := <-defaultChan:
+			routed["default"] = append(routed["default"], messageI.Msg.(map[string]interface{})["temperature"])
+		case messageI := <-routesChan:
+			c.Assert(messageI, DeepEquals, map[string]interface{}{"OutRoutes": []string{"default", "hot", "warm"}})
+		case messageI := <-countsChan:
+			c.Assert(messageI, DeepEquals, map[string]interface{}{
+				"Counts": map[string]interface{}{"hot": 2.0, "warm": 1.0, "default": 1.0},
+			})
+		}
+	}
+}
+
+func (s *SwitchSuite) TestSwitchAll(c *C) {
+	log.Println("testing Switch in all mode")
+	b, ch := test_utils.NewBlock("testingSwitchAll", "switch")
+	go blocks.BlockRoutine(b)
+	hotChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "hot", FromRoute: "hot", Channel: hotChan}
+	warmChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "warm", FromRoute: "warm", Channel: warmChan}
+
+	ruleMsg := map[string]interface{}{
+		"Mode": "all",
+		"Cases": []interface{}{
+			map[string]interface{}{"Name": "hot", "Filter": ".temperature > 50"},
+			map[string]interface{}{"Name": "warm", "Filter": ".temperature > 20"},
+		},
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, t := range []float64{60, 30} {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"temperature": t}, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	hot, warm := 0, 0
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(hot, Equals, 1)
+			c.Assert(warm, Equals, 2)
+			return
+		case <-hotChan:
+			hot++
+		case <-warmChan:
+			warm++
+		}
+	}
+}
+
+func (s *SwitchSuite) TestSwitchOrder(c *C) {
+	log.Println("testing Switch keeps cases and default in order")
+	b, ch := test_utils.NewBlock("testingSwitchOrder", "switch")
+	go blocks.BlockRoutine(b)
+	// one channel listening to both routes sees every message
+	allChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "hot", FromRoute: "hot", Channel: allChan}
+	ch.AddChan <- &blocks.AddChanMsg{Route: "default", FromRoute: "default", Channel: allChan}
+
+	ruleMsg := map[string]interface{}{
+		"Cases": []interface{}{
+			map[string]interface{}{"Name": "hot", "Filter": ".temperature > 50"},
+		},
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	// a case can't take the name of a block's own routes, so this rule is
+	// turned down and the one before it kept
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{
+		"Cases": []interface{}{
+			map[string]interface{}{"Name": "out", "Filter": ".temperature > 50"},
+		},
+	}, Route: "rule"}
+
+	temperatures := []interface{}{60.0, 10.0, 70.0, 5.0, 80.0, 0.0}
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, t := range temperatures {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"temperature": t}, Route: "in"}
+		}
+	})
+
+	ruleChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: ruleChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	seen := []interface{}{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(seen, DeepEquals, temperatures)
+			return
+		case messageI := <-allChan:
+			seen = append(seen, messageI.Msg.(map[string]interface{})["temperature"])
+		case messageI := <-ruleChan:
+			c.Assert(messageI.(map[string]interface{})["Cases"], DeepEquals, ruleMsg["Cases"])
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"log"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type TemplateSuite struct{}
+
+var templateSuite = Suite(&TemplateSuite{})
+
+func (s *TemplateSuite) TestTemplate(c *C) {
+	log.Println("testing Template")
+	b, ch := test_utils.NewBlock("testingTemplate", "template")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{
+		"Template":   `{{upper .level}}: {{.name | default "someone"}} tagged {{join ", " .tags}} on {{date "2006-01-02" .time}} {{json .extra}}`,
+		"OutputPath": ".email.subject",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	event := map[string]interface{}{
+		"level": "warn",
+		"tags":  []interface{}{"a", "b"},
+		"time":  1400000000000.0,
+		"extra": map[string]interface{}{"n": 1.0},
+	}
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: event, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	out := []interface{}{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(out, DeepEquals, []interface{}{
+				map[string]interface{}{
+					"level": "warn",
+					"tags":  []interface{}{"a", "b"},
+					"time":  1400000000000.0,
+					"extra": map[string]interface{}{"n": 1.0},
+					"email": map[string]interface{}{"subject": `WARN: someone tagged a, b on 2014-05-13 {"n":1}`},
+				},
+			})
+			// the inbound message is left as it was
+			_, changed := event["email"]
+			c.Assert(changed, Equals, false)
+			return
+		case messageI := <-outChan:
+			out = append(out, messageI.Msg)
+		}
+	}
+}
+
+func (s *TemplateSuite) TestTemplateWholeMessage(c *C) {
+	log.Println("testing Template rendering the whole message")
+	b, ch := test_utils.NewBlock("testingTemplateWhole", "template")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{
+		"Template": `https://example.com/users/{{.id}}?q={{lower .q}}`,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"id": "42", "q": "HELLO"}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	out := []interface{}{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(out, DeepEquals, []interface{}{"https://example.com/users/42?q=hello"})
+			return
+		case messageI := <-outChan:
+			out = append(out, messageI.Msg)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"log"
+
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type ThrottleSuite struct{}
+
+var throttleSuite = Suite(&ThrottleSuite{})
+
+// throttleRun sends msgs to a throttle block with the given rule, and
+// returns what came out along with the stats it reported at 800ms.
+func throttleRun(c *C, name string, ruleMsg map[string]interface{}, msgs []interface{}) ([]interface{}, interface{}) {
+	result := test_utils.RunBlock(name, test_utils.BlockRun{
+		Kind:    "throttle",
+		Rule:    ruleMsg,
+		Msgs:    msgs,
+		Routes:  []string{"out"},
+		Queries: []string{"stats"},
+	})
+	c.Assert(result.Errors, HasLen, 0)
+	return result.Out["out"], result.Queries["stats"]
+}
+
+func (s *ThrottleSuite) TestThrottleDropByKey(c *C) {
+	log.Println("testing Throttle dropping by key")
+	// at most one per user every ten minutes
+	out, stats := throttleRun(c, "testingThrottleDrop", map[string]interface{}{
+		"KeyPath":  ".user",
+		"Rate":     1.0,
+		"Interval": "10m",
+	}, []interface{}{
+		map[string]interface{}{"user": "a", "n": 1.0},
+		map[string]interface{}{"user": "a", "n": 2.0},
+		map[string]interface{}{"user": "b", "n": 3.0},
+		map[string]interface{}{"user": "a", "n": 4.0},
+	})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{"user": "a", "n": 1.0},
+		map[string]interface{}{"user": "b", "n": 3.0},
+	})
+	c.Assert(stats, DeepEquals, map[string]interface{}{"Passed": 2.0, "Dropped": 2.0, "Queued": 0.0, "Keys": 2.0})
+}
+
+func (s *ThrottleSuite) TestThrottleDelay(c *C) {
+	log.Println("testing Throttle delaying")
+	out, _ := throttleRun(c, "testingThrottleDelay", map[string]interface{}{
+		"Mode":     "delay",
+		"Rate":     10.0,
+		"Interval": "1s",
+	}, []interface{}{1.0, 2.0, 3.0})
+	c.Assert(out, DeepEquals, []interface{}{1.0, 2.0, 3.0})
+}
+
+func (s *ThrottleSuite) TestThrottleDebounce(c *C) {
+	log.Println("testing Throttle debouncing")
+	out, stats := throttleRun(c, "testingThrottleDebounce", map[string]interface{}{
+		"Mode":  "debounce",
+		"Quiet": "200ms",
+	}, []interface{}{1.0, 2.0, 3.0})
+	c.Assert(out, DeepEquals, []interface{}{3.0})
+	c.Assert(stats, DeepEquals, map[string]interface{}{"Passed": 1.0, "Dropped": 2.0, "Queued": 0.0, "Keys": 0.0})
+}
+
+func (s *ThrottleSuite) TestThrottleDistinct(c *C) {
+	log.Println("testing Throttle distinct until changed")
+	out, _ := throttleRun(c, "testingThrottleDistinct", map[string]interface{}{
+		"Mode":      "distinct",
+		"ValuePath": ".state",
+	}, []interface{}{
+		map[string]interface{}{"state": "up"},
+		map[string]interface{}{"state": "up"},
+		map[string]interface{}{"state": "down"},
+		map[string]interface{}{"state": "down"},
+		map[string]interface{}{"state": "up"},
+	})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{"state": "up"},
+		map[string]interface{}{"state": "down"},
+		map[string]interface{}{"state": "up"},
+	})
+}
+
+func (s *ThrottleSuite) TestThrottleDistinctForgets(c *C) {
+	log.Println("testing Throttle forgetting idle keys in distinct mode")
+	out, stats := throttleRun(c, "testingThrottleDistinctForgets", map[string]interface{}{
+		"Mode":       "distinct",
+		"KeyPath":    ".host",
+		"ValuePath":  ".state",
+		"TimeToLive": "200ms",
+	}, []interface{}{
+		map[string]interface{}{"host": "a", "state": "up"},
+		map[string]interface{}{"host": "a", "state": "up"},
+		map[string]interface{}{"host": "b", "state": "up"},
+	})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{"host": "a", "state": "up"},
+		map[string]interface{}{"host": "b", "state": "up"},
+	})
+	c.Assert(stats, DeepEquals, map[string]interface{}{"Passed": 2.0, "Dropped": 1.0, "Queued": 0.0, "Keys": 0.0})
+}
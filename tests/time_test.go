@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"log"
+
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type TimeSuite struct{}
+
+var timeSuite = Suite(&TimeSuite{})
+
+// timeRun sends msgs to a time block with the given rule, and returns the
+// times it added and the messages that failed.
+func timeRun(c *C, name string, ruleMsg map[string]interface{}, msgs []interface{}) ([]interface{}, []interface{}) {
+	result := test_utils.RunBlock(name, test_utils.BlockRun{
+		Kind:   "time",
+		Rule:   ruleMsg,
+		Msgs:   msgs,
+		Routes: []string{"out", "failed"},
+	})
+	c.Assert(result.Errors, HasLen, 0)
+	out := []interface{}{}
+	for _, msg := range result.Out["out"] {
+		out = append(out, msg.(map[string]interface{})["time"])
+	}
+	return out, result.Out["failed"]
+}
+
+func (s *TimeSuite) TestTimeAuto(c *C) {
+	log.Println("testing Time detecting formats")
+	out, failed := timeRun(c, "testingTimeAuto", map[string]interface{}{
+		"Path": ".t",
+	}, []interface{}{
+		map[string]interface{}{"t": "10/Oct/2000:13:55:36 -0700"},
+		map[string]interface{}{"t": "2000-10-10T20:55:36Z"},
+		map[string]interface{}{"t": 971211336.0},
+		map[string]interface{}{"t": 971211336000.0},
+		map[string]interface{}{"t": "yesterday"},
+	})
+	expected := map[string]interface{}{"ms": 971211336000.0, "rfc3339": "2000-10-10T20:55:36Z"}
+	c.Assert(out, DeepEquals, []interface{}{expected, expected, expected, expected})
+	c.Assert(failed, DeepEquals, []interface{}{
+		map[string]interface{}{
+			"msg":   map[string]interface{}{"t": "yesterday"},
+			"error": "could not parse the time",
+		},
+	})
+}
+
+func (s *TimeSuite) TestTimeZonesAndTruncate(c *C) {
+	log.Println("testing Time with time zones and truncation")
+	out, _ := timeRun(c, "testingTimeZones", map[string]interface{}{
+		"Path":           ".t",
+		"Layouts":        []interface{}{"2006-01-02 15:04"},
+		"Timezone":       "Europe/London",
+		"OutputTimezone": "America/New_York",
+		"Truncate":       "day",
+	}, []interface{}{
+		// half past three in the morning in London is still the evening before in New York
+		map[string]interface{}{"t": "2014-07-01 03:30"},
+	})
+	c.Assert(out, DeepEquals, []interface{}{
+		map[string]interface{}{"ms": 1404100800000.0, "rfc3339": "2014-06-30T00:00:00-04:00"},
+	})
+}
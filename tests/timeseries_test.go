@@ -1,7 +1,9 @@
 package tests
 
 import (
+	"encoding/json"
 	"log"
+	"net/url"
 	"time"
 
 	"github.com/nytlabs/streamtools/st/blocks"
@@ -37,3 +39,86 @@ func (s *TimeseriesSuite) TestTimeseries(c *C) {
 		}
 	}
 }
+
+func (s *TimeseriesSuite) TestTimeseriesDownsample(c *C) {
+	log.Println("testing Timeseries downsampling")
+	b, ch := test_utils.NewBlock("testingTimeseriesDownsample", "timeseries")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	ruleMsg := map[string]interface{}{
+		"Path":       ".v",
+		"TimePath":   ".t",
+		"GroupPath":  ".host",
+		"Retention":  "1m",
+		"NumSamples": 100.0,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	base := 1000000000000.0
+	points := []map[string]interface{}{
+		{"host": "a", "t": base - 120000, "v": 99.0},
+		{"host": "a", "t": base + 2000, "v": 3.0},
+		{"host": "a", "t": base, "v": 1.0},
+		{"host": "a", "t": base + 1000, "v": 2.0},
+		{"host": "a", "t": base + 3000, "v": "not a number"},
+		{"host": "a", "t": base + 10000, "v": 10.0},
+		{"host": "a", "t": base + 11000, "v": 20.0},
+		{"host": "b", "t": base, "v": 5.0},
+	}
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, p := range points {
+			ch.InChan <- &blocks.Msg{Msg: p, Route: "in"}
+		}
+	})
+
+	queryChan := make(blocks.MsgChan)
+	paramChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{Route: "timeseries", MsgChan: queryChan}
+		ch.QueryParamChan <- &blocks.QueryParamMsg{
+			Route:    "timeseries",
+			RespChan: paramChan,
+			Params:   url.Values{"step": []string{"10s"}, "agg": []string{"mean"}, "key": []string{"a"}},
+		}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	queried, downsampled := false, false
+	for {
+		select {
+		case messageI := <-queryChan:
+			queried = true
+			series := messageI.(map[string]interface{})["timeseries"].(map[string]interface{})["Series"].(map[string]interface{})
+			a, _ := json.Marshal(series["a"])
+			expected := `{"Values":[{"Timestamp":1000000000000,"Value":1},{"Timestamp":1000000001000,"Value":2},{"Timestamp":1000000002000,"Value":3},{"Timestamp":1000000010000,"Value":10},{"Timestamp":1000000011000,"Value":20}]}`
+			if len(series) != 2 || string(a) != expected {
+				log.Println("unexpected series", string(a))
+				c.Fail()
+			}
+		case messageI := <-paramChan:
+			downsampled = true
+			series := messageI.(map[string]interface{})["timeseries"].(map[string]interface{})["Series"].(map[string]interface{})
+			a, _ := json.Marshal(series["a"])
+			expected := `{"Values":[{"Timestamp":1000000000000,"Value":2},{"Timestamp":1000000010000,"Value":15}]}`
+			if len(series) != 1 || string(a) != expected {
+				log.Println("unexpected downsampled series", string(a))
+				c.Fail()
+			}
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if !queried || !downsampled {
+				log.Println("expected a timeseries query and a downsampled query")
+				c.Fail()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package tests
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type ToS3Suite struct{}
+
+var toS3Suite = Suite(&ToS3Suite{})
+
+func (s *ToS3Suite) TestToS3(c *C) {
+	log.Println("testing ToS3")
+
+	var lock sync.Mutex
+	objects := map[string][]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var lines []map[string]interface{}
+		scanner := bufio.NewScanner(gz)
+		for scanner.Scan() {
+			var line map[string]interface{}
+			json.Unmarshal(scanner.Bytes(), &line)
+			lines = append(lines, line)
+		}
+		lock.Lock()
+		objects[r.URL.Path] = lines
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	b, ch := test_utils.NewBlock("testingToS3", "tos3")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Endpoint":    server.URL,
+		"Bucket":      "archive",
+		"KeyTemplate": "events/dt={{.Date}}/hour={{.Hour}}/{{.Seq}}.json.gz",
+		"MaxCount":    2.0,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	for i := 0; i < 3; i++ {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"n": float64(i)}, Route: "in"}
+	}
+
+	// the third message is still buffered, so flush it
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "flush"}
+	})
+
+	time.AfterFunc(time.Duration(1500)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if len(objects) != 2 {
+				log.Println("expected 2 objects, got", len(objects))
+				c.Fail()
+			}
+			keyPattern := regexp.MustCompile(`^/archive/events/dt=\d{4}-\d{2}-\d{2}/hour=\d{2}/[01]\.json\.gz$`)
+			total := 0
+			for k, lines := range objects {
+				if !keyPattern.MatchString(k) {
+					log.Println("unexpected key", k)
+					c.Fail()
+				}
+				total += len(lines)
+			}
+			if total != 3 {
+				log.Println("expected 3 messages, got", total)
+				c.Fail()
+			}
+			return
+		}
+	}
+}
+
+func (s *ToS3Suite) TestToS3Retry(c *C) {
+	log.Println("testing ToS3 retrying a failed upload to an escaped key")
+
+	var lock sync.Mutex
+	puts := 0
+	objects := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		puts++
+		if puts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		objects[r.URL.Path]++
+	}))
+	defer server.Close()
+
+	b, ch := test_utils.NewBlock("testingToS3Retry", "tos3")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Endpoint":    server.URL,
+		"Bucket":      "archive",
+		"KeyTemplate": "raw logs/a?b.json.gz",
+		"MaxCount":    1.0,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"n": 1.0}, Route: "in"}
+
+	time.AfterFunc(time.Duration(2500)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			c.Assert(puts, Equals, 2)
+			c.Assert(objects, DeepEquals, map[string]int{"/archive/raw logs/a?b.json.gz": 1})
+			return
+		}
+	}
+}
+
+func (s *ToS3Suite) TestToS3Spill(c *C) {
+	log.Println("testing ToS3 saving an object it couldn't upload")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "streamtools_test_tos3")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	b, ch := test_utils.NewBlock("testingToS3Spill", "tos3")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Endpoint":       server.URL,
+		"Bucket":         "archive",
+		"KeyTemplate":    "events/{{.Seq}}.json.gz",
+		"SpillDirectory": dir,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"n": 1.0}, Route: "in"}
+
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			// the block saves the object once its last attempt fails, which
+			// happens after it has been told to quit
+			path := filepath.Join(dir, "events_0.json.gz")
+			for i := 0; i < 20; i++ {
+				if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+					break
+				}
+				time.Sleep(time.Duration(100) * time.Millisecond)
+			}
+			f, err := os.Open(path)
+			c.Assert(err, IsNil)
+			defer f.Close()
+			gz, err := gzip.NewReader(f)
+			c.Assert(err, IsNil)
+			body, err := ioutil.ReadAll(gz)
+			c.Assert(err, IsNil)
+			c.Assert(string(body), Equals, "{\"n\":1}\n")
+			return
+		}
+	}
+}
+
+func (s *ToS3Suite) TestToS3BadRule(c *C) {
+	log.Println("testing ToS3 keeps its rule when a new one is bad")
+	b, ch := test_utils.NewBlock("testingToS3BadRule", "tos3")
+	go blocks.BlockRoutine(b)
+
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{
+		"Endpoint": "http://localhost:9000",
+		"Bucket":   "archive",
+		"MaxCount": 2.0,
+	}, Route: "rule"}
+	// the endpoint is fine but the bucket is missing, so none of it is used
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{
+		"Endpoint": "http://elsewhere:9000",
+		"MaxCount": 5.0,
+	}, Route: "rule"}
+
+	ruleChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: ruleChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(300)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			return
+		case messageI := <-ruleChan:
+			rule := messageI.(map[string]interface{})
+			c.Assert(rule["Endpoint"], Equals, "http://localhost:9000")
+			c.Assert(rule["Bucket"], Equals, "archive")
+			c.Assert(rule["MaxCount"], Equals, 2)
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package tests
 
 import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
 	"time"
 
@@ -43,7 +47,21 @@ func (s *ToFileSuite) TestToFile(c *C) {
 	for {
 		select {
 		case messageI := <-queryOutChan:
-			if !reflect.DeepEqual(messageI, ruleMsg) {
+			expected := map[string]interface{}{
+				"Filename":       "foobar.log",
+				"Append":         false,
+				"Gzip":           false,
+				"Format":         "json",
+				"Columns":        []string{},
+				"Headers":        []string{},
+				"Path":           "",
+				"MaxBytes":       0.0,
+				"RotateInterval": "",
+				"FlushInterval":  "",
+				"Fsync":          "never",
+			}
+			if !reflect.DeepEqual(messageI, expected) {
+				log.Println("rule mismatch", messageI)
 				c.Fail()
 			}
 
@@ -59,3 +77,129 @@ func (s *ToFileSuite) TestToFile(c *C) {
 		}
 	}
 }
+
+func (s *ToFileSuite) TestToFileRotateCSV(c *C) {
+	log.Println("testing toFile rotation and csv")
+	dir, err := ioutil.TempDir("", "streamtools_test_to_file")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, ch := test_utils.NewBlock("testingToFileRotate", "tofile")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Filename": filepath.Join(dir, "out-{{.Seq}}.csv.gz"),
+		"Format":   "csv",
+		"Columns":  []interface{}{".name", ".count"},
+		"Headers":  []interface{}{"name", "count"},
+		"Gzip":     true,
+		"Append":   true,
+		"MaxBytes": 20.0,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	for _, name := range []string{"alpha", "beta", "gamma"} {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"name": name, "count": 1.5}, Route: "in"}
+	}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			// let the block close its last file
+			time.Sleep(100 * time.Millisecond)
+			files, _ := filepath.Glob(filepath.Join(dir, "out-*.csv.gz"))
+			if len(files) < 2 {
+				log.Println("expected the file to rotate, got", files)
+				c.Fail()
+			}
+			rows := 0
+			for _, name := range files {
+				f, err := os.Open(name)
+				if err != nil {
+					c.Fatal(err)
+				}
+				gz, err := gzip.NewReader(f)
+				if err != nil {
+					c.Fatal(err)
+				}
+				scanner := bufio.NewScanner(gz)
+				first := true
+				for scanner.Scan() {
+					if first && scanner.Text() != "name,count" {
+						log.Println("missing header in", name, scanner.Text())
+						c.Fail()
+					}
+					if !first {
+						rows++
+					}
+					first = false
+				}
+				f.Close()
+			}
+			if rows != 3 {
+				log.Println("expected 3 rows, got", rows)
+				c.Fail()
+			}
+			return
+		}
+	}
+}
+
+func (s *ToFileSuite) TestToFileRotateStatic(c *C) {
+	log.Println("testing toFile rotating a file whose name doesn't change")
+	dir, err := ioutil.TempDir("", "streamtools_test_to_file")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, ch := test_utils.NewBlock("testingToFileRotateStatic", "tofile")
+	go blocks.BlockRoutine(b)
+
+	filename := filepath.Join(dir, "out.log")
+	ruleMsg := map[string]interface{}{
+		"Filename": filename,
+		"Append":   false,
+		"MaxBytes": 12.0,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	for i := 1; i <= 3; i++ {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"n": float64(i)}, Route: "in"}
+	}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			// let the block close its last file
+			time.Sleep(100 * time.Millisecond)
+			rotated, _ := filepath.Glob(filename + ".*")
+			c.Assert(rotated, HasLen, 1)
+			finished, err := ioutil.ReadFile(rotated[0])
+			c.Assert(err, IsNil)
+			c.Assert(string(finished), Equals, "{\"n\":1}\n{\"n\":2}\n")
+			current, err := ioutil.ReadFile(filename)
+			c.Assert(err, IsNil)
+			c.Assert(string(current), Equals, "{\"n\":3}\n")
+			return
+		}
+	}
+}
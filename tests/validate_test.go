@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"log"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type ValidateSuite struct{}
+
+var validateSuite = Suite(&ValidateSuite{})
+
+func (s *ValidateSuite) TestValidate(c *C) {
+	log.Println("testing Validate")
+	b, ch := test_utils.NewBlock("testingValidate", "validate")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+	invalidChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "invalid", FromRoute: "invalid", Channel: invalidChan}
+
+	ruleMsg := map[string]interface{}{
+		"Schema": map[string]interface{}{
+			"type":     "object",
+			"required": []interface{}{"id", "email"},
+			"properties": map[string]interface{}{
+				"id":    map[string]interface{}{"type": "integer", "minimum": 1.0},
+				"email": map[string]interface{}{"type": "string", "format": "email"},
+				"tags": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"$ref": "#/definitions/tag"},
+					"uniqueItems": true,
+				},
+			},
+			"definitions": map[string]interface{}{
+				"tag": map[string]interface{}{"type": "string", "enum": []interface{}{"new", "vip"}},
+			},
+		},
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	good := map[string]interface{}{"id": 1.0, "email": "a@example.com", "tags": []interface{}{"new", "vip"}}
+	bad := map[string]interface{}{"id": 0.5, "tags": []interface{}{"vip", "vip", "old"}}
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: good, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: bad, Route: "in"}
+	})
+
+	countsChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: countsChan, Route: "counts"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	valid, invalid := []interface{}{}, []interface{}{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(valid, DeepEquals, []interface{}{good})
+			c.Assert(invalid, DeepEquals, []interface{}{
+				map[string]interface{}{
+					"msg": bad,
+					"violations": []interface{}{
+						map[string]interface{}{"path": "", "keyword": "required", "message": "is missing email"},
+						map[string]interface{}{"path": "/id", "keyword": "type", "message": "expected integer but got number"},
+						map[string]interface{}{"path": "/tags", "keyword": "uniqueItems", "message": "has duplicate items"},
+						map[string]interface{}{"path": "/tags/2", "keyword": "enum", "message": "value is not one of the allowed values"},
+					},
+				},
+			})
+			return
+		case messageI := <-outChan:
+			valid = append(valid, messageI.Msg)
+		case messageI := <-invalidChan:
+			invalid = append(invalid, messageI.Msg)
+		case messageI := <-countsChan:
+			c.Assert(messageI, DeepEquals, map[string]interface{}{"Valid": 1.0, "Invalid": 1.0})
+		}
+	}
+}
+
+func (s *ValidateSuite) TestValidateRefPattern(c *C) {
+	log.Println("testing Validate with a pattern behind a $ref")
+	b, ch := test_utils.NewBlock("testingValidateRefPattern", "validate")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+	invalidChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "invalid", FromRoute: "invalid", Channel: invalidChan}
+
+	ruleMsg := map[string]interface{}{
+		"Schema": map[string]interface{}{
+			"$defs": map[string]interface{}{
+				"s": map[string]interface{}{"pattern": "^a"},
+			},
+			"$ref": "#/$defs/s",
+		},
+		"Path": ".name",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	good := map[string]interface{}{"name": "abc"}
+	bad := map[string]interface{}{"name": "xyz"}
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: good, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: bad, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	valid, invalid := []interface{}{}, []interface{}{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(valid, DeepEquals, []interface{}{good})
+			c.Assert(invalid, DeepEquals, []interface{}{
+				map[string]interface{}{
+					"msg": bad,
+					"violations": []interface{}{
+						map[string]interface{}{"path": "", "keyword": "pattern", "message": "does not match ^a"},
+					},
+				},
+			})
+			return
+		case messageI := <-outChan:
+			valid = append(valid, messageI.Msg)
+		case messageI := <-invalidChan:
+			invalid = append(invalid, messageI.Msg)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type WindowSuite struct{}
+
+var windowSuite = Suite(&WindowSuite{})
+
+func (s *WindowSuite) TestWindowTumbling(c *C) {
+	log.Println("testing Window tumbling")
+	b, ch := test_utils.NewBlock("testingWindowTumbling", "window")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"TimePath":  ".t",
+		"GroupPath": ".user",
+		"Type":      "tumbling",
+		"Size":      "10s",
+		"Lateness":  "5s",
+		"Aggregations": []interface{}{
+			map[string]interface{}{"Name": "n", "Op": "count"},
+			map[string]interface{}{"Name": "total", "Op": "sum", "Path": ".v"},
+		},
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	events := []map[string]interface{}{
+		{"t": 1000.0, "user": "a", "v": 1.0},
+		{"t": 2000.0, "user": "b", "v": 2.0},
+		{"t": 9000.0, "user": "a", "v": 3.0},
+		{"t": 12000.0, "user": "a", "v": 4.0},
+		// moves the watermark to 11s, closing the first window
+		{"t": 16000.0, "user": "b", "v": 5.0},
+		// too late for the first window, so it is dropped
+		{"t": 3000.0, "user": "a", "v": 10.0},
+	}
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, e := range events {
+			ch.InChan <- &blocks.Msg{Msg: e, Route: "in"}
+		}
+	})
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "flush"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	expected := []interface{}{
+		map[string]interface{}{"Start": 0.0, "End": 10000.0, "Group": "a", "Aggregates": map[string]interface{}{"n": 2.0, "total": 4.0}},
+		map[string]interface{}{"Start": 0.0, "End": 10000.0, "Group": "b", "Aggregates": map[string]interface{}{"n": 1.0, "total": 2.0}},
+		map[string]interface{}{"Start": 10000.0, "End": 20000.0, "Group": "a", "Aggregates": map[string]interface{}{"n": 1.0, "total": 4.0}},
+		map[string]interface{}{"Start": 10000.0, "End": 20000.0, "Group": "b", "Aggregates": map[string]interface{}{"n": 1.0, "total": 5.0}},
+	}
+	i := 0
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if i != len(expected) {
+				log.Println("expected", len(expected), "windows, got", i)
+				c.Fail()
+			}
+			return
+		case messageI := <-outChan:
+			if i >= len(expected) || !reflect.DeepEqual(messageI.Msg, expected[i]) {
+				log.Println("unexpected window", messageI.Msg)
+				c.Fail()
+			}
+			i++
+		}
+	}
+}
+
+func (s *WindowSuite) TestWindowSession(c *C) {
+	log.Println("testing Window session")
+	b, ch := test_utils.NewBlock("testingWindowSession", "window")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"TimePath": ".t",
+		"Type":     "session",
+		"Gap":      "5s",
+		"Aggregations": []interface{}{
+			map[string]interface{}{"Op": "count"},
+			map[string]interface{}{"Op": "distinct", "Path": ".page"},
+			map[string]interface{}{"Op": "max", "Path": ".v"},
+		},
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	events := []map[string]interface{}{
+		{"t": "1970-01-01T00:00:00Z", "page": "/", "v": 1.0},
+		{"t": "1970-01-01T00:00:02Z", "page": "/about", "v": 7.0},
+		{"t": "1970-01-01T00:00:01Z", "page": "/", "v": 3.0},
+		{"t": "1970-01-01T00:00:10Z", "page": "/", "v": 2.0},
+	}
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for _, e := range events {
+			ch.InChan <- &blocks.Msg{Msg: e, Route: "in"}
+		}
+	})
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "flush"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	expected := []interface{}{
+		map[string]interface{}{"Start": 0.0, "End": 7000.0, "Aggregates": map[string]interface{}{"count": 3.0, "distinct": 2.0, "max": 7.0}},
+		map[string]interface{}{"Start": 10000.0, "End": 15000.0, "Aggregates": map[string]interface{}{"count": 1.0, "distinct": 1.0, "max": 2.0}},
+	}
+	i := 0
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			if i != len(expected) {
+				log.Println("expected", len(expected), "sessions, got", i)
+				c.Fail()
+			}
+			return
+		case messageI := <-outChan:
+			if i >= len(expected) || !reflect.DeepEqual(messageI.Msg, expected[i]) {
+				log.Println("unexpected session", messageI.Msg)
+				c.Fail()
+			}
+			i++
+		}
+	}
+}